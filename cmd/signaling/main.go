@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,8 +16,10 @@ import (
 	"github.com/poki/netlib/internal"
 	"github.com/poki/netlib/internal/cloudflare"
 	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling"
 	"github.com/poki/netlib/internal/signaling/stores"
 	"github.com/poki/netlib/internal/util"
+	"github.com/poki/netlib/internal/webhook"
 	"github.com/rs/cors"
 	"go.uber.org/zap"
 )
@@ -34,6 +38,14 @@ func main() {
 	if err != nil {
 		logger.Panic("failed setup store", zap.Error(err))
 	}
+	if stores.MigrationsDryRun() {
+		// The pending migrations are logged, don't serve on an old schema.
+		cancel()
+		if flushed != nil {
+			<-flushed
+		}
+		return
+	}
 
 	if os.Getenv("ENV") == "local" || os.Getenv("ENV") == "test" {
 		rand.Seed(0)
@@ -41,21 +53,77 @@ func main() {
 		rand.Seed(time.Now().UnixNano())
 	}
 
+	authKey, err := cloudflareAuthKey()
+	if err != nil {
+		logger.Panic("failed to read CLOUDFLARE_AUTH_KEY_FILE", zap.Error(err))
+	}
 	credentialsClient := cloudflare.NewCredentialsClient(
 		os.Getenv("CLOUDFLARE_ZONE"),
 		os.Getenv("CLOUDFLARE_APP_ID"),
 		os.Getenv("CLOUDFLARE_AUTH_USER"),
-		os.Getenv("CLOUDFLARE_AUTH_KEY"),
+		authKey,
 		2*time.Hour,
 	)
+	maxInFlight, err := strconv.Atoi(util.Getenv("CLOUDFLARE_MAX_INFLIGHT", strconv.Itoa(cloudflare.DefaultMaxInFlight)))
+	if err != nil {
+		logger.Panic("invalid CLOUDFLARE_MAX_INFLIGHT", zap.Error(err))
+	}
+	queueTimeout, err := time.ParseDuration(util.Getenv("CLOUDFLARE_QUEUE_TIMEOUT", cloudflare.DefaultQueueTimeout.String()))
+	if err != nil {
+		logger.Panic("invalid CLOUDFLARE_QUEUE_TIMEOUT", zap.Error(err))
+	}
+	credentialsClient.LimitConcurrency(maxInFlight, queueTimeout)
+	maxAttempts, err := strconv.Atoi(util.Getenv("CLOUDFLARE_MAX_ATTEMPTS", strconv.Itoa(cloudflare.DefaultMaxAttempts)))
+	if err != nil {
+		logger.Panic("invalid CLOUDFLARE_MAX_ATTEMPTS", zap.Error(err))
+	}
+	credentialsClient.Retry(maxAttempts, cloudflare.DefaultRetryDelay)
 	go credentialsClient.Run(ctx)
+	go reloadCredentialsOnHangup(ctx, credentialsClient)
+
+	config, err := signaling.ConfigFromEnv()
+	if err != nil {
+		logger.Panic("failed to read config", zap.Error(err))
+	}
+	if file := os.Getenv("FEATURE_FLAGS_FILE"); file != "" {
+		go reloadFeaturesOnHangup(ctx, file, config.Features)
+	}
+
+	config.CredentialsLimiter, err = signaling.CredentialsLimiterFromEnv(store)
+	if err != nil {
+		logger.Panic("failed to read config", zap.Error(err))
+	}
+
+	if webhookURL := os.Getenv("WEBHOOK_URL"); webhookURL != "" {
+		var events []string
+		for _, e := range strings.Split(os.Getenv("WEBHOOK_EVENTS"), ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				events = append(events, e)
+			}
+		}
+		config.Webhook = webhook.New(webhookURL, os.Getenv("WEBHOOK_SECRET"), events)
+		config.Webhook.DeadLetter = func(ctx context.Context, event webhook.Event, payload []byte, err error) {
+			pg, ok := store.(*stores.PostgresStore)
+			if !ok {
+				return
+			}
+			if err := pg.AddDeadLetter(ctx, "webhook", payload, err); err != nil {
+				logger.Error("failed to store dead letter", zap.Error(err), zap.ByteString("payload", payload))
+			}
+		}
+		config.Webhook.Run(ctx)
+	}
 
-	mux, cleanup := internal.Signaling(ctx, store, credentialsClient)
+	mux, shutdown := internal.Signaling(ctx, store, credentialsClient, config)
 
-	cors := cors.Default()
+	// Let preflight requests through, the signaling handler answers them
+	// based on its own origin configuration.
+	cors := cors.New(cors.Options{OptionsPassthrough: true})
 	handler := logging.Middleware(cors.Handler(mux), logger)
 
-	if metricsURL, ok := os.LookupEnv("METRICS_URL"); ok {
+	if config.PersistEvents {
+		handler = metrics.Middleware(handler, metrics.NewStoreClient(store))
+	} else if metricsURL, ok := os.LookupEnv("METRICS_URL"); ok {
 		client := metrics.NewClient(metricsURL)
 		handler = metrics.Middleware(handler, client)
 	}
@@ -65,8 +133,9 @@ func main() {
 		Addr:    addr,
 		Handler: handler,
 
+		// Connections outlive the signal, they're drained by the shutdown.
 		BaseContext: func(net.Listener) context.Context {
-			return ctx
+			return util.WithoutCancel(ctx)
 		},
 
 		ReadTimeout:  5 * time.Second,
@@ -74,8 +143,16 @@ func main() {
 		IdleTimeout:  650 * time.Second,
 	}
 
+	server.TLSConfig = config.ClientTLS
+
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if config.TLSCertFile != "" {
+			err = server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("failed to listen and server", zap.Error(err))
 		}
 	}()
@@ -90,8 +167,73 @@ func main() {
 		logger.Fatal("failed to shutdown server", zap.Error(err))
 	}
 
-	cleanup()
+	if err := shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shutdown signaling", zap.Error(err))
+	}
 	if flushed != nil {
 		<-flushed
 	}
 }
+
+// cloudflareAuthKey returns the Cloudflare API key, read from the file in
+// CLOUDFLARE_AUTH_KEY_FILE when set so it can be rotated without a restart.
+func cloudflareAuthKey() (string, error) {
+	file := os.Getenv("CLOUDFLARE_AUTH_KEY_FILE")
+	if file == "" {
+		return os.Getenv("CLOUDFLARE_AUTH_KEY"), nil
+	}
+	key, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+// reloadCredentialsOnHangup rereads the Cloudflare API key and invalidates
+// the cached TURN credentials on SIGHUP, e.g. after a secret rotation.
+func reloadCredentialsOnHangup(ctx context.Context, client *cloudflare.CredentialsClient) {
+	logger := logging.GetLogger(ctx)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-hangup:
+		case <-ctx.Done():
+			return
+		}
+		key, err := cloudflareAuthKey()
+		if err != nil {
+			logger.Error("failed to reload CLOUDFLARE_AUTH_KEY_FILE, only invalidating credentials", zap.Error(err))
+			client.Invalidate()
+			continue
+		}
+		logger.Info("reloading Cloudflare credentials")
+		client.SetAuth(os.Getenv("CLOUDFLARE_AUTH_USER"), key)
+	}
+}
+
+// reloadFeaturesOnHangup rereads the feature flags from file on SIGHUP, the
+// flags in effect are kept when the file is invalid.
+func reloadFeaturesOnHangup(ctx context.Context, file string, features *signaling.Features) {
+	logger := logging.GetLogger(ctx)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-hangup:
+		case <-ctx.Done():
+			return
+		}
+		flags, err := signaling.LoadFeatureFlags(file)
+		if err == nil {
+			err = features.Set(flags)
+		}
+		if err != nil {
+			logger.Error("failed to reload FEATURE_FLAGS_FILE, keeping the current flags", zap.Error(err))
+			continue
+		}
+		logger.Info("reloaded feature flags")
+	}
+}
@@ -0,0 +1,14 @@
+Feature: Large packets are sent in chunks
+
+  Scenario: Chunked packets are reassembled by the client
+    Given the "signaling" backend is running with:
+      | CHUNK_THRESHOLD | 32 |
+    And "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+
+    When "blue" creates a lobby
+    And "blue" receives the network event "lobby" with the argument "prb67ouj837u"
+
+    When "yellow" connects to the lobby "prb67ouj837u"
+    Then "blue" receives the network event "connected" with the argument "[Peer: 3t3cfgcqup9e]"
+    And "yellow" receives the network event "connected" with the argument "[Peer: h5yzwyizlwao]"
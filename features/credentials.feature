@@ -0,0 +1,17 @@
+Feature: Peers can request TURN credentials
+
+  Scenario: A rate limited credentials request is rejected with its code
+    Given the "signaling" backend is running with:
+      | CREDENTIALS_RATE_LIMIT   | 1      |
+      | CREDENTIALS_RATE_LIMITER | memory |
+    And "green" is connected and ready for game "0b5d9e5c-51a5-4e86-8c0a-a6b8ac07cd3b"
+
+    When "green" requests the signaling packet:
+      """
+      {"type": "credentials"}
+      """
+    And "green" requests the signaling packet:
+      """
+      {"type": "credentials"}
+      """
+    Then the request of "green" is rejected with the code "rate-limited"
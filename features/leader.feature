@@ -0,0 +1,53 @@
+Feature: The lobby leader is handed over when it leaves
+
+  Background:
+    Given the "signaling" backend is running
+
+
+  Scenario: The next peer becomes the leader when the leader closes
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "green" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "blue,yellow,green" are joined in a lobby
+
+    When "blue" disconnects
+    Then "yellow" receives the signaling packet:
+      """
+      {"type": "leader", "leader": "{{yellow.id}}"}
+      """
+    And "green" receives the signaling packet:
+      """
+      {"type": "leader", "leader": "{{yellow.id}}"}
+      """
+    And "green" receives the signaling packet:
+      """
+      {"type": "disconnect", "id": "{{blue.id}}"}
+      """
+
+
+  Scenario: The leader transfers the lobby
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "blue,yellow" are joined in a lobby
+
+    When "blue" sends the signaling packet:
+      """
+      {"type": "transfer-leader", "rid": "r1", "leader": "{{yellow.id}}"}
+      """
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "leader", "rid": "r1", "leader": "{{yellow.id}}"}
+      """
+    And "yellow" receives the signaling packet:
+      """
+      {"type": "leader", "leader": "{{yellow.id}}"}
+      """
+
+    When "blue" sends the signaling packet:
+      """
+      {"type": "transfer-leader", "rid": "r2", "leader": "{{blue.id}}"}
+      """
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "error", "rid": "r2", "code": "not-leader"}
+      """
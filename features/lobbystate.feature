@@ -0,0 +1,65 @@
+Feature: The leader can close and reopen a lobby
+
+  Background:
+    Given the "signaling" backend is running
+
+
+  Scenario: A closed lobby can't be joined until it's reopened
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "green" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "blue,yellow" are joined in a lobby
+
+    When "blue" sends the signaling packet:
+      """
+      {"type": "set-lobby-state", "rid": "r1", "state": "closed"}
+      """
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "lobby-state", "rid": "r1", "lobby": "{{blue.lobby}}", "state": "closed"}
+      """
+    And "yellow" receives the signaling packet:
+      """
+      {"type": "lobby-state", "lobby": "{{blue.lobby}}", "state": "closed"}
+      """
+
+    When "green" sends the signaling packet:
+      """
+      {"type": "join", "rid": "r2", "lobby": "{{blue.lobby}}"}
+      """
+    Then "green" receives the signaling packet:
+      """
+      {"type": "error", "rid": "r2", "code": "lobby-not-joinable"}
+      """
+
+    When "blue" sends the signaling packet:
+      """
+      {"type": "set-lobby-state", "rid": "r3", "state": "waiting"}
+      """
+    And "blue" receives the signaling packet:
+      """
+      {"type": "lobby-state", "rid": "r3", "state": "waiting"}
+      """
+    And "green" sends the signaling packet:
+      """
+      {"type": "join", "rid": "r4", "lobby": "{{blue.lobby}}"}
+      """
+    Then "green" receives the signaling packet:
+      """
+      {"type": "joined", "rid": "r4", "lobby": "{{blue.lobby}}"}
+      """
+
+
+  Scenario: Only the leader can change the state
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "blue,yellow" are joined in a lobby
+
+    When "yellow" sends the signaling packet:
+      """
+      {"type": "set-lobby-state", "rid": "r1", "state": "closed"}
+      """
+    Then "yellow" receives the signaling packet:
+      """
+      {"type": "error", "rid": "r1", "code": "not-leader"}
+      """
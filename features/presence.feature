@@ -0,0 +1,46 @@
+Feature: Players can follow the presence of other players
+
+  Background:
+    Given the "signaling" backend is running with:
+      | PLAYER_TOKEN_SECRET | cucumber-secret |
+
+
+  Scenario: A subscriber sees a player go offline
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "green" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+
+    When "blue" sends the signaling packet:
+      """
+      {"type": "subscribe-presence", "rid": "r1", "players": ["{{green.player}}"]}
+      """
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "presence", "rid": "r1", "players": [{"player": "{{green.player}}", "online": true}]}
+      """
+
+    When "green" disconnects
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "presence-changed", "player": "{{green.player}}", "online": false}
+      """
+
+
+  Scenario: The lobby of a player is only shared while it's public
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "green" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+
+    When "green" creates a lobby with these settings:
+      """
+      {
+        "public": true
+      }
+      """
+    And "green" receives the network event "lobby"
+    And "blue" sends the signaling packet:
+      """
+      {"type": "subscribe-presence", "rid": "r1", "players": ["{{green.player}}"]}
+      """
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "presence", "rid": "r1", "players": [{"player": "{{green.player}}", "online": true, "lobby": "{{green.lobby}}"}]}
+      """
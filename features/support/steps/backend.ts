@@ -1,14 +1,23 @@
 import { spawn } from 'child_process'
-import { After, Given } from '@cucumber/cucumber'
+import { After, DataTable, Given } from '@cucumber/cucumber'
 import { World } from '../world'
 
 Given('the {string} backend is running', async function (this: World, backend: string) {
+  return await startBackend(this, backend, {})
+})
+
+Given('the {string} backend is running with:', async function (this: World, backend: string, settings: DataTable) {
+  return await startBackend(this, backend, settings.rowsHash())
+})
+
+async function startBackend (world: World, backend: string, env: {[key: string]: string}): Promise<void> {
   return await new Promise(resolve => {
     const port = 10000 + Math.ceil(Math.random() * 1000)
     const prc = spawn(`/tmp/netlib-cucumber-${backend}`, [], {
       windowsHide: true,
       env: {
         ...process.env,
+        ...env,
         ADDR: `127.0.0.1:${port}`,
         ENV: 'test'
       }
@@ -20,39 +29,39 @@ Given('the {string} backend is running', async function (this: World, backend: s
         try {
           const entry = JSON.parse(line)
           if (entry.message === 'listening') {
-            resolve(undefined)
+            resolve()
           }
         } catch (_) {
         }
-        this.print(line)
+        world.print(line)
       })
     })
     prc.addListener('exit', () => {
-      this.print(`${backend} exited`)
+      world.print(`${backend} exited`)
     })
 
     // Create a promise that resolves when the backend is closed so
     // we can block for it in the After step that kills the backend:
     const waiter = new Promise<void>(resolve => {
       prc.addListener('close', () => {
-        this.print(`${backend} closed (exitcode: ${prc.exitCode ?? 0})`)
+        world.print(`${backend} closed (exitcode: ${prc.exitCode ?? 0})`)
         prc.unref()
         prc.removeAllListeners()
         resolve()
       })
     })
 
-    this.backends.set(backend, { process: prc, port, wait: waiter })
+    world.backends.set(backend, { process: prc, port, wait: waiter })
     switch (backend) {
       case 'signaling':
-        this.signalingURL = `ws://127.0.0.1:${port}/v0/signaling`
+        world.signalingURL = `ws://127.0.0.1:${port}/v0/signaling`
         break
       case 'testproxy':
-        this.testproxyURL = `http://127.0.0.1:${port}`
+        world.testproxyURL = `http://127.0.0.1:${port}`
         break
     }
   })
-})
+}
 
 After(async function (this: World) {
   for (const [key, backend] of this.backends) {
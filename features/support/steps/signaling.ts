@@ -0,0 +1,60 @@
+import { Then, When } from '@cucumber/cucumber'
+import { World } from '../world'
+
+// fillPlaceholders replaces {{player.id}}, {{player.lobby}} and {{player.player}}
+// with the peer ID, current lobby and player ID of a player.
+function fillPlaceholders (world: World, blob: string): string {
+  return blob.replace(/{{(\w+)\.(id|lobby|player)}}/g, (_, playerName: string, field: string) => {
+    const player = world.players.get(playerName)
+    if (player === undefined) {
+      throw new Error(`player ${playerName} not found`)
+    }
+    switch (field) {
+      case 'id':
+        return player.network.id
+      case 'lobby':
+        return (player.network as any).signaling.currentLobby ?? ''
+      default:
+        return player.packets.find(p => p.type === 'welcome')?.playerId ?? ''
+    }
+  })
+}
+
+When('{string} sends the signaling packet:', function (this: World, playerName: string, packetBlob: string) {
+  const player = this.players.get(playerName)
+  if (player == null) {
+    throw new Error('no such player')
+  }
+  ;(player.network as any).signaling.send(JSON.parse(fillPlaceholders(this, packetBlob)))
+})
+
+Then('{string} receives the signaling packet:', async function (this: World, playerName: string, packetBlob: string) {
+  const player = this.players.get(playerName)
+  if (player == null) {
+    throw new Error('no such player')
+  }
+  await player.waitForPacket(JSON.parse(fillPlaceholders(this, packetBlob)))
+})
+
+When('{string} requests the signaling packet:', async function (this: World, playerName: string, packetBlob: string) {
+  const player = this.players.get(playerName)
+  if (player == null) {
+    throw new Error('no such player')
+  }
+  player.lastRequestError = undefined
+  try {
+    await (player.network as any).signaling.request(JSON.parse(fillPlaceholders(this, packetBlob)))
+  } catch (e) {
+    player.lastRequestError = e
+  }
+})
+
+Then('the request of {string} is rejected with the code {string}', function (this: World, playerName: string, code: string) {
+  const player = this.players.get(playerName)
+  if (player == null) {
+    throw new Error('no such player')
+  }
+  if (player.lastRequestError?.code !== code) {
+    throw new Error(`expected the request to be rejected with ${code}, got ${String(player.lastRequestError)}`)
+  }
+})
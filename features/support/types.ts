@@ -12,8 +12,22 @@ export class Player {
   public lastReceivedLobbies: LobbyListEntry[] = []
   public events: RecordedEvent[] = []
   public scanIndex = 0
+  public packets: any[] = []
+  public packetScanIndex = 0
+  public lastRequestError: any = undefined
 
   constructor (public name: string, public network: Network) {
+    // Record the raw signaling packets for packets the library doesn't handle:
+    const signaling = (network as any).signaling
+    const handle = signaling.handleSignalingMessage.bind(signaling)
+    signaling.handleSignalingMessage = async (data: string): Promise<void> => {
+      try {
+        this.packets.push(JSON.parse(data))
+      } catch (_) {
+      }
+      return await handle(data)
+    }
+
     allEvents.forEach(eventName => {
       const events = this.events
       this.network.on(eventName as any, function () {
@@ -77,6 +91,57 @@ export class Player {
       }
     })
   }
+
+  async waitForPacket (expected: any): Promise<any> {
+    const find = (): any => {
+      const ix = this.packets.slice(this.packetScanIndex).findIndex(p => matchPacket(p, expected))
+      if (ix < 0) {
+        return undefined
+      }
+      const packet = this.packets[this.packetScanIndex + ix]
+      this.packetScanIndex += ix + 1
+      return packet
+    }
+
+    return await new Promise((resolve, reject) => {
+      const packet = find()
+      if (packet !== undefined) {
+        resolve(packet)
+        return
+      }
+      let interval: NodeJS.Timeout | null = null
+      const timeout = setTimeout(() => {
+        if (interval !== null) {
+          clearInterval(interval)
+        }
+        const others = this.packets.slice(this.packetScanIndex).map(p => JSON.stringify(p)).join(' + ')
+        reject(new Error(`Packet ${JSON.stringify(expected)} not found, timed out, got: ${others}`))
+      }, 20000)
+      interval = setInterval(() => {
+        const packet = find()
+        if (packet !== undefined) {
+          if (interval !== null) {
+            clearInterval(interval)
+          }
+          clearTimeout(timeout)
+          resolve(packet)
+        }
+      }, 100)
+    })
+  }
+}
+
+export function matchPacket (packet: any, expected: any): boolean {
+  if (typeof expected !== 'object' || expected === null) {
+    return packet === expected
+  }
+  if (typeof packet !== 'object' || packet === null) {
+    return false
+  }
+  if (Array.isArray(expected)) {
+    return Array.isArray(packet) && packet.length === expected.length && expected.every((e, i) => matchPacket(packet[i], e))
+  }
+  return Object.keys(expected).every(key => matchPacket(packet[key], expected[key]))
 }
 
 function matchEvent (e: RecordedEvent, eventName: string, matchArguments: any[] = []): boolean {
@@ -0,0 +1,46 @@
+Feature: Peers can switch lobbies in one step
+
+  Background:
+    Given the "signaling" backend is running
+
+
+  Scenario: A peer switches to another lobby
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "green" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "blue,yellow" are joined in a lobby
+
+    When "green" creates a lobby
+    And "green" receives the network event "lobby"
+    And "yellow" sends the signaling packet:
+      """
+      {"type": "switch-lobby", "rid": "r1", "lobby": "{{green.lobby}}"}
+      """
+    Then "yellow" receives the signaling packet:
+      """
+      {"type": "joined", "rid": "r1", "lobby": "{{green.lobby}}"}
+      """
+    And "blue" receives the signaling packet:
+      """
+      {"type": "disconnect", "id": "{{yellow.id}}"}
+      """
+    And "green" receives the signaling packet:
+      """
+      {"type": "connect", "id": "{{yellow.id}}"}
+      """
+
+
+  Scenario: A peer stays in its lobby when switching to a lobby that doesn't exist
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "blue,yellow" are joined in a lobby
+
+    When "yellow" sends the signaling packet:
+      """
+      {"type": "switch-lobby", "rid": "r1", "lobby": "nosuchlobby"}
+      """
+    Then "yellow" receives the signaling packet:
+      """
+      {"type": "error", "rid": "r1", "code": "lobby-not-found"}
+      """
+    And "blue" has not seen the "disconnected" event
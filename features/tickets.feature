@@ -0,0 +1,51 @@
+Feature: Players are matched into lobbies with tickets
+
+  Background:
+    Given the "signaling" backend is running
+
+
+  Scenario: Two tickets are matched into a lobby
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+    And "yellow" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+
+    When "blue" sends the signaling packet:
+      """
+      {"type": "matchmaking-ticket", "rid": "r1", "skill": 1200, "maxPlayers": 2}
+      """
+    And "blue" receives the signaling packet:
+      """
+      {"type": "ticket", "rid": "r1"}
+      """
+    And "yellow" sends the signaling packet:
+      """
+      {"type": "matchmaking-ticket", "rid": "r2", "skill": 1250, "maxPlayers": 2}
+      """
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "ticket-matched"}
+      """
+    And "yellow" receives the signaling packet:
+      """
+      {"type": "ticket-matched"}
+      """
+
+
+  Scenario: A peer can't have more tickets waiting than allowed
+    Given "blue" is connected and ready for game "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+
+    When "blue" sends the signaling packet:
+      """
+      {"type": "matchmaking-ticket", "rid": "r1", "skill": 1200, "maxPlayers": 4}
+      """
+    And "blue" receives the signaling packet:
+      """
+      {"type": "ticket", "rid": "r1"}
+      """
+    And "blue" sends the signaling packet:
+      """
+      {"type": "matchmaking-ticket", "rid": "r2", "skill": 1200, "maxPlayers": 4}
+      """
+    Then "blue" receives the signaling packet:
+      """
+      {"type": "error", "rid": "r2", "code": "ticket-limit"}
+      """
@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/signaling"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+// adminOnly only lets requests through that carry the admin bearer token.
+func adminOnly(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			util.ErrorAndAbort(w, r, http.StatusNotFound, "not-found")
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			util.ErrorAndAbort(w, r, http.StatusUnauthorized, "")
+		}
+		next(w, r)
+	}
+}
+
+func announceHandler(store stores.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := logging.GetLogger(ctx)
+		if r.Method != http.MethodPost {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+
+		packet := signaling.AnnouncementPacket{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&packet); err != nil {
+			util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
+		}
+		if packet.Message == "" {
+			util.ErrorAndAbort(w, r, http.StatusBadRequest, "", errors.New("no message supplied"))
+		}
+
+		if err := signaling.BroadcastAll(ctx, store, packet); err != nil {
+			util.ErrorAndAbort(w, r, http.StatusInternalServerError, "", err)
+		}
+		logger.Info("announcement published", zap.String("message", packet.Message))
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// credentialsTopic is the pubsub topic that makes every node invalidate its
+// cached TURN credentials.
+const credentialsTopic = "credentials-invalidate"
+
+// invalidateCredentialsHandler makes all nodes drop their cached TURN
+// credentials and fetch new ones, to call after rotating the TURN secret.
+func invalidateCredentialsHandler(store stores.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := logging.GetLogger(ctx)
+		if r.Method != http.MethodPost {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+		if err := store.Publish(ctx, credentialsTopic, []byte("{}")); err != nil {
+			util.ErrorAndAbort(w, r, http.StatusInternalServerError, "", err)
+		}
+		logger.Info("credentials invalidation published")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// drainHandler disconnects the connections of this node selected by the
+// request, e.g. {"membersBelow": 2, "retryAfter": "10s"}. Unlike the other
+// admin endpoints it only affects the node that receives the request.
+func drainHandler(drainer *signaling.Drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if r.Method != http.MethodPost {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+
+		request := struct {
+			Game         string   `json:"game"`
+			Lobbies      []string `json:"lobbies"`
+			MembersBelow int      `json:"membersBelow"`
+			MinAge       string   `json:"minAge"`
+			RetryAfter   string   `json:"retryAfter"`
+		}{}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+		decoder.DisallowUnknownFields() // A typo shouldn't turn into draining everything.
+		if err := decoder.Decode(&request); err != nil {
+			util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
+		}
+		filter := signaling.DrainFilter{
+			Game:         request.Game,
+			Lobbies:      request.Lobbies,
+			MembersBelow: request.MembersBelow,
+		}
+		var retryAfter time.Duration
+		var err error
+		if request.MinAge != "" {
+			if filter.MinAge, err = time.ParseDuration(request.MinAge); err != nil {
+				util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
+			}
+		}
+		if request.RetryAfter != "" {
+			if retryAfter, err = time.ParseDuration(request.RetryAfter); err != nil {
+				util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
+			}
+		}
+
+		drained, err := drainer.Drain(ctx, filter, retryAfter)
+		if err != nil {
+			util.ErrorAndAbort(w, r, http.StatusInternalServerError, "", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"drained": drained}) //nolint:errcheck
+	}
+}
+
+// candidatesHandler lists the candidate types relayed per lobby through this
+// node, optionally filtered with the game and lobby query parameters. It's
+// only available with TALLY_CANDIDATES enabled.
+func candidatesHandler(candidates *signaling.CandidateTally) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if candidates == nil {
+			util.ErrorAndAbort(w, r, http.StatusNotFound, "not-found")
+		}
+		if r.Method != http.MethodGet {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+		query := r.URL.Query()
+		util.RenderJSON(w, r, http.StatusOK, map[string]any{
+			"lobbies": candidates.Snapshot(query.Get("game"), query.Get("lobby")),
+		})
+	}
+}
+
+// trafficHandler lists the signaling traffic per lobby on this node, the
+// chattiest lobbies first, optionally filtered with the game and lobby query
+// parameters.
+func trafficHandler(traffic *signaling.LobbyTraffic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+		query := r.URL.Query()
+		util.RenderJSON(w, r, http.StatusOK, map[string]any{
+			"lobbies": traffic.Snapshot(query.Get("game"), query.Get("lobby")),
+		})
+	}
+}
+
+// storeOpsHandler lists the store operations per connection on this node, the
+// busiest connections first, optionally filtered with the game query parameter.
+func storeOpsHandler(node *signaling.Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+		util.RenderJSON(w, r, http.StatusOK, map[string]any{
+			"connections": node.StoreOps(r.URL.Query().Get("game")),
+		})
+	}
+}
+
+// eventsHandler queries the persisted analytics events, the newest first,
+// filtered with the game, category, action, peer and lobby query parameters
+// and bounded with since and until (RFC 3339) and limit.
+func eventsHandler(store stores.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if r.Method != http.MethodGet {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+		query := r.URL.Query()
+		eventQuery := stores.EventQuery{
+			Game:     query.Get("game"),
+			Category: query.Get("category"),
+			Action:   query.Get("action"),
+			Peer:     query.Get("peer"),
+			Lobby:    query.Get("lobby"),
+		}
+		var err error
+		if raw := query.Get("since"); raw != "" {
+			if eventQuery.Since, err = time.Parse(time.RFC3339, raw); err != nil {
+				util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
+			}
+		}
+		if raw := query.Get("until"); raw != "" {
+			if eventQuery.Until, err = time.Parse(time.RFC3339, raw); err != nil {
+				util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
+			}
+		}
+		if raw := query.Get("limit"); raw != "" {
+			if eventQuery.Limit, err = strconv.Atoi(raw); err != nil {
+				util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
+			}
+		}
+
+		events, err := store.QueryEvents(ctx, eventQuery)
+		if err != nil {
+			util.ErrorAndAbort(w, r, http.StatusInternalServerError, "", err)
+		}
+		util.RenderJSON(w, r, http.StatusOK, map[string]any{
+			"events": events,
+		})
+	}
+}
+
+// loadHandler reports the load of this node for load balancers, see
+// signaling.NodeLoad for the schema.
+func loadHandler(node *signaling.Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		util.RenderJSON(w, r, http.StatusOK, node.Load())
+	}
+}
+
+// playersHandler lists the peers of a player, the oldest session first, to
+// find the events and logs of a player given by the game and player query
+// parameters across its sessions.
+func playersHandler(store stores.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if r.Method != http.MethodGet {
+			util.ErrorAndAbort(w, r, http.StatusMethodNotAllowed, "")
+		}
+		query := r.URL.Query()
+		if !util.IsUUID(query.Get("game")) || query.Get("player") == "" {
+			util.ErrorAndAbort(w, r, http.StatusBadRequest, "", errors.New("no game or player supplied"))
+		}
+		peers, err := store.GetPlayerPeers(ctx, query.Get("game"), query.Get("player"))
+		if err != nil {
+			util.ErrorAndAbort(w, r, http.StatusInternalServerError, "", err)
+		}
+		if peers == nil {
+			peers = []string{}
+		}
+		util.RenderJSON(w, r, http.StatusOK, map[string]any{
+			"peers": peers,
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling"
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+// publishStore records what's published.
+type publishStore struct {
+	stores.Store
+
+	published map[string][]string
+}
+
+func (s *publishStore) Publish(_ context.Context, topic string, data []byte) error {
+	s.published[topic] = append(s.published[topic], string(data))
+	return nil
+}
+
+func TestAnnounceHandler(t *testing.T) {
+	store := &publishStore{published: make(map[string][]string)}
+	disabled := httptest.NewServer(adminOnly("", announceHandler(store)))
+	defer disabled.Close()
+	server := httptest.NewServer(adminOnly("secret", announceHandler(store)))
+	defer server.Close()
+
+	for _, test := range []struct {
+		url, method, token, body string
+		status                   int
+	}{
+		{disabled.URL, http.MethodPost, "", `{"message":"hi"}`, http.StatusNotFound},
+		{server.URL, http.MethodPost, "", `{"message":"hi"}`, http.StatusUnauthorized},
+		{server.URL, http.MethodPost, "wrong", `{"message":"hi"}`, http.StatusUnauthorized},
+		{server.URL, http.MethodGet, "secret", "", http.StatusMethodNotAllowed},
+		{server.URL, http.MethodPost, "secret", `{"data":{"minutes":5}}`, http.StatusBadRequest},
+		{server.URL, http.MethodPost, "secret", `{"message":"maintenance in 5 minutes"}`, http.StatusAccepted},
+	} {
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Fatalf("expected %d for %s %q with %q, got %d", test.status, test.method, test.body, test.token, res.StatusCode)
+		}
+	}
+
+	// Only the accepted request is published.
+	got := store.published[signaling.AnnouncementsTopic]
+	if len(got) != 1 || got[0] != `{"type":"announcement","message":"maintenance in 5 minutes"}` {
+		t.Fatalf("expected the announcement to be published once, got %v", got)
+	}
+}
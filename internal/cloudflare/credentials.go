@@ -11,35 +11,146 @@ import (
 	"time"
 
 	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
 	"go.uber.org/zap"
 )
 
 type CredentialsClient struct {
-	zone     string
-	appID    string
-	authUser string
-	authKey  string
+	baseURL string
+	zone    string
+	appID   string
 
 	lifetime time.Duration
 
-	mutex  sync.RWMutex
-	cached *Credentials
+	// mutex guards the auth and the cache. generation is bumped by
+	// Invalidate, credentials fetched in an older generation aren't cached.
+	mutex      sync.RWMutex
+	authUser   string
+	authKey    string
+	cached     *Credentials
+	generation uint64
+
+	// refresh wakes Run up to fetch new credentials after Invalidate.
+	refresh chan struct{}
+
+	// inflight bounds the number of concurrent upstream calls made by
+	// GetCredentials, requests wait at most queueTimeout for a slot.
+	inflight     chan struct{}
+	queueTimeout time.Duration
+
+	// Transient upstream errors are retried up to maxAttempts times with
+	// exponential backoff starting at retryDelay.
+	maxAttempts int
+	retryDelay  time.Duration
 
 	HasFetchedFirstCredentials bool
 }
 
+const DefaultMaxInFlight = 4
+const DefaultQueueTimeout = 5 * time.Second
+
+const DefaultMaxAttempts = 4
+const DefaultRetryDelay = 200 * time.Millisecond
+const maxRetryDelay = 5 * time.Second
+
+// retryDeadline bounds the total time GetCredentials spends retrying, on top
+// of the deadline of the request context.
+const retryDeadline = 10 * time.Second
+
+var ErrTooManyRequests = util.NewError("rate-limited", "too many concurrent credential requests")
+
+// retryableError marks upstream errors that are worth retrying.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
 func NewCredentialsClient(zone, appID, user, key string, lifetime time.Duration) *CredentialsClient {
 	c := &CredentialsClient{
-		zone:     zone,
-		appID:    appID,
+		baseURL: "https://api.cloudflare.com/client/v4",
+		zone:    zone,
+		appID:   appID,
+
 		authUser: user,
 		authKey:  key,
 
 		lifetime: lifetime,
+
+		refresh: make(chan struct{}, 1),
 	}
+	c.LimitConcurrency(DefaultMaxInFlight, DefaultQueueTimeout)
+	c.Retry(DefaultMaxAttempts, DefaultRetryDelay)
 	return c
 }
 
+// Retry sets how often transient upstream errors (network errors, timeouts,
+// 429 and 5xx responses) are attempted and the initial backoff between attempts.
+// It should be called before the client is used.
+func (c *CredentialsClient) Retry(maxAttempts int, delay time.Duration) {
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	c.maxAttempts = maxAttempts
+	c.retryDelay = delay
+}
+
+// LimitConcurrency sets the maximum number of concurrent upstream calls and
+// how long a request waits for a free slot before failing with ErrTooManyRequests.
+// It should be called before the client is used.
+func (c *CredentialsClient) LimitConcurrency(limit int, queueTimeout time.Duration) {
+	if limit <= 0 {
+		limit = DefaultMaxInFlight
+	}
+	c.inflight = make(chan struct{}, limit)
+	c.queueTimeout = queueTimeout
+}
+
+// Invalidate drops the cached credentials and makes Run fetch new ones right
+// away, e.g. after the TURN secret was rotated. Until they're fetched
+// GetCredentials fetches them itself.
+func (c *CredentialsClient) Invalidate() {
+	c.mutex.Lock()
+	c.cached = nil
+	c.generation++
+	c.mutex.Unlock()
+	metrics.Inc("netlib_credentials_invalidations_total")
+
+	select {
+	case c.refresh <- struct{}{}:
+	default: // A refresh is already pending.
+	}
+}
+
+// SetAuth replaces the Cloudflare API credentials without a restart and
+// invalidates the credentials fetched with the old ones.
+func (c *CredentialsClient) SetAuth(user, key string) {
+	c.mutex.Lock()
+	c.authUser = user
+	c.authKey = key
+	c.mutex.Unlock()
+	c.Invalidate()
+}
+
+// store caches creds unless the cache was invalidated since generation.
+func (c *CredentialsClient) store(creds *Credentials, generation uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return false
+	}
+	c.cached = creds
+	return true
+}
+
+func (c *CredentialsClient) currentGeneration() uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.generation
+}
+
 func (c *CredentialsClient) Run(ctx context.Context) {
 	logger := logging.GetLogger(ctx)
 
@@ -51,26 +162,27 @@ func (c *CredentialsClient) Run(ctx context.Context) {
 	for ctx.Err() == nil {
 		start := time.Now()
 		logger.Info("refetching credentials")
+		generation := c.currentGeneration()
 		fetchctx, fetchcancel := context.WithTimeout(ctx, 2*time.Minute)
-		creds, err := c.fetchCredentials(fetchctx)
+		creds, err := c.fetchCredentialsWithRetry(fetchctx)
 		fetchcancel()
+		wait := c.lifetime / 2
 		if err != nil {
 			logger.Error("failed to fetch credentials", zap.Error(err),
 				zap.Duration("duration", time.Since(start)))
-			time.Sleep(1 * time.Minute)
-			continue
+			wait = time.Minute
+		} else if c.store(creds, generation) {
+			logger.Info("fetched credentials", zap.Duration("duration", time.Since(start)))
+			logger.Info("credentials cache set")
+		} else {
+			logger.Info("credentials invalidated while fetching, refetching")
+			wait = 0
 		}
-		logger.Info("fetched credentials", zap.Duration("duration", time.Since(start)))
-
-		c.mutex.Lock()
-		c.cached = creds
-		c.mutex.Unlock()
-
-		logger.Info("credentials cache set")
 
 		select {
-		case <-time.After(c.lifetime / 2):
-			continue
+		case <-time.After(wait):
+		case <-c.refresh:
+			logger.Info("credentials invalidated")
 		case <-ctx.Done():
 			return
 		}
@@ -79,31 +191,126 @@ func (c *CredentialsClient) Run(ctx context.Context) {
 
 func (c *CredentialsClient) GetCredentials(ctx context.Context) (*Credentials, error) {
 	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	if c.cached == nil {
+	cached := c.cached
+	c.mutex.RUnlock()
+	if cached != nil {
+		return cached, nil
+	}
+	if c.zone == "" {
 		return nil, errors.New("no credentials available")
 	}
-	return c.cached, nil
+
+	// Nothing cached yet (e.g. the first fetch in Run failed), fetch upstream
+	// but bound the number of concurrent calls to protect the Cloudflare API.
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-c.inflight }()
+
+	c.mutex.RLock()
+	cached = c.cached
+	c.mutex.RUnlock()
+	if cached != nil {
+		return cached, nil // Fetched while we were waiting.
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, retryDeadline)
+	defer cancel()
+	generation := c.currentGeneration()
+	creds, err := c.fetchCredentialsWithRetry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.store(creds, generation)
+	return creds, nil
+}
+
+func (c *CredentialsClient) acquire(ctx context.Context) error {
+	select {
+	case c.inflight <- struct{}{}:
+		return nil
+	default:
+	}
+
+	metrics.Inc("netlib_credentials_queue_waits_total")
+	timer := time.NewTimer(c.queueTimeout)
+	defer timer.Stop()
+	select {
+	case c.inflight <- struct{}{}:
+		return nil
+	case <-timer.C:
+		metrics.Inc("netlib_credentials_queue_timeouts_total")
+		return ErrTooManyRequests
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *CredentialsClient) fetchCredentialsWithRetry(ctx context.Context) (*Credentials, error) {
+	logger := logging.GetLogger(ctx)
+
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		creds, err := c.fetchCredentials(ctx)
+		var retryable retryableError
+		if err == nil || !errors.As(err, &retryable) {
+			return creds, err
+		}
+		if attempt >= c.maxAttempts {
+			metrics.Inc("netlib_credentials_retry_giveups_total", "reason", "attempts")
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			metrics.Inc("netlib_credentials_retry_giveups_total", "reason", "deadline")
+			return nil, err
+		}
+
+		logger.Warn("failed to fetch credentials, retrying", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		metrics.Inc("netlib_credentials_retries_total")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			metrics.Inc("netlib_credentials_retry_giveups_total", "reason", "deadline")
+			return nil, err
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
 }
 
 func (c *CredentialsClient) fetchCredentials(ctx context.Context) (*Credentials, error) {
-	url := "https://api.cloudflare.com/client/v4/zones/" + c.zone + "/webrtc-turn/credential/" + c.appID
+	c.mutex.RLock()
+	user, key := c.authUser, c.authKey
+	c.mutex.RUnlock()
+
+	url := c.baseURL + "/zones/" + c.zone + "/webrtc-turn/credential/" + c.appID
 	body := strings.NewReader(fmt.Sprintf(`{"lifetime":%d}`, c.lifetime/time.Second))
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-Auth-Email", c.authUser)
-	req.Header.Set("X-Auth-Key", c.authKey)
+	req.Header.Set("X-Auth-Email", user)
+	req.Header.Set("X-Auth-Key", key)
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
+	requested := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, retryableError{err}
 	}
+	defer resp.Body.Close() //nolint:errcheck
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected error from Cloudflare: %s", resp.Status)
+		err := fmt.Errorf("unexpected error from Cloudflare: %s", resp.Status)
+		if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, retryableError{err}
+		}
+		return nil, err
 	}
 
 	response := response{}
@@ -120,5 +327,7 @@ func (c *CredentialsClient) fetchCredentials(ctx context.Context) (*Credentials,
 		Username:   response.Result.Userid,
 		Credential: response.Result.Credential,
 		Lifetime:   response.Result.Lifetime,
+		// Counted from the request so they never expire before ExpiresAt.
+		ExpiresAt: requested.Add(time.Duration(response.Result.Lifetime) * time.Second).UnixMilli(),
 	}, nil
 }
@@ -0,0 +1,100 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testCredentialsClient(t *testing.T) (*CredentialsClient, *atomic.Int32, *atomic.Value) {
+	var calls atomic.Int32
+	var lastKey atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		lastKey.Store(r.Header.Get("X-Auth-Key"))
+		fmt.Fprintf(w, `{"success":true,"result":{"protocol":"udp/50000","dns":{"name":"turn.example.com"},"lifetime":7200,"userid":"user","credential":"credential-%d"}}`, n)
+	}))
+	t.Cleanup(server.Close)
+
+	c := NewCredentialsClient("zone", "app", "user", "old-key", 2*time.Hour)
+	c.baseURL = server.URL
+	return c, &calls, &lastKey
+}
+
+func TestInvalidateForcesFetch(t *testing.T) {
+	c, calls, _ := testCredentialsClient(t)
+	ctx := context.Background()
+
+	first, err := c.GetCredentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.GetCredentials(ctx); err != nil || again != first {
+		t.Fatalf("expected the cached credentials, got %v %v", again, err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", n)
+	}
+
+	c.Invalidate()
+	fresh, err := c.GetCredentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("expected invalidation to cause an upstream call, got %d calls", n)
+	}
+	if fresh.Credential == first.Credential {
+		t.Fatalf("expected fresh credentials, got %s again", fresh.Credential)
+	}
+}
+
+func TestSetAuthUsesNewKey(t *testing.T) {
+	c, _, lastKey := testCredentialsClient(t)
+	ctx := context.Background()
+
+	if _, err := c.GetCredentials(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.SetAuth("user", "new-key")
+	if _, err := c.GetCredentials(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if key := lastKey.Load(); key != "new-key" {
+		t.Fatalf("expected the new key to be used, got %v", key)
+	}
+}
+
+func TestStaleFetchIsNotCached(t *testing.T) {
+	c, _, _ := testCredentialsClient(t)
+	generation := c.currentGeneration()
+	c.Invalidate()
+	if c.store(&Credentials{Credential: "stale"}, generation) {
+		t.Fatal("credentials fetched before the invalidation shouldn't be cached")
+	}
+}
+
+func TestCredentialsExpiresAt(t *testing.T) {
+	c, _, _ := testCredentialsClient(t)
+	ctx := context.Background()
+
+	before := time.Now()
+	creds, err := c.GetCredentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	lifetime := time.Duration(creds.Lifetime) * time.Second
+	if creds.ExpiresAt < before.Add(lifetime).UnixMilli() || creds.ExpiresAt > after.Add(lifetime).UnixMilli() {
+		t.Fatalf("expected the credentials to expire a lifetime after the request, got %d", creds.ExpiresAt)
+	}
+
+	// Cached credentials keep expiring at the same time.
+	if cached, err := c.GetCredentials(ctx); err != nil || cached.ExpiresAt != creds.ExpiresAt {
+		t.Fatalf("expected the cached credentials to keep their expiry, got %v (%v)", cached, err)
+	}
+}
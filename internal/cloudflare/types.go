@@ -7,6 +7,9 @@ type Credentials struct {
 	Username   string `json:"username"`
 	Credential string `json:"credential"`
 	Lifetime   int    `json:"lifetime"`
+	// ExpiresAt is when the credentials expire in milliseconds on the clock
+	// of the server, Lifetime counts from when they were fetched.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
 }
 
 type response struct {
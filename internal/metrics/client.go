@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/koenbollen/logging"
@@ -23,6 +24,16 @@ const maxConnsPerHost = 32
 const maxRetries = 5
 const backoffRange = 1000 // milliseconds, picked randomly from a range times the number of retries
 
+// Events are sent by a fixed number of workers from a bounded queue, when the
+// queue is full events are dropped instead of piling up goroutines.
+const workers = 8
+const queueSize = 1024
+
+// After failureThreshold consecutive failed events the backend is considered
+// unavailable and events are dropped for backendCooldown.
+const failureThreshold = 5
+const backendCooldown = 30 * time.Second
+
 type EventParams struct {
 	Game     string `json:"game"`
 	Category string `json:"category"`
@@ -36,6 +47,20 @@ type EventParams struct {
 type Client struct {
 	url    string
 	client http.Client
+	// store persists the events instead of sending them to url, see
+	// NewStoreClient.
+	store EventStore
+
+	queue chan queuedEvent
+
+	failures         atomic.Int32
+	unavailableUntil atomic.Int64
+}
+
+type queuedEvent struct {
+	logger    *zap.Logger
+	event     *Event
+	userAgent string
 }
 
 func NewClient(url string) *Client {
@@ -52,10 +77,40 @@ func NewClient(url string) *Client {
 				TLSHandshakeTimeout: timeout,
 			},
 		},
+		queue: make(chan queuedEvent, queueSize),
 	}
+	c.start()
 	return c
 }
 
+func (c *Client) start() {
+	for i := 0; i < workers; i++ {
+		go c.work()
+	}
+}
+
+func (c *Client) work() {
+	for event := range c.queue {
+		if time.Now().UnixNano() < c.unavailableUntil.Load() {
+			Inc("netlib_metrics_events_dropped_total", "reason", "unavailable")
+			continue
+		}
+		var delivered bool
+		if c.store != nil {
+			delivered = c.persist(event)
+		} else {
+			delivered = c.send(event)
+		}
+		if delivered {
+			c.failures.Store(0)
+		} else if c.failures.Add(1) >= failureThreshold {
+			event.logger.Warn("metrics backend unavailable, dropping events", zap.Duration("cooldown", backendCooldown))
+			c.unavailableUntil.Store(time.Now().Add(backendCooldown).UnixNano())
+			c.failures.Store(0)
+		}
+	}
+}
+
 func (c *Client) Record(ctx context.Context, category, action, game, peerID, lobbyID string, data ...string) {
 	if len(data)%2 != 0 {
 		panic("data must be pairs")
@@ -79,6 +134,14 @@ func (c *Client) RecordEvent(ctx context.Context, params EventParams) {
 	now := util.Now(ctx)
 	remoteAddr, _ := ctx.Value(remoteAddrKey).(string)
 	userAgent, _ := ctx.Value(userAgentKey).(string)
+	if edge, _ := ctx.Value(edgeKey).(string); edge != "" {
+		data := make(map[string]string, len(params.Data)+1)
+		for k, v := range params.Data {
+			data[k] = v
+		}
+		data["edge"] = edge
+		params.Data = data
+	}
 
 	event := &Event{
 		Time:    now.UnixMilli(),
@@ -94,14 +157,25 @@ func (c *Client) RecordEvent(ctx context.Context, params EventParams) {
 		Data: params.Data,
 	}
 
-	payload, err := json.Marshal(event)
-	if err != nil {
-		logger.Error("failed to marshal event", zap.Error(err))
-		return
+	select {
+	case c.queue <- queuedEvent{logger: logger, event: event, userAgent: userAgent}:
+	default:
+		Inc("netlib_metrics_events_dropped_total", "reason", "queue_full")
 	}
+}
 
+// send posts the event to the backend, it returns false when the event
+// couldn't be delivered.
+func (c *Client) send(event queuedEvent) bool {
 	idempotency := xid.New().String()
-	logger = logger.With(zap.String("idempotency", idempotency))
+	logger := event.logger.With(zap.String("idempotency", idempotency))
+	userAgent := event.userAgent
+
+	payload, err := json.Marshal(event.event)
+	if err != nil {
+		logger.Error("failed to marshal event", zap.Error(err))
+		return true // the backend isn't to blame.
+	}
 
 	// Use a new context, we want to record events of users that are already disconnected.
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -115,7 +189,7 @@ func (c *Client) RecordEvent(ctx context.Context, params EventParams) {
 		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
 		if err != nil {
 			logger.Error("failed to create metrics request", zap.Error(err))
-			return
+			return false
 		}
 		req.Header.Set("X-Idempotency-ID", idempotency)
 		if userAgent != "" {
@@ -139,9 +213,10 @@ func (c *Client) RecordEvent(ctx context.Context, params EventParams) {
 			if resp.StatusCode/100 == 5 {
 				continue
 			}
-			return
+			return true // the backend is up, it just didn't like this event.
 		}
 
-		return
+		return true
 	}
+	return false
 }
@@ -11,6 +11,7 @@ type metricsContextKey int
 var clientKey = metricsContextKey(0)
 var remoteAddrKey = metricsContextKey(1)
 var userAgentKey = metricsContextKey(2)
+var edgeKey = metricsContextKey(3)
 
 func Middleware(next http.Handler, client *Client) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -28,6 +29,12 @@ func Middleware(next http.Handler, client *Client) http.Handler {
 	})
 }
 
+// WithEdge tags all events recorded with the returned context with the CDN
+// edge the connection came through.
+func WithEdge(ctx context.Context, edge string) context.Context {
+	return context.WithValue(ctx, edgeKey, edge)
+}
+
 func Record(ctx context.Context, category, action, game, peerID, lobbyID string, data ...string) {
 	if client, ok := ctx.Value(clientKey).(*Client); ok {
 		client.Record(ctx, category, action, game, peerID, lobbyID, data...)
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets (in seconds) used by Observe.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+type series struct {
+	name   string
+	labels string
+}
+
+// registry keeps in-process counters, gauges and histograms that are exposed
+// in the Prometheus text format. It is intentionally small, we only need a
+// handful of metric types and don't want to pull in the full client library.
+type registry struct {
+	mutex      sync.Mutex
+	counters   map[series]float64
+	gauges     map[series]float64
+	histograms map[series]*histogram
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var defaultRegistry = &registry{
+	counters:   make(map[series]float64),
+	gauges:     make(map[series]float64),
+	histograms: make(map[series]*histogram),
+}
+
+func newSeries(name string, labels []string) series {
+	if len(labels)%2 != 0 {
+		panic("labels must be pairs")
+	}
+	if len(labels) == 0 {
+		return series{name: name}
+	}
+	var b strings.Builder
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return series{name: name, labels: b.String()}
+}
+
+// Add increments the counter with the given name and label pairs by delta.
+func Add(name string, delta float64, labels ...string) {
+	s := newSeries(name, labels)
+	defaultRegistry.mutex.Lock()
+	defaultRegistry.counters[s] += delta
+	defaultRegistry.mutex.Unlock()
+}
+
+// Inc increments the counter with the given name and label pairs by one.
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+// Set sets the gauge with the given name and label pairs to value.
+func Set(name string, value float64, labels ...string) {
+	s := newSeries(name, labels)
+	defaultRegistry.mutex.Lock()
+	defaultRegistry.gauges[s] = value
+	defaultRegistry.mutex.Unlock()
+}
+
+// Observe records value in the histogram with the given name and label pairs.
+func Observe(name string, value float64, labels ...string) {
+	ObserveBuckets(name, value, DefaultBuckets, labels...)
+}
+
+// ObserveBuckets is like Observe but with custom buckets, for values that
+// aren't in the range of DefaultBuckets. A histogram keeps the buckets it was
+// first observed with.
+func ObserveBuckets(name string, value float64, buckets []float64, labels ...string) {
+	s := newSeries(name, labels)
+	defaultRegistry.mutex.Lock()
+	defer defaultRegistry.mutex.Unlock()
+	h, ok := defaultRegistry.histograms[s]
+	if !ok {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		defaultRegistry.histograms[s] = h
+	}
+	for i, le := range h.buckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Handler returns a http.Handler exposing all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(defaultRegistry.render())) //nolint:errcheck
+	})
+}
+
+func (r *registry) render() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var b strings.Builder
+	writeSimple := func(typ string, values map[series]float64) {
+		for _, name := range sortedNames(values) {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+			for _, s := range sortedSeries(values, name) {
+				fmt.Fprintf(&b, "%s%s %s\n", name, braces(s.labels), formatFloat(values[s]))
+			}
+		}
+	}
+	writeSimple("counter", r.counters)
+	writeSimple("gauge", r.gauges)
+
+	for _, name := range sortedNames(r.histograms) {
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		for _, s := range sortedSeries(r.histograms, name) {
+			h := r.histograms[s]
+			sep := ""
+			if s.labels != "" {
+				sep = ","
+			}
+			for i, le := range h.buckets {
+				fmt.Fprintf(&b, "%s_bucket{%s%sle=\"%s\"} %d\n", name, s.labels, sep, formatFloat(le), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, s.labels, sep, h.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, braces(s.labels), formatFloat(h.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, braces(s.labels), h.count)
+		}
+	}
+	return b.String()
+}
+
+func sortedNames[V any](m map[series]V) []string {
+	seen := make(map[string]struct{})
+	var names []string
+	for s := range m {
+		if _, ok := seen[s.name]; !ok {
+			seen[s.name] = struct{}{}
+			names = append(names, s.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedSeries[V any](m map[series]V, name string) []series {
+	var list []series
+	for s := range m {
+		if s.name == name {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].labels < list[j].labels })
+	return list
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryRender(t *testing.T) {
+	r := &registry{
+		counters:   make(map[series]float64),
+		gauges:     make(map[series]float64),
+		histograms: make(map[series]*histogram),
+	}
+	defaultRegistry, r = r, defaultRegistry
+	defer func() { defaultRegistry = r }()
+
+	Inc("test_total", "type", `a"b`)
+	Set("test_gauge", 3)
+	Observe("test_seconds", 0.003, "type", "join")
+	Observe("test_seconds", 20, "type", "join")
+	ObserveBuckets("test_lifetime_seconds", 90, []float64{60, 600})
+
+	out := defaultRegistry.render()
+	for _, want := range []string{
+		"# TYPE test_total counter\n",
+		`test_total{type="a\"b"} 1` + "\n",
+		"test_gauge 3\n",
+		`test_seconds_bucket{type="join",le="0.0025"} 0` + "\n",
+		`test_seconds_bucket{type="join",le="0.005"} 1` + "\n",
+		`test_seconds_bucket{type="join",le="+Inf"} 2` + "\n",
+		`test_seconds_count{type="join"} 2` + "\n",
+		`test_lifetime_seconds_bucket{le="60"} 0` + "\n",
+		`test_lifetime_seconds_bucket{le="600"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
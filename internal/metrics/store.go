@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// storeBatchSize is the most events a worker persists at once, the events
+// waiting in the queue are batched so a busy node doesn't do an insert per
+// event.
+const storeBatchSize = 100
+
+// EventStore is the part of stores.Store events are persisted with.
+type EventStore interface {
+	AppendEvents(ctx context.Context, events []stores.Event) error
+}
+
+// NewStoreClient returns a client that persists the events to store instead
+// of sending them to a metrics backend, so they can be queried later with
+// stores.Store.QueryEvents. Events are written by the same bounded queue and
+// workers, recording an event never waits on the store.
+func NewStoreClient(store EventStore) *Client {
+	c := &Client{
+		store: store,
+		queue: make(chan queuedEvent, queueSize),
+	}
+	c.start()
+	return c
+}
+
+// persist stores first and the events queued behind it, it returns false
+// when they couldn't be stored.
+func (c *Client) persist(first queuedEvent) bool {
+	batch := []stores.Event{storedEvent(first.event)}
+drain:
+	for len(batch) < storeBatchSize {
+		select {
+		case event, ok := <-c.queue:
+			if !ok {
+				break drain
+			}
+			batch = append(batch, storedEvent(event.event))
+		default:
+			break drain
+		}
+	}
+
+	// Use a new context, we want to record events of users that are already disconnected.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := c.store.AppendEvents(ctx, batch); err != nil {
+		first.logger.Error("failed to persist events", zap.Error(err), zap.Int("events", len(batch)))
+		Add("netlib_metrics_events_dropped_total", float64(len(batch)), "reason", "store_error")
+		return false
+	}
+	return true
+}
+
+func storedEvent(e *Event) stores.Event {
+	return stores.Event{
+		Time:     time.UnixMilli(e.Time).UTC(),
+		Game:     e.Game,
+		Client:   e.Client,
+		Version:  e.Version,
+		Category: e.Category,
+		Action:   e.Action,
+		Peer:     e.Peer,
+		Lobby:    e.Lobby,
+		Data:     e.Data,
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+type eventStore struct {
+	mutex   sync.Mutex
+	batches [][]stores.Event
+}
+
+func (s *eventStore) AppendEvents(ctx context.Context, events []stores.Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+func TestStoreClientBatches(t *testing.T) {
+	store := &eventStore{}
+	// Without workers the events stay queued, persist drains them like a worker would.
+	c := &Client{store: store, queue: make(chan queuedEvent, queueSize)}
+	for i := 0; i < storeBatchSize+10; i++ {
+		c.RecordEvent(context.Background(), EventParams{Game: "game", Category: "lobby", Action: "join", PeerID: "peer"})
+	}
+	first := <-c.queue
+	if !c.persist(first) {
+		t.Fatal("expected the events to be persisted")
+	}
+	if len(store.batches) != 1 || len(store.batches[0]) != storeBatchSize {
+		t.Fatalf("expected a single batch of %d events, got %d batches", storeBatchSize, len(store.batches))
+	}
+	if len(c.queue) != 10 {
+		t.Fatalf("expected the rest to stay queued, got %d", len(c.queue))
+	}
+	event := store.batches[0][0]
+	if event.Game != "game" || event.Action != "join" || event.Peer != "peer" || time.Since(event.Time) > time.Minute {
+		t.Fatalf("unexpected stored event %+v", event)
+	}
+}
+
+func TestStoreClientRecordsInBackground(t *testing.T) {
+	store := &eventStore{}
+	c := NewStoreClient(store)
+	c.RecordEvent(context.Background(), EventParams{Game: "game", Category: "lobby", Action: "create"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		store.mutex.Lock()
+		n := len(store.batches)
+		store.mutex.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the event to be persisted")
+}
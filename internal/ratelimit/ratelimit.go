@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrLimited = util.NewError("rate-limited", "rate limit reached, try again later")
+
+// Limiter allows a bounded number of events per window. Allow returns the
+// number of events left in the current window, or ErrLimited.
+type Limiter interface {
+	Allow(ctx context.Context) (remaining int, err error)
+}
+
+// Memory is a fixed window Limiter for single node deployments.
+type Memory struct {
+	limit  int
+	window time.Duration
+
+	mutex sync.Mutex
+	start time.Time
+	count int
+}
+
+func NewMemory(limit int, window time.Duration) *Memory {
+	return &Memory{
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (m *Memory) Allow(ctx context.Context) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.start) >= m.window {
+		m.start = now.Truncate(m.window)
+		m.count = 0
+	}
+	if m.count >= m.limit {
+		return 0, ErrLimited
+	}
+	m.count++
+	return m.limit - m.count, nil
+}
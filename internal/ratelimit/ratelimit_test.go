@@ -0,0 +1,30 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewMemory(2, time.Hour)
+	for _, want := range []int{1, 0} {
+		if remaining, err := limiter.Allow(ctx); err != nil || remaining != want {
+			t.Fatalf("expected %d remaining, got %d (%v)", want, remaining, err)
+		}
+	}
+	if _, err := limiter.Allow(ctx); err != ErrLimited {
+		t.Fatalf("expected ErrLimited, got %v", err)
+	}
+
+	// The budget is back in the next window.
+	limiter = NewMemory(1, 10*time.Millisecond)
+	if _, err := limiter.Allow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if remaining, err := limiter.Allow(ctx); err != nil || remaining != 0 {
+		t.Fatalf("expected a new window, got %d (%v)", remaining, err)
+	}
+}
@@ -6,24 +6,39 @@ import (
 	"sync/atomic"
 
 	"github.com/poki/netlib/internal/cloudflare"
+	"github.com/poki/netlib/internal/metrics"
 	"github.com/poki/netlib/internal/signaling"
 	"github.com/poki/netlib/internal/signaling/stores"
 	"github.com/poki/netlib/internal/util"
 )
 
-func Signaling(ctx context.Context, store stores.Store, credentialsClient *cloudflare.CredentialsClient) (http.Handler, func()) {
+func Signaling(ctx context.Context, store stores.Store, credentialsClient *cloudflare.CredentialsClient, config signaling.Config) (http.Handler, func(context.Context) error) {
 	mux := http.NewServeMux()
 
-	openConnections, signaling := signaling.Handler(ctx, store, credentialsClient)
+	_, signaling, node := signaling.Handler(ctx, store, credentialsClient, config)
 
-	cleanup := func() {
-		openConnections.Wait()
-	}
+	cleanup := node.Shutdown
 	mux.Handle("/v0/signaling", signaling)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/admin/announce", adminOnly(config.AdminToken, announceHandler(store)))
+	mux.HandleFunc("/admin/drain", adminOnly(config.AdminToken, drainHandler(node.Drainer)))
+	mux.HandleFunc("/admin/credentials/invalidate", adminOnly(config.AdminToken, invalidateCredentialsHandler(store)))
+	if credentialsClient != nil {
+		store.Subscribe(ctx, credentialsTopic, func(ctx context.Context, _ []byte) {
+			credentialsClient.Invalidate()
+		})
+	}
+	mux.HandleFunc("/admin/candidates", adminOnly(config.AdminToken, candidatesHandler(node.Candidates)))
+	mux.HandleFunc("/admin/traffic", adminOnly(config.AdminToken, trafficHandler(node.Traffic)))
+	mux.HandleFunc("/admin/store-ops", adminOnly(config.AdminToken, storeOpsHandler(node)))
+	mux.HandleFunc("/admin/events", adminOnly(config.AdminToken, eventsHandler(store)))
+	mux.HandleFunc("/admin/load", adminOnly(config.AdminToken, loadHandler(node)))
+	mux.HandleFunc("/admin/players", adminOnly(config.AdminToken, playersHandler(store)))
 
 	hasCredentials := uint32(0)
 	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		if atomic.LoadUint32(&hasCredentials) != 0 {
+		// Without Cloudflare there are no credentials to wait for.
+		if credentialsClient == nil || atomic.LoadUint32(&hasCredentials) != 0 {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
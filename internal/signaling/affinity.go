@@ -0,0 +1,77 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Affinity is the node a lobby was created on. Clients reconnecting through
+// a load balancer that can route on it end up on the same node as most of
+// their lobby, which saves relaying every packet between nodes.
+type Affinity struct {
+	Node     string `json:"node"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// setAffinityCookie pins the next connections of the client to this node on
+// load balancers with cookie based sticky sessions. A cookie for another node
+// means the load balancer couldn't honor it, e.g. because that node is gone.
+func setAffinityCookie(w http.ResponseWriter, r *http.Request, config *Config) {
+	if config.NodeID == "" || config.AffinityCookie == "" {
+		return
+	}
+	if cookie, err := r.Cookie(config.AffinityCookie); err == nil && cookie.Value != config.NodeID {
+		metrics.Inc("netlib_affinity_misses_total")
+	}
+	// Reconnects within the connection cap go to this node, without a cap the
+	// cookie lasts for the browser session.
+	maxAge := 0
+	if config.MaxConnectionTime > 0 {
+		maxAge = int(config.MaxConnectionTime.Seconds())
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.AffinityCookie,
+		Value:    config.NodeID,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode, // Games are embedded on other sites.
+	})
+}
+
+// localAffinity is the Affinity of lobbies created on this node, nil when
+// the node has no identity.
+func (p *Peer) localAffinity() *Affinity {
+	if p.config.NodeID == "" {
+		return nil
+	}
+	return &Affinity{Node: p.config.NodeID, Endpoint: p.config.NodeEndpoint}
+}
+
+// lobbyAffinity returns the Affinity of the lobby of the peer. It's only a
+// hint, so it's nil when affinity is disabled or can't be determined.
+func (p *Peer) lobbyAffinity(ctx context.Context) *Affinity {
+	if p.config.NodeID == "" {
+		return nil
+	}
+	node, endpoint, err := p.store.GetLobbyNode(ctx, p.Game, p.Lobby)
+	if err != nil {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("failed to get lobby node", zap.String("lobby", p.Lobby), zap.Error(err))
+		return nil
+	}
+	if node == "" {
+		return nil
+	}
+	locality := "remote"
+	if node == p.config.NodeID {
+		locality = "local"
+	}
+	metrics.Inc("netlib_lobby_locality_total", "locality", locality)
+	return &Affinity{Node: node, Endpoint: endpoint}
+}
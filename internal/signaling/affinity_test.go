@@ -0,0 +1,27 @@
+package signaling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetAffinityCookie(t *testing.T) {
+	config := &Config{NodeID: "node-1", AffinityCookie: "netlib-node"}
+
+	r := httptest.NewRequest(http.MethodGet, "/v0/signaling", nil)
+	r.AddCookie(&http.Cookie{Name: "netlib-node", Value: "node-2"})
+	w := httptest.NewRecorder()
+	setAffinityCookie(w, r, config)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "netlib-node" || cookies[0].Value != "node-1" {
+		t.Fatalf("expected the cookie to point to this node, got %v", cookies)
+	}
+
+	// Without a node identity the cookie isn't set.
+	w = httptest.NewRecorder()
+	setAffinityCookie(w, r, &Config{AffinityCookie: "netlib-node"})
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("expected no cookie, got %v", cookies)
+	}
+}
@@ -0,0 +1,75 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// AnnouncementsTopic is the pubsub topic announcements are published on so
+// every node delivers them to its own peers.
+const AnnouncementsTopic = "announcements"
+
+// Announcements are delivered in batches of announceBatchSize peers every
+// announceBatchInterval to avoid a burst of writes on large nodes.
+const announceBatchSize = 500
+const announceBatchInterval = 100 * time.Millisecond
+
+type AnnouncementPacket struct {
+	Type string `json:"type"`
+
+	Message string         `json:"message"`
+	Data    map[string]any `json:"data,omitempty"`
+}
+
+// BroadcastAll sends packet to every peer connected to any node of the
+// cluster. It's meant for admin use and isn't reachable by clients.
+func BroadcastAll(ctx context.Context, store stores.Store, packet AnnouncementPacket) error {
+	packet.Type = "announcement"
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	return store.Publish(ctx, AnnouncementsTopic, data)
+}
+
+// deliverAnnouncements returns the subscription callback that delivers
+// announcements published by BroadcastAll to the peers of this node.
+func deliverAnnouncements(registry *peerRegistry) stores.SubscriptionCallback {
+	return func(ctx context.Context, data []byte) {
+		logger := logging.GetLogger(ctx)
+		packet := AnnouncementPacket{}
+		if err := json.Unmarshal(data, &packet); err != nil {
+			logger.Error("invalid announcement", zap.Error(err))
+			return
+		}
+
+		peers := registry.Snapshot()
+		logger.Info("delivering announcement", zap.Int("peers", len(peers)))
+
+		onResult := func(err error) {
+			if err != nil {
+				metrics.Inc("netlib_announcements_total", "result", "failed")
+			} else {
+				metrics.Inc("netlib_announcements_total", "result", "delivered")
+			}
+		}
+		for i, p := range peers {
+			if i > 0 && i%announceBatchSize == 0 {
+				select {
+				case <-time.After(announceBatchInterval):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !p.Enqueue(packet, onResult) {
+				metrics.Inc("netlib_announcements_total", "result", "dropped")
+			}
+		}
+	}
+}
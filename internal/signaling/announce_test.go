@@ -0,0 +1,68 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+// announceStore delivers published packets to its single subscriber.
+type announceStore struct {
+	stores.Store
+
+	topic    string
+	callback stores.SubscriptionCallback
+}
+
+func (s *announceStore) Publish(ctx context.Context, topic string, data []byte) error {
+	s.topic = topic
+	s.callback(ctx, data)
+	return nil
+}
+
+func TestAnnouncementsReachEveryPeer(t *testing.T) {
+	registry := newPeerRegistry()
+	var peers []*Peer
+	for _, id := range []string{"a", "b", "c"} {
+		p := &Peer{config: &Config{MaxQueuedMessages: 4, MaxQueuedBytes: 1024}, queues: newQueues(4), ID: id}
+		registry.Add(p)
+		peers = append(peers, p)
+	}
+	// Peers in a lobby get announcements too.
+	registry.Join(peers[0], "lobby")
+
+	ctx := context.Background()
+	store := &announceStore{callback: deliverAnnouncements(registry)}
+	packet := AnnouncementPacket{Type: "ignored", Message: "maintenance in 5 minutes", Data: map[string]any{"minutes": 5.0}}
+	if err := BroadcastAll(ctx, store, packet); err != nil {
+		t.Fatal(err)
+	}
+	if store.topic != AnnouncementsTopic {
+		t.Fatalf("expected the announcement on %s, got %s", AnnouncementsTopic, store.topic)
+	}
+	for _, p := range peers {
+		q, ok := p.nextQueued(ctx)
+		if !ok {
+			t.Fatalf("expected an announcement for %s", p.ID)
+		}
+		got := AnnouncementPacket{}
+		if err := json.Unmarshal(q.packet, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != "announcement" || got.Message != packet.Message || got.Data["minutes"] != 5.0 {
+			t.Fatalf("unexpected announcement for %s: %s", p.ID, q.packet)
+		}
+	}
+
+	// Invalid announcements aren't delivered.
+	store.callback(ctx, []byte("not json"))
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for _, p := range peers {
+		if q, ok := p.nextQueued(canceled); ok {
+			t.Fatalf("expected nothing queued for %s, got %s", p.ID, q.packet)
+		}
+	}
+}
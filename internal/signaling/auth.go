@@ -0,0 +1,80 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+// remoteAuthTimeout bounds how long RemoteAuth waits for the backend.
+const remoteAuthTimeout = 5 * time.Second
+
+// AuthFunc authenticates a connection before its websocket is accepted, e.g.
+// by validating a token from a query parameter or header against a game's own
+// backend. The returned identity is attached to the Peer, an error rejects the
+// connection with a 401.
+type AuthFunc func(ctx context.Context, r *http.Request) (identity string, err error)
+
+// authenticate runs auth for r and returns the identity, it aborts the request
+// when auth rejects it. Without auth every connection is accepted.
+func authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, auth AuthFunc) string {
+	if auth == nil {
+		return ""
+	}
+	identity, err := auth(ctx, r)
+	if err != nil {
+		// The reason stays in the logs, it could tell an attacker what to change.
+		logger := logging.GetLogger(ctx)
+		logger.Info("connection rejected by auth", zap.Error(err))
+		util.ErrorAndAbort(w, r, http.StatusUnauthorized, "unauthorized")
+	}
+	return identity
+}
+
+// RemoteAuth returns an AuthFunc that asks the backend at url about every
+// connection, it's what AUTH_URL configures. The token query parameter of the
+// connection, or else its Authorization header, is forwarded as a bearer
+// token. A 200 response accepts the connection with the (trimmed) body as
+// identity, any other response or an empty body rejects it.
+func RemoteAuth(url string) AuthFunc {
+	client := &http.Client{Timeout: remoteAuthTimeout}
+	return func(ctx context.Context, r *http.Request) (string, error) {
+		authorization := r.Header.Get("Authorization")
+		if token := r.URL.Query().Get("token"); token != "" {
+			authorization = "Bearer " + token
+		}
+		if authorization == "" {
+			return "", errors.New("no token")
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", authorization)
+		res, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("auth backend replied %d", res.StatusCode)
+		}
+		body, err := io.ReadAll(io.LimitReader(res.Body, MaxPlayerIDLength*4))
+		if err != nil {
+			return "", err
+		}
+		identity := strings.TrimSpace(string(body))
+		if identity == "" {
+			return "", errors.New("auth backend replied without an identity")
+		}
+		return identity, nil
+	}
+}
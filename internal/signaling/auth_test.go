@@ -0,0 +1,76 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	auth := func(ctx context.Context, r *http.Request) (string, error) {
+		if token := r.URL.Query().Get("token"); token != "valid" {
+			return "", errors.New("invalid token")
+		}
+		return "player-1", nil
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v0/signaling?token=valid", nil)
+	if identity := authenticate(r.Context(), httptest.NewRecorder(), r, auth); identity != "player-1" {
+		t.Fatalf("expected the identity of the auth func, got %q", identity)
+	}
+	if identity := authenticate(r.Context(), httptest.NewRecorder(), r, nil); identity != "" {
+		t.Fatalf("expected no identity without auth, got %q", identity)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/v0/signaling?token=forged", nil)
+	w := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Fatalf("expected the request to be aborted, got %v", recovered)
+			}
+		}()
+		authenticate(r.Context(), w, r, auth)
+	}()
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestRemoteAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer valid":
+			w.Write([]byte("player-1\n")) //nolint:errcheck
+		case "Bearer anonymous":
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer backend.Close()
+	auth := RemoteAuth(backend.URL)
+
+	for _, test := range []struct {
+		name     string
+		url      string
+		header   string
+		identity string
+	}{
+		{"query token", "/v0/signaling?token=valid", "", "player-1"},
+		{"header token", "/v0/signaling", "Bearer valid", "player-1"},
+		{"rejected token", "/v0/signaling?token=forged", "", ""},
+		{"empty identity", "/v0/signaling?token=anonymous", "", ""},
+		{"no token", "/v0/signaling", "", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		identity, err := auth(r.Context(), r)
+		if identity != test.identity || (err == nil) != (test.identity != "") {
+			t.Fatalf("%s: expected identity %q, got %q and %v", test.name, test.identity, identity, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+)
+
+// MaxBatchSize is the most packets a batch can hold, enough for the startup
+// sequence of a client (e.g. join, set-peer-data and set-ready).
+const MaxBatchSize = 10
+
+var ErrInvalidBatch = util.NewError("invalid-batch", "a batch holds at least one and at most max packets, none of them batches").WithParams("max", MaxBatchSize)
+
+// BatchPacket holds packets that are handled in order as if they were sent
+// one by one, until one of them fails.
+type BatchPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Packets []json.RawMessage `json:"packets"`
+}
+
+// BatchResultPacket is sent once a batch is handled. Handled is the number of
+// packets that succeeded, when a packet failed Failed is its index and Code
+// and Message its error.
+type BatchResultPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Handled int    `json:"handled"`
+	Failed  *int   `json:"failed,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// packetDispatcher handles a single packet like the read loop does.
+type packetDispatcher func(ctx context.Context, typ, requestID string, raw []byte) error
+
+// HandleBatchPacket dispatches the packets of a batch in order. Every packet
+// gets its usual replies, a packet replied with an error stops the batch and
+// the remaining packets are skipped. A packet that would close the connection
+// on its own still does so.
+func (p *Peer) HandleBatchPacket(ctx context.Context, raw []byte, dispatch packetDispatcher) error {
+	packet := BatchPacket{}
+	if err := json.Unmarshal(raw, &packet); err != nil {
+		return fmt.Errorf("unable to unmarshal json: %w", err)
+	}
+	if len(packet.Packets) == 0 || len(packet.Packets) > MaxBatchSize {
+		p.ReplyError(ctx, packet.RequestID, ErrInvalidBatch)
+		return nil
+	}
+	// The packets count towards the packet rate like separate packets, the
+	// batch itself was already counted by the read loop.
+	if p.limiter != nil {
+		if err := p.limiter.waitFor(ctx, len(packet.Packets)-1, 0); err != nil {
+			return err
+		}
+	}
+	metrics.Inc("netlib_batches_total")
+
+	result := BatchResultPacket{
+		RequestID: packet.RequestID,
+		Type:      "batch-result",
+	}
+	for i, sub := range packet.Packets {
+		sub, err := p.decode(sub)
+		if err != nil {
+			return fmt.Errorf("%w: batch packet %d: %w", util.ErrProtocol, i, err)
+		}
+		typeOnly := struct {
+			Type      string
+			RequestID string `json:"rid"`
+		}{}
+		if err := json.Unmarshal(sub, &typeOnly); err != nil {
+			return fmt.Errorf("batch packet %d: unable to unmarshal json: %w", i, err)
+		}
+
+		if typeOnly.Type == "batch" {
+			p.ReplyError(ctx, typeOnly.RequestID, ErrInvalidBatch)
+		} else if err := dispatch(ctx, typeOnly.Type, typeOnly.RequestID, sub); err != nil {
+			return fmt.Errorf("batch packet %d (%s): %w", i, typeOnly.Type, err)
+		}
+		if p.replyErr != nil {
+			// replyErr stays set so the batch itself is nacked.
+			failed := i
+			result.Failed = &failed
+			result.Code = errorCode(p.replyErr)
+			result.Message = p.replyErr.Error()
+			break
+		}
+		result.Handled++
+		if p.closedPacketReceived {
+			break
+		}
+	}
+	return p.Send(ctx, result)
+}
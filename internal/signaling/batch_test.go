@@ -0,0 +1,197 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/poki/netlib/internal/util"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+var errTestFailed = util.NewError("test-failed", "failed on purpose")
+
+// batchServer handles the batches sent to it with a dispatcher that records
+// the packets in order and replies an error to "fail" and fails hard on
+// "crash" packets. The recorded packets and handler errors are sent on done
+// after every batch.
+func batchServer(t *testing.T, done chan<- []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		p := &Peer{conn: conn, config: &Config{}, ID: "peer", Game: "game"}
+		for {
+			_, raw, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			var handled []string
+			err = p.HandleBatchPacket(ctx, raw, func(ctx context.Context, typ, requestID string, raw []byte) error {
+				handled = append(handled, requestID)
+				switch typ {
+				case "fail":
+					p.ReplyError(ctx, requestID, errTestFailed)
+				case "crash":
+					return fmt.Errorf("crashed")
+				}
+				return nil
+			})
+			if err != nil {
+				handled = append(handled, err.Error())
+			}
+			p.replyErr = nil
+			done <- handled
+		}
+	}))
+}
+
+func sendBatch(ctx context.Context, t *testing.T, conn *websocket.Conn, packets ...string) {
+	raw := make([]json.RawMessage, len(packets))
+	for i, packet := range packets {
+		raw[i] = json.RawMessage(packet)
+	}
+	if err := wsjson.Write(ctx, conn, BatchPacket{RequestID: "batch", Type: "batch", Packets: raw}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchOrderAndPartialFailure(t *testing.T) {
+	done := make(chan []string, 1)
+	server := batchServer(t, done)
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	// All packets are handled in order.
+	sendBatch(ctx, t, conn, `{"type":"ok","rid":"1"}`, `{"type":"ok","rid":"2"}`, `{"type":"ok","rid":"3"}`)
+	if handled := <-done; strings.Join(handled, ",") != "1,2,3" {
+		t.Fatalf("expected the packets in order, got %v", handled)
+	}
+	result := BatchResultPacket{}
+	if err := wsjson.Read(ctx, conn, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Type != "batch-result" || result.RequestID != "batch" || result.Handled != 3 || result.Failed != nil {
+		t.Fatalf("expected all packets to be handled, got %+v", result)
+	}
+
+	// The batch stops at the first failed packet.
+	sendBatch(ctx, t, conn, `{"type":"ok","rid":"1"}`, `{"type":"fail","rid":"2"}`, `{"type":"ok","rid":"3"}`)
+	if handled := <-done; strings.Join(handled, ",") != "1,2" {
+		t.Fatalf("expected the batch to stop at the failure, got %v", handled)
+	}
+	reply := struct {
+		Type      string `json:"type"`
+		RequestID string `json:"rid"`
+		Code      string `json:"code"`
+	}{}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.RequestID != "2" || reply.Code != "test-failed" {
+		t.Fatalf("expected the failed packet to get its error, got %+v", reply)
+	}
+	result = BatchResultPacket{}
+	if err := wsjson.Read(ctx, conn, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Handled != 1 || result.Failed == nil || *result.Failed != 1 || result.Code != "test-failed" {
+		t.Fatalf("expected the second packet to be reported as failed, got %+v", result)
+	}
+
+	// Nested batches fail like any other packet.
+	sendBatch(ctx, t, conn, `{"type":"ok","rid":"1"}`, `{"type":"batch","rid":"2","packets":[]}`)
+	if handled := <-done; strings.Join(handled, ",") != "1" {
+		t.Fatalf("expected the nested batch not to be dispatched, got %v", handled)
+	}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil || reply.Code != "invalid-batch" || reply.RequestID != "2" {
+		t.Fatalf("expected the nested batch to be rejected, got %+v (%v)", reply, err)
+	}
+	result = BatchResultPacket{}
+	if err := wsjson.Read(ctx, conn, &result); err != nil || result.Failed == nil || *result.Failed != 1 {
+		t.Fatalf("expected the nested batch to be reported as failed, got %+v (%v)", result, err)
+	}
+
+	// A packet that fails hard fails the batch with its index.
+	sendBatch(ctx, t, conn, `{"type":"ok","rid":"1"}`, `{"type":"crash","rid":"2"}`, `{"type":"ok","rid":"3"}`)
+	if handled := <-done; len(handled) != 3 || handled[2] != "batch packet 1 (crash): crashed" {
+		t.Fatalf("expected the batch to fail at the crash, got %v", handled)
+	}
+}
+
+func TestBatchSizeBounded(t *testing.T) {
+	done := make(chan []string, 1)
+	server := batchServer(t, done)
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	packets := make([]string, MaxBatchSize+1)
+	for i := range packets {
+		packets[i] = `{"type":"ok"}`
+	}
+	for _, batch := range [][]string{nil, packets} {
+		sendBatch(ctx, t, conn, batch...)
+		if handled := <-done; len(handled) != 0 {
+			t.Fatalf("expected no packets to be handled, got %v", handled)
+		}
+		reply := struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		}{}
+		if err := wsjson.Read(ctx, conn, &reply); err != nil || reply.Code != "invalid-batch" {
+			t.Fatalf("expected the batch of %d to be rejected, got %+v (%v)", len(batch), reply, err)
+		}
+	}
+}
+
+func TestHandlerBatch(t *testing.T) {
+	ctx := context.Background()
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	_, handler, _ := Handler(ctx, store, nil, Config{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readServerInfo(ctx, t, conn)
+	sendBatch(ctx, t, conn, `{"type":"hello","game":"4307bd86-e1df-41b8-b9df-e22afcf084bd"}`, `{"type":"pong"}`)
+
+	welcome := WelcomePacket{}
+	if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Type != "welcome" || welcome.ID == "" {
+		t.Fatalf("expected a welcome, got %+v", welcome)
+	}
+	result := BatchResultPacket{}
+	if err := wsjson.Read(ctx, conn, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Type != "batch-result" || result.Handled != 2 {
+		t.Fatalf("expected both packets to be handled, got %+v", result)
+	}
+}
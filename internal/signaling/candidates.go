@@ -0,0 +1,162 @@
+package signaling
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/poki/netlib/internal/metrics"
+)
+
+// maxTalliedCandidateSize bounds how much of a candidate packet is scanned for
+// its type, candidate lines are far shorter than this.
+const maxTalliedCandidateSize = 2048
+
+// maxTalliedLobbies bounds the memory of a CandidateTally, lobbies not seen
+// for longer than a connection can last are evicted first.
+const maxTalliedLobbies = 10000
+
+// candidateType returns the type of the candidate in a candidate packet, or
+// "" for an end-of-candidates packet. It scans the raw packet for the typ
+// field of the candidate line instead of decoding it, tallying happens for
+// every relayed candidate.
+func candidateType(raw []byte) string {
+	if len(raw) > maxTalliedCandidateSize {
+		raw = raw[:maxTalliedCandidateSize]
+	}
+	i := bytes.Index(raw, []byte(" typ "))
+	if i < 0 {
+		return ""
+	}
+	typ := raw[i+len(" typ "):]
+	if end := bytes.IndexAny(typ, " \""); end >= 0 {
+		typ = typ[:end]
+	}
+	switch string(typ) {
+	case "host", "srflx", "prflx", "relay":
+		return string(typ)
+	}
+	return "unknown"
+}
+
+// CandidateCounts are the relayed candidates per type.
+type CandidateCounts struct {
+	Host    uint64 `json:"host"`
+	Srflx   uint64 `json:"srflx"`
+	Prflx   uint64 `json:"prflx"`
+	Relay   uint64 `json:"relay"`
+	Unknown uint64 `json:"unknown"`
+}
+
+func (c *CandidateCounts) add(typ string) {
+	switch typ {
+	case "host":
+		c.Host++
+	case "srflx":
+		c.Srflx++
+	case "prflx":
+		c.Prflx++
+	case "relay":
+		c.Relay++
+	default:
+		c.Unknown++
+	}
+}
+
+// LobbyCandidates are the candidates relayed in a lobby by this node.
+type LobbyCandidates struct {
+	Game       string          `json:"game"`
+	Lobby      string          `json:"lobby"`
+	Candidates CandidateCounts `json:"candidates"`
+}
+
+type talliedLobby struct {
+	counts   CandidateCounts
+	lastSeen time.Time
+}
+
+// CandidateTally counts the types of the candidates relayed through this node
+// per lobby. It's observational only, candidates are forwarded as they are.
+type CandidateTally struct {
+	mutex   sync.Mutex
+	lobbies map[lobbyKey]*talliedLobby
+	// maxAge is how long a lobby can go unseen before it's evicted.
+	maxAge time.Duration
+}
+
+type lobbyKey struct {
+	game  string
+	lobby string
+}
+
+// NewCandidateTally evicts lobbies that weren't seen for maxConnectionTime
+// when it's full, see Config.MaxConnectionTime. Without a cap (zero or
+// negative) the default MaxConnectionTime is used.
+func NewCandidateTally(maxConnectionTime time.Duration) *CandidateTally {
+	if maxConnectionTime <= 0 {
+		maxConnectionTime = MaxConnectionTime
+	}
+	return &CandidateTally{
+		lobbies: make(map[lobbyKey]*talliedLobby),
+		maxAge:  maxConnectionTime,
+	}
+}
+
+// Observe tallies the candidate packet raw relayed in lobby.
+func (t *CandidateTally) Observe(game, lobby string, raw []byte) {
+	typ := candidateType(raw)
+	if typ == "" {
+		return
+	}
+	metrics.Inc("netlib_relayed_candidates_total", "type", typ)
+
+	now := time.Now()
+	key := lobbyKey{game, lobby}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l, found := t.lobbies[key]
+	if !found {
+		if len(t.lobbies) >= maxTalliedLobbies {
+			t.evict(now.Add(-t.maxAge))
+		}
+		if len(t.lobbies) >= maxTalliedLobbies {
+			metrics.Inc("netlib_candidate_tally_dropped_total")
+			return
+		}
+		l = &talliedLobby{}
+		t.lobbies[key] = l
+	}
+	l.counts.add(typ)
+	l.lastSeen = now
+}
+
+// evict removes the lobbies not seen since before, t.mutex must be held.
+func (t *CandidateTally) evict(before time.Time) {
+	for key, l := range t.lobbies {
+		if l.lastSeen.Before(before) {
+			delete(t.lobbies, key)
+		}
+	}
+}
+
+// Snapshot returns the tallies of the lobbies of game, or of all games when
+// game is empty, optionally limited to a single lobby.
+func (t *CandidateTally) Snapshot(game, lobby string) []LobbyCandidates {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	list := []LobbyCandidates{}
+	for key, l := range t.lobbies {
+		if (game != "" && key.game != game) || (lobby != "" && key.lobby != lobby) {
+			continue
+		}
+		list = append(list, LobbyCandidates{Game: key.game, Lobby: key.lobby, Candidates: l.counts})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Game != list[j].Game {
+			return list[i].Game < list[j].Game
+		}
+		return list[i].Lobby < list[j].Lobby
+	})
+	return list
+}
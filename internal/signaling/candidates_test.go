@@ -0,0 +1,39 @@
+package signaling
+
+import "testing"
+
+func TestCandidateType(t *testing.T) {
+	for raw, want := range map[string]string{
+		string(testCandidate): "srflx",
+		`{"type":"candidate","candidate":{"candidate":"candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host generation 0"}}`: "host",
+		`{"type":"candidate","candidate":{"candidate":"candidate:3 1 udp 41885439 198.51.100.1 3478 typ relay"}}`:               "relay",
+		`{"type":"candidate","candidate":{"candidate":"candidate:4 1 udp 1 203.0.113.9 9 typ weird raddr 0.0.0.0"}}`:            "unknown",
+		`{"type":"candidate","candidate":null}`: "",
+	} {
+		if got := candidateType([]byte(raw)); got != want {
+			t.Errorf("expected %q for %s, got %q", want, raw, got)
+		}
+	}
+}
+
+func TestCandidateTally(t *testing.T) {
+	tally := NewCandidateTally(MaxConnectionTime)
+	tally.Observe("game", "a", testCandidate)
+	tally.Observe("game", "a", []byte(`{"candidate":{"candidate":"candidate:1 1 udp 1 10.0.0.1 1 typ host"}}`))
+	tally.Observe("game", "b", []byte(`{"candidate":{"candidate":"candidate:1 1 udp 1 10.0.0.1 1 typ relay"}}`))
+	tally.Observe("game", "b", []byte(`{"candidate":null}`))
+
+	all := tally.Snapshot("game", "")
+	if len(all) != 2 || all[0].Lobby != "a" || all[1].Lobby != "b" {
+		t.Fatalf("unexpected snapshot %+v", all)
+	}
+	if c := all[0].Candidates; c.Srflx != 1 || c.Host != 1 || c.Relay != 0 {
+		t.Fatalf("unexpected counts for a: %+v", c)
+	}
+	if c := all[1].Candidates; c.Relay != 1 || c.Host != 0 {
+		t.Fatalf("unexpected counts for b: %+v", c)
+	}
+	if list := tally.Snapshot("other", ""); len(list) != 0 {
+		t.Fatalf("expected nothing for another game, got %+v", list)
+	}
+}
@@ -0,0 +1,76 @@
+package signaling
+
+import "github.com/poki/netlib/internal/util"
+
+// ChunkingCapability lets clients receive packets larger than the chunk
+// threshold as a sequence of chunk packets.
+const ChunkingCapability = "chunking"
+
+// AcksCapability lets clients add a message ID to packets to have them
+// acknowledged once they're handled.
+const AcksCapability = "acks"
+
+// capabilitySet holds the capabilities negotiated by a client as bit flags.
+type capabilitySet uint32
+
+const (
+	capChunking capabilitySet = 1 << iota
+	capAcks
+	capDictionary
+)
+
+// knownCapabilities are the capabilities this server supports in the order
+// they're echoed back in the welcome. New opt-in behavior gets an entry here
+// instead of its own flag on the Peer.
+var knownCapabilities = []struct {
+	name string
+	flag capabilitySet
+}{
+	{ChunkingCapability, capChunking},
+	{AcksCapability, capAcks},
+	{DictionaryCapability, capDictionary},
+}
+
+// Has reports whether all capabilities in c are in the set.
+func (s capabilitySet) Has(c capabilitySet) bool {
+	return s&c == c
+}
+
+// Names returns the names of the capabilities in the set.
+func (s capabilitySet) Names() []string {
+	var names []string
+	for _, known := range knownCapabilities {
+		if s.Has(known.flag) {
+			names = append(names, known.name)
+		}
+	}
+	return names
+}
+
+var ErrHandshakeRequired = util.NewError("handshake-required", "a hello is required before other packets")
+
+// handshakePackets can be sent before the capabilities are negotiated when
+// Config.RequireHello is set. The server pings right away, so a pong is too.
+var handshakePackets = map[string]bool{
+	"hello":     true,
+	"reconnect": true,
+	"pong":      true,
+}
+
+// negotiateCapabilities returns the requested capabilities this server
+// supports for the protocol version, unknown capabilities are ignored.
+func negotiateCapabilities(requested []string, version int) capabilitySet {
+	var set capabilitySet
+	for _, name := range requested {
+		for _, known := range knownCapabilities {
+			if known.name != name {
+				continue
+			}
+			if known.flag == capDictionary && compressionDictionaries[version] == nil {
+				continue
+			}
+			set |= known.flag
+		}
+	}
+	return set
+}
@@ -0,0 +1,90 @@
+package signaling
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	set := negotiateCapabilities([]string{"acks", "unknown", DictionaryCapability, "acks"}, ProtocolVersion)
+	if !set.Has(capAcks) || !set.Has(capDictionary) || set.Has(capChunking) {
+		t.Fatalf("unexpected capabilities %v", set.Names())
+	}
+	if got, want := set.Names(), []string{AcksCapability, DictionaryCapability}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// Versions without a dictionary don't get the dictionary capability.
+	if set := negotiateCapabilities([]string{DictionaryCapability}, 0); set != 0 {
+		t.Fatalf("expected no capabilities, got %v", set.Names())
+	}
+	if names := negotiateCapabilities(nil, ProtocolVersion).Names(); names != nil {
+		t.Fatalf("expected no capabilities, got %v", names)
+	}
+}
+
+func TestRequireHello(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		ctx := context.Background()
+		store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+		_, handler, _ := Handler(ctx, store, nil, Config{
+			RequireHello: strict,
+			ICEServers:   []ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}},
+		})
+		server := httptest.NewServer(handler)
+
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readServerInfo(ctx, t, conn)
+
+		// Strict servers reject the packet but keep the connection open,
+		// lenient servers handle it with the default capabilities.
+		if err := wsjson.Write(ctx, conn, map[string]string{"type": "credentials", "rid": "early"}); err != nil {
+			t.Fatal(err)
+		}
+		reply := struct {
+			Type   string
+			Code   string
+			Params map[string]any
+		}{}
+		if err := wsjson.Read(ctx, conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if strict && (reply.Code != "handshake-required" || reply.Params["type"] != "credentials") {
+			t.Fatalf("expected the credentials to require a hello, got %+v", reply)
+		} else if !strict && reply.Type != "credentials" {
+			t.Fatalf("expected credentials without a hello, got %+v", reply)
+		}
+
+		if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: "4307bd86-e1df-41b8-b9df-e22afcf084bd"}); err != nil {
+			t.Fatal(err)
+		}
+		welcome := WelcomePacket{}
+		if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+			t.Fatal(err)
+		}
+		if welcome.Type != "welcome" {
+			t.Fatalf("expected a welcome, got %+v", welcome)
+		}
+		if err := wsjson.Write(ctx, conn, map[string]string{"type": "credentials"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := wsjson.Read(ctx, conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != "credentials" {
+			t.Fatalf("expected credentials after the hello, got %+v", reply)
+		}
+
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+	}
+}
@@ -0,0 +1,169 @@
+package signaling
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+)
+
+const (
+	// capacityChurnWindow is how far back closed connections count towards
+	// the churn used for the retry hint.
+	capacityChurnWindow = time.Minute
+
+	minCapacityRetryAfter = time.Second
+	maxCapacityRetryAfter = 5 * time.Minute
+)
+
+// Reasons a connection is rejected over capacity, used in the response body
+// and as the metrics label.
+const (
+	capacityGlobal = "global"
+	capacityIP     = "ip"
+)
+
+// connectionLimiter tracks the open connections of this node in total and per
+// client IP, and how fast they are closing to estimate when a slot frees up.
+type connectionLimiter struct {
+	maxTotal int
+	maxPerIP int
+	fallback time.Duration
+
+	mutex sync.Mutex
+	total int
+	perIP map[string]int
+
+	// closes counts the connections closed since windowStart, prevCloses
+	// those of the window before it.
+	windowStart time.Time
+	closes      int
+	prevCloses  int
+}
+
+func newConnectionLimiter(config *Config) *connectionLimiter {
+	return &connectionLimiter{
+		maxTotal: config.MaxConnections,
+		maxPerIP: config.MaxConnectionsPerIP,
+		fallback: config.CapacityRetryAfter,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Acquire counts a new connection from ip, when a cap is reached it returns
+// the reason and how long the client should wait before retrying instead.
+func (l *connectionLimiter) Acquire(ip string, now time.Time) (reason string, retryAfter time.Duration, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return capacityGlobal, l.retryAfter(now, l.total-l.maxTotal+1), false
+	}
+	if l.maxPerIP > 0 && ip != "" && l.perIP[ip] >= l.maxPerIP {
+		// The churn of a single IP says nothing useful, it's up to the client.
+		return capacityIP, l.fallback, false
+	}
+	l.total++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	return "", 0, true
+}
+
+// Release undoes an Acquire when the connection closes.
+func (l *connectionLimiter) Release(ip string, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total--
+	if ip != "" {
+		if l.perIP[ip] <= 1 {
+			delete(l.perIP, ip)
+		} else {
+			l.perIP[ip]--
+		}
+	}
+	l.rotate(now)
+	l.closes++
+}
+
+// rotate moves on to a new churn window when the current one is over.
+func (l *connectionLimiter) rotate(now time.Time) {
+	switch elapsed := now.Sub(l.windowStart); {
+	case elapsed >= 2*capacityChurnWindow:
+		l.prevCloses, l.closes = 0, 0
+		l.windowStart = now
+	case elapsed >= capacityChurnWindow:
+		l.prevCloses, l.closes = l.closes, 0
+		l.windowStart = l.windowStart.Add(capacityChurnWindow)
+	}
+}
+
+// retryAfter estimates how long it takes until needed slots are freed at the
+// current close rate, the fallback when nothing closed recently. The caller
+// must hold the mutex.
+func (l *connectionLimiter) retryAfter(now time.Time, needed int) time.Duration {
+	l.rotate(now)
+	observed := capacityChurnWindow + now.Sub(l.windowStart)
+	closes := l.prevCloses + l.closes
+	if closes == 0 {
+		return l.fallback
+	}
+	perClose := float64(observed) / float64(closes)
+	wait := time.Duration(math.Ceil(perClose * float64(needed)))
+	if wait < minCapacityRetryAfter {
+		return minCapacityRetryAfter
+	} else if wait > maxCapacityRetryAfter {
+		return maxCapacityRetryAfter
+	}
+	return wait
+}
+
+// clientIP returns the IP the connection came from, taken from header when
+// set (the first entry when it's a list) and from the remote address otherwise.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if ip, _, _ := strings.Cut(r.Header.Get(header), ","); strings.TrimSpace(ip) != "" {
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// capacityResponse is the body of a connection rejected over capacity.
+type capacityResponse struct {
+	Status int    `json:"status"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+	// RetryAfter is in milliseconds, the Retry-After header has it rounded
+	// up to seconds.
+	RetryAfter int64 `json:"retryAfter"`
+}
+
+// rejectOverCapacity renders the capacity-exceeded response and aborts the
+// request. Over the global cap the node is unavailable (503), over the per-IP
+// cap the client is sending too many connections (429).
+func rejectOverCapacity(w http.ResponseWriter, r *http.Request, reason string, retryAfter time.Duration) {
+	metrics.Inc("netlib_capacity_rejections_total", "reason", reason)
+	status := http.StatusServiceUnavailable
+	if reason == capacityIP {
+		status = http.StatusTooManyRequests
+	}
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	util.RenderJSON(w, r, status, capacityResponse{
+		Status:     status,
+		Key:        "capacity-exceeded",
+		Reason:     reason,
+		RetryAfter: retryAfter.Milliseconds(),
+	})
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,88 @@
+package signaling
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	limiter := newConnectionLimiter(&Config{MaxConnections: 3, MaxConnectionsPerIP: 2, CapacityRetryAfter: 30 * time.Second})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if _, _, ok := limiter.Acquire("1.1.1.1", now); !ok {
+			t.Fatalf("expected connection %d to be accepted", i)
+		}
+	}
+	if reason, retryAfter, ok := limiter.Acquire("1.1.1.1", now); ok || reason != capacityIP || retryAfter != 30*time.Second {
+		t.Fatalf("expected the per-IP cap with the default retry, got %q %v %v", reason, retryAfter, ok)
+	}
+	if _, _, ok := limiter.Acquire("2.2.2.2", now); !ok {
+		t.Fatal("expected another IP to be accepted")
+	}
+
+	// Nothing closed yet, so there is no churn to go by.
+	if reason, retryAfter, ok := limiter.Acquire("3.3.3.3", now); ok || reason != capacityGlobal || retryAfter != 30*time.Second {
+		t.Fatalf("expected the global cap with the default retry, got %q %v %v", reason, retryAfter, ok)
+	}
+
+	// One close every 10 seconds frees the slot of the next connection in about 10 seconds.
+	for i := 0; i < 6; i++ {
+		limiter.Release("1.1.1.1", now.Add(time.Duration(i)*10*time.Second))
+		limiter.Acquire("1.1.1.1", now.Add(time.Duration(i)*10*time.Second))
+	}
+	reason, retryAfter, ok := limiter.Acquire("3.3.3.3", now.Add(time.Minute))
+	if ok || reason != capacityGlobal {
+		t.Fatalf("expected the global cap, got %q %v", reason, ok)
+	}
+	if retryAfter < 5*time.Second || retryAfter > 20*time.Second {
+		t.Fatalf("expected a retry based on the churn, got %v", retryAfter)
+	}
+
+	limiter.Release("2.2.2.2", now.Add(time.Minute))
+	if _, _, ok := limiter.Acquire("3.3.3.3", now.Add(time.Minute)); !ok {
+		t.Fatal("expected a released slot to be reused")
+	}
+}
+
+func TestRejectOverCapacity(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v0/signaling", nil)
+	func() {
+		defer func() {
+			if recover() != http.ErrAbortHandler {
+				t.Fatal("expected the request to be aborted")
+			}
+		}()
+		rejectOverCapacity(w, r, capacityIP, 1500*time.Millisecond)
+	}()
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After to be rounded up, got %q", got)
+	}
+	body := capacityResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Key != "capacity-exceeded" || body.Reason != capacityIP || body.RetryAfter != 1500 {
+		t.Fatalf("unexpected body %+v", body)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/v0/signaling", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.2")
+	if ip := clientIP(r, ""); ip != "10.0.0.1" {
+		t.Fatalf("expected the remote address, got %q", ip)
+	}
+	if ip := clientIP(r, "X-Forwarded-For"); ip != "1.2.3.4" {
+		t.Fatalf("expected the first forwarded IP, got %q", ip)
+	}
+}
@@ -0,0 +1,99 @@
+package signaling
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DefaultChunkThreshold is the packet size in bytes above which packets are
+// split into chunks for clients that support chunking.
+const DefaultChunkThreshold = 16 * 1024
+
+// MaxChunks bounds the number of chunks a single packet can be split into.
+const MaxChunks = 256
+
+type ChunkPacket struct {
+	Type string `json:"type"`
+
+	ID    uint64 `json:"id"`
+	Seq   int    `json:"seq"`
+	Total int    `json:"total"`
+	Data  string `json:"data"`
+}
+
+// splitChunks splits raw into chunk packets of at most size bytes of data each.
+// Chunks are split on rune boundaries so every chunk is valid UTF-8.
+func splitChunks(id uint64, raw []byte, size int) ([]ChunkPacket, error) {
+	var parts []string
+	for len(raw) > 0 {
+		n := size
+		if n >= len(raw) {
+			n = len(raw)
+		} else {
+			for n > 0 && !utf8.RuneStart(raw[n]) {
+				n--
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("chunk size %d too small", size)
+			}
+		}
+		parts = append(parts, string(raw[:n]))
+		raw = raw[n:]
+	}
+	if len(parts) > MaxChunks {
+		return nil, fmt.Errorf("packet too large to chunk: %d chunks", len(parts))
+	}
+	chunks := make([]ChunkPacket, len(parts))
+	for i, part := range parts {
+		chunks[i] = ChunkPacket{
+			Type:  "chunk",
+			ID:    id,
+			Seq:   i,
+			Total: len(parts),
+			Data:  part,
+		}
+	}
+	return chunks, nil
+}
+
+// ChunkAssembler reassembles chunked packets on the client side. Add returns
+// the original packet once all of its chunks have been received, in any order.
+type ChunkAssembler struct {
+	mutex   sync.Mutex
+	pending map[uint64]*chunkedPacket
+}
+
+type chunkedPacket struct {
+	parts    []string
+	received int
+}
+
+func (a *ChunkAssembler) Add(chunk ChunkPacket) ([]byte, bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if chunk.Total <= 0 || chunk.Total > MaxChunks || chunk.Seq < 0 || chunk.Seq >= chunk.Total || chunk.Data == "" {
+		return nil, false, fmt.Errorf("invalid chunk %d/%d", chunk.Seq, chunk.Total)
+	}
+	if a.pending == nil {
+		a.pending = make(map[uint64]*chunkedPacket)
+	}
+	packet, ok := a.pending[chunk.ID]
+	if !ok {
+		packet = &chunkedPacket{parts: make([]string, chunk.Total)}
+		a.pending[chunk.ID] = packet
+	} else if len(packet.parts) != chunk.Total {
+		return nil, false, fmt.Errorf("chunk total mismatch for %d", chunk.ID)
+	}
+	if packet.parts[chunk.Seq] == "" {
+		packet.received++
+	}
+	packet.parts[chunk.Seq] = chunk.Data
+	if packet.received < chunk.Total {
+		return nil, false, nil
+	}
+	delete(a.pending, chunk.ID)
+	return []byte(strings.Join(packet.parts, "")), true, nil
+}
@@ -0,0 +1,160 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestChunksRoundTrip(t *testing.T) {
+	raw := []byte(`{"type":"lobbies","lobbies":[{"code":"` + strings.Repeat("é🔥x", 100) + `"}]}`)
+
+	chunks, err := splitChunks(1, raw, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected multiple chunks, got %d", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if !utf8.ValidString(chunk.Data) {
+			t.Fatalf("chunk %d isn't valid UTF-8", chunk.Seq)
+		}
+	}
+
+	a := &ChunkAssembler{}
+	// Deliver out of order, the assembler should still restore the packet.
+	for i := len(chunks) - 1; i >= 0; i-- {
+		out, done, err := a.Add(chunks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != (i == 0) {
+			t.Fatalf("unexpected done=%v at chunk %d", done, i)
+		}
+		if done && string(out) != string(raw) {
+			t.Fatalf("reassembled packet differs:\n%s\n%s", out, raw)
+		}
+	}
+}
+
+func TestChunkAssemblerInterleaved(t *testing.T) {
+	a := &ChunkAssembler{}
+	first, _ := splitChunks(1, []byte(`{"type":"first"}`), 4)
+	second, _ := splitChunks(2, []byte(`{"type":"second"}`), 4)
+
+	// A chunk received twice isn't counted twice.
+	if _, done, err := a.Add(first[0]); done || err != nil {
+		t.Fatalf("expected the packet to be incomplete, got %v %v", done, err)
+	}
+	if _, done, err := a.Add(first[0]); done || err != nil {
+		t.Fatalf("expected a duplicate chunk not to complete the packet, got %v %v", done, err)
+	}
+	for _, chunk := range second {
+		out, done, err := a.Add(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done && string(out) != `{"type":"second"}` {
+			t.Fatalf("expected the second packet, got %s", out)
+		}
+	}
+	var out []byte
+	for _, chunk := range first[1:] {
+		var err error
+		if out, _, err = a.Add(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(out) != `{"type":"first"}` {
+		t.Fatalf("expected the first packet, got %s", out)
+	}
+	if len(a.pending) != 0 {
+		t.Fatalf("expected no pending packets, got %d", len(a.pending))
+	}
+}
+
+func TestChunkAssemblerRejectsInvalidChunks(t *testing.T) {
+	a := &ChunkAssembler{}
+	for _, chunk := range []ChunkPacket{
+		{ID: 1, Seq: 0, Total: 0, Data: "x"},
+		{ID: 1, Seq: 2, Total: 2, Data: "x"},
+		{ID: 1, Seq: -1, Total: 2, Data: "x"},
+		{ID: 1, Seq: 0, Total: MaxChunks + 1, Data: "x"},
+		{ID: 1, Seq: 0, Total: 2, Data: ""},
+	} {
+		if _, _, err := a.Add(chunk); err == nil {
+			t.Errorf("expected chunk %+v to be rejected", chunk)
+		}
+	}
+	if _, _, err := a.Add(ChunkPacket{ID: 2, Seq: 0, Total: 2, Data: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Add(ChunkPacket{ID: 2, Seq: 1, Total: 3, Data: "x"}); err == nil {
+		t.Fatal("expected a chunk with another total to be rejected")
+	}
+}
+
+func TestSendChunked(t *testing.T) {
+	lobbies := LobbiesPacket{Type: "lobbies"}
+	for i := 0; i < 50; i++ {
+		lobbies.RequestID += "0123456789"
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{conn: conn, config: &Config{ChunkThreshold: 64}}
+		p.negotiate([]string{ChunkingCapability}, ProtocolVersion)
+		if err := p.Send(r.Context(), lobbies); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	a := &ChunkAssembler{}
+	for chunks := 0; ; chunks++ {
+		chunk := ChunkPacket{}
+		if err := wsjson.Read(ctx, conn, &chunk); err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Type != "chunk" {
+			t.Fatalf("expected a chunk, got %+v", chunk)
+		}
+		raw, done, err := a.Add(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !done {
+			continue
+		}
+		if chunks == 0 {
+			t.Fatal("expected the packet to be split")
+		}
+		out := LobbiesPacket{}
+		if err := json.Unmarshal(raw, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Type != "lobbies" || out.RequestID != lobbies.RequestID {
+			t.Fatalf("expected the original packet, got %+v", out)
+		}
+		return
+	}
+}
@@ -0,0 +1,146 @@
+package signaling
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a certificate for name signed by parent, or a self
+// signed CA without a parent. The PEM of the certificate and its key are
+// written to dir.
+func testCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ClientTLSConfig(filepath.Join(dir, "missing.crt")); err == nil {
+		t.Fatal("expected a missing CA file to be rejected")
+	}
+	empty := filepath.Join(dir, "empty.crt")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientTLSConfig(empty); err == nil || !strings.Contains(err.Error(), "no certificates") {
+		t.Fatalf("expected a file without certificates to be rejected, got %v", err)
+	}
+
+	_, _, caFile, _ := testCertificate(t, dir, "ca", nil, nil)
+	config, err := ClientTLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("expected certificates to be optional at the TLS level, got %v", config.ClientAuth)
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := testCertificate(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := testCertificate(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := testCertificate(t, dir, "dedicated-server-1", ca, caKey)
+	_, _, strangerCert, strangerKey := testCertificate(t, dir, "stranger", nil, nil)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientIdentity(r)) //nolint:errcheck
+	}))
+	var err error
+	server.TLS, err = ClientTLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS.Certificates = []tls.Certificate{pair}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	identity := func(certFile, keyFile string) (string, error) {
+		config := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		if certFile != "" {
+			pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{pair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		res, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	if got, err := identity(clientCert, clientKey); err != nil || got != "dedicated-server-1" {
+		t.Fatalf("expected the identity of the certificate, got %q (%v)", got, err)
+	}
+	// Browsers without a certificate still connect, without an identity.
+	if got, err := identity("", ""); err != nil || got != "" {
+		t.Fatalf("expected no identity without a certificate, got %q (%v)", got, err)
+	}
+	// Certificates of another CA are never verified.
+	if got, err := identity(strangerCert, strangerKey); err == nil && got != "" {
+		t.Fatalf("expected no identity for a certificate of another CA, got %q", got)
+	}
+}
@@ -0,0 +1,198 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// CompressionQueryParam set to "off" on the signaling URL disables
+// permessage-deflate for the connection, for clients behind proxies that
+// break it.
+const CompressionQueryParam = "compression"
+
+// GameQueryParam on the signaling URL names the game of the connection before
+// its hello, so the Compression of the game can be applied to the upgrade.
+const GameQueryParam = "game"
+
+// ErrGameMismatch disconnects a client whose hello names another game than
+// the GameQueryParam it connected with, the compression of the connection
+// would be that of the wrong game.
+var ErrGameMismatch = util.NewError("game-mismatch", "the game of the hello differs from the game of the signaling URL")
+
+// checkGame returns an error when game isn't the game the peer connected
+// with, connections without the GameQueryParam can be of any game.
+func (p *Peer) checkGame(game string) error {
+	if p.urlGame != "" && game != p.urlGame {
+		return fmt.Errorf("%w: %w", util.ErrProtocol, ErrGameMismatch)
+	}
+	return nil
+}
+
+// The modes of Compression, context takeover compresses better at the cost
+// of about 8 kB of memory per connection.
+const (
+	CompressionNoContextTakeover = "no-context-takeover"
+	CompressionContextTakeover   = "context-takeover"
+	CompressionOff               = "off"
+)
+
+var compressionModes = map[string]websocket.CompressionMode{
+	"":                           websocket.CompressionNoContextTakeover,
+	CompressionNoContextTakeover: websocket.CompressionNoContextTakeover,
+	CompressionContextTakeover:   websocket.CompressionContextTakeover,
+	CompressionOff:               websocket.CompressionDisabled,
+}
+
+// Compression configures permessage-deflate for the connections of a game.
+type Compression struct {
+	// Mode is one of the Compression modes, empty is no context takeover.
+	Mode string `json:"mode"`
+	// Threshold is the size in bytes below which packets aren't compressed,
+	// zero uses the default of the websocket library for the mode.
+	Threshold int `json:"threshold"`
+}
+
+func (c Compression) validate() error {
+	if _, ok := compressionModes[c.Mode]; !ok {
+		return fmt.Errorf("unknown compression mode %q", c.Mode)
+	}
+	if c.Threshold < 0 {
+		return fmt.Errorf("negative compression threshold %d", c.Threshold)
+	}
+	return nil
+}
+
+// compressionFor returns the Compression of game, Config.Compression for
+// games without their own.
+func (c *Config) compressionFor(game string) Compression {
+	if compression, ok := c.GameCompression[game]; ok {
+		return compression
+	}
+	return c.Compression
+}
+
+const (
+	// EarlyPackets is how many packets a connection counts as fresh, decode
+	// failures after that aren't blamed on compression.
+	EarlyPackets = 10
+
+	// compressionFallbackTTL is how long compression stays disabled for a
+	// client whose connection broke on a corrupt compressed frame.
+	compressionFallbackTTL = 10 * time.Minute
+)
+
+var ErrCompressionFailed = util.NewError("compression-failed", "packets can't be decoded, reconnect with compression disabled").WithParams("query", CompressionQueryParam+"=off")
+
+// compressionDisabled reports whether the client asked to connect without
+// compression.
+func compressionDisabled(r *http.Request) bool {
+	return r.URL.Query().Get(CompressionQueryParam) == "off"
+}
+
+// compressionNegotiated reports whether the upgrade response enabled
+// permessage-deflate, it must be called after websocket.Accept.
+func compressionNegotiated(w http.ResponseWriter) bool {
+	return strings.Contains(w.Header().Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+}
+
+// isCompressionError reports whether a read failed on a corrupt compressed
+// frame. The websocket library doesn't export an error for this, and it
+// already closed the connection.
+func isCompressionError(err error) bool {
+	return strings.Contains(err.Error(), "flate: ")
+}
+
+// compressionGuard watches the first packets of a compressed connection for
+// decode failures, the only sign of a proxy corrupting compressed frames.
+type compressionGuard struct {
+	compressed bool
+	decoded    int
+}
+
+// fresh reports whether decode failures can still be blamed on compression.
+func (g *compressionGuard) fresh() bool {
+	return g.compressed && g.decoded < EarlyPackets
+}
+
+func (g *compressionGuard) decodeSucceeded() {
+	g.decoded++
+}
+
+// compressionFallbacks remembers the clients whose connection broke on a
+// corrupt compressed frame, their next connections have compression disabled
+// even when they don't ask for it. Clients are keyed by compressionClient.
+type compressionFallbacks struct {
+	mutex sync.Mutex
+	until map[string]time.Time
+}
+
+func newCompressionFallbacks() *compressionFallbacks {
+	return &compressionFallbacks{
+		until: make(map[string]time.Time),
+	}
+}
+
+// compressionClient identifies the client of r for compressionFallbacks. A
+// broken proxy usually serves a whole network behind a single IP, so the IP
+// alone would also disable compression for the other browsers behind it.
+func compressionClient(ip string, r *http.Request) string {
+	if ip == "" {
+		return ""
+	}
+	return ip + " " + r.Header.Get("User-Agent")
+}
+
+func (f *compressionFallbacks) remember(client string, now time.Time) {
+	if client == "" {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for other, until := range f.until {
+		if !now.Before(until) {
+			delete(f.until, other)
+		}
+	}
+	f.until[client] = now.Add(compressionFallbackTTL)
+}
+
+func (f *compressionFallbacks) disabled(client string, now time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	until, found := f.until[client]
+	return found && now.Before(until)
+}
+
+// fallBackFromCompression tells the client to reconnect without compression
+// and closes the connection, when the connection already broke the close
+// code is all the client might get. It doesn't return.
+func fallBackFromCompression(ctx context.Context, conn *websocket.Conn, reason string) {
+	hintCompressionFallback(ctx, conn, reason)
+	closeForCompressionFallback(conn)
+}
+
+// hintCompressionFallback sends the hint of fallBackFromCompression without
+// closing the connection yet.
+func hintCompressionFallback(ctx context.Context, conn *websocket.Conn, reason string) {
+	logger := logging.GetLogger(ctx)
+	logger.Warn("compressed packets can't be decoded, falling back", zap.String("reason", reason))
+	metrics.Inc("netlib_compression_fallbacks_total", "reason", reason)
+	util.ReplyError(ctx, conn, ErrCompressionFailed)
+}
+
+// closeForCompressionFallback closes the connection after the hint of
+// hintCompressionFallback. It doesn't return.
+func closeForCompressionFallback(conn *websocket.Conn) {
+	conn.Close(websocket.StatusInvalidFramePayloadData, "compression-failed") //nolint:errcheck
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,195 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/util"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestCompressionGuard(t *testing.T) {
+	uncompressed := &compressionGuard{}
+	if uncompressed.fresh() {
+		t.Fatal("expected an uncompressed connection to never blame compression")
+	}
+
+	guard := &compressionGuard{compressed: true}
+	if !guard.fresh() {
+		t.Fatal("expected a new compressed connection to blame compression")
+	}
+	for i := 0; i < EarlyPackets; i++ {
+		guard.decodeSucceeded()
+	}
+	if guard.fresh() {
+		t.Fatal("expected the connection to no longer be fresh")
+	}
+}
+
+func TestCompressionFallbacks(t *testing.T) {
+	client := func(ip, userAgent string) string {
+		r := httptest.NewRequest(http.MethodGet, "/v0/signaling", nil)
+		r.Header.Set("User-Agent", userAgent)
+		return compressionClient(ip, r)
+	}
+	fallbacks := newCompressionFallbacks()
+	now := time.Now()
+	fallbacks.remember(client("10.0.0.1", "chrome"), now)
+	if !fallbacks.disabled(client("10.0.0.1", "chrome"), now.Add(time.Minute)) {
+		t.Fatal("expected compression to be disabled for the remembered client")
+	}
+	if fallbacks.disabled(client("10.0.0.2", "chrome"), now) {
+		t.Fatal("expected compression to stay enabled for other IPs")
+	}
+	if fallbacks.disabled(client("10.0.0.1", "firefox"), now) {
+		t.Fatal("expected compression to stay enabled for other browsers behind the same IP")
+	}
+	later := now.Add(compressionFallbackTTL)
+	fallbacks.remember(client("10.0.0.2", "chrome"), later)
+	if fallbacks.disabled(client("10.0.0.1", "chrome"), later) || len(fallbacks.until) != 1 {
+		t.Fatalf("expected the expired client to be forgotten, got %v", fallbacks.until)
+	}
+	if client("", "chrome") != "" {
+		t.Fatal("expected clients without an IP not to be remembered")
+	}
+}
+
+func TestCompressionFallbackHint(t *testing.T) {
+	ctx := context.Background()
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	_, handler, _ := Handler(ctx, store, nil, Config{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Corrupt frames show up as packets that aren't json.
+	sendCorrupt := func(conn *websocket.Conn) {
+		if err := conn.Write(ctx, websocket.MessageText, []byte("\x8b\x1f{\"ty")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{CompressionMode: websocket.CompressionNoContextTakeover})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatal("expected compression to be negotiated")
+	}
+	readServerInfo(ctx, t, conn)
+	sendCorrupt(conn)
+	packet := struct {
+		Type   string         `json:"type"`
+		Code   string         `json:"code"`
+		Params map[string]any `json:"params"`
+	}{}
+	if err := wsjson.Read(ctx, conn, &packet); err != nil {
+		t.Fatal(err)
+	}
+	if packet.Code != "compression-failed" || packet.Params["query"] != "compression=off" {
+		t.Fatalf("expected the compression fallback hint, got %+v", packet)
+	}
+	_, _, err = conn.Read(ctx)
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Reason != "compression-failed" {
+		t.Fatalf("expected the connection to be closed with the hint, got %v", err)
+	}
+
+	// Following the hint the connection has no compression and corrupt packets
+	// are a protocol error right away.
+	conn, resp, err = websocket.Dial(ctx, url+"?"+CompressionQueryParam+"=off", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if resp.Header.Get("Sec-WebSocket-Extensions") != "" {
+		t.Fatal("expected compression to be disabled")
+	}
+	sendCorrupt(conn)
+	for {
+		if _, _, err = conn.Read(ctx); err != nil {
+			break
+		}
+	}
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusInvalidFramePayloadData || closeErr.Reason != "protocol error" {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+}
+
+func TestGameCompression(t *testing.T) {
+	ctx := context.Background()
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	config := Config{
+		Compression: Compression{Mode: CompressionContextTakeover},
+		GameCompression: map[string]Compression{
+			"shooter": {Mode: CompressionOff},
+			"puzzle":  {Mode: CompressionNoContextTakeover, Threshold: 1024},
+		},
+	}
+	_, handler, _ := Handler(ctx, store, nil, config)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, test := range []struct {
+		name      string
+		query     string
+		userAgent string
+		expected  string
+	}{
+		{"default", "", "", "permessage-deflate"},
+		{"unconfigured game", "?game=other", "", "permessage-deflate"},
+		{"disabled for the game", "?game=shooter", "", ""},
+		{"game without context takeover", "?game=puzzle", "", "permessage-deflate; client_no_context_takeover; server_no_context_takeover"},
+		{"safari", "?game=puzzle", "Mozilla/5.0 (Macintosh) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Safari/605.1.15", ""},
+		{"client opted out", "?game=puzzle&compression=off", "", ""},
+	} {
+		conn, resp, err := websocket.Dial(ctx, url+test.query, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			HTTPHeader:      http.Header{"User-Agent": []string{test.userAgent}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close(websocket.StatusNormalClosure, "") //nolint:errcheck
+		if extensions := resp.Header.Get("Sec-WebSocket-Extensions"); extensions != test.expected {
+			t.Fatalf("%s: expected extensions %q, got %q", test.name, test.expected, extensions)
+		}
+	}
+
+	if threshold := config.compressionFor("puzzle").Threshold; threshold != 1024 {
+		t.Fatalf("expected the threshold of the game, got %d", threshold)
+	}
+	if err := (Compression{Mode: "brotli"}).validate(); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+}
+
+func TestGameMismatch(t *testing.T) {
+	const game = "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+	p := &Peer{urlGame: game, quotas: newQuotaTracker(nil)}
+	err := p.HandleHelloPacket(context.Background(), HelloPacket{Type: "hello", Game: "9b5b2c2e-4a5f-4e4f-8d6a-2f3c1e0b7a91"})
+	if !errors.Is(err, ErrGameMismatch) || !errors.Is(err, util.ErrProtocol) {
+		t.Fatalf("expected a game mismatch protocol error, got %v", err)
+	}
+	err = p.HandleReconnectPacket(context.Background(), ReconnectPacket{Type: "reconnect", Game: "9b5b2c2e-4a5f-4e4f-8d6a-2f3c1e0b7a91", ID: "peer", Secret: "secret"})
+	if !errors.Is(err, ErrGameMismatch) {
+		t.Fatalf("expected a game mismatch for the reconnect, got %v", err)
+	}
+	if p.Game != "" {
+		t.Fatalf("expected the peer not to be introduced, got game %q", p.Game)
+	}
+	if err := p.checkGame(game); err != nil {
+		t.Fatalf("expected the game of the URL to be accepted, got %v", err)
+	}
+	if err := (&Peer{}).checkGame(game); err != nil {
+		t.Fatalf("expected connections without a game on the URL to accept any game, got %v", err)
+	}
+}
@@ -0,0 +1,771 @@
+package signaling
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/poki/netlib/internal/ratelimit"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/webhook"
+)
+
+// DefaultLobbyCodeCooldown is how long a released lobby code isn't handed
+// out again, long enough for clients of the old lobby to have given up.
+const DefaultLobbyCodeCooldown = 10 * time.Minute
+
+// DefaultMatchmakingCandidates is how many lobbies matchmaking considers
+// before it creates a new lobby.
+const DefaultMatchmakingCandidates = 10
+
+// DefaultExpiryWarning is how long before MaxConnectionTime clients are told
+// their connection is expiring.
+const DefaultExpiryWarning = time.Minute
+
+// DefaultCapacityRetryAfter is the retry hint for connections rejected over
+// capacity when there is no recent churn to base it on.
+const DefaultCapacityRetryAfter = 30 * time.Second
+
+// DefaultStoreOpsWindow is the sliding window MaxStoreOps is counted over.
+const DefaultStoreOpsWindow = time.Minute
+
+// DefaultNegotiationWindow is the window MaxNegotiations is counted over.
+const DefaultNegotiationWindow = 10 * time.Second
+
+// DefaultClosedLobbyRetention is how long the server remembers why it closed
+// a lobby, longer than any reconnect window.
+const DefaultClosedLobbyRetention = time.Hour
+
+// DefaultMaxSessionLifetime is how long a session can be kept alive by
+// reconnecting before the peer has to start a new one.
+const DefaultMaxSessionLifetime = 24 * time.Hour
+
+// DefaultTicketTTL is how long a matchmaking ticket waits to be matched.
+const DefaultTicketTTL = 2 * time.Minute
+
+// DefaultTicketSkillWindow and DefaultTicketWidenAfter are the matchmaking
+// ticket criteria, see Matcher.
+const DefaultTicketSkillWindow = 100
+const DefaultTicketWidenAfter = 15 * time.Second
+
+// DefaultMaxTicketsPerPeer is how many matchmaking tickets a peer can have
+// waiting at once.
+const DefaultMaxTicketsPerPeer = 1
+
+// MaxLobbiesPerConnection is how many lobbies a connection can be in at the
+// same time, a connection is a single peer with a single lobby.
+const MaxLobbiesPerConnection = 1
+
+// MaxNodeIDLength is the size of the node column of lobbies.
+const MaxNodeIDLength = 64
+
+// DefaultEventRetention is how long persisted events are kept.
+const DefaultEventRetention = 7 * 24 * time.Hour
+
+// Config holds the tunable settings of the signaling Handler.
+type Config struct {
+	// GameQuotas limits the resources a single game can use on a shared
+	// deployment, keyed by game ID. Games without an entry are unlimited.
+	GameQuotas map[string]Quota `json:"gameQuotas"`
+
+	// Compression configures permessage-deflate, GameCompression overrides it
+	// for the games keyed by game ID. The game is read from the GameQueryParam
+	// of the signaling URL since compression is negotiated before the hello.
+	// Safari and clients that ask for it never get compression.
+	Compression     Compression            `json:"compression"`
+	GameCompression map[string]Compression `json:"gameCompression"`
+
+	// ChunkThreshold is the packet size in bytes above which packets are split
+	// into chunks for clients that support the "chunking" capability.
+	ChunkThreshold int `json:"chunkThreshold"`
+
+	// AllowedOrigins are the host patterns (e.g. "*.example.com") of origins
+	// allowed to connect, empty allows any origin.
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// AllowedHeaders are returned on CORS preflight requests, empty allows
+	// whatever headers the client requested.
+	AllowedHeaders []string `json:"allowedHeaders"`
+
+	// RequireClientCert rejects connections without a verified TLS client
+	// certificate. Peers with a verified certificate skip the origin check.
+	RequireClientCert bool `json:"requireClientCert"`
+	// TLSCertFile and TLSKeyFile make the server binary serve over TLS,
+	// ClientTLS verifies client certificates against the CA bundle of
+	// TLS_CLIENT_CA_FILE, see ClientTLSConfig.
+	TLSCertFile string      `json:"-"`
+	TLSKeyFile  string      `json:"-"`
+	ClientTLS   *tls.Config `json:"-"`
+
+	// EdgeHeader is the request header identifying the CDN edge a connection
+	// came through (e.g. "CF-Ray"), empty disables edge tagging.
+	EdgeHeader string `json:"edgeHeader"`
+	// MetricEdges are the edges labelled in metrics, connections through
+	// other edges are labelled "other". Logs and events get any edge.
+	MetricEdges []string `json:"metricEdges"`
+	// MetricGames are the games labelled in the lobby metrics, other games
+	// are labelled "other".
+	MetricGames []string `json:"metricGames"`
+
+	// MaxPacketSize, MaxPacketRate and MaxReadRate limit what a single
+	// connection can send: the size of one packet in bytes, packets per second
+	// and bytes per second. Connections over their rate are throttled first
+	// and disconnected when they keep going, zero keeps the default packet
+	// size of 32KB and disables the rate limits. MaxReadRate can't be lower
+	// than the packet size.
+	MaxPacketSize int `json:"maxPacketSize"`
+	MaxPacketRate int `json:"maxPacketRate"`
+	MaxReadRate   int `json:"maxReadRate"`
+
+	// MaxQueuedMessages and MaxQueuedBytes bound the packets queued for a
+	// slow peer during broadcasts, a peer over either limit is disconnected.
+	// Zero uses DefaultMaxQueuedMessages and DefaultMaxQueuedBytes, see also
+	// QueueWriteTimeout.
+	MaxQueuedMessages int `json:"maxQueuedMessages"`
+	MaxQueuedBytes    int `json:"maxQueuedBytes"`
+
+	// ValidateSignals rejects description and candidate packets that don't
+	// parse as SDP or ICE candidates or are larger than MaxSignalSize instead
+	// of forwarding them. Off by default as it might reject unusual SDP.
+	ValidateSignals bool `json:"validateSignals"`
+
+	// ReplyInvalidEvents sends an error for event packets that can't be
+	// recorded, by default they're only logged and counted.
+	ReplyInvalidEvents bool `json:"replyInvalidEvents"`
+
+	// TallyCandidates counts the types of the relayed candidates per lobby
+	// for the /admin/candidates endpoint and the metrics.
+	TallyCandidates bool `json:"tallyCandidates"`
+	MaxSignalSize   int  `json:"maxSignalSize"`
+
+	// ICEServers are sent to clients together with the Cloudflare TURN
+	// credentials, e.g. public STUN servers and a backup TURN server.
+	ICEServers []ICEServer `json:"iceServers"`
+
+	// AdminToken is the bearer token for the admin endpoints, empty disables them.
+	AdminToken string `json:"-"`
+
+	// HandlerTimeouts overrides the time handling a packet type may take,
+	// see DefaultHandlerTimeouts.
+	HandlerTimeouts map[string]time.Duration `json:"-"`
+
+	// SeamlessWindow is how long a peer can be disconnected before its lobby
+	// is told it's reconnecting, zero uses DefaultSeamlessWindow. It has to be
+	// shorter than DefaultDisconnectThreshold.
+	SeamlessWindow time.Duration `json:"-"`
+
+	// ReapInterval and ReapBatchSize control how often and how many stale
+	// lobbies are removed at a time, zero uses the defaults.
+	ReapInterval  time.Duration `json:"-"`
+	ReapBatchSize int           `json:"reapBatchSize"`
+
+	// ReuseLobbyCodes hands out the short codes of reaped lobbies again once
+	// LobbyCodeCooldown passed, zero uses DefaultLobbyCodeCooldown.
+	ReuseLobbyCodes   bool          `json:"reuseLobbyCodes"`
+	LobbyCodeCooldown time.Duration `json:"-"`
+	// CaseSensitiveLobbyCodes generates mixed case lobby codes and keeps the
+	// case of the codes peers send, by default codes are lowercase and the
+	// codes peers send are lowercased so they can be typed in any case.
+	CaseSensitiveLobbyCodes bool `json:"caseSensitiveLobbyCodes"`
+
+	// MaxConnectionTime caps how long a connection stays open, zero uses
+	// MaxConnectionTime and a negative value disables the cap. ExpiryWarning
+	// is how long before that a connection-expiring packet is sent, zero uses
+	// DefaultExpiryWarning and a negative value disables the warning.
+	MaxConnectionTime time.Duration `json:"-"`
+	ExpiryWarning     time.Duration `json:"-"`
+	// MaxSessionLifetime caps how long a session, a peer ID and secret, can
+	// be kept alive by reconnecting, counted from the hello that started it.
+	// Older sessions can't reconnect and have to start over with a new hello,
+	// so a leaked secret isn't valid forever. Zero uses
+	// DefaultMaxSessionLifetime and a negative value disables the cap.
+	MaxSessionLifetime time.Duration `json:"-"`
+
+	// MaxCloseDelay caps how far in the future a lobby can be scheduled to
+	// close, zero uses DefaultMaxCloseDelay.
+	MaxCloseDelay time.Duration `json:"-"`
+
+	// NodeID identifies this node to load balancers for sticky reconnects,
+	// it's sent to clients with the NodeEndpoint they can connect to directly
+	// and set as the AffinityCookie at upgrade time. Empty disables affinity.
+	NodeID         string `json:"nodeID"`
+	NodeEndpoint   string `json:"nodeEndpoint"`
+	AffinityCookie string `json:"affinityCookie"`
+
+	// MatchmakingCandidates bounds how many of the fullest lobbies with room
+	// matchmaking tries before it creates a new lobby, trading packing for
+	// predictable latency on big pools. Zero uses DefaultMatchmakingCandidates,
+	// a negative value considers every lobby.
+	MatchmakingCandidates int `json:"matchmakingCandidates"`
+
+	// MaxPresenceSubscriptions is how many players a peer can follow the
+	// presence of, zero uses DefaultMaxPresenceSubscriptions.
+	MaxPresenceSubscriptions int `json:"maxPresenceSubscriptions"`
+
+	// TicketTTL is how long a matchmaking ticket waits to be matched, the
+	// skill of matched tickets is at most TicketSkillWindow apart, widened
+	// every TicketWidenAfter a ticket waited, see Matcher. Zero uses the
+	// defaults.
+	TicketTTL         time.Duration `json:"-"`
+	TicketSkillWindow float64       `json:"ticketSkillWindow"`
+	TicketWidenAfter  time.Duration `json:"-"`
+	// MaxTicketsPerPeer is how many tickets a peer can have waiting at once,
+	// zero uses DefaultMaxTicketsPerPeer.
+	MaxTicketsPerPeer int `json:"maxTicketsPerPeer"`
+
+	// SortableMetaKeys are the custom data keys list packets can sort on,
+	// sorting on one isn't indexed so keep it to games with few lobbies.
+	SortableMetaKeys []string `json:"sortableMetaKeys"`
+
+	// MaxConnections and MaxConnectionsPerIP cap the open connections of this
+	// node, zero is unlimited. Connections over a cap are rejected before the
+	// upgrade with a capacity-exceeded body and a retry hint based on how fast
+	// connections are closing, CapacityRetryAfter when that's unknown. The
+	// client IP is read from ClientIPHeader (e.g. "CF-Connecting-IP") when
+	// set, the remote address otherwise.
+	MaxConnections      int           `json:"maxConnections"`
+	MaxConnectionsPerIP int           `json:"maxConnectionsPerIP"`
+	CapacityRetryAfter  time.Duration `json:"-"`
+	ClientIPHeader      string        `json:"clientIPHeader"`
+
+	// MaxStoreOps is how many store operations the packets of a single
+	// connection may cause within StoreOpsWindow, connections going over it
+	// are disconnected. Zero is unlimited, a zero StoreOpsWindow uses
+	// DefaultStoreOpsWindow.
+	MaxStoreOps    int           `json:"maxStoreOps"`
+	StoreOpsWindow time.Duration `json:"-"`
+
+	// MaxNegotiations is how many offers and answers a peer may send to a
+	// single lobbymate within NegotiationWindow, more are dropped. Zero is
+	// unlimited, a zero NegotiationWindow uses DefaultNegotiationWindow.
+	MaxNegotiations   int           `json:"maxNegotiations"`
+	NegotiationWindow time.Duration `json:"-"`
+
+	// MaxLobbyLimits are the highest limits a lobby can be created with, see
+	// CreatePacket.Limits. A zero field doesn't allow lobbies to override that
+	// limit, leaving it all zero ignores the limits of lobbies.
+	MaxLobbyLimits stores.LobbyLimits `json:"maxLobbyLimits"`
+
+	// PoolReadBuffers reads packets into pooled buffers instead of allocating
+	// one per packet, see readBuffers. Disable it when a handler keeps the
+	// raw packet after it returns.
+	PoolReadBuffers bool `json:"poolReadBuffers"`
+
+	// PersistEvents stores the client analytics events with the store instead
+	// of sending them to the metrics backend. Persisted events are pruned after
+	// EventRetention, zero uses DefaultEventRetention.
+	PersistEvents  bool          `json:"persistEvents"`
+	EventRetention time.Duration `json:"-"`
+
+	// ClosedLobbyRetention is how long the server remembers why it closed a
+	// lobby, to tell peers reconnecting to it. Zero uses
+	// DefaultClosedLobbyRetention.
+	ClosedLobbyRetention time.Duration `json:"-"`
+
+	// ServerVersion is sent to clients in the server-info packet, empty uses
+	// Version.
+	ServerVersion string `json:"serverVersion"`
+
+	// Features turns features on or off per game, nil enables everything.
+	// FEATURE_FLAGS holds the FeatureFlags as JSON, FEATURE_FLAGS_FILE reads
+	// them from a file that is reloaded on SIGHUP.
+	Features *Features `json:"-"`
+
+	// Auth is called for every connection before it's accepted, nil accepts
+	// all connections. AUTH_URL sets it to RemoteAuth.
+	Auth AuthFunc `json:"-"`
+	// RequireAuthForCredentials refuses TURN credentials to peers without an
+	// identity from Auth, relaying for anonymous peers costs money.
+	RequireAuthForCredentials bool `json:"requireAuthForCredentials"`
+	// RequireHello rejects the packets of a peer until it negotiated its
+	// capabilities with a hello or reconnect, otherwise packets before that
+	// are handled with the default capabilities.
+	RequireHello bool `json:"requireHello"`
+	// PlayerTokenSecret signs the player tokens of peers without an identity
+	// from Auth, empty only gives authenticated peers a PlayerID. Rotating it
+	// gives every anonymous player a new ID.
+	PlayerTokenSecret string `json:"-"`
+
+	// Webhook receives lobby lifecycle events, nil disables it.
+	Webhook *webhook.Client `json:"-"`
+
+	// CredentialsLimiter caps the rate of credentials requests, nil is unlimited.
+	CredentialsLimiter ratelimit.Limiter `json:"-"`
+}
+
+func (c *Config) setDefaults() {
+	if c.ChunkThreshold <= 0 {
+		c.ChunkThreshold = DefaultChunkThreshold
+	}
+	if c.MaxQueuedMessages <= 0 {
+		c.MaxQueuedMessages = DefaultMaxQueuedMessages
+	}
+	if c.MaxQueuedBytes <= 0 {
+		c.MaxQueuedBytes = DefaultMaxQueuedBytes
+	}
+	if c.LobbyCodeCooldown <= 0 {
+		c.LobbyCodeCooldown = DefaultLobbyCodeCooldown
+	}
+	if c.MaxSignalSize <= 0 {
+		c.MaxSignalSize = DefaultMaxSignalSize
+	}
+	if c.MaxCloseDelay <= 0 {
+		c.MaxCloseDelay = DefaultMaxCloseDelay
+	}
+	if c.MatchmakingCandidates == 0 {
+		c.MatchmakingCandidates = DefaultMatchmakingCandidates
+	}
+	if c.MaxPresenceSubscriptions <= 0 {
+		c.MaxPresenceSubscriptions = DefaultMaxPresenceSubscriptions
+	}
+	if c.TicketTTL <= 0 {
+		c.TicketTTL = DefaultTicketTTL
+	}
+	if c.MaxTicketsPerPeer <= 0 {
+		c.MaxTicketsPerPeer = DefaultMaxTicketsPerPeer
+	}
+	if c.TicketSkillWindow <= 0 {
+		c.TicketSkillWindow = DefaultTicketSkillWindow
+	}
+	if c.TicketWidenAfter <= 0 {
+		c.TicketWidenAfter = DefaultTicketWidenAfter
+	}
+	if c.MaxConnectionTime == 0 {
+		c.MaxConnectionTime = MaxConnectionTime
+	}
+	if c.ExpiryWarning == 0 {
+		c.ExpiryWarning = DefaultExpiryWarning
+	}
+	if c.MaxSessionLifetime == 0 {
+		c.MaxSessionLifetime = DefaultMaxSessionLifetime
+	}
+	if c.CapacityRetryAfter <= 0 {
+		c.CapacityRetryAfter = DefaultCapacityRetryAfter
+	}
+	if c.StoreOpsWindow <= 0 {
+		c.StoreOpsWindow = DefaultStoreOpsWindow
+	}
+	if c.NegotiationWindow <= 0 {
+		c.NegotiationWindow = DefaultNegotiationWindow
+	}
+	if c.ClosedLobbyRetention <= 0 {
+		c.ClosedLobbyRetention = DefaultClosedLobbyRetention
+	}
+	if c.PersistEvents && c.EventRetention <= 0 {
+		c.EventRetention = DefaultEventRetention
+	}
+}
+
+type Quota struct {
+	// MaxLobbies is the maximum number of active (non-empty) lobbies, 0 means unlimited.
+	MaxLobbies int `json:"maxLobbies"`
+	// MaxPeers is the maximum number of peers connected to this node, 0 means unlimited.
+	MaxPeers int `json:"maxPeers"`
+}
+
+// ConfigFromEnv reads the Config from the environment, unset variables
+// keep the defaults.
+func ConfigFromEnv() (Config, error) {
+	config := Config{}
+	if err := envJSON("GAME_QUOTAS", &config.GameQuotas); err != nil {
+		return config, err
+	}
+	if err := envInt("CHUNK_THRESHOLD", &config.ChunkThreshold); err != nil {
+		return config, err
+	}
+	if err := envJSON("ICE_SERVERS", &config.ICEServers); err != nil {
+		return config, err
+	}
+	if err := validateICEServers(config.ICEServers); err != nil {
+		return config, fmt.Errorf("invalid ICE_SERVERS: %w", err)
+	}
+	if err := envJSON("COMPRESSION", &config.Compression); err != nil {
+		return config, err
+	}
+	if err := config.Compression.validate(); err != nil {
+		return config, fmt.Errorf("invalid COMPRESSION: %w", err)
+	}
+	if err := envJSON("GAME_COMPRESSION", &config.GameCompression); err != nil {
+		return config, err
+	}
+	for game, compression := range config.GameCompression {
+		if err := compression.validate(); err != nil {
+			return config, fmt.Errorf("invalid GAME_COMPRESSION for %s: %w", game, err)
+		}
+	}
+	envList("ALLOWED_ORIGINS", &config.AllowedOrigins)
+	envList("ALLOWED_HEADERS", &config.AllowedHeaders)
+	envList("SORTABLE_META_KEYS", &config.SortableMetaKeys)
+	if err := envBool("REQUIRE_CLIENT_CERT", &config.RequireClientCert); err != nil {
+		return config, err
+	}
+	if err := tlsFromEnv(&config); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_PACKET_SIZE", &config.MaxPacketSize); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_PACKET_RATE", &config.MaxPacketRate); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_READ_RATE", &config.MaxReadRate); err != nil {
+		return config, err
+	}
+	maxPacketSize := config.MaxPacketSize
+	if maxPacketSize <= 0 {
+		maxPacketSize = defaultReadLimit
+	}
+	if config.MaxReadRate > 0 && config.MaxReadRate < maxPacketSize {
+		// The read bucket holds a second worth of bytes, a larger packet could never be read.
+		return config, fmt.Errorf("invalid MAX_READ_RATE: must be at least the packet size of %d bytes", maxPacketSize)
+	}
+	if err := envInt("MAX_QUEUED_MESSAGES", &config.MaxQueuedMessages); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_QUEUED_BYTES", &config.MaxQueuedBytes); err != nil {
+		return config, err
+	}
+	if err := envBool("VALIDATE_SIGNALS", &config.ValidateSignals); err != nil {
+		return config, err
+	}
+	if err := envBool("REPLY_INVALID_EVENTS", &config.ReplyInvalidEvents); err != nil {
+		return config, err
+	}
+	if err := envBool("TALLY_CANDIDATES", &config.TallyCandidates); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_SIGNAL_SIZE", &config.MaxSignalSize); err != nil {
+		return config, err
+	}
+	config.EdgeHeader = os.Getenv("EDGE_HEADER")
+	envList("METRIC_EDGES", &config.MetricEdges)
+	envList("METRIC_GAMES", &config.MetricGames)
+	config.NodeID = os.Getenv("NODE_ID")
+	if len(config.NodeID) > MaxNodeIDLength {
+		return config, fmt.Errorf("invalid NODE_ID: longer than %d bytes", MaxNodeIDLength)
+	}
+	if cookie := (http.Cookie{Name: "node", Value: config.NodeID}); cookie.Valid() != nil {
+		// The node is the value of the AffinityCookie.
+		return config, fmt.Errorf("invalid NODE_ID: %q isn't a valid cookie value", config.NodeID)
+	}
+	config.NodeEndpoint = os.Getenv("NODE_ENDPOINT")
+	config.AffinityCookie = os.Getenv("AFFINITY_COOKIE")
+	config.AdminToken = os.Getenv("ADMIN_TOKEN")
+	if err := envDurations("HANDLER_TIMEOUTS", &config.HandlerTimeouts); err != nil {
+		return config, err
+	}
+	if raw, ok := os.LookupEnv("SEAMLESS_WINDOW"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid SEAMLESS_WINDOW: %w", err)
+		}
+		// A longer window would drop the peer before its lobby heard it's gone.
+		if d >= DefaultDisconnectThreshold {
+			return config, fmt.Errorf("invalid SEAMLESS_WINDOW: must be shorter than the disconnect threshold of %s", DefaultDisconnectThreshold)
+		}
+		config.SeamlessWindow = d
+	}
+	if raw, ok := os.LookupEnv("REAP_INTERVAL"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid REAP_INTERVAL: %w", err)
+		}
+		config.ReapInterval = d
+	}
+	if err := envInt("REAP_BATCH_SIZE", &config.ReapBatchSize); err != nil {
+		return config, err
+	}
+	if err := envBool("REUSE_LOBBY_CODES", &config.ReuseLobbyCodes); err != nil {
+		return config, err
+	}
+	if err := envBool("CASE_SENSITIVE_LOBBY_CODES", &config.CaseSensitiveLobbyCodes); err != nil {
+		return config, err
+	}
+	if raw, ok := os.LookupEnv("LOBBY_CODE_COOLDOWN"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid LOBBY_CODE_COOLDOWN: %w", err)
+		}
+		config.LobbyCodeCooldown = d
+	}
+	if err := envInt("MATCHMAKING_CANDIDATES", &config.MatchmakingCandidates); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_CONNECTIONS", &config.MaxConnections); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_CONNECTIONS_PER_IP", &config.MaxConnectionsPerIP); err != nil {
+		return config, err
+	}
+	if raw, ok := os.LookupEnv("CAPACITY_RETRY_AFTER"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid CAPACITY_RETRY_AFTER: %w", err)
+		}
+		config.CapacityRetryAfter = d
+	}
+	config.ClientIPHeader = os.Getenv("CLIENT_IP_HEADER")
+	if raw, ok := os.LookupEnv("MAX_CONNECTION_TIME"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid MAX_CONNECTION_TIME: %w", err)
+		}
+		config.MaxConnectionTime = d
+	}
+	if raw, ok := os.LookupEnv("EXPIRY_WARNING"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid EXPIRY_WARNING: %w", err)
+		}
+		config.ExpiryWarning = d
+	}
+	if raw, ok := os.LookupEnv("MAX_SESSION_LIFETIME"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid MAX_SESSION_LIFETIME: %w", err)
+		}
+		config.MaxSessionLifetime = d
+	}
+	if err := envInt("MAX_PRESENCE_SUBSCRIPTIONS", &config.MaxPresenceSubscriptions); err != nil {
+		return config, err
+	}
+	if raw, ok := os.LookupEnv("TICKET_TTL"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid TICKET_TTL: %w", err)
+		}
+		config.TicketTTL = d
+	}
+	if raw, ok := os.LookupEnv("TICKET_SKILL_WINDOW"); ok {
+		window, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid TICKET_SKILL_WINDOW: %w", err)
+		}
+		config.TicketSkillWindow = window
+	}
+	if raw, ok := os.LookupEnv("TICKET_WIDEN_AFTER"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid TICKET_WIDEN_AFTER: %w", err)
+		}
+		config.TicketWidenAfter = d
+	}
+	if err := envInt("MAX_TICKETS_PER_PEER", &config.MaxTicketsPerPeer); err != nil {
+		return config, err
+	}
+	if raw, ok := os.LookupEnv("MAX_CLOSE_DELAY"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid MAX_CLOSE_DELAY: %w", err)
+		}
+		config.MaxCloseDelay = d
+	}
+	config.ServerVersion = os.Getenv("SERVER_VERSION")
+	if err := envInt("MAX_STORE_OPS", &config.MaxStoreOps); err != nil {
+		return config, err
+	}
+	if raw, ok := os.LookupEnv("STORE_OPS_WINDOW"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid STORE_OPS_WINDOW: %w", err)
+		}
+		config.StoreOpsWindow = d
+	}
+	if err := envBool("POOL_READ_BUFFERS", &config.PoolReadBuffers); err != nil {
+		return config, err
+	}
+	if err := envInt("MAX_NEGOTIATIONS", &config.MaxNegotiations); err != nil {
+		return config, err
+	}
+	if raw, ok := os.LookupEnv("NEGOTIATION_WINDOW"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid NEGOTIATION_WINDOW: %w", err)
+		}
+		config.NegotiationWindow = d
+	}
+	if err := envJSON("MAX_LOBBY_LIMITS", &config.MaxLobbyLimits); err != nil {
+		return config, err
+	}
+	switch sink := os.Getenv("EVENTS_SINK"); sink {
+	case "", "metrics":
+	case "store":
+		config.PersistEvents = true
+	default:
+		return config, fmt.Errorf("invalid EVENTS_SINK: %q", sink)
+	}
+	if raw, ok := os.LookupEnv("EVENT_RETENTION"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid EVENT_RETENTION: %w", err)
+		}
+		config.EventRetention = d
+	}
+	if url := os.Getenv("AUTH_URL"); url != "" {
+		config.Auth = RemoteAuth(url)
+	}
+	if err := envBool("REQUIRE_AUTH_FOR_CREDENTIALS", &config.RequireAuthForCredentials); err != nil {
+		return config, err
+	}
+	if config.RequireAuthForCredentials && config.Auth == nil {
+		// Without Auth no peer has an identity, nobody would get credentials.
+		return config, fmt.Errorf("invalid REQUIRE_AUTH_FOR_CREDENTIALS: needs AUTH_URL")
+	}
+	if err := envBool("REQUIRE_HELLO", &config.RequireHello); err != nil {
+		return config, err
+	}
+	config.PlayerTokenSecret = os.Getenv("PLAYER_TOKEN_SECRET")
+	if raw, ok := os.LookupEnv("CLOSED_LOBBY_RETENTION"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid CLOSED_LOBBY_RETENTION: %w", err)
+		}
+		config.ClosedLobbyRetention = d
+	}
+	var flags *FeatureFlags
+	if err := envJSON("FEATURE_FLAGS", &flags); err != nil {
+		return config, err
+	}
+	if file := os.Getenv("FEATURE_FLAGS_FILE"); file != "" {
+		loaded, err := LoadFeatureFlags(file)
+		if err != nil {
+			return config, fmt.Errorf("invalid FEATURE_FLAGS_FILE: %w", err)
+		}
+		flags = &loaded
+	}
+	if flags != nil {
+		features, err := NewFeatures(*flags)
+		if err != nil {
+			return config, fmt.Errorf("invalid FEATURE_FLAGS: %w", err)
+		}
+		config.Features = features
+	}
+	return config, nil
+}
+
+// tlsFromEnv loads the certificates of TLS_CERT_FILE, TLS_KEY_FILE and
+// TLS_CLIENT_CA_FILE, so a server that can't verify its clients fails at
+// startup instead of rejecting every connection.
+func tlsFromEnv(config *Config) error {
+	config.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	config.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("invalid TLS_CERT_FILE: needs both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if config.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			return fmt.Errorf("invalid TLS_CERT_FILE: %w", err)
+		}
+	}
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		if config.TLSCertFile == "" {
+			// Without TLS there are no client certificates to verify.
+			return fmt.Errorf("invalid TLS_CLIENT_CA_FILE: needs TLS_CERT_FILE")
+		}
+		clientTLS, err := ClientTLSConfig(caFile)
+		if err != nil {
+			return fmt.Errorf("invalid TLS_CLIENT_CA_FILE: %w", err)
+		}
+		config.ClientTLS = clientTLS
+	}
+	if config.RequireClientCert && config.ClientTLS == nil {
+		return fmt.Errorf("invalid REQUIRE_CLIENT_CERT: needs TLS_CLIENT_CA_FILE")
+	}
+	return nil
+}
+
+// CredentialsLimiterFromEnv returns the limiter of CREDENTIALS_RATE_LIMIT
+// requests per CREDENTIALS_RATE_WINDOW, nil without a limit. The limit is
+// shared by the cluster through a postgres store, unless the deployment is a
+// single node and CREDENTIALS_RATE_LIMITER asks for the in-memory limiter.
+func CredentialsLimiterFromEnv(store stores.Store) (ratelimit.Limiter, error) {
+	limit := 0
+	if err := envInt("CREDENTIALS_RATE_LIMIT", &limit); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+	window := time.Minute
+	if raw, ok := os.LookupEnv("CREDENTIALS_RATE_WINDOW"); ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CREDENTIALS_RATE_WINDOW: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid CREDENTIALS_RATE_WINDOW: must be positive")
+		}
+		window = d
+	}
+	if pg, ok := store.(*stores.PostgresStore); ok && os.Getenv("CREDENTIALS_RATE_LIMITER") != "memory" {
+		return pg.RateLimiter("credentials", limit, window), nil
+	}
+	return ratelimit.NewMemory(limit, window), nil
+}
+
+func envList(name string, dst *[]string) {
+	if raw, ok := os.LookupEnv(name); ok {
+		*dst = nil
+		for _, v := range strings.Split(raw, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*dst = append(*dst, v)
+			}
+		}
+	}
+}
+
+func envJSON(name string, dst any) error {
+	if raw, ok := os.LookupEnv(name); ok {
+		if err := json.Unmarshal([]byte(raw), dst); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func envInt(name string, dst *int) error {
+	if raw, ok := os.LookupEnv(name); ok {
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dst = v
+	}
+	return nil
+}
+
+func envBool(name string, dst *bool) error {
+	if raw, ok := os.LookupEnv(name); ok {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dst = v
+	}
+	return nil
+}
+
+// envDurations parses a list of key=duration pairs, e.g. "credentials=20s,create=5s".
+func envDurations(name string, dst *map[string]time.Duration) error {
+	var pairs []string
+	envList(name, &pairs)
+	for _, pair := range pairs {
+		key, raw, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid %s: expected key=duration, got %q", name, pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if *dst == nil {
+			*dst = make(map[string]time.Duration)
+		}
+		(*dst)[strings.TrimSpace(key)] = d
+	}
+	return nil
+}
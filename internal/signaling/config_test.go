@@ -0,0 +1,156 @@
+package signaling
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/ratelimit"
+)
+
+func TestConfigFromEnvRequireAuthForCredentials(t *testing.T) {
+	t.Setenv("REQUIRE_AUTH_FOR_CREDENTIALS", "true")
+	if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "AUTH_URL") {
+		t.Fatalf("expected the flag to need AUTH_URL, got %v", err)
+	}
+
+	t.Setenv("AUTH_URL", "http://auth.example/check")
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.RequireAuthForCredentials || config.Auth == nil {
+		t.Fatalf("expected auth to be required and configured, got %+v", config)
+	}
+}
+
+func TestConfigFromEnvMaxReadRate(t *testing.T) {
+	t.Setenv("MAX_READ_RATE", "65536")
+	if config, err := ConfigFromEnv(); err != nil || config.MaxReadRate != 65536 {
+		t.Fatalf("expected a read rate of 65536, got %d (%v)", config.MaxReadRate, err)
+	}
+
+	// Below the default packet size of 32KB.
+	t.Setenv("MAX_READ_RATE", "16384")
+	if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "MAX_READ_RATE") {
+		t.Fatalf("expected a read rate below the packet size to be rejected, got %v", err)
+	}
+
+	t.Setenv("MAX_PACKET_SIZE", "8192")
+	if _, err := ConfigFromEnv(); err != nil {
+		t.Fatalf("expected a read rate above a smaller packet size, got %v", err)
+	}
+}
+
+func TestConfigFromEnvNodeID(t *testing.T) {
+	t.Setenv("NODE_ID", "node-1.eu-west")
+	if config, err := ConfigFromEnv(); err != nil || config.NodeID != "node-1.eu-west" {
+		t.Fatalf("expected the node ID, got %q (%v)", config.NodeID, err)
+	}
+
+	for _, id := range []string{strings.Repeat("n", MaxNodeIDLength+1), "node;1", "node\"1"} {
+		t.Setenv("NODE_ID", id)
+		if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "NODE_ID") {
+			t.Fatalf("expected %q to be rejected, got %v", id, err)
+		}
+	}
+}
+
+func TestConfigFromEnvTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := testCertificate(t, dir, "ca", nil, nil)
+	_, _, certFile, keyFile := testCertificate(t, dir, "server", ca, caKey)
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"TLS_CERT_FILE": certFile}, "TLS_CERT_FILE"},
+		{map[string]string{"TLS_CERT_FILE": caFile, "TLS_KEY_FILE": keyFile}, "TLS_CERT_FILE"},
+		{map[string]string{"TLS_CLIENT_CA_FILE": caFile}, "TLS_CLIENT_CA_FILE"},
+		{map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_CLIENT_CA_FILE": keyFile}, "TLS_CLIENT_CA_FILE"},
+		{map[string]string{"REQUIRE_CLIENT_CERT": "true"}, "REQUIRE_CLIENT_CERT"},
+		{map[string]string{"REQUIRE_CLIENT_CERT": "true", "TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile}, "REQUIRE_CLIENT_CERT"},
+	} {
+		for _, name := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE", "REQUIRE_CLIENT_CERT"} {
+			t.Setenv(name, test.env[name])
+			if _, ok := test.env[name]; !ok {
+				os.Unsetenv(name) //nolint:errcheck
+			}
+		}
+		if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("expected %v to be rejected for %s, got %v", test.env, test.err, err)
+		}
+	}
+
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", caFile)
+	t.Setenv("REQUIRE_CLIENT_CERT", "true")
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.RequireClientCert || config.ClientTLS == nil || config.TLSCertFile != certFile {
+		t.Fatalf("expected client certificates to be required and verified, got %+v", config)
+	}
+}
+
+func TestCredentialsLimiterFromEnv(t *testing.T) {
+	if limiter, err := CredentialsLimiterFromEnv(nil); err != nil || limiter != nil {
+		t.Fatalf("expected no limiter without a limit, got %v (%v)", limiter, err)
+	}
+
+	t.Setenv("CREDENTIALS_RATE_LIMIT", "many")
+	if _, err := CredentialsLimiterFromEnv(nil); err == nil || !strings.Contains(err.Error(), "CREDENTIALS_RATE_LIMIT") {
+		t.Fatalf("expected an invalid limit to be rejected, got %v", err)
+	}
+	t.Setenv("CREDENTIALS_RATE_LIMIT", "100")
+	for _, window := range []string{"soon", "0s", "-1m"} {
+		t.Setenv("CREDENTIALS_RATE_WINDOW", window)
+		if _, err := CredentialsLimiterFromEnv(nil); err == nil || !strings.Contains(err.Error(), "CREDENTIALS_RATE_WINDOW") {
+			t.Fatalf("expected a window of %q to be rejected, got %v", window, err)
+		}
+	}
+
+	// Without a postgres store the limit can only be kept in memory.
+	t.Setenv("CREDENTIALS_RATE_WINDOW", "1s")
+	limiter, err := CredentialsLimiterFromEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := limiter.(*ratelimit.Memory); !ok {
+		t.Fatalf("expected an in-memory limiter, got %T", limiter)
+	}
+}
+
+func TestConfigFromEnvSeamlessWindow(t *testing.T) {
+	t.Setenv("SEAMLESS_WINDOW", "2s")
+	if config, err := ConfigFromEnv(); err != nil || config.SeamlessWindow != 2*time.Second {
+		t.Fatalf("expected a window of 2s, got %s (%v)", config.SeamlessWindow, err)
+	}
+
+	for _, window := range []string{"soon", DefaultDisconnectThreshold.String()} {
+		t.Setenv("SEAMLESS_WINDOW", window)
+		if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "SEAMLESS_WINDOW") {
+			t.Fatalf("expected a window of %q to be rejected, got %v", window, err)
+		}
+	}
+}
+
+func TestConfigFromEnvGameQuotas(t *testing.T) {
+	t.Setenv("GAME_QUOTAS", `{"game": {"maxLobbies": 10, "maxPeers": 100}}`)
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota := config.GameQuotas["game"]; quota.MaxLobbies != 10 || quota.MaxPeers != 100 {
+		t.Fatalf("expected the quota of the game, got %+v", config.GameQuotas)
+	}
+
+	t.Setenv("GAME_QUOTAS", `{"game": 10}`)
+	if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "GAME_QUOTAS") {
+		t.Fatalf("expected invalid quotas to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrInvalidConnectionResult = util.NewError("invalid-connection-result", "invalid connection result")
+
+// candidateTypes are the ICE candidate types from RFC 8445, prflx is only
+// seen when the remote side learned an address from connectivity checks.
+var candidateTypes = map[string]struct{}{
+	"host":  {},
+	"srflx": {},
+	"prflx": {},
+	"relay": {},
+}
+
+// validateConnectionResult checks the reported values against their enums,
+// successful connections have to report the candidate type that was chosen.
+func validateConnectionResult(packet ConnectionResultPacket) error {
+	switch packet.Result {
+	case "success":
+		if _, found := candidateTypes[packet.CandidateType]; !found {
+			return ErrInvalidConnectionResult.WithParams("field", "candidateType")
+		}
+	case "failure":
+		if _, found := candidateTypes[packet.CandidateType]; packet.CandidateType != "" && !found {
+			return ErrInvalidConnectionResult.WithParams("field", "candidateType")
+		}
+	default:
+		return ErrInvalidConnectionResult.WithParams("field", "result")
+	}
+	return nil
+}
+
+// HandleConnectionResultPacket records whether a peer-to-peer connection the
+// server signaled was established and how, the server never sees this itself.
+func (p *Peer) HandleConnectionResultPacket(ctx context.Context, packet ConnectionResultPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if err := validateConnectionResult(packet); err != nil {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	}
+
+	candidateType := packet.CandidateType
+	if candidateType == "" {
+		candidateType = "none"
+	}
+	metrics.Inc("netlib_connection_results_total", "result", packet.Result, "candidate_type", candidateType)
+	metrics.RecordEvent(ctx, metrics.EventParams{
+		Game:     p.Game,
+		Category: "rtc",
+		Action:   "connection-result",
+		PeerID:   p.ID,
+		LobbyID:  p.Lobby,
+		Data: map[string]string{
+			"result":        packet.Result,
+			"candidateType": candidateType,
+			"remote":        packet.Peer,
+		},
+	})
+	return nil
+}
@@ -0,0 +1,30 @@
+package signaling
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateConnectionResult(t *testing.T) {
+	tests := []struct {
+		result, candidateType string
+		valid                 bool
+	}{
+		{"success", "host", true},
+		{"success", "relay", true},
+		{"success", "", false},
+		{"success", "turn", false},
+		{"failure", "", true},
+		{"failure", "srflx", true},
+		{"failure", "bogus", false},
+		{"maybe", "host", false},
+	}
+	for _, test := range tests {
+		err := validateConnectionResult(ConnectionResultPacket{Result: test.result, CandidateType: test.candidateType})
+		if test.valid && err != nil {
+			t.Errorf("%s/%s: unexpected error %v", test.result, test.candidateType, err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidConnectionResult) {
+			t.Errorf("%s/%s: expected ErrInvalidConnectionResult, got %v", test.result, test.candidateType, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// pooledCodeStore hands out a released code that another node already
+// created a lobby with.
+type pooledCodeStore struct {
+	stores.Store
+
+	mutex   sync.Mutex
+	created []string
+}
+
+func (s *pooledCodeStore) ClaimReleasedCode(context.Context, time.Duration) (string, error) {
+	return "POOLED", nil
+}
+
+func (s *pooledCodeStore) CreateLobby(_ context.Context, _, lobby, _ string, _ stores.LobbyOptions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.created = append(s.created, lobby)
+	if lobby == "POOLED" {
+		return stores.ErrLobbyExists
+	}
+	return nil
+}
+
+func (s *pooledCodeStore) JoinLobby(_ context.Context, _, _, id string, _ stores.Role) ([]string, error) {
+	return []string{id}, nil
+}
+
+func (s *pooledCodeStore) MarkLobbyFilled(context.Context, string, string) (*stores.LobbyLifetime, error) {
+	return nil, nil
+}
+
+func (s *pooledCodeStore) Subscribe(context.Context, string, stores.SubscriptionCallback) {}
+
+func TestCreateRetriesCollidingPooledCode(t *testing.T) {
+	store := &pooledCodeStore{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		config := &Config{ReuseLobbyCodes: true, LobbyCodeCooldown: time.Hour}
+		p := &Peer{store: store, conn: conn, config: config, quotas: newQuotaTracker(nil), registry: newPeerRegistry(), connCtx: r.Context(), ID: "peer", Game: "game"}
+		if err := p.HandleCreatePacket(r.Context(), CreatePacket{Type: "create", RequestID: "create", CodeFormat: "short"}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	reply := map[string]any{}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if len(store.created) != 2 || store.created[0] != "POOLED" {
+		t.Fatalf("expected the pooled code to be tried once before a new one, got %v", store.created)
+	}
+	if reply["rid"] != "create" || reply["type"] != "joined" || reply["lobby"] != store.created[1] {
+		t.Fatalf("expected to join the lobby with the new code, got %v", reply)
+	}
+}
@@ -0,0 +1,78 @@
+package signaling
+
+import (
+	"context"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/cloudflare"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/ratelimit"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+var ErrCredentialsUnavailable = util.NewError("credentials-unavailable", "no TURN credentials available")
+var ErrCredentialsUnauthenticated = util.NewError("credentials-unauthenticated", "TURN credentials require an authenticated peer")
+
+// HandleCredentialsPacket replies with the Cloudflare TURN credentials and the
+// static ICE servers. Without a client, e.g. for STUN only or self-hosted TURN
+// setups, or when fetching the credentials fails, only the static servers are
+// sent. When there are none either the client gets an error. With
+// Config.RequireAuthForCredentials peers without an AuthIdentity get nothing.
+func (p *Peer) HandleCredentialsPacket(ctx context.Context, packet CredentialsRequestPacket, client *cloudflare.CredentialsClient) error {
+	logger := logging.GetLogger(ctx)
+	if p.config.RequireAuthForCredentials && p.AuthIdentity == "" {
+		// Checked first so anonymous requests don't use up the credentials budget.
+		metrics.Inc("netlib_credentials_unauthenticated_total")
+		p.ReplyError(ctx, packet.RequestID, ErrCredentialsUnauthenticated)
+		return nil
+	}
+	relay := p.config.Features.Enabled(p.Game, FeatureRelay)
+	if !relay {
+		// Only TURN is disabled, the static servers are still sent.
+		if len(p.config.ICEServers) == 0 {
+			metrics.Inc("netlib_feature_rejections_total", "feature", FeatureRelay)
+			p.ReplyError(ctx, packet.RequestID, ErrFeatureDisabled.WithParams("feature", FeatureRelay))
+			return nil
+		}
+		client = nil
+	}
+	if relay && !allowCredentials(ctx, p.config.CredentialsLimiter) {
+		p.ReplyError(ctx, packet.RequestID, ratelimit.ErrLimited)
+		return nil
+	}
+	if client == nil {
+		if len(p.config.ICEServers) == 0 {
+			p.ReplyError(ctx, packet.RequestID, ErrCredentialsUnavailable)
+			return nil
+		}
+		return p.Send(ctx, CredentialsPacket{
+			RequestID:  packet.RequestID,
+			Type:       "credentials",
+			ServerTime: util.Now(ctx).UnixMilli(),
+			IceServers: mergeICEServers(nil, p.config.ICEServers),
+		})
+	}
+
+	credentials, err := client.GetCredentials(ctx)
+	if err != nil && len(p.config.ICEServers) == 0 {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		// The static servers are still useful without TURN credentials.
+		logger.Warn("failed to get credentials, only sending static ice servers", zap.Error(err))
+		return p.Send(ctx, CredentialsPacket{
+			RequestID:  packet.RequestID,
+			Type:       "credentials",
+			ServerTime: util.Now(ctx).UnixMilli(),
+			IceServers: mergeICEServers(nil, p.config.ICEServers),
+		})
+	}
+	return p.Send(ctx, CredentialsPacket{
+		RequestID:   packet.RequestID,
+		Type:        "credentials",
+		ServerTime:  util.Now(ctx).UnixMilli(),
+		Credentials: *credentials,
+		IceServers:  mergeICEServers(credentials, p.config.ICEServers),
+	})
+}
@@ -0,0 +1,218 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/ratelimit"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestCredentialsWithoutCloudflare(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		check  func(t *testing.T, reply map[string]any)
+	}{
+		{"static servers", Config{ICEServers: []ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}}}, func(t *testing.T, reply map[string]any) {
+			servers, _ := reply["iceServers"].([]any)
+			if reply["type"] != "credentials" || len(servers) != 1 {
+				t.Fatalf("expected only the static server, got %v", reply)
+			}
+		}},
+		{"no servers", Config{}, func(t *testing.T, reply map[string]any) {
+			if reply["type"] != "error" || reply["code"] != "credentials-unavailable" || reply["rid"] != "creds" {
+				t.Fatalf("expected credentials-unavailable, got %v", reply)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+				p := &Peer{conn: conn, config: &test.config}
+				if err := p.HandleCredentialsPacket(r.Context(), CredentialsRequestPacket{RequestID: "creds", Type: "credentials"}, nil); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			reply := map[string]any{}
+			if err := wsjson.Read(ctx, conn, &reply); err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, reply)
+		})
+	}
+}
+
+func TestCredentialsRequireAuth(t *testing.T) {
+	static := []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}}
+	tests := []struct {
+		name     string
+		require  bool
+		identity string
+		want     string
+	}{
+		{"authenticated", true, "player-1", "credentials"},
+		{"unauthenticated", true, "", "credentials-unauthenticated"},
+		{"not required", false, "", "credentials"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+				config := &Config{ICEServers: static, RequireAuthForCredentials: test.require}
+				p := &Peer{conn: conn, config: config, AuthIdentity: test.identity}
+				if err := p.HandleCredentialsPacket(r.Context(), CredentialsRequestPacket{RequestID: "creds", Type: "credentials"}, nil); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			reply := map[string]any{}
+			if err := wsjson.Read(ctx, conn, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply["type"] != test.want && reply["code"] != test.want {
+				t.Fatalf("expected %s, got %v", test.want, reply)
+			}
+			// Clients match the reply to their request, errors included.
+			if reply["rid"] != "creds" {
+				t.Fatalf("expected the request ID to be echoed, got %v", reply)
+			}
+			if servers, _ := reply["iceServers"].([]any); test.want == "credentials" && len(servers) != 1 {
+				t.Fatalf("expected the static server, got %v", reply)
+			}
+		})
+	}
+}
+
+func TestCredentialsServerTime(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{conn: conn, config: &Config{ICEServers: []ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}}}}
+		for i := 0; i < 2; i++ {
+			if err := p.HandleCredentialsPacket(r.Context(), CredentialsRequestPacket{Type: "credentials"}, nil); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	before := time.Now().UnixMilli()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	var previous int64
+	for i := 0; i < 2; i++ {
+		reply := CredentialsPacket{}
+		if err := wsjson.Read(ctx, conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.ServerTime < before || reply.ServerTime > time.Now().UnixMilli() {
+			t.Fatalf("expected the time of the server, got %d", reply.ServerTime)
+		}
+		if reply.ServerTime < previous {
+			t.Fatalf("expected the server time to never go back, got %d after %d", reply.ServerTime, previous)
+		}
+		previous = reply.ServerTime
+	}
+}
+
+// failingLimiter can't reach its store.
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(context.Context) (int, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestCredentialsRateLimit(t *testing.T) {
+	static := []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}}
+	tests := []struct {
+		name    string
+		limiter ratelimit.Limiter
+		want    []string
+	}{
+		{"within the limit", ratelimit.NewMemory(2, time.Hour), []string{"credentials", "credentials"}},
+		{"over the limit", ratelimit.NewMemory(1, time.Hour), []string{"credentials", "rate-limited"}},
+		{"failing limiter", failingLimiter{}, []string{"credentials", "credentials"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+				p := &Peer{conn: conn, config: &Config{ICEServers: static, CredentialsLimiter: test.limiter}}
+				for i := range test.want {
+					packet := CredentialsRequestPacket{RequestID: strconv.Itoa(i), Type: "credentials"}
+					if err := p.HandleCredentialsPacket(r.Context(), packet, nil); err != nil {
+						t.Error(err)
+					}
+				}
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			for i, want := range test.want {
+				reply := map[string]any{}
+				if err := wsjson.Read(ctx, conn, &reply); err != nil {
+					t.Fatal(err)
+				}
+				if reply["type"] != want && reply["code"] != want {
+					t.Fatalf("expected %s, got %v", want, reply)
+				}
+				// The rejection has to reach the request it belongs to.
+				if reply["rid"] != strconv.Itoa(i) {
+					t.Fatalf("expected the reply to request %d, got %v", i, reply)
+				}
+			}
+		})
+	}
+}
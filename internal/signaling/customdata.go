@@ -0,0 +1,109 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// MaxCustomDataSize bounds the custom data of a lobby, it's sent with every
+// lobby in a list so it's meant for a few fields like the map or game mode.
+const MaxCustomDataSize = 4096
+
+// UpdateCustomDataPacket changes the custom data of the lobby with a JSON merge
+// patch (RFC 7396), only the leader can send it.
+type UpdateCustomDataPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Patch map[string]any `json:"patch"`
+}
+
+// CustomDataChangedPacket is sent to all members of the lobby when the custom
+// data changed. It only holds the patch, a member that didn't see every
+// version before Version has missed a change and should send a
+// GetCustomDataPacket to resync.
+type CustomDataChangedPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby   string         `json:"lobby"`
+	Version int64          `json:"version"`
+	Patch   map[string]any `json:"patch"`
+}
+
+type GetCustomDataPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+// CustomDataPacket is the full custom data of the lobby at Version.
+type CustomDataPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby      string         `json:"lobby"`
+	Version    int64          `json:"version"`
+	CustomData map[string]any `json:"customData"`
+}
+
+func (p *Peer) HandleUpdateCustomDataPacket(ctx context.Context, packet UpdateCustomDataPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	version, others, err := p.store.UpdateLobbyCustomData(ctx, p.Game, p.Lobby, p.ID, packet.Patch, MaxCustomDataSize)
+	if errors.Is(err, stores.ErrNotLeader) || errors.Is(err, stores.ErrCustomDataTooLarge) || errors.Is(err, stores.ErrNotFound) {
+		metrics.Inc("netlib_custom_data_rejections_total")
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logger.Debug("lobby custom data updated",
+		zap.String("game", p.Game),
+		zap.String("lobby", p.Lobby),
+		zap.Int64("version", version))
+
+	changed := CustomDataChangedPacket{
+		Type:    "custom-data-changed",
+		Lobby:   p.Lobby,
+		Version: version,
+		Patch:   packet.Patch,
+	}
+	if err := p.broadcast(ctx, others, changed); err != nil {
+		return err
+	}
+	changed.RequestID = packet.RequestID
+	return p.Send(ctx, changed)
+}
+
+func (p *Peer) HandleGetCustomDataPacket(ctx context.Context, packet GetCustomDataPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+	data, version, err := p.store.GetLobbyCustomData(ctx, p.Game, p.Lobby)
+	if err != nil {
+		return err
+	}
+	return p.Send(ctx, CustomDataPacket{
+		RequestID:  packet.RequestID,
+		Type:       "custom-data",
+		Lobby:      p.Lobby,
+		Version:    version,
+		CustomData: data,
+	})
+}
@@ -0,0 +1,183 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+)
+
+// customDataStore keeps the custom data of a single lobby led by peerA with
+// peerB as its other member.
+type customDataStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	data      map[string]any
+	version   int64
+	published [][]byte
+}
+
+func (s *customDataStore) UpdateLobbyCustomData(ctx context.Context, game, lobby, id string, patch map[string]any, maxSize int) (int64, []string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id != "peerA" {
+		return 0, nil, stores.ErrNotLeader
+	}
+	s.data = stores.ApplyMergePatch(s.data, patch)
+	s.version++
+	return s.version, []string{"peerA", "peerB"}, nil
+}
+
+func (s *customDataStore) GetLobbyCustomData(context.Context, string, string) (map[string]any, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, _ := json.Marshal(s.data)
+	var copied map[string]any
+	_ = json.Unmarshal(data, &copied)
+	return copied, s.version, nil
+}
+
+func (s *customDataStore) Publish(ctx context.Context, topic string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.published = append(s.published, data)
+	return nil
+}
+
+// customDataMirror is how a client keeps its copy of the custom data.
+type customDataMirror struct {
+	data    map[string]any
+	version int64
+}
+
+// apply applies a change, it returns false when a version was missed and the
+// client has to resync.
+func (m *customDataMirror) apply(changed CustomDataChangedPacket) bool {
+	if changed.Version != m.version+1 {
+		return false
+	}
+	m.data = stores.ApplyMergePatch(m.data, changed.Patch)
+	m.version = changed.Version
+	return true
+}
+
+func (m *customDataMirror) resync(snapshot CustomDataPacket) {
+	m.data = snapshot.CustomData
+	m.version = snapshot.Version
+}
+
+func TestCustomDataDeltas(t *testing.T) {
+	store := &customDataStore{}
+	patches := []map[string]any{
+		{"map": "desert", "mode": "ffa", "rules": map[string]any{"time": 60.0}},
+		{"rules": map[string]any{"time": 90.0}},
+		{"mode": nil},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		leader := &Peer{store: store, conn: conn, config: &Config{}, ID: "peerA", Game: "game", Lobby: "lobby"}
+		member := &Peer{store: store, conn: conn, config: &Config{}, ID: "peerB", Game: "game", Lobby: "lobby"}
+		if err := member.HandleUpdateCustomDataPacket(ctx, UpdateCustomDataPacket{RequestID: "denied", Patch: patches[0]}); err != nil {
+			t.Error(err)
+		}
+		for _, patch := range patches {
+			if err := leader.HandleUpdateCustomDataPacket(ctx, UpdateCustomDataPacket{Patch: patch}); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := member.HandleGetCustomDataPacket(ctx, GetCustomDataPacket{RequestID: "resync"}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	var snapshot CustomDataPacket
+	rejected := false
+	for snapshot.Type != "custom-data" {
+		_, raw, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var packet struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			t.Fatal(err)
+		}
+		switch packet.Type {
+		case "error":
+			rejected = rejected || packet.Code == "not-leader"
+		case "custom-data":
+			if err := json.Unmarshal(raw, &snapshot); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !rejected {
+		t.Fatal("expected the update of a member to be rejected")
+	}
+	if snapshot.Version != 3 {
+		t.Fatalf("expected version 3, got %d", snapshot.Version)
+	}
+
+	// The other member only receives the patches.
+	var deltas []CustomDataChangedPacket
+	for _, raw := range store.published {
+		var changed CustomDataChangedPacket
+		if err := json.Unmarshal(raw, &changed); err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, changed)
+	}
+	if len(deltas) != 3 || len(deltas[1].Patch) != 1 {
+		t.Fatalf("unexpected deltas %+v", deltas)
+	}
+
+	complete := &customDataMirror{}
+	for _, changed := range deltas {
+		if !complete.apply(changed) {
+			t.Fatalf("unexpected gap at version %d", changed.Version)
+		}
+	}
+	if !reflect.DeepEqual(complete.data, snapshot.CustomData) {
+		t.Fatalf("deltas resulted in %v, expected %v", complete.data, snapshot.CustomData)
+	}
+
+	// A member that missed the second change notices at the third and resyncs.
+	behind := &customDataMirror{}
+	if !behind.apply(deltas[0]) {
+		t.Fatal("unexpected gap at the first version")
+	}
+	if behind.apply(deltas[2]) {
+		t.Fatal("expected a gap to be detected")
+	}
+	if behind.version != 1 || behind.data["mode"] != "ffa" {
+		t.Fatalf("a change past a gap must not be applied, got %v", behind.data)
+	}
+	behind.resync(snapshot)
+	if !reflect.DeepEqual(behind.data, complete.data) || behind.version != complete.version {
+		t.Fatalf("resync resulted in %v, expected %v", behind.data, complete.data)
+	}
+}
@@ -0,0 +1,96 @@
+package signaling
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+// DictionaryCapability lets clients receive packets compressed with a preset
+// dictionary of common signaling strings. Stock permessage-deflate starts
+// every message with an empty window so the SDP boilerplate repeated in every
+// offer and answer is barely compressed, see BenchmarkDictionaryCompression.
+//
+// Compressed packets are sent as binary messages holding raw DEFLATE data,
+// text messages are still plain JSON. Clients may send compressed packets
+// the same way.
+const DictionaryCapability = "deflate-dict"
+
+// maxInflatedSize bounds the size of a decompressed packet.
+const maxInflatedSize = 256 * 1024
+
+var ErrInflatedTooLarge = util.NewError("packet-too-large", "decompressed packet too large")
+
+// dictionaryV1 holds strings common in signaling packets of protocol version
+// 1. DEFLATE favours matches close to the end of the dictionary, so the most
+// common strings are last. It must never change once released, a changed
+// dictionary needs a new protocol version.
+const dictionaryV1 = `a=extmap:1 urn:ietf:params:rtp-hdrext:sdes:mid` +
+	"\r\na=sctp-port:5000\r\na=max-message-size:262144\r\n" +
+	"a=group:BUNDLE 0\r\na=extmap-allow-mixed\r\na=msid-semantic: WMS\r\n" +
+	"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\nc=IN IP4 0.0.0.0\r\n" +
+	"a=ice-options:trickle\r\na=fingerprint:sha-256 \r\na=setup:actpass\r\na=setup:active\r\na=mid:0\r\n" +
+	"v=0\r\no=- 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=ice-ufrag:\r\na=ice-pwd:\r\n" +
+	` generation 0 ufrag  network-id  network-cost 10","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"` +
+	` typ host tcptype passive typ srflx raddr 0.0.0.0 rport 0 typ relay raddr ` +
+	`{"type":"candidate","source":"","recipient":"","candidate":{"candidate":"candidate: 1 udp 2 1 tcp ` +
+	`{"type":"description","source":"","recipient":"","description":{"type":"offer","sdp":"v=0\r\no=- `
+
+// compressionDictionaries are the dictionaries per protocol version, clients
+// on versions without a dictionary fall back to stock compression.
+var compressionDictionaries = map[int]*dictionary{
+	1: newDictionary([]byte(dictionaryV1)),
+}
+
+type dictionary struct {
+	data    []byte
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func newDictionary(data []byte) *dictionary {
+	d := &dictionary{data: data}
+	d.writers.New = func() any {
+		w, _ := flate.NewWriterDict(nil, flate.BestSpeed, d.data)
+		return w
+	}
+	d.readers.New = func() any {
+		return flate.NewReaderDict(nil, d.data)
+	}
+	return d
+}
+
+// Compress returns the raw DEFLATE data of raw using the dictionary.
+func (d *dictionary) Compress(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := d.writers.Get().(*flate.Writer)
+	defer d.writers.Put(w)
+	w.Reset(&buf) // Reset keeps the dictionary.
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress inflates data compressed with the dictionary.
+func (d *dictionary) Decompress(data []byte) ([]byte, error) {
+	r := d.readers.Get().(io.ReadCloser)
+	defer d.readers.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), d.data); err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(io.LimitReader(r, maxInflatedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxInflatedSize {
+		return nil, ErrInflatedTooLarge
+	}
+	return raw, nil
+}
@@ -0,0 +1,82 @@
+package signaling
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+// testOffer is a typical description packet as sent by Chrome.
+var testOffer = []byte(`{"type":"description","source":"c3k9f7s2","recipient":"b1p0q8z4","description":{"type":"offer","sdp":"v=0\r\no=- 4611731400430051336 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=group:BUNDLE 0\r\na=extmap-allow-mixed\r\na=msid-semantic: WMS\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\nc=IN IP4 0.0.0.0\r\na=ice-ufrag:7UaD\r\na=ice-pwd:pGVkZOwh3CJGZp5qW1KZ9xSb\r\na=ice-options:trickle\r\na=fingerprint:sha-256 5B:3F:9D:43:2C:8E:AA:71:F0:0C:6D:16:3A:D4:9E:2B:47:91:C5:0E:DB:19:62:8A:3F:7E:05:CC:B1:4D:2A:90\r\na=setup:actpass\r\na=mid:0\r\na=sctp-port:5000\r\na=max-message-size:262144\r\n"}}`)
+
+var testCandidate = []byte(`{"type":"candidate","source":"c3k9f7s2","recipient":"b1p0q8z4","candidate":{"candidate":"candidate:842163049 1 udp 1677729535 203.0.113.7 55066 typ srflx raddr 0.0.0.0 rport 0 generation 0 ufrag 7UaD network-cost 999","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"7UaD"}}`)
+
+func stockCompress(t testing.TB, raw []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	if _, err := w.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDictionaryRoundTrip(t *testing.T) {
+	d := compressionDictionaries[ProtocolVersion]
+	for _, packet := range [][]byte{testOffer, testCandidate} {
+		compressed, err := d.Compress(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stock := stockCompress(t, packet); len(compressed) >= len(stock) {
+			t.Errorf("dictionary doesn't beat stock compression: %d >= %d bytes", len(compressed), len(stock))
+		}
+		raw, err := d.Decompress(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, packet) {
+			t.Fatalf("round trip changed the packet: %s", raw)
+		}
+	}
+}
+
+func TestDictionaryDecompressLimit(t *testing.T) {
+	d := compressionDictionaries[ProtocolVersion]
+	bomb, err := d.Compress(make([]byte, maxInflatedSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decompress(bomb); err != ErrInflatedTooLarge {
+		t.Fatalf("expected ErrInflatedTooLarge, got %v", err)
+	}
+}
+
+func BenchmarkDictionaryCompression(b *testing.B) {
+	d := compressionDictionaries[ProtocolVersion]
+	for _, bench := range []struct {
+		name   string
+		packet []byte
+	}{{"offer", testOffer}, {"candidate", testCandidate}} {
+		b.Run(bench.name+"/stock", func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = len(stockCompress(b, bench.packet))
+			}
+			b.ReportMetric(float64(size)/float64(len(bench.packet)), "ratio")
+		})
+		b.Run(bench.name+"/dictionary", func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				compressed, err := d.Compress(bench.packet)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(compressed)
+			}
+			b.ReportMetric(float64(size)/float64(len(bench.packet)), "ratio")
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package signaling
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// DrainFilter selects the connections of this node to drain, all set
+// conditions have to match. The zero value drains every connection.
+type DrainFilter struct {
+	// Game only drains peers of this game.
+	Game string
+	// Lobbies only drains the members of these lobbies.
+	Lobbies []string
+	// MembersBelow only drains lobbies with fewer members (on all nodes),
+	// e.g. 2 to clean up lobbies with a single peer before scaling in.
+	MembersBelow int
+	// MinAge only drains connections that have been open at least this long.
+	MinAge time.Duration
+}
+
+// DrainPacket tells a client to reconnect, to another node behind the load
+// balancer, after waiting retryAfter milliseconds.
+type DrainPacket struct {
+	Type string `json:"type"`
+
+	RetryAfter int64 `json:"retryAfter"`
+}
+
+// Drainer closes selected connections of this node so their clients
+// reconnect elsewhere, see Handler.
+type Drainer struct {
+	store    stores.Store
+	registry *peerRegistry
+}
+
+// Drain disconnects the connections matching filter. The clients are told to
+// reconnect after a random delay of up to retryAfter so they don't all arrive
+// at once, their lobby membership is kept for the usual reconnect window.
+// Whole lobbies are selected so lobbies are kept together where possible.
+func (d *Drainer) Drain(ctx context.Context, filter DrainFilter, retryAfter time.Duration) (int, error) {
+	logger := logging.GetLogger(ctx)
+
+	lobbies := make(map[string]struct{}, len(filter.Lobbies))
+	for _, lobby := range filter.Lobbies {
+		lobbies[lobby] = struct{}{}
+	}
+	counts := make(map[string]int)
+
+	now := time.Now()
+	drained := 0
+	for _, c := range d.registry.Connections() {
+		if filter.Game != "" && c.game != filter.Game {
+			continue
+		}
+		if filter.MinAge > 0 && now.Sub(c.connectedAt) < filter.MinAge {
+			continue
+		}
+		if len(lobbies) > 0 || filter.MembersBelow > 0 {
+			if c.lobby == "" {
+				continue
+			}
+			if _, found := lobbies[c.lobby]; len(lobbies) > 0 && !found {
+				continue
+			}
+		}
+		if filter.MembersBelow > 0 {
+			key := c.game + c.lobby
+			count, found := counts[key]
+			if !found {
+				players, spectators, err := d.store.MemberCount(ctx, c.game, c.lobby)
+				if err != nil {
+					return drained, err
+				}
+				count = players + spectators
+				counts[key] = count
+			}
+			if count >= filter.MembersBelow {
+				continue
+			}
+		}
+
+		d.drain(c.peer, retryAfter)
+		drained++
+	}
+
+	logger.Info("drained connections", zap.Int("drained", drained), zap.Any("filter", filter))
+	metrics.Add("netlib_drained_connections_total", float64(drained))
+	return drained, nil
+}
+
+func (d *Drainer) drain(p *Peer, retryAfter time.Duration) {
+	var delay int64
+	if retryAfter > 0 {
+		delay = rand.Int63n(retryAfter.Milliseconds() + 1)
+	}
+	// Closing without a close packet keeps the peer in its lobby until it
+	// reconnects or the disconnect threshold passes.
+	p.draining.Store(true)
+	closeConn := func(error) {
+		go p.conn.Close(websocket.StatusGoingAway, "draining") //nolint:errcheck
+	}
+	if !p.Enqueue(DrainPacket{Type: "drain", RetryAfter: delay}, closeConn) {
+		closeConn(nil)
+	}
+}
@@ -0,0 +1,29 @@
+package signaling
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxEdgeLength bounds the edge so a bogus header can't blow up the logs and
+// events with long values, metrics only label Config.MetricEdges.
+const maxEdgeLength = 32
+
+// edgeFromRequest returns the CDN edge the request came through. For CF-Ray
+// only the datacenter suffix (e.g. "AMS" of "7a1b2c3d4e5f6a7b-AMS") is used,
+// the ray ID itself is unique per request.
+func edgeFromRequest(r *http.Request, header string) string {
+	if header == "" {
+		return ""
+	}
+	edge := strings.TrimSpace(r.Header.Get(header))
+	if strings.EqualFold(header, "CF-Ray") {
+		if i := strings.LastIndexByte(edge, '-'); i >= 0 {
+			edge = edge[i+1:]
+		}
+	}
+	if len(edge) > maxEdgeLength {
+		edge = edge[:maxEdgeLength]
+	}
+	return edge
+}
@@ -0,0 +1,31 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidEvent = util.NewError("invalid-event", "invalid event params")
+
+// HandleEventPacket records an analytics event. Analytics are best effort,
+// so an event that doesn't fit metrics.EventParams (e.g. a number in data) is
+// counted and dropped instead of ending the connection. The client only gets
+// an error when Config.ReplyInvalidEvents is set.
+func (p *Peer) HandleEventPacket(ctx context.Context, raw []byte) {
+	params := metrics.EventParams{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("dropping invalid event", zap.String("peer", p.ID), zap.Error(err))
+		metrics.Inc("netlib_invalid_events_total")
+		if p.config.ReplyInvalidEvents {
+			p.ReplyError(ctx, "", ErrInvalidEvent)
+		}
+		return
+	}
+	metrics.RecordEvent(ctx, params)
+}
@@ -0,0 +1,66 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+// invalidEvent has a number in data, which only holds strings.
+var invalidEvent = []byte(`{"type":"event","category":"game","action":"score","data":{"score":12}}`)
+
+func TestInvalidEventIsIgnored(t *testing.T) {
+	p := &Peer{config: &Config{}}
+	p.HandleEventPacket(context.Background(), invalidEvent)
+	if p.replyErr != nil {
+		t.Fatalf("expected the event to be dropped silently, got %v", p.replyErr)
+	}
+}
+
+func TestInvalidEventKeepsConnection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p := &Peer{conn: conn, config: &Config{ReplyInvalidEvents: true}}
+		p.HandleEventPacket(r.Context(), invalidEvent)
+		if err := conn.Write(r.Context(), websocket.MessageText, []byte(`{"type":"pong"}`)); err != nil {
+			t.Error(err)
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	_, raw, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := struct {
+		Type string
+		Code string
+	}{}
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.Code != "invalid-event" {
+		t.Fatalf("expected an invalid-event error, got %s", raw)
+	}
+	// The connection is still usable after the error.
+	if _, raw, err = conn.Read(ctx); err != nil || !strings.Contains(string(raw), "pong") {
+		t.Fatalf("expected the connection to survive, got %s (%v)", raw, err)
+	}
+}
@@ -0,0 +1,30 @@
+package signaling
+
+import (
+	"context"
+	"time"
+)
+
+// ConnectionExpiringPacket tells a client its connection is closed in
+// ExpiresIn milliseconds because of Config.MaxConnectionTime, so it can open a
+// new connection and reconnect as the same peer before that happens.
+type ConnectionExpiringPacket struct {
+	Type string `json:"type"`
+
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// warnBeforeExpiry calls warn lead before deadline, right away when that's
+// already passed. Nothing is sent when ctx is done before then.
+func warnBeforeExpiry(ctx context.Context, deadline time.Time, lead time.Duration, warn func(context.Context, time.Duration) error, onError func(error)) {
+	timer := time.NewTimer(time.Until(deadline.Add(-lead)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+	if err := warn(ctx, time.Until(deadline)); err != nil && ctx.Err() == nil {
+		onError(err)
+	}
+}
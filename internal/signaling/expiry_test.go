@@ -0,0 +1,47 @@
+package signaling
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWarnBeforeExpiry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	warned := make(chan time.Duration, 1)
+	go warnBeforeExpiry(ctx, deadline, 100*time.Millisecond, func(ctx context.Context, expiresIn time.Duration) error {
+		if ctx.Err() != nil {
+			t.Error("expected the warning before the connection is closed")
+		}
+		warned <- expiresIn
+		return nil
+	}, func(err error) {
+		t.Error(err)
+	})
+
+	select {
+	case expiresIn := <-warned:
+		if expiresIn <= 0 || expiresIn > 100*time.Millisecond {
+			t.Fatalf("expected the warning about 100ms before the deadline, got %v", expiresIn)
+		}
+	case <-ctx.Done():
+		t.Fatal("connection closed without a warning")
+	}
+}
+
+func TestWarnBeforeExpiryClosedEarly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		warnBeforeExpiry(ctx, time.Now().Add(time.Hour), time.Minute, func(context.Context, time.Duration) error {
+			t.Error("expected no warning for a connection closed early")
+			return nil
+		}, func(error) {})
+		close(done)
+	}()
+	cancel()
+	<-done
+}
@@ -0,0 +1,148 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrFeatureDisabled = util.NewError("feature-disabled", "feature is disabled for this game")
+
+// The features that can be turned off per game, all are enabled unless a
+// flag disables them.
+const (
+	// FeatureRelay hands out TURN relay servers with the credentials packet,
+	// without it the packet only has the static ICE servers.
+	FeatureRelay       = "relay"
+	FeatureAutoStart   = "auto-start"
+	FeatureMatchmaking = "matchmaking"
+	FeatureInvites     = "invites"
+	FeatureKV          = "kv"
+	FeatureCustomData  = "custom-data"
+	FeatureMembers     = "members"
+	FeatureReady       = "ready"
+	FeatureSwitchLobby = "switch-lobby"
+	FeaturePresence    = "presence"
+)
+
+var knownFeatures = map[string]struct{}{
+	FeatureRelay:       {},
+	FeatureAutoStart:   {},
+	FeatureMatchmaking: {},
+	FeatureInvites:     {},
+	FeatureKV:          {},
+	FeatureCustomData:  {},
+	FeatureMembers:     {},
+	FeatureReady:       {},
+	FeatureSwitchLobby: {},
+	FeaturePresence:    {},
+}
+
+// packetFeatures are the features a packet type belongs to. Features that are
+// an option of a packet, like FeatureAutoStart, are checked by its handler.
+var packetFeatures = map[string]string{
+	"matchmake":          FeatureMatchmaking,
+	"matchmaking-ticket": FeatureMatchmaking,
+	"cancel-ticket":      FeatureMatchmaking,
+	"create-invite":      FeatureInvites,
+	"kv-set":             FeatureKV,
+	"kv-cas":             FeatureKV,
+	"kv-increment":       FeatureKV,
+	"kv-get":             FeatureKV,
+	"update-custom-data": FeatureCustomData,
+	"get-custom-data":    FeatureCustomData,
+	"subscribe-members":  FeatureMembers,
+	"set-ready":          FeatureReady,
+	"reset-ready":        FeatureReady,
+	"switch-lobby":       FeatureSwitchLobby,
+	"subscribe-presence": FeaturePresence,
+}
+
+// FeatureFlags turn features on or off. A flag of the game in Games takes
+// precedence over the flag in Defaults, features without either are enabled.
+type FeatureFlags struct {
+	Defaults map[string]bool            `json:"defaults"`
+	Games    map[string]map[string]bool `json:"games"`
+}
+
+func (f *FeatureFlags) validate() error {
+	for feature := range f.Defaults {
+		if _, ok := knownFeatures[feature]; !ok {
+			return fmt.Errorf("unknown feature %q", feature)
+		}
+	}
+	for game, flags := range f.Games {
+		for feature := range flags {
+			if _, ok := knownFeatures[feature]; !ok {
+				return fmt.Errorf("unknown feature %q for game %s", feature, game)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FeatureFlags) enabled(game, feature string) bool {
+	if enabled, ok := f.Games[game][feature]; ok {
+		return enabled
+	}
+	if enabled, ok := f.Defaults[feature]; ok {
+		return enabled
+	}
+	return true
+}
+
+// LoadFeatureFlags reads the FeatureFlags from a JSON file, unknown features
+// are an error so a typo doesn't go unnoticed.
+func LoadFeatureFlags(file string) (FeatureFlags, error) {
+	flags := FeatureFlags{}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return flags, err
+	}
+	if err := json.Unmarshal(raw, &flags); err != nil {
+		return flags, err
+	}
+	return flags, flags.validate()
+}
+
+// Features holds the FeatureFlags in effect, they can be replaced while the
+// server runs. A nil *Features enables everything.
+type Features struct {
+	flags atomic.Pointer[FeatureFlags]
+}
+
+func NewFeatures(flags FeatureFlags) (*Features, error) {
+	f := &Features{}
+	return f, f.Set(flags)
+}
+
+// Set replaces the flags, packets already being handled use the old ones.
+func (f *Features) Set(flags FeatureFlags) error {
+	if err := flags.validate(); err != nil {
+		return err
+	}
+	f.flags.Store(&flags)
+	return nil
+}
+
+// Enabled reports whether feature is enabled for game.
+func (f *Features) Enabled(game, feature string) bool {
+	if f == nil {
+		return true
+	}
+	flags := f.flags.Load()
+	return flags == nil || flags.enabled(game, feature)
+}
+
+// packetDisabled returns the feature of the packet type when it's disabled
+// for game.
+func (f *Features) packetDisabled(game, typ string) (string, bool) {
+	feature, ok := packetFeatures[typ]
+	if !ok || f.Enabled(game, feature) {
+		return "", false
+	}
+	return feature, true
+}
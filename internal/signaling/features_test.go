@@ -0,0 +1,132 @@
+package signaling
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestFeatureFlagsResolution(t *testing.T) {
+	features, err := NewFeatures(FeatureFlags{
+		Defaults: map[string]bool{FeatureRelay: false, FeatureKV: false},
+		Games: map[string]map[string]bool{
+			"a": {FeatureRelay: true},
+			"b": {FeatureMatchmaking: false},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		game, feature string
+		enabled       bool
+	}{
+		{"a", FeatureRelay, true},        // the game overrides the default
+		{"b", FeatureRelay, false},       // the default
+		{"a", FeatureKV, false},          // the default without an override
+		{"b", FeatureMatchmaking, false}, // only for this game
+		{"a", FeatureMatchmaking, true},  // without any flag
+	} {
+		if got := features.Enabled(tc.game, tc.feature); got != tc.enabled {
+			t.Errorf("expected %s enabled=%v for %s, got %v", tc.feature, tc.enabled, tc.game, got)
+		}
+	}
+
+	if err := features.Set(FeatureFlags{Defaults: map[string]bool{"relays": false}}); err == nil {
+		t.Fatal("expected an unknown feature to be rejected")
+	}
+	if !features.Enabled("a", FeatureRelay) {
+		t.Fatal("expected the flags to be kept after a failed update")
+	}
+	if err := features.Set(FeatureFlags{}); err != nil {
+		t.Fatal(err)
+	}
+	if !features.Enabled("b", FeatureKV) {
+		t.Fatal("expected the updated flags to enable everything")
+	}
+
+	var none *Features
+	if !none.Enabled("a", FeatureRelay) {
+		t.Fatal("expected no flags to enable everything")
+	}
+}
+
+func TestLoadFeatureFlags(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "flags.json")
+	if err := os.WriteFile(file, []byte(`{"games": {"a": {"auto-start": false}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := LoadFeatureFlags(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.enabled("a", FeatureAutoStart) || !flags.enabled("b", FeatureAutoStart) {
+		t.Fatalf("unexpected flags %+v", flags)
+	}
+}
+
+func TestFeatureDisabledPacketRejected(t *testing.T) {
+	const gameA = "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+	const gameB = "9e8e5c41-3c2f-4b52-9d0f-1f0b5c7b6a11"
+	ctx := context.Background()
+	features, err := NewFeatures(FeatureFlags{
+		Games: map[string]map[string]bool{gameA: {FeatureRelay: false}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	_, handler, _ := Handler(ctx, store, nil, Config{Features: features})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	stun := []ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}}
+	_, stunHandler, _ := Handler(ctx, store, nil, Config{Features: features, ICEServers: stun})
+	stunServer := httptest.NewServer(stunHandler)
+	defer stunServer.Close()
+
+	requestCredentials := func(server *httptest.Server, game string) map[string]any {
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		readServerInfo(ctx, t, conn)
+		if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: game}); err != nil {
+			t.Fatal(err)
+		}
+		welcome := WelcomePacket{}
+		if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+			t.Fatal(err)
+		}
+		if err := wsjson.Write(ctx, conn, CredentialsRequestPacket{RequestID: "creds", Type: "credentials"}); err != nil {
+			t.Fatal(err)
+		}
+		reply := map[string]any{}
+		if err := wsjson.Read(ctx, conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	reply := requestCredentials(server, gameA)
+	params, _ := reply["params"].(map[string]any)
+	if reply["rid"] != "creds" || reply["code"] != "feature-disabled" || params["feature"] != FeatureRelay {
+		t.Fatalf("expected relay to be disabled for game A, got %v", reply)
+	}
+	if reply := requestCredentials(server, gameB); reply["rid"] != "creds" || reply["code"] != "credentials-unavailable" {
+		t.Fatalf("expected game B to get past the feature flag, got %v", reply)
+	}
+
+	// Without relay the static servers are still handed out.
+	reply = requestCredentials(stunServer, gameA)
+	servers, _ := reply["iceServers"].([]any)
+	if reply["type"] != "credentials" || len(servers) != 1 {
+		t.Fatalf("expected the static servers for game A, got %v", reply)
+	}
+}
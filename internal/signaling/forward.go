@@ -0,0 +1,126 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidRecipients = util.NewError("invalid-recipients", "recipients must be other members of the lobby")
+
+// resolveRecipients returns the peers a signaling packet is forwarded to: its
+// recipient, its recipient list or all others for the broadcast flag. Every
+// recipient has to be another member of the lobby, otherwise nothing is
+// forwarded.
+func resolveRecipients(self string, members []string, routing ForwardablePacket) ([]string, error) {
+	if routing.Broadcast && (routing.Recipient != "" || len(routing.Recipients) > 0) {
+		return nil, ErrInvalidRecipients.WithParams("reason", "broadcast with recipients")
+	}
+	if routing.Recipient != "" && len(routing.Recipients) > 0 {
+		return nil, ErrInvalidRecipients.WithParams("reason", "recipient with recipients")
+	}
+
+	inLobby := make(map[string]bool, len(members))
+	for _, id := range members {
+		inLobby[id] = true
+	}
+	if !inLobby[self] {
+		return nil, stores.ErrNotInLobby
+	}
+
+	if routing.Broadcast {
+		recipients := make([]string, 0, len(members))
+		for _, id := range members {
+			if id != self {
+				recipients = append(recipients, id)
+			}
+		}
+		return recipients, nil
+	}
+
+	ids := routing.Recipients
+	if len(ids) == 0 {
+		ids = []string{routing.Recipient}
+	}
+	recipients := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	var invalid []string
+	for _, id := range ids {
+		if id == self || !inLobby[id] {
+			invalid = append(invalid, id)
+		} else if !seen[id] {
+			seen[id] = true
+			recipients = append(recipients, id)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, ErrInvalidRecipients.WithParams("recipients", invalid)
+	}
+	return recipients, nil
+}
+
+// resolveRecipients resolves the recipients of a signaling packet against the
+// members of the lobby of the peer, see resolveRecipients. The peer gets an
+// error reply when they're invalid, nil recipients are returned then.
+func (p *Peer) resolveRecipients(ctx context.Context, typ string, routing ForwardablePacket) ([]string, error) {
+	if p.Lobby == "" {
+		p.ReplyError(ctx, "", stores.ErrNotInLobby)
+		return nil, nil
+	}
+	members, err := p.store.GetLobby(ctx, p.Game, p.Lobby)
+	if err == stores.ErrNotFound {
+		p.ReplyError(ctx, "", stores.ErrNotInLobby)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	recipients, err := resolveRecipients(p.ID, members, routing)
+	if err != nil {
+		metrics.Inc("netlib_forward_rejections_total", "type", typ)
+		p.ReplyError(ctx, "", err)
+		return nil, nil
+	}
+	return recipients, nil
+}
+
+// forwardToRecipients forwards raw to each peer of its recipient list, or
+// to all other members of the lobby when it's a broadcast. Every recipient
+// receives the packet with only itself as recipient.
+func (p *Peer) forwardToRecipients(ctx context.Context, typ string, routing ForwardablePacket, raw []byte) error {
+	logger := logging.GetLogger(ctx)
+	recipients, err := p.resolveRecipients(ctx, typ, routing)
+	if err != nil || recipients == nil {
+		return err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return fmt.Errorf("%w: %w", util.ErrProtocol, err)
+	}
+	delete(fields, "recipients")
+	delete(fields, "broadcast")
+	negotiation := p.negotiations != nil && isNegotiation(typ, raw)
+	forwarded := 0
+	for _, id := range recipients {
+		if negotiation && p.negotiationThrottled(ctx, id) {
+			continue
+		}
+		forwarded++
+		fields["recipient"], _ = json.Marshal(id)
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if err := p.store.Publish(ctx, p.Game+p.Lobby+id, data); err != nil {
+			logger.Error("failed to publish packet", zap.Error(err), zap.String("recipient", id))
+		}
+	}
+	metrics.Add("netlib_forwarded_packets_total", float64(forwarded), "type", typ)
+	return nil
+}
@@ -0,0 +1,112 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"nhooyr.io/websocket"
+)
+
+func TestResolveRecipients(t *testing.T) {
+	members := []string{"host", "b", "c", "d"}
+	tests := []struct {
+		name    string
+		self    string
+		routing ForwardablePacket
+		want    []string
+		err     error
+		invalid []string
+	}{
+		{"recipients", "host", ForwardablePacket{Recipients: []string{"b", "d"}}, []string{"b", "d"}, nil, nil},
+		{"duplicates", "host", ForwardablePacket{Recipients: []string{"b", "b"}}, []string{"b"}, nil, nil},
+		{"broadcast", "c", ForwardablePacket{Broadcast: true}, []string{"host", "b", "d"}, nil, nil},
+		{"other lobby", "host", ForwardablePacket{Recipients: []string{"b", "x"}}, nil, ErrInvalidRecipients, []string{"x"}},
+		{"self", "host", ForwardablePacket{Recipients: []string{"host"}}, nil, ErrInvalidRecipients, []string{"host"}},
+		{"sender not in lobby", "x", ForwardablePacket{Recipients: []string{"b"}}, nil, stores.ErrNotInLobby, nil},
+		{"sender not in lobby broadcast", "x", ForwardablePacket{Broadcast: true}, nil, stores.ErrNotInLobby, nil},
+		{"broadcast with recipients", "host", ForwardablePacket{Broadcast: true, Recipients: []string{"b"}}, nil, ErrInvalidRecipients, nil},
+		{"recipient with recipients", "host", ForwardablePacket{Recipient: "c", Recipients: []string{"b"}}, nil, ErrInvalidRecipients, nil},
+		{"recipient", "host", ForwardablePacket{Recipient: "c"}, []string{"c"}, nil, nil},
+		{"recipient in other lobby", "host", ForwardablePacket{Recipient: "x"}, nil, ErrInvalidRecipients, []string{"x"}},
+		{"no recipient", "host", ForwardablePacket{}, nil, ErrInvalidRecipients, []string{""}},
+		{"sender not in lobby recipient", "x", ForwardablePacket{Recipient: "b"}, nil, stores.ErrNotInLobby, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveRecipients(test.self, members, test.routing)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if !reflect.DeepEqual(got, test.want) && (len(got) > 0 || len(test.want) > 0) {
+				t.Fatalf("expected recipients %v, got %v", test.want, got)
+			}
+			if test.invalid != nil {
+				var coded *util.Error
+				if !errors.As(err, &coded) || !reflect.DeepEqual(coded.Params["recipients"], test.invalid) {
+					t.Fatalf("expected invalid recipients %v, got %v", test.invalid, err)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardToOtherLobby(t *testing.T) {
+	store := &publishStore{published: make(map[string]int)}
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{store: store, conn: conn, config: &Config{}, ID: "a", Game: "game", Lobby: "lobby"}
+		// x shares the prefix of the topics of another lobby, it mustn't
+		// reach the peer c of lobby "lobbyx".
+		for _, recipient := range []string{"x", "c"} {
+			raw := `{"type":"candidate","source":"a","recipient":"` + recipient + `","candidate":{"candidate":""}}`
+			if err := p.HandlePacket(r.Context(), "candidate", []byte(raw)); err != nil {
+				t.Error(err)
+			}
+		}
+		close(done)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	_, raw, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := struct {
+		Type   string
+		Code   string
+		Params map[string]any
+	}{}
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.Code != "invalid-recipients" {
+		t.Fatalf("expected an invalid-recipients error, got %s", raw)
+	}
+	<-done
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if len(store.published) != 1 || store.published["gamelobbyc"] != 1 {
+		t.Fatalf("expected only the member to get the candidate, got %v", store.published)
+	}
+}
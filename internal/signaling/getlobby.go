@@ -0,0 +1,91 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+)
+
+// MaxLobbyLookups is the number of get-lobby packets a client IP can send per
+// LobbyLookupWindow, enough for a join screen but too few to guess codes.
+const MaxLobbyLookups = 10
+const LobbyLookupWindow = time.Minute
+
+var ErrTooManyLookups = util.NewError("rate-limited", "too many lobby lookups")
+
+// lobbyLookups counts the get-lobby packets per client IP across connections,
+// so reconnecting doesn't reset the budget.
+type lobbyLookups struct {
+	mutex   sync.Mutex
+	windows map[string]lookupWindow
+}
+
+type lookupWindow struct {
+	start time.Time
+	count int
+}
+
+func newLobbyLookups() *lobbyLookups {
+	return &lobbyLookups{
+		windows: make(map[string]lookupWindow),
+	}
+}
+
+// allow counts a lookup by ip and reports whether it's within the budget, a
+// nil lobbyLookups allows everything.
+func (l *lobbyLookups) allow(ip string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	window, found := l.windows[ip]
+	if !found || now.Sub(window.start) > LobbyLookupWindow {
+		for other, w := range l.windows {
+			if now.Sub(w.start) > LobbyLookupWindow {
+				delete(l.windows, other)
+			}
+		}
+		window = lookupWindow{start: now}
+	}
+	window.count++
+	l.windows[ip] = window
+	return window.count <= MaxLobbyLookups
+}
+
+// HandleGetLobbyPacket returns the public state of a lobby so clients can
+// preview it before joining. Private lobbies aren't listed, but knowing their
+// code is enough to look them up, just like it's enough to join them.
+func (p *Peer) HandleGetLobbyPacket(ctx context.Context, packet GetLobbyPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	packet.Lobby = p.config.normalizeLobbyCode(packet.Lobby)
+	if len(packet.Lobby) > 20 {
+		return fmt.Errorf("lobby code too long")
+	}
+
+	if !p.lookups.allow(p.ip, util.Now(ctx)) {
+		p.ReplyError(ctx, packet.RequestID, ErrTooManyLookups.WithParams("max", MaxLobbyLookups, "window", LobbyLookupWindow.Seconds()))
+		return nil
+	}
+
+	lobby, err := p.store.GetLobbyInfo(ctx, p.Game, packet.Lobby)
+	if err == stores.ErrNotFound {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lobby.Password = "" // Never reveal the password, even if the store returned it.
+
+	return p.Send(ctx, LobbyInfoPacket{
+		RequestID: packet.RequestID,
+		Type:      "lobby-info",
+		Lobby:     *lobby,
+	})
+}
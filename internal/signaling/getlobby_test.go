@@ -0,0 +1,157 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// codeStore only knows the lobby 23AB.
+type codeStore struct {
+	stores.Store
+}
+
+func (s *codeStore) GetLobbyInfo(ctx context.Context, game, lobby string) (*stores.Lobby, error) {
+	if lobby != "23AB" {
+		return nil, stores.ErrNotFound
+	}
+	return &stores.Lobby{Code: lobby}, nil
+}
+
+func TestGetLobbyNormalizesCodes(t *testing.T) {
+	codes := []string{"23AB", "  23AB\t", "23ab", "z3a8", " Z3A8 "}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{store: &codeStore{}, conn: conn, config: &Config{}, ID: "peer", Game: "game"}
+		for i, code := range codes {
+			if err := p.HandleGetLobbyPacket(r.Context(), GetLobbyPacket{RequestID: strconv.Itoa(i), Lobby: code}); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	for _, code := range codes {
+		packet := LobbyInfoPacket{}
+		if err := wsjson.Read(ctx, conn, &packet); err != nil {
+			t.Fatal(err)
+		}
+		if packet.Type != "lobby-info" || packet.Lobby.Code != "23AB" {
+			t.Fatalf("expected %q to resolve to lobby 23AB, got %+v", code, packet)
+		}
+	}
+}
+
+// casesStore knows lobbies whose codes only differ in case.
+type casesStore struct {
+	stores.Store
+}
+
+func (s *casesStore) GetLobbyInfo(ctx context.Context, game, lobby string) (*stores.Lobby, error) {
+	switch lobby {
+	case "23AB", "k3f8z1a9q2xw", "K3f8Z1a9q2XW":
+		return &stores.Lobby{Code: lobby}, nil
+	}
+	return nil, stores.ErrNotFound
+}
+
+func TestGetLobbyCaseSensitiveCodes(t *testing.T) {
+	for _, test := range []struct {
+		caseSensitive bool
+		codes         map[string]string // What a code resolves to, empty if not found.
+	}{
+		{false, map[string]string{
+			"k3f8z1a9q2xw":   "k3f8z1a9q2xw",
+			"K3f8Z1a9q2XW":   "k3f8z1a9q2xw",
+			" K3F8Z1A9Q2XW ": "k3f8z1a9q2xw",
+			"z3a8":           "23AB",
+		}},
+		{true, map[string]string{
+			"k3f8z1a9q2xw":   "k3f8z1a9q2xw",
+			"K3f8Z1a9q2XW":   "K3f8Z1a9q2XW",
+			" K3F8Z1A9Q2XW ": "",
+			"z3a8":           "23AB",
+		}},
+	} {
+		codes := make([]string, 0, len(test.codes))
+		for code := range test.codes {
+			codes = append(codes, code)
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			p := &Peer{store: &casesStore{}, conn: conn, config: &Config{CaseSensitiveLobbyCodes: test.caseSensitive}, ID: "peer", Game: "game"}
+			for i, code := range codes {
+				if err := p.HandleGetLobbyPacket(r.Context(), GetLobbyPacket{RequestID: strconv.Itoa(i), Lobby: code}); err != nil {
+					t.Error(err)
+				}
+			}
+		}))
+
+		ctx := context.Background()
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, code := range codes {
+			packet := LobbyInfoPacket{}
+			if err := wsjson.Read(ctx, conn, &packet); err != nil {
+				t.Fatal(err)
+			}
+			want := test.codes[code]
+			if want == "" && packet.Type != "error" {
+				t.Fatalf("expected %q not to be found with case sensitive %v, got %+v", code, test.caseSensitive, packet)
+			} else if want != "" && (packet.Type != "lobby-info" || packet.Lobby.Code != want) {
+				t.Fatalf("expected %q to resolve to lobby %s with case sensitive %v, got %+v", code, want, test.caseSensitive, packet)
+			}
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+	}
+}
+
+func TestLobbyLookupsPerIP(t *testing.T) {
+	lookups := newLobbyLookups()
+	now := time.Now()
+	for i := 0; i < MaxLobbyLookups; i++ {
+		if !lookups.allow("10.0.0.1", now) {
+			t.Fatalf("expected lookup %d to be allowed", i)
+		}
+	}
+	// Peers share the budget of their IP, a new connection doesn't reset it.
+	if lookups.allow("10.0.0.1", now) {
+		t.Fatal("expected the lookups over the budget to be limited")
+	}
+	if !lookups.allow("10.0.0.2", now) {
+		t.Fatal("expected other IPs to have their own budget")
+	}
+	if !lookups.allow("10.0.0.1", now.Add(LobbyLookupWindow+time.Second)) {
+		t.Fatal("expected a new budget in the next window")
+	}
+	if _, found := lookups.windows["10.0.0.2"]; found {
+		t.Fatal("expected the expired window of the other IP to be dropped")
+	}
+}
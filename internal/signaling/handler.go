@@ -1,69 +1,249 @@
 package signaling
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/koenbollen/logging"
 	"github.com/poki/netlib/internal/cloudflare"
 	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/ratelimit"
 	"github.com/poki/netlib/internal/signaling/stores"
 	"github.com/poki/netlib/internal/util"
 	"go.uber.org/zap"
 	"nhooyr.io/websocket"
 )
 
+// MaxConnectionTime is the default of Config.MaxConnectionTime.
 const MaxConnectionTime = 1 * time.Hour
 
-func Handler(ctx context.Context, store stores.Store, cloudflare *cloudflare.CredentialsClient) (*sync.WaitGroup, http.HandlerFunc) {
+// Node is the state of the connections of this node for the admin endpoints.
+type Node struct {
+	Drainer *Drainer
+	// Candidates is nil unless Config.TallyCandidates is set.
+	Candidates *CandidateTally
+	Traffic    *LobbyTraffic
+
+	// id, endpoint and maxConnections are reported in the Load.
+	id             string
+	endpoint       string
+	maxConnections int
+
+	mutex       sync.RWMutex
+	closing     bool
+	connections *sync.WaitGroup
+	stopManager context.CancelFunc
+	managerDone chan struct{}
+}
+
+// Handler returns the websocket handler, the open connections to wait for on
+// shutdown and the Node. The TimeoutManager and Matcher keep running after ctx
+// is done so disconnecting peers are still handled, they're stopped by
+// Node.Shutdown.
+func Handler(ctx context.Context, store stores.Store, cloudflare *cloudflare.CredentialsClient, config Config) (*sync.WaitGroup, http.HandlerFunc, *Node) {
+	config.setDefaults()
 	manager := &TimeoutManager{
-		Store: store,
+		Store:   store,
+		Webhook: config.Webhook,
+
+		SeamlessWindow: config.SeamlessWindow,
+		ReapInterval:   config.ReapInterval,
+		ReapBatchSize:  config.ReapBatchSize,
+		ReuseCodes:     config.ReuseLobbyCodes,
+		EventRetention: config.EventRetention,
+
+		ClosedLobbyRetention: config.ClosedLobbyRetention,
+		MaxSessionLifetime:   config.MaxSessionLifetime,
+		MaxConnectionTime:    config.MaxConnectionTime,
+		MetricGames:          config.MetricGames,
 	}
-	go manager.Run(ctx)
+	matcher := &Matcher{
+		Store:       store,
+		SkillWindow: config.TicketSkillWindow,
+		WidenAfter:  config.TicketWidenAfter,
+
+		CaseSensitiveCodes: config.CaseSensitiveLobbyCodes,
+	}
+	managerCtx, stopManager := context.WithCancel(util.WithoutCancel(ctx))
+	managerDone := make(chan struct{})
+	go func() {
+		defer close(managerDone)
+		matched := make(chan struct{})
+		go func() {
+			defer close(matched)
+			matcher.Run(managerCtx)
+		}()
+		manager.Run(managerCtx)
+		<-matched
+	}()
+
+	peerStore := meteredStore{store}
+	quotas := newQuotaTracker(config.GameQuotas)
+	connections := newConnectionLimiter(&config)
+	fallbacks := newCompressionFallbacks()
+	lookups := newLobbyLookups()
+	stats := newStatsCache(StatsRefreshInterval)
+	readBuffers := newReadBuffers(&config)
+
+	registry := newPeerRegistry()
+	store.Subscribe(ctx, AnnouncementsTopic, deliverAnnouncements(registry))
 
 	wg := &sync.WaitGroup{}
+	node := &Node{
+		Drainer: &Drainer{store: store, registry: registry},
+		Traffic: NewLobbyTraffic(),
+
+		id:             config.NodeID,
+		endpoint:       config.NodeEndpoint,
+		maxConnections: config.MaxConnections,
+
+		connections: wg,
+		stopManager: stopManager,
+		managerDone: managerDone,
+	}
+	if config.TallyCandidates {
+		node.Candidates = NewCandidateTally(config.MaxConnectionTime)
+	}
+
 	return wg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			handlePreflight(w, r, &config)
+			return
+		}
+		if !node.enter() {
+			util.ErrorAndAbort(w, r, http.StatusServiceUnavailable, "shutting-down")
+		}
+		defer wg.Done()
+
 		ctx := r.Context()
 		logger := logging.GetLogger(ctx)
 		logger.Debug("upgrading connection")
 
-		ctx, cancel := context.WithTimeout(ctx, MaxConnectionTime)
+		var cancel context.CancelFunc
+		if config.MaxConnectionTime > 0 {
+			ctx, cancel = context.WithTimeout(ctx, config.MaxConnectionTime)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
 		defer cancel()
 
-		userAgentLower := strings.ToLower(r.Header.Get("User-Agent"))
-		isSafari := strings.Contains(userAgentLower, "safari") && !strings.Contains(userAgentLower, "chrome") && !strings.Contains(userAgentLower, "android")
+		edge := edgeFromRequest(r, config.EdgeHeader)
+		if edge != "" {
+			logger = logger.With(zap.String("edge", edge))
+			ctx = logging.WithLogger(ctx, logger)
+			ctx = metrics.WithEdge(ctx, edge)
+		}
+		metrics.Inc("netlib_connections_total", "edge", metricLabel(config.MetricEdges, edge))
+
+		ip := clientIP(r, config.ClientIPHeader)
+		if reason, retryAfter, ok := connections.Acquire(ip, time.Now()); !ok {
+			logger.Info("connection over capacity", zap.String("reason", reason), zap.Duration("retryAfter", retryAfter))
+			rejectOverCapacity(w, r, reason, retryAfter)
+		}
+		defer func() { connections.Release(ip, time.Now()) }()
+
+		identity := clientIdentity(r)
+		if identity == "" && config.RequireClientCert {
+			util.ErrorAndAbort(w, r, http.StatusUnauthorized, "client-certificate-required")
+		}
+		authIdentity := authenticate(ctx, w, r, config.Auth)
+
 		acceptOptions := &websocket.AcceptOptions{
-			// Allow any origin/game to connect.
-			InsecureSkipVerify: true,
+			// Allow any origin/game to connect unless an allowlist is configured,
+			// peers with a verified client certificate aren't browsers and have no origin.
+			InsecureSkipVerify: len(config.AllowedOrigins) == 0 || identity != "",
+			OriginPatterns:     config.AllowedOrigins,
+			Subprotocols:       []string{CompactSubprotocol},
 		}
 
-		if isSafari {
+		compression := config.compressionFor(r.URL.Query().Get(GameQueryParam))
+		acceptOptions.CompressionMode = compressionModes[compression.Mode]
+		acceptOptions.CompressionThreshold = compression.Threshold
+		if isSafari(ctx, r.Header.Get("User-Agent")) || compressionDisabled(r) || fallbacks.disabled(compressionClient(ip, r), time.Now()) {
 			acceptOptions.CompressionMode = websocket.CompressionDisabled
 		}
 
+		setAffinityCookie(w, r, &config)
 		conn, err := websocket.Accept(w, r, acceptOptions)
 		if err != nil {
 			util.ErrorAndAbort(w, r, http.StatusBadRequest, "", err)
 		}
 
-		wg.Add(1)
-		defer wg.Done()
+		if config.MaxPacketSize > 0 {
+			conn.SetReadLimit(int64(config.MaxPacketSize))
+		}
+		guard := &compressionGuard{compressed: compressionNegotiated(w)}
 
 		peer := &Peer{
-			store: store,
-			conn:  conn,
+			store:    peerStore,
+			conn:     conn,
+			config:   &config,
+			quotas:   quotas,
+			registry: registry,
+
+			candidates:   node.Candidates,
+			negotiations: newNegotiationLimiter(&config),
+			limiter:      newReadLimiter(&config),
+			traffic:      node.Traffic,
+			storeOps:     newStoreOps(&config),
+			stats:        stats,
+			lookups:      lookups,
+			ip:           ip,
+
+			connCtx: ctx,
 
 			retrievedIDCallback: manager.Reconnected,
+
+			compact: conn.Subprotocol() == CompactSubprotocol,
+			urlGame: r.URL.Query().Get(GameQueryParam),
+
+			ClientIdentity: identity,
+			AuthIdentity:   authIdentity,
+			Edge:           edge,
+
+			queues: newQueues(config.MaxQueuedMessages),
+		}
+		registry.Add(peer)
+		defer registry.Remove(peer)
+		if node.isClosing() {
+			// Shutdown started after this connection was counted, it might have
+			// missed it in the registry.
+			node.Drainer.drain(peer, shutdownRetryAfter)
+		}
+		go peer.runQueue(ctx)
+		if identity != "" {
+			logger.Info("client certificate verified", zap.String("identity", identity))
+		}
+		if authIdentity != "" {
+			logger.Info("client authenticated", zap.String("identity", authIdentity))
 		}
 		defer func() {
-			logger.Info("peer websocket closed", zap.String("peer", peer.ID))
+			logger.Info("peer websocket closed", zap.String("peer", peer.ID), zap.String("player", peer.PlayerID))
 			conn.Close(websocket.StatusInternalError, "unexpceted closure")
 
-			if !peer.closedPacketReceived {
+			if peer.countedForQuota {
+				quotas.ReleasePeer(peer.Game)
+			}
+
+			peer.leaveClosedLobby()
+			peer.stopTraffic()
+			if peer.presenceOnline {
+				pctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), logger), time.Second*10)
+				defer cancel()
+				peer.stopPresence(pctx)
+			}
+			peer.releaseSlot(ctx)
+			if peer.ticketsSubscribed {
+				tctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), logger), time.Second*10)
+				defer cancel()
+				peer.cancelTickets(tctx)
+			}
+			if !peer.closedPacketReceived && !peer.superseded.Load() {
 				// At this point ctx has already been cancelled, so we create a new one to use for the disconnect.
 				nctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), logger), time.Second*10)
 				defer cancel()
@@ -71,67 +251,166 @@ func Handler(ctx context.Context, store stores.Store, cloudflare *cloudflare.Cre
 			}
 		}()
 
-		go func() { // Sending ping packet every 30 to check if the tcp connection is still alive.
-			ticker := time.NewTicker(30 * time.Second)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					if err := peer.Send(ctx, PingPacket{Type: "ping"}); err != nil && !util.IsPipeError(err) {
-						logger.Error("failed to send ping packet", zap.String("peer", peer.ID), zap.Error(err))
-					}
-				case <-ctx.Done():
-					return
+		if err := peer.Send(ctx, serverInfo(&config)); err != nil {
+			util.ErrorAndDisconnect(ctx, conn, err)
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && config.ExpiryWarning > 0 {
+			go warnBeforeExpiry(ctx, deadline, config.ExpiryWarning, func(ctx context.Context, expiresIn time.Duration) error {
+				return peer.Send(ctx, ConnectionExpiringPacket{Type: "connection-expiring", ExpiresIn: expiresIn.Milliseconds()})
+			}, func(err error) {
+				if !util.IsPipeError(err) {
+					logger.Error("failed to send connection-expiring packet", zap.String("peer", peer.ID), zap.Error(err))
 				}
+			})
+		}
+
+		go pingLoop(ctx, PingInterval, PingTimeout, func(ctx context.Context) error {
+			return peer.Send(ctx, PingPacket{Type: "ping"})
+		}, func(err error) {
+			if !util.IsPipeError(err) {
+				logger.Error("failed to send ping packet", zap.String("peer", peer.ID), zap.Error(err))
 			}
-		}()
+		})
+
+		// dispatch handles a single packet, batches dispatch each of theirs.
+		dispatch := func(ctx context.Context, typ, requestID string, raw []byte) error {
+			if config.RequireHello && peer.ID == "" && !handshakePackets[typ] {
+				// Not a disconnect, the client can still send its hello.
+				metrics.Inc("netlib_handshake_rejections_total", "type", packetTypeLabel(typ))
+				peer.ReplyError(ctx, requestID, ErrHandshakeRequired.WithParams("type", typ))
+				return nil
+			}
+			if feature, disabled := config.Features.packetDisabled(peer.Game, typ); disabled {
+				metrics.Inc("netlib_feature_rejections_total", "feature", feature)
+				peer.ReplyError(ctx, requestID, ErrFeatureDisabled.WithParams("feature", feature))
+				return nil
+			}
+			switch typ {
+			case "credentials":
+				packet := CredentialsRequestPacket{}
+				if err := json.Unmarshal(raw, &packet); err != nil {
+					return fmt.Errorf("unable to unmarshal json: %w", err)
+				}
+				return peer.HandleCredentialsPacket(ctx, packet, cloudflare)
+
+			case "event":
+				peer.HandleEventPacket(ctx, raw)
 
+			case "pong":
+				// ignore, ping/pong is just for the tcp keepalive.
+
+			default:
+				return peer.HandlePacket(ctx, typ, raw)
+			}
+			return nil
+		}
+
+		// buf holds the packet being handled when read buffers are pooled, it's
+		// put back once the next packet is read.
+		var buf *bytes.Buffer
+		defer func() { readBuffers.put(buf) }()
 		for ctx.Err() == nil {
+			readBuffers.put(buf)
+			var typ websocket.MessageType
 			var raw []byte
-			if _, raw, err = conn.Read(ctx); err != nil {
+			readStart := time.Now()
+			if typ, raw, buf, err = readBuffers.read(ctx, conn); err != nil {
+				fallback := guard.fresh() && isCompressionError(err)
+				if fallback {
+					// The hint might not get through on a broken connection, make
+					// the next one from this client go without compression.
+					fallbacks.remember(compressionClient(ip, r), time.Now())
+					hintCompressionFallback(ctx, conn, "frame")
+				}
+				peer.closeImplicitly(logger, err)
+				if fallback {
+					closeForCompressionFallback(conn)
+				}
+				util.ErrorAndDisconnect(ctx, conn, err)
+			}
+			// Time spent blocked in Read is mostly the client being idle, keep it
+			// separate from the processing time to tell a slow server from a quiet client.
+			metrics.Observe("netlib_read_wait_seconds", time.Since(readStart).Seconds())
+			peer.countRead(len(raw))
+			frameSize := len(raw)
+			// Throttling is observed by the limiter, it's not part of either.
+			if err := peer.limiter.wait(ctx, len(raw)); err != nil {
 				util.ErrorAndDisconnect(ctx, conn, err)
 			}
+			readDone := time.Now()
 
-			typeOnly := struct{ Type string }{}
+			if dictionary := peer.encoding().dictionary; typ == websocket.MessageBinary && dictionary != nil {
+				if raw, err = dictionary.Decompress(raw); err != nil {
+					util.ErrorAndDisconnect(ctx, conn, fmt.Errorf("%w: %w", util.ErrProtocol, err))
+				}
+			}
+			if raw, err = peer.decode(raw); err != nil {
+				util.ErrorAndDisconnect(ctx, conn, fmt.Errorf("%w: %w", util.ErrProtocol, err))
+			}
+
+			typeOnly := struct {
+				Type      string
+				MessageID string `json:"messageId"`
+				RequestID string `json:"rid"`
+			}{}
 			if err := json.Unmarshal(raw, &typeOnly); err != nil {
+				if guard.fresh() {
+					fallBackFromCompression(ctx, conn, "payload")
+				}
 				util.ErrorAndDisconnect(ctx, conn, err)
 			}
+			guard.decodeSucceeded()
+			observePacketSize("in", typeOnly.Type, frameSize)
 
 			if peer.closedPacketReceived {
 				logger.Warn("received packet after close", zap.String("peer", peer.ID), zap.String("type", typeOnly.Type))
 				continue
 			}
 
-			switch typeOnly.Type {
-			case "credentials":
-				credentials, err := cloudflare.GetCredentials(ctx)
-				if err != nil {
-					util.ReplyError(ctx, conn, err)
-				} else {
-					packet := CredentialsPacket{
-						Type:        "credentials",
-						Credentials: *credentials,
-					}
-					if err := peer.Send(ctx, packet); err != nil {
-						util.ErrorAndDisconnect(ctx, conn, err)
-					}
+			err := runWithTimeout(withStoreOps(ctx, peer.storeOps), config.handlerTimeout(typeOnly.Type), typeOnly.Type, func(ctx context.Context) error {
+				if typeOnly.Type == "batch" {
+					return peer.HandleBatchPacket(ctx, raw, dispatch)
 				}
+				return dispatch(ctx, typeOnly.Type, typeOnly.RequestID, raw)
+			})
+			if err != nil {
+				util.ErrorAndDisconnect(ctx, conn, err)
+			}
+			if peer.storeOps.exceeded(time.Now()) {
+				metrics.Inc("netlib_store_budget_disconnects_total")
+				util.ErrorAndDisconnect(ctx, conn, ErrStoreBudgetExceeded.WithParams("max", config.MaxStoreOps, "window", config.StoreOpsWindow.Seconds()))
+			}
+			peer.syncTraffic()
+			peer.syncLimits(ctx)
+			peer.syncMembersSubscription()
+			peer.syncPresence(ctx)
 
-			case "event":
-				params := metrics.EventParams{}
-				if err := json.Unmarshal(raw, &params); err != nil {
-					util.ErrorAndDisconnect(ctx, conn, err)
-				}
-				go metrics.RecordEvent(ctx, params)
-
-			case "pong":
-				// ignore, ping/pong is just for the tcp keepalive.
-
-			default:
-				if err := peer.HandlePacket(ctx, typeOnly.Type, raw); err != nil {
-					util.ErrorAndDisconnect(ctx, conn, err)
-				}
+			if err := peer.acknowledge(ctx, typeOnly.MessageID); err != nil {
+				util.ErrorAndDisconnect(ctx, conn, err)
 			}
+
+			metrics.Observe("netlib_packet_duration_seconds", time.Since(readDone).Seconds(), "type", packetTypeLabel(typeOnly.Type))
 		}
-	})
+	}), node
+}
+
+// allowCredentials checks the credentials budget, when the limiter itself
+// fails the request is allowed so a store outage doesn't break TURN.
+func allowCredentials(ctx context.Context, limiter ratelimit.Limiter) bool {
+	if limiter == nil {
+		return true
+	}
+	remaining, err := limiter.Allow(ctx)
+	if err == ratelimit.ErrLimited {
+		metrics.Inc("netlib_credentials_rate_limited_total")
+		metrics.Set("netlib_credentials_budget_remaining", 0)
+		return false
+	} else if err != nil {
+		logger := logging.GetLogger(ctx)
+		logger.Error("failed to check credentials rate limit", zap.Error(err))
+		return true
+	}
+	metrics.Set("netlib_credentials_budget_remaining", float64(remaining))
+	return true
 }
@@ -0,0 +1,83 @@
+package signaling
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/poki/netlib/internal/cloudflare"
+)
+
+// ICEServer is an RTCIceServer as passed to RTCPeerConnection by clients.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+
+	// Priority orders the servers, lower first. Servers with the same
+	// priority as the Cloudflare TURN server (0) come after it.
+	Priority int `json:"priority,omitempty"`
+}
+
+// validateICEServers checks the static ICE servers from the config, so a
+// typo is caught at startup instead of breaking connections of clients.
+func validateICEServers(servers []ICEServer) error {
+	for i, server := range servers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("ice server %d has no urls", i)
+		}
+		for _, url := range server.URLs {
+			scheme, rest, found := strings.Cut(url, ":")
+			if !found || rest == "" {
+				return fmt.Errorf("ice server %d has an invalid url %q", i, url)
+			}
+			switch scheme {
+			case "stun", "stuns":
+			case "turn", "turns":
+				if server.Username == "" || server.Credential == "" {
+					return fmt.Errorf("ice server %d has a turn url %q without username and credential", i, url)
+				}
+			default:
+				return fmt.Errorf("ice server %d has an invalid url scheme %q", i, url)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeICEServers returns the Cloudflare TURN server, if any, together with
+// the static servers ordered by priority. Urls are deduplicated, a url is only
+// kept in the first server (by priority) that lists it.
+func mergeICEServers(credentials *cloudflare.Credentials, static []ICEServer) []ICEServer {
+	servers := make([]ICEServer, 0, len(static)+1)
+	if credentials != nil && credentials.URL != "" {
+		servers = append(servers, ICEServer{
+			URLs:       []string{credentials.URL},
+			Username:   credentials.Username,
+			Credential: credentials.Credential,
+		})
+	}
+	servers = append(servers, static...)
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].Priority < servers[j].Priority
+	})
+
+	seen := make(map[string]struct{})
+	merged := make([]ICEServer, 0, len(servers))
+	for _, server := range servers {
+		var urls []string
+		for _, url := range server.URLs {
+			if _, found := seen[url]; !found {
+				seen[url] = struct{}{}
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		server.URLs = urls
+		server.Priority = 0 // Only used for ordering, not sent to clients.
+		merged = append(merged, server)
+	}
+	return merged
+}
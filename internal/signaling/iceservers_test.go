@@ -0,0 +1,53 @@
+package signaling
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/poki/netlib/internal/cloudflare"
+)
+
+func TestMergeICEServers(t *testing.T) {
+	credentials := &cloudflare.Credentials{URL: "turn:turn.example.com:3478?transport=udp", Username: "user", Credential: "pass"}
+	static := []ICEServer{
+		{URLs: []string{"turn:backup.example.com:3478"}, Username: "backup", Credential: "secret", Priority: 10},
+		{URLs: []string{"stun:stun.example.com:3478", "stun:stun2.example.com:3478"}, Priority: -1},
+		{URLs: []string{"stun:stun.example.com:3478"}, Priority: 5}, // Duplicate, dropped.
+	}
+
+	got := mergeICEServers(credentials, static)
+	want := []ICEServer{
+		{URLs: []string{"stun:stun.example.com:3478", "stun:stun2.example.com:3478"}},
+		{URLs: []string{"turn:turn.example.com:3478?transport=udp"}, Username: "user", Credential: "pass"},
+		{URLs: []string{"turn:backup.example.com:3478"}, Username: "backup", Credential: "secret"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected servers:\n got %+v\nwant %+v", got, want)
+	}
+
+	// Without Cloudflare credentials the static servers are still returned.
+	if got := mergeICEServers(nil, static); len(got) != 2 {
+		t.Fatalf("expected the 2 static servers, got %+v", got)
+	}
+}
+
+func TestValidateICEServers(t *testing.T) {
+	valid := []ICEServer{
+		{URLs: []string{"stun:stun.example.com:3478"}},
+		{URLs: []string{"turns:turn.example.com:443"}, Username: "user", Credential: "pass"},
+	}
+	if err := validateICEServers(valid); err != nil {
+		t.Fatal(err)
+	}
+	invalid := [][]ICEServer{
+		{{}},
+		{{URLs: []string{"https://stun.example.com"}}},
+		{{URLs: []string{"stun:"}}},
+		{{URLs: []string{"turn:turn.example.com:3478"}}},
+	}
+	for _, servers := range invalid {
+		if err := validateICEServers(servers); err == nil {
+			t.Errorf("expected %+v to be invalid", servers)
+		}
+	}
+}
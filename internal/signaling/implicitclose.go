@@ -0,0 +1,58 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// implicitCloseReason returns the reason to close a peer with when err means
+// the client closed its websocket on purpose: browsers send 1001 (going away)
+// when a tab is closed or navigates away and 1000 when the client calls
+// close(). Drops without a close frame (1006) are network issues and keep the
+// reconnect window.
+func implicitCloseReason(err error) (string, bool) {
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return "", false
+	}
+	switch closeErr.Code {
+	case websocket.StatusNormalClosure:
+		if closeErr.Reason != "" {
+			return closeErr.Reason, true
+		}
+		return "normal-closure", true
+	case websocket.StatusGoingAway:
+		if closeErr.Reason != "" {
+			return closeErr.Reason, true
+		}
+		return "going-away", true
+	}
+	return "", false
+}
+
+// closeImplicitly leaves the lobby right away, like a close packet would,
+// when the socket read failed because the client closed the websocket on
+// purpose, not when the server closed it to drain the node. Otherwise, or
+// when leaving fails, the peer is handled by the TimeoutManager once the
+// connection is gone.
+func (p *Peer) closeImplicitly(logger *zap.Logger, err error) {
+	reason, ok := implicitCloseReason(err)
+	if !ok || p.ID == "" || p.closedPacketReceived || p.superseded.Load() || p.draining.Load() {
+		return
+	}
+	metrics.Inc("netlib_implicit_closes_total")
+
+	// The connection context might be done already, e.g. at MaxConnectionTime.
+	ctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), logger), time.Second*10)
+	defer cancel()
+	if err := p.HandleClosePacket(ctx, ClosePacket{Type: "close", ID: p.ID, Reason: reason}); err != nil {
+		logger.Warn("failed to close peer, falling back to the disconnect timeout", zap.String("peer", p.ID), zap.Error(err))
+		p.closedPacketReceived = false
+	}
+}
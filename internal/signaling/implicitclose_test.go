@@ -0,0 +1,33 @@
+package signaling
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestImplicitCloseReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+		ok     bool
+	}{
+		{"going away", websocket.CloseError{Code: websocket.StatusGoingAway}, "going-away", true},
+		{"normal closure", fmt.Errorf("failed to read: %w", websocket.CloseError{Code: websocket.StatusNormalClosure}), "normal-closure", true},
+		{"client reason", websocket.CloseError{Code: websocket.StatusNormalClosure, Reason: "game over"}, "game over", true},
+		{"abnormal", websocket.CloseError{Code: websocket.StatusAbnormalClosure}, "", false},
+		{"internal error", websocket.CloseError{Code: websocket.StatusInternalError}, "", false},
+		{"eof", io.EOF, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason, ok := implicitCloseReason(test.err)
+			if reason != test.reason || ok != test.ok {
+				t.Errorf("expected %q %v, got %q %v", test.reason, test.ok, reason, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+const DefaultInviteMaxUses = 1
+const DefaultInviteLifetime = 24 * time.Hour
+const MaxInviteLifetime = 7 * 24 * time.Hour
+
+// HandleCreateInvitePacket lets the leader mint an invite token, other peers
+// can join the lobby with the token without knowing the lobby code.
+func (p *Peer) HandleCreateInvitePacket(ctx context.Context, packet CreateInvitePacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	maxUses := packet.MaxUses
+	if maxUses <= 0 {
+		maxUses = DefaultInviteMaxUses
+	}
+	lifetime := time.Duration(packet.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = DefaultInviteLifetime
+	} else if lifetime > MaxInviteLifetime {
+		lifetime = MaxInviteLifetime
+	}
+	expiresAt := util.Now(ctx).Add(lifetime)
+
+	token := util.GenerateInviteToken(ctx)
+	err := p.store.CreateInvite(ctx, p.Game, p.Lobby, p.ID, token, maxUses, expiresAt)
+	if err == stores.ErrNotLeader {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logger.Info("invite created", zap.String("game", p.Game), zap.String("lobby", p.Lobby), zap.String("peer", p.ID), zap.Int("maxUses", maxUses))
+	metrics.Record(ctx, "lobby", "invite-created", p.Game, p.ID, p.Lobby)
+
+	return p.Send(ctx, InvitePacket{
+		RequestID: packet.RequestID,
+		Type:      "invite",
+		Token:     token,
+		MaxUses:   maxUses,
+		ExpiresAt: expiresAt.UnixMilli(),
+	})
+}
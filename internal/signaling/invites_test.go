@@ -0,0 +1,76 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+)
+
+// inviteStore knows the invite "full" of a full lobby, other invites are
+// invalid.
+type inviteStore struct {
+	stores.Store
+}
+
+func (s *inviteStore) JoinLobbyByInvite(ctx context.Context, game, token, id string) (string, []string, error) {
+	if token != "full" {
+		return "", nil, stores.ErrInvalidInvite
+	}
+	return "", nil, stores.ErrLobbyFull
+}
+
+func TestJoinByInviteErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{store: &inviteStore{}, conn: conn, config: &Config{}, ID: "peer", Game: "game"}
+		for _, token := range []string{"full", "unknown"} {
+			if err := p.HandleJoinPacket(r.Context(), JoinPacket{RequestID: token, Lobby: "lobby", Invite: token}); err != nil {
+				t.Error(err)
+			}
+		}
+		if p.Lobby != "" {
+			t.Errorf("expected the peer to not join, got %q", p.Lobby)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	for _, code := range []string{"lobby-full", "invalid-invite"} {
+		_, raw, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := struct {
+			Type   string
+			Code   string
+			Params map[string]any
+		}{}
+		if err := json.Unmarshal(raw, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != "error" || reply.Code != code {
+			t.Fatalf("expected a %s error, got %s", code, raw)
+		}
+		// The code of lobbies joined by invite isn't revealed.
+		if _, ok := reply.Params["lobby"]; ok {
+			t.Fatalf("expected no lobby in the error, got %s", raw)
+		}
+	}
+}
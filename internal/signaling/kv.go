@@ -0,0 +1,184 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+)
+
+// The key-value storage of a lobby is meant for small shared state like votes
+// or a scoreboard, not as a database, so it's kept small.
+const (
+	MaxLobbyKeys   = 32
+	MaxKVKeyLength = 64
+	MaxKVValueSize = 256
+)
+
+var ErrInvalidKV = util.NewError("invalid-kv", "invalid key or value")
+
+type KVSetPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type KVCompareAndSetPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Key      string          `json:"key"`
+	Expected json.RawMessage `json:"expected"`
+	Value    json.RawMessage `json:"value"`
+}
+
+type KVIncrementPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Key string   `json:"key"`
+	By  *float64 `json:"by"`
+}
+
+type KVGetPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+type KVPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby  string                     `json:"lobby"`
+	Values map[string]json.RawMessage `json:"values"`
+}
+
+// KVChangedPacket is sent to all members of the lobby when a key changed, a
+// null value means the key was deleted.
+type KVChangedPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby string          `json:"lobby"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Peer  string          `json:"peer"`
+}
+
+func validateKVUpdate(update stores.KVUpdate) error {
+	if update.Key == "" || len(update.Key) > MaxKVKeyLength {
+		return ErrInvalidKV.WithParams("reason", "key", "max", MaxKVKeyLength)
+	}
+	if len(update.Value) > MaxKVValueSize || len(update.Expected) > MaxKVValueSize {
+		return ErrInvalidKV.WithParams("reason", "value", "max", MaxKVValueSize)
+	}
+	return nil
+}
+
+// kvClientErrors are the errors of a key-value update the client caused,
+// they're replied instead of ending the connection.
+var kvClientErrors = []error{
+	ErrInvalidKV,
+	stores.ErrKVConflict,
+	stores.ErrKVTooManyKeys,
+	stores.ErrKVNotANumber,
+	stores.ErrNotLeader,
+	stores.ErrNotInLobby,
+	stores.ErrNotFound,
+}
+
+// updateKV applies update to the key-value storage of the lobby of the peer
+// and tells all members about the new value.
+func (p *Peer) updateKV(ctx context.Context, requestID string, update stores.KVUpdate) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+	update.MaxKeys = MaxLobbyKeys
+
+	err := validateKVUpdate(update)
+	var value json.RawMessage
+	var others []string
+	if err == nil {
+		value, others, err = p.store.UpdateLobbyKV(ctx, p.Game, p.Lobby, p.ID, update)
+	}
+	for _, clientErr := range kvClientErrors {
+		if errors.Is(err, clientErr) {
+			metrics.Inc("netlib_kv_rejections_total")
+			p.ReplyError(ctx, requestID, err)
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	changed := KVChangedPacket{
+		Type:  "kv-changed",
+		Lobby: p.Lobby,
+		Key:   update.Key,
+		Value: value,
+		Peer:  p.ID,
+	}
+	if err := p.broadcast(ctx, others, changed); err != nil {
+		return err
+	}
+	changed.RequestID = requestID
+	return p.Send(ctx, changed)
+}
+
+func (p *Peer) HandleKVSetPacket(ctx context.Context, packet KVSetPacket) error {
+	return p.updateKV(ctx, packet.RequestID, stores.KVUpdate{
+		Op:    stores.KVSet,
+		Key:   packet.Key,
+		Value: packet.Value,
+	})
+}
+
+func (p *Peer) HandleKVCompareAndSetPacket(ctx context.Context, packet KVCompareAndSetPacket) error {
+	return p.updateKV(ctx, packet.RequestID, stores.KVUpdate{
+		Op:       stores.KVCompareAndSet,
+		Key:      packet.Key,
+		Expected: packet.Expected,
+		Value:    packet.Value,
+	})
+}
+
+func (p *Peer) HandleKVIncrementPacket(ctx context.Context, packet KVIncrementPacket) error {
+	by := 1.0
+	if packet.By != nil {
+		by = *packet.By
+	}
+	return p.updateKV(ctx, packet.RequestID, stores.KVUpdate{
+		Op:  stores.KVIncrement,
+		Key: packet.Key,
+		By:  by,
+	})
+}
+
+func (p *Peer) HandleKVGetPacket(ctx context.Context, packet KVGetPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+	values, err := p.store.GetLobbyKV(ctx, p.Game, p.Lobby)
+	if err != nil {
+		return err
+	}
+	return p.Send(ctx, KVPacket{
+		RequestID: packet.RequestID,
+		Type:      "kv",
+		Lobby:     p.Lobby,
+		Values:    values,
+	})
+}
@@ -0,0 +1,32 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+func TestValidateKVUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update stores.KVUpdate
+		valid  bool
+	}{
+		{"valid", stores.KVUpdate{Key: "votes", Value: json.RawMessage(`1`)}, true},
+		{"empty key", stores.KVUpdate{Value: json.RawMessage(`1`)}, false},
+		{"long key", stores.KVUpdate{Key: strings.Repeat("k", MaxKVKeyLength+1)}, false},
+		{"large value", stores.KVUpdate{Key: "k", Value: json.RawMessage(`"` + strings.Repeat("v", MaxKVValueSize) + `"`)}, false},
+		{"large expected", stores.KVUpdate{Key: "k", Expected: json.RawMessage(`"` + strings.Repeat("v", MaxKVValueSize) + `"`)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateKVUpdate(test.update)
+			if test.valid && err != nil || !test.valid && !errors.Is(err, ErrInvalidKV) {
+				t.Fatalf("unexpected result %v", err)
+			}
+		})
+	}
+}
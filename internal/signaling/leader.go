@@ -0,0 +1,98 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// LobbyLockTTL bounds how long a lobby critical section can hold its lock,
+// see stores.Store.LockLobby.
+const LobbyLockTTL = 5 * time.Second
+
+// HandleTransferLeaderPacket lets the leader hand the lobby over to another member.
+func (p *Peer) HandleTransferLeaderPacket(ctx context.Context, packet TransferLeaderPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	// Locked with migrateLeader so the leader packets go out in the order
+	// the leader changed.
+	leader := LeaderPacket{
+		Type:   "leader",
+		Lobby:  p.Lobby,
+		Leader: packet.Leader,
+	}
+	err := p.store.LockLobby(ctx, p.Game, p.Lobby, LobbyLockTTL, func(ctx context.Context) error {
+		peers, err := p.store.TransferOwnership(ctx, p.Game, p.Lobby, p.ID, packet.Leader)
+		if err != nil {
+			return err
+		}
+		return p.broadcast(ctx, peers, leader)
+	})
+	if errors.Is(err, stores.ErrNotLeader) || errors.Is(err, stores.ErrNotInLobby) || errors.Is(err, stores.ErrNotPlayer) {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	metrics.Record(ctx, "lobby", "leader-transferred", p.Game, p.ID, p.Lobby)
+
+	leader.RequestID = packet.RequestID
+	return p.Send(ctx, leader)
+}
+
+// migrateLeader makes the remaining player with the lowest seat the leader when
+// the leader left the lobby, nothing happens when the leaving peer wasn't the
+// leader. Peers that left and rejoined keep their seat but are stored at the
+// end, so others is sorted by seat first. It must be called in the critical
+// section of the leave, see leaveLobby.
+func migrateLeader(ctx context.Context, store stores.Store, game, lobby, leaving string, others []string) error {
+	logger := logging.GetLogger(ctx)
+	seats, err := store.GetSeats(ctx, game, lobby)
+	if err != nil {
+		return err
+	}
+	candidates := append([]string(nil), others...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return seats[candidates[i]] < seats[candidates[j]]
+	})
+	for _, id := range candidates {
+		if id == leaving {
+			continue
+		}
+		peers, err := store.TransferOwnership(ctx, game, lobby, leaving, id)
+		if errors.Is(err, stores.ErrNotLeader) || errors.Is(err, stores.ErrNotFound) {
+			return nil
+		} else if errors.Is(err, stores.ErrNotInLobby) || errors.Is(err, stores.ErrNotPlayer) {
+			continue // Left in the meantime or a spectator, try the next peer.
+		} else if err != nil {
+			return err
+		}
+		logger.Info("leader migrated", zap.String("game", game), zap.String("lobby", lobby), zap.String("leader", id))
+
+		data, _ := json.Marshal(LeaderPacket{
+			Type:   "leader",
+			Lobby:  lobby,
+			Leader: id,
+		})
+		for _, peer := range peers {
+			if err := store.Publish(ctx, game+lobby+peer, data); err != nil {
+				logger.Error("failed to publish leader packet", zap.Error(err))
+			}
+		}
+		return nil
+	}
+	return nil
+}
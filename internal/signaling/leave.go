@@ -0,0 +1,81 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// leaveLobby removes id from the lobby as one critical section of the lobby:
+// the leader moves on to the next peer and the others get a disconnect
+// packet, or the lobby is closed when id was the last peer in it. Closing
+// (1000/1001), the close packet and timeouts all leave through here. games
+// are the games labelled in the lifetime metric, see Config.MetricGames.
+func leaveLobby(ctx context.Context, store stores.Store, hook *webhook.Client, games []string, game, lobby, id string) error {
+	var others []string
+	err := store.LockLobby(ctx, game, lobby, LobbyLockTTL, func(ctx context.Context) error {
+		var err error
+		others, err = store.LeaveLobby(ctx, game, lobby, id)
+		if err != nil {
+			return err
+		}
+		return announceLeave(ctx, store, game, lobby, id, others)
+	})
+	if err != nil {
+		return err
+	}
+	if len(others) == 0 {
+		observeLobbyEmptied(ctx, store, games, game, lobby)
+		emitLobbyEvent(ctx, hook, LobbyClosed, game, lobby, id)
+	}
+	return nil
+}
+
+// announceLeave migrates the leader away from id and tells the others that id
+// left the lobby and that their ready states were cleared, nothing is sent
+// when there are no others. It must run in the critical section that removed
+// id from the lobby.
+func announceLeave(ctx context.Context, store stores.Store, game, lobby, id string, others []string) error {
+	logger := logging.GetLogger(ctx)
+	if len(others) == 0 {
+		return nil
+	}
+	if err := migrateLeader(ctx, store, game, lobby, id, others); err != nil {
+		return err
+	}
+	data, err := json.Marshal(DisconnectPacket{
+		Type: "disconnect",
+		ID:   id,
+	})
+	if err != nil {
+		return err
+	}
+	ready, err := json.Marshal(readyReset(len(others)))
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other != id {
+			if err := store.Publish(ctx, game+lobby+other, data); err != nil {
+				logger.Error("failed to publish disconnect packet", zap.Error(err))
+			}
+			if err := store.Publish(ctx, game+lobby+other, ready); err != nil {
+				logger.Error("failed to publish ready packet", zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// leaveLobby makes the peer leave its lobby, see leaveLobby.
+func (p *Peer) leaveLobby(ctx context.Context) error {
+	if err := leaveLobby(ctx, p.store, p.config.Webhook, p.config.MetricGames, p.Game, p.Lobby, p.ID); err != nil {
+		return err
+	}
+	p.leftLobby()
+	return nil
+}
@@ -0,0 +1,182 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/webhook"
+)
+
+// leaveStore keeps the peers of a single lobby, the first peer is its leader.
+type leaveStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	peers     []string
+	seats     map[string]int
+	leaders   []string
+	locked    bool
+	emptied   int
+	published map[string][]string
+}
+
+func (s *leaveStore) GetSeats(context.Context, string, string) (map[string]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.seats, nil
+}
+
+func (s *leaveStore) LockLobby(ctx context.Context, _, _ string, _ time.Duration, fn func(context.Context) error) error {
+	s.mutex.Lock()
+	s.locked = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.locked = false
+		s.mutex.Unlock()
+	}()
+	return fn(ctx)
+}
+
+func (s *leaveStore) LeaveLobby(_ context.Context, _, _, id string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.locked {
+		return nil, errors.New("left outside of a critical section")
+	}
+	var others []string
+	for _, peer := range s.peers {
+		if peer != id {
+			others = append(others, peer)
+		}
+	}
+	s.peers = others
+	return others, nil
+}
+
+func (s *leaveStore) MarkLobbyEmptied(_ context.Context, game, lobby string) (*stores.LobbyLifetime, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.peers) > 0 {
+		return nil, nil
+	}
+	s.emptied++
+	return &stores.LobbyLifetime{Game: game, Code: lobby, CreatedAt: time.Now(), EmptiedAt: time.Now(), ClosedAt: time.Now()}, nil
+}
+
+func (s *leaveStore) TransferOwnership(_ context.Context, _, _, from, to string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.locked {
+		return nil, errors.New("migrated outside of a critical section")
+	}
+	s.leaders = append(s.leaders, to)
+	return append([]string{}, s.peers...), nil
+}
+
+func (s *leaveStore) Publish(_ context.Context, topic string, data []byte) error {
+	packet := struct{ Type string }{}
+	json.Unmarshal(data, &packet) //nolint:errcheck
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.published == nil {
+		s.published = make(map[string][]string)
+	}
+	s.published[topic] = append(s.published[topic], packet.Type)
+	return nil
+}
+
+func TestCloseLeavesLobby(t *testing.T) {
+	events := make(chan webhook.Event, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := webhook.Event{}
+		json.NewDecoder(r.Body).Decode(&event) //nolint:errcheck
+		events <- event
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hook := webhook.New(server.URL, "", nil)
+	hook.Run(ctx)
+
+	store := &leaveStore{peers: []string{"a", "b", "c"}}
+	registry := newPeerRegistry()
+	peer := func(id string) *Peer {
+		p := &Peer{
+			store:    store,
+			config:   &Config{Webhook: hook},
+			registry: registry,
+			ID:       id,
+			Game:     "game",
+			Lobby:    "lobby",
+		}
+		registry.Add(p)
+		registry.Join(p, "lobby")
+		return p
+	}
+
+	// The leader closing moves the leader on and tells the others.
+	a := peer("a")
+	if err := a.HandleClosePacket(ctx, ClosePacket{Type: "close"}); err != nil {
+		t.Fatal(err)
+	}
+	if a.Lobby != "" {
+		t.Fatalf("expected the peer to have left, still in %q", a.Lobby)
+	}
+	// The connection stays registered, without its membership.
+	for _, c := range registry.Connections() {
+		if c.peer == a && c.lobby != "" {
+			t.Fatalf("expected the membership of the peer to be gone, still in %q", c.lobby)
+		}
+	}
+	for _, id := range []string{"b", "c"} {
+		if got := store.published["gamelobby"+id]; len(got) != 3 || got[0] != "leader" || got[1] != "disconnect" || got[2] != "ready" {
+			t.Fatalf("expected %s to get a leader, disconnect and ready packet, got %v", id, got)
+		}
+	}
+
+	b := peer("b")
+	if err := b.HandleClosePacket(ctx, ClosePacket{Type: "close"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("expected no event while peers remain, got %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The last peer closing closes the lobby.
+	c := peer("c")
+	if err := c.HandleClosePacket(ctx, ClosePacket{Type: "close"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Type != LobbyClosed || event.Lobby != "lobby" || event.Peer != "c" {
+			t.Fatalf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a lobby closed event")
+	}
+	if store.emptied != 1 {
+		t.Fatalf("expected the lobby to be marked emptied once, got %d", store.emptied)
+	}
+}
+
+func TestLeaderMigratesToLowestSeat(t *testing.T) {
+	// b left and rejoined, it's stored after c but kept its seat.
+	store := &leaveStore{peers: []string{"a", "c", "b"}, seats: map[string]int{"a": 0, "b": 1, "c": 2}}
+	if err := leaveLobby(context.Background(), store, nil, nil, "game", "lobby", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.leaders) != 1 || store.leaders[0] != "b" {
+		t.Fatalf("expected b to become the leader, got %v", store.leaders)
+	}
+}
@@ -0,0 +1,71 @@
+package signaling
+
+import (
+	"context"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// lobbyLifetimeBuckets are the histogram buckets (in seconds) for lobby
+// lifetimes and fill times, from 10 seconds to a day.
+var lobbyLifetimeBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400, 43200, 86400}
+
+func visibilityLabel(public bool) string {
+	if public {
+		return "public"
+	}
+	return "private"
+}
+
+// observeLobbyClosed records the lifetime of a pruned or closed lobby. The
+// lifetime of lobbies the last peer left was recorded by observeLobbyEmptied
+// already. Games not in games are labelled "other".
+func observeLobbyClosed(lobby stores.LobbyLifetime, games []string) {
+	if lobby.EmptiedAt.IsZero() {
+		observeLifetime(lobby, games)
+	}
+}
+
+func observeLifetime(lobby stores.LobbyLifetime, games []string) {
+	if lobby.ClosedAt.Before(lobby.CreatedAt) {
+		return
+	}
+	metrics.ObserveBuckets("netlib_lobby_lifetime_seconds", lobby.ClosedAt.Sub(lobby.CreatedAt).Seconds(), lobbyLifetimeBuckets,
+		"game", metricLabel(games, lobby.Game), "visibility", visibilityLabel(lobby.Public))
+}
+
+// observeLobbyEmptied records the lifetime of the lobby when the last peer
+// left it. Peers only leave once their reconnect window passed and only the
+// first time the lobby emptied counts, so reconnects don't stretch or repeat
+// it.
+func observeLobbyEmptied(ctx context.Context, store stores.Store, games []string, game, lobby string) {
+	emptied, err := store.MarkLobbyEmptied(ctx, game, lobby)
+	if err != nil {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("failed to mark lobby emptied", zap.String("lobby", lobby), zap.Error(err))
+		return
+	}
+	if emptied == nil {
+		return
+	}
+	observeLifetime(*emptied, games)
+}
+
+// observeLobbyFilled records the time it took the lobby to reach its capacity
+// the first time, peers leaving and rejoining a full lobby aren't counted.
+func observeLobbyFilled(ctx context.Context, store stores.Store, games []string, game, lobby string) {
+	filled, err := store.MarkLobbyFilled(ctx, game, lobby)
+	if err != nil {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("failed to mark lobby filled", zap.String("lobby", lobby), zap.Error(err))
+		return
+	}
+	if filled == nil {
+		return
+	}
+	metrics.ObserveBuckets("netlib_lobby_time_to_full_seconds", filled.FilledAt.Sub(filled.CreatedAt).Seconds(), lobbyLifetimeBuckets,
+		"game", metricLabel(games, game), "visibility", visibilityLabel(filled.Public))
+}
@@ -0,0 +1,50 @@
+package signaling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+// lifetimeCount returns the number of lifetimes observed for game.
+func lifetimeCount(t *testing.T, game string) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	prefix := `netlib_lobby_lifetime_seconds_count{game="` + game + `",visibility="public"} `
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return "0"
+}
+
+func TestObserveLobbyClosed(t *testing.T) {
+	games := []string{"lifetime-game"}
+	created := time.Now().Add(-time.Minute)
+	before := lifetimeCount(t, otherLabel)
+
+	observeLobbyClosed(stores.LobbyLifetime{Game: "lifetime-game", Public: true, CreatedAt: created, ClosedAt: time.Now()}, games)
+	if got := lifetimeCount(t, "lifetime-game"); got != "1" {
+		t.Fatalf("expected the lifetime of an allowed game, got %s", got)
+	}
+
+	// Lobbies the last peer left were observed when they emptied.
+	observeLobbyClosed(stores.LobbyLifetime{Game: "lifetime-game", Public: true, CreatedAt: created, EmptiedAt: created, ClosedAt: time.Now()}, games)
+	if got := lifetimeCount(t, "lifetime-game"); got != "1" {
+		t.Fatalf("expected an emptied lobby to not be observed again, got %s", got)
+	}
+
+	observeLobbyClosed(stores.LobbyLifetime{Game: "unknown-game", Public: true, CreatedAt: created, ClosedAt: time.Now()}, games)
+	if got := lifetimeCount(t, "unknown-game"); got != "0" {
+		t.Fatalf("expected no series for a game that isn't allowed, got %s", got)
+	}
+	if got := lifetimeCount(t, otherLabel); got == before {
+		t.Fatalf("expected the game to be labelled %q", otherLabel)
+	}
+}
@@ -0,0 +1,76 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// clampLobbyLimits clamps the limits requested for a lobby to MaxLobbyLimits,
+// limits lobbies aren't allowed to override are dropped.
+func (c *Config) clampLobbyLimits(requested stores.LobbyLimits) stores.LobbyLimits {
+	return stores.LobbyLimits{
+		PacketRate:   clampLimit(requested.PacketRate, c.MaxLobbyLimits.PacketRate),
+		ReadRate:     clampLimit(requested.ReadRate, c.MaxLobbyLimits.ReadRate),
+		Negotiations: clampLimit(requested.Negotiations, c.MaxLobbyLimits.Negotiations),
+	}
+}
+
+func clampLimit(requested, max int) int {
+	if requested <= 0 || max <= 0 {
+		return 0
+	}
+	if requested > max {
+		return max
+	}
+	return requested
+}
+
+// effectiveLimits returns the limits of the peers in a lobby: the limits of
+// the lobby, clamped again in case MaxLobbyLimits was lowered after the lobby
+// was created, and the limits of the node for the rest.
+func (c *Config) effectiveLimits(lobby stores.LobbyLimits) stores.LobbyLimits {
+	limits := c.clampLobbyLimits(lobby)
+	if limits.PacketRate == 0 {
+		limits.PacketRate = c.MaxPacketRate
+	}
+	if limits.ReadRate == 0 {
+		limits.ReadRate = c.MaxReadRate
+	}
+	if limits.Negotiations == 0 {
+		limits.Negotiations = c.MaxNegotiations
+	}
+	return limits
+}
+
+// syncLimits applies the limits of the lobby of the peer once it joined or
+// left a lobby, outside a lobby the limits of the node apply.
+func (p *Peer) syncLimits(ctx context.Context) {
+	key := lobbyKey{p.Game, p.Lobby}
+	if key == p.limitsLobby {
+		return
+	}
+	p.limitsLobby = key
+
+	var lobby stores.LobbyLimits
+	if p.Lobby != "" && p.config.MaxLobbyLimits != (stores.LobbyLimits{}) {
+		var err error
+		lobby, err = p.store.GetLobbyLimits(ctx, p.Game, p.Lobby)
+		if err != nil && !errors.Is(err, stores.ErrNotFound) {
+			logging.GetLogger(ctx).Warn("failed to get lobby limits, using the limits of the node",
+				zap.String("game", p.Game),
+				zap.String("lobby", p.Lobby),
+				zap.Error(err),
+			)
+		}
+	}
+	limits := p.config.effectiveLimits(lobby)
+	if p.limiter != nil {
+		p.limiter.setRates(limits.PacketRate, limits.ReadRate, time.Now())
+	}
+	p.setNegotiationLimit(limits.Negotiations)
+}
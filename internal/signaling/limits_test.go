@@ -0,0 +1,118 @@
+package signaling
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+// limitsStore holds the limits of the lobbies, counting the lookups.
+type limitsStore struct {
+	stores.Store
+
+	limits  map[string]stores.LobbyLimits
+	lookups int
+}
+
+func (s *limitsStore) GetLobbyLimits(ctx context.Context, game, lobby string) (stores.LobbyLimits, error) {
+	s.lookups++
+	limits, ok := s.limits[lobby]
+	if !ok {
+		return stores.LobbyLimits{}, stores.ErrNotFound
+	}
+	return limits, nil
+}
+
+func TestLobbyLimitsClamped(t *testing.T) {
+	config := &Config{
+		MaxPacketRate:   10,
+		MaxReadRate:     1000,
+		MaxNegotiations: 5,
+		MaxLobbyLimits:  stores.LobbyLimits{PacketRate: 100, Negotiations: 20},
+	}
+
+	// Overrides within the maximum are kept, the read rate can't be overridden.
+	requested := stores.LobbyLimits{PacketRate: 50, ReadRate: 5000, Negotiations: 500}
+	stored := config.clampLobbyLimits(requested)
+	if want := (stores.LobbyLimits{PacketRate: 50, Negotiations: 20}); stored != want {
+		t.Fatalf("expected %+v to be stored, got %+v", want, stored)
+	}
+	if want := (stores.LobbyLimits{PacketRate: 50, ReadRate: 1000, Negotiations: 20}); config.effectiveLimits(stored) != want {
+		t.Fatalf("expected the limits of the node for the rest, got %+v", config.effectiveLimits(stored))
+	}
+
+	// Lobbies created before the maximum was lowered are clamped again.
+	config.MaxLobbyLimits.PacketRate = 30
+	if limits := config.effectiveLimits(stored); limits.PacketRate != 30 {
+		t.Fatalf("expected the lowered maximum, got %+v", limits)
+	}
+
+	// Without maximums lobbies can't override anything.
+	config.MaxLobbyLimits = stores.LobbyLimits{}
+	if limits := config.effectiveLimits(requested); limits != (stores.LobbyLimits{PacketRate: 10, ReadRate: 1000, Negotiations: 5}) {
+		t.Fatalf("expected the limits of the node, got %+v", limits)
+	}
+}
+
+func TestSyncLimits(t *testing.T) {
+	ctx := context.Background()
+	store := &limitsStore{limits: map[string]stores.LobbyLimits{
+		"action": {PacketRate: 500, Negotiations: 1000},
+		"turns":  {},
+	}}
+	config := &Config{
+		MaxPacketRate:     10,
+		MaxNegotiations:   5,
+		NegotiationWindow: time.Second,
+		MaxLobbyLimits:    stores.LobbyLimits{PacketRate: 100, Negotiations: 50},
+	}
+	p := &Peer{store: store, config: config, limiter: newReadLimiter(config), negotiations: newNegotiationLimiter(config), ID: "peer", Game: "game"}
+
+	p.syncLimits(ctx)
+	if p.limiter.packets.rate != 10 || p.negotiations.limit != 5 {
+		t.Fatalf("expected the limits of the node outside a lobby, got %v and %d", p.limiter.packets.rate, p.negotiations.limit)
+	}
+	if store.lookups != 0 {
+		t.Fatal("expected no lookup outside a lobby")
+	}
+
+	// The override of the lobby is honored up to the maximum.
+	p.Lobby = "action"
+	p.syncLimits(ctx)
+	if p.limiter.packets.rate != 100 || p.negotiations.limit != 50 {
+		t.Fatalf("expected the clamped limits of the lobby, got %v and %d", p.limiter.packets.rate, p.negotiations.limit)
+	}
+	p.syncLimits(ctx)
+	if store.lookups != 1 {
+		t.Fatalf("expected the limits to be looked up once per lobby, got %d lookups", store.lookups)
+	}
+
+	// A lobby without overrides gets the limits of the node.
+	p.Lobby = "turns"
+	p.syncLimits(ctx)
+	if p.limiter.packets.rate != 10 || p.negotiations.limit != 5 {
+		t.Fatalf("expected the limits of the node, got %v and %d", p.limiter.packets.rate, p.negotiations.limit)
+	}
+}
+
+func TestReadBucketWithRate(t *testing.T) {
+	now := time.Now()
+	b := newReadBucket(100, now)
+	b.take(40, now)
+
+	// Raising the rate doesn't refill the bucket.
+	b = b.withRate(1000, now)
+	if b.rate != 1000 || b.tokens != 60 {
+		t.Fatalf("expected the tokens to be kept, got %v at %v", b.tokens, b.rate)
+	}
+	// Lowering it caps the tokens at the new burst.
+	b = b.withRate(10, now)
+	if b.tokens != 10 {
+		t.Fatalf("expected the tokens to be capped, got %v", b.tokens)
+	}
+	if b.withRate(0, now) != nil {
+		t.Fatal("expected no bucket without a rate")
+	}
+}
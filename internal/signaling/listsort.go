@@ -0,0 +1,60 @@
+package signaling
+
+import (
+	"strings"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrInvalidSort = util.NewError("invalid-sort", "invalid sort field or direction")
+
+// metaSortPrefix prefixes the custom data fields in a ListSort, e.g. "meta.rating".
+const metaSortPrefix = "meta."
+
+// ListSort is the order a list packet asks for, Field is "createdAt" (the
+// default), "playerCount" or "meta.<key>" for a key in
+// Config.SortableMetaKeys. Direction is "asc" or "desc" (the default).
+type ListSort struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
+}
+
+// lobbySort validates sort against the sortable fields, nil is the default order.
+func lobbySort(sort *ListSort, config *Config) (stores.LobbySort, error) {
+	if sort == nil {
+		return stores.LobbySort{}, nil
+	}
+	result := stores.LobbySort{}
+	switch sort.Direction {
+	case "", "desc":
+	case "asc":
+		result.Ascending = true
+	default:
+		return result, ErrInvalidSort.WithParams("direction", sort.Direction)
+	}
+
+	switch field := stores.LobbySortField(sort.Field); field {
+	case "", stores.SortCreatedAt:
+		result.Field = stores.SortCreatedAt
+	case stores.SortPlayerCount:
+		result.Field = field
+	default:
+		key, ok := strings.CutPrefix(sort.Field, metaSortPrefix)
+		if !ok || !isSortableMetaKey(config, key) {
+			return result, ErrInvalidSort.WithParams("field", sort.Field)
+		}
+		result.Field = stores.SortMeta
+		result.MetaKey = key
+	}
+	return result, nil
+}
+
+func isSortableMetaKey(config *Config, key string) bool {
+	for _, k := range config.SortableMetaKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
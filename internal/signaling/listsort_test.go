@@ -0,0 +1,94 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestLobbySort(t *testing.T) {
+	config := &Config{SortableMetaKeys: []string{"rating"}}
+	tests := []struct {
+		sort *ListSort
+		want stores.LobbySort
+		err  bool
+	}{
+		{nil, stores.LobbySort{}, false},
+		{&ListSort{}, stores.LobbySort{Field: stores.SortCreatedAt}, false},
+		{&ListSort{Field: "playerCount", Direction: "asc"}, stores.LobbySort{Field: stores.SortPlayerCount, Ascending: true}, false},
+		{&ListSort{Field: "meta.rating"}, stores.LobbySort{Field: stores.SortMeta, MetaKey: "rating"}, false},
+		{&ListSort{Field: "meta.level"}, stores.LobbySort{}, true},
+		{&ListSort{Field: "ping"}, stores.LobbySort{}, true},
+		{&ListSort{Field: "createdAt", Direction: "sideways"}, stores.LobbySort{}, true},
+	}
+	for _, test := range tests {
+		got, err := lobbySort(test.sort, config)
+		if test.err {
+			if !errors.Is(err, ErrInvalidSort) {
+				t.Errorf("%+v: expected ErrInvalidSort, got %v", test.sort, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%+v: expected %+v, got %+v %v", test.sort, test.want, got, err)
+		}
+	}
+}
+
+// listStore hides full lobbies when asked to.
+type listStore struct {
+	stores.Store
+}
+
+func (s *listStore) ListLobbies(_ context.Context, _ string, options stores.ListOptions) ([]stores.Lobby, error) {
+	lobbies := []stores.Lobby{{Code: "open", PlayerCount: 1, MaxPlayers: 2}}
+	if !options.HideFull {
+		lobbies = append(lobbies, stores.Lobby{Code: "full", PlayerCount: 2, MaxPlayers: 2})
+	}
+	return lobbies, nil
+}
+
+func TestListHideFull(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{store: &listStore{}, conn: conn, config: &Config{}, ID: "peer", Game: "game"}
+		for _, hideFull := range []bool{false, true} {
+			if err := p.HandleListPacket(r.Context(), ListPacket{Type: "list", RequestID: strconv.FormatBool(hideFull), HideFull: hideFull}); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	for _, want := range []struct {
+		rid     string
+		lobbies int
+	}{{"false", 2}, {"true", 1}} {
+		packet := LobbiesPacket{}
+		if err := wsjson.Read(ctx, conn, &packet); err != nil {
+			t.Fatal(err)
+		}
+		if packet.RequestID != want.rid || len(packet.Lobbies) != want.lobbies {
+			t.Fatalf("expected %d lobbies for %s, got %+v", want.lobbies, want.rid, packet)
+		}
+	}
+}
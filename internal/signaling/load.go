@@ -0,0 +1,106 @@
+package signaling
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"time"
+)
+
+// LoadSchemaVersion is the version of the NodeLoad schema, it's only bumped
+// when a field changes meaning or is removed, new fields don't bump it.
+const LoadSchemaVersion = 1
+
+// NodeLoad is the load of a node for external load balancers, it's computed
+// from in-process counters so it's cheap to poll.
+type NodeLoad struct {
+	Version  int       `json:"version"`
+	Time     time.Time `json:"time"`
+	Node     string    `json:"node"`
+	Endpoint string    `json:"endpoint"`
+	// Draining is set once the node is shutting down, it refuses new
+	// connections from then on.
+	Draining bool `json:"draining"`
+
+	// Connections are the open websocket connections, MaxConnections is
+	// Config.MaxConnections, zero is unlimited.
+	Connections    int `json:"connections"`
+	MaxConnections int `json:"maxConnections"`
+	// Lobbies are the lobbies with at least one member on this node.
+	Lobbies int                 `json:"lobbies"`
+	Games   map[string]GameLoad `json:"games"`
+
+	Goroutines int `json:"goroutines"`
+	CPUs       int `json:"cpus"`
+	// CPUSeconds is the cpu time used by the process since it started, it's
+	// only available on Linux. MemoryBytes is the memory mapped by the Go
+	// runtime, HeapBytes the part of it holding live and unswept objects.
+	CPUSeconds  *float64 `json:"cpuSeconds,omitempty"`
+	MemoryBytes uint64   `json:"memoryBytes"`
+	HeapBytes   uint64   `json:"heapBytes"`
+}
+
+// GameLoad is the share of a game in the load of a node, connections that
+// didn't say hello yet aren't counted towards a game.
+type GameLoad struct {
+	Connections int `json:"connections"`
+	Lobbies     int `json:"lobbies"`
+}
+
+// Load returns the current load of the node.
+func (n *Node) Load() NodeLoad {
+	load := NodeLoad{
+		Version:        LoadSchemaVersion,
+		Time:           time.Now(),
+		Node:           n.id,
+		Endpoint:       n.endpoint,
+		Draining:       n.isClosing(),
+		MaxConnections: n.maxConnections,
+		Goroutines:     runtime.NumGoroutine(),
+		CPUs:           runtime.GOMAXPROCS(0),
+	}
+	load.Connections, load.Lobbies, load.Games = n.Drainer.registry.Load()
+
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/objects:bytes"},
+	}
+	metrics.Read(samples)
+	load.MemoryBytes = samples[0].Value.Uint64()
+	load.HeapBytes = samples[1].Value.Uint64()
+
+	if raw, err := os.ReadFile("/proc/self/stat"); err == nil {
+		if seconds, ok := parseProcCPU(raw); ok {
+			load.CPUSeconds = &seconds
+		}
+	}
+	return load
+}
+
+// procClockTicks is USER_HZ, the unit of the cpu times in /proc.
+const procClockTicks = 100
+
+// parseProcCPU returns the user and system time of a /proc/<pid>/stat line.
+func parseProcCPU(raw []byte) (float64, bool) {
+	// The command name can hold spaces and parentheses, the fields after it
+	// start at the last parenthesis with the state (field 3).
+	i := bytes.LastIndexByte(raw, ')')
+	if i < 0 {
+		return 0, false
+	}
+	fields := bytes.Fields(raw[i+1:])
+	if len(fields) < 13 {
+		return 0, false
+	}
+	utime, err := strconv.ParseUint(string(fields[11]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	stime, err := strconv.ParseUint(string(fields[12]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return float64(utime+stime) / procClockTicks, true
+}
@@ -0,0 +1,63 @@
+package signaling
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNodeLoad(t *testing.T) {
+	registry := newPeerRegistry()
+	peers := []*Peer{
+		{Game: "shooter", ID: "a"},
+		{Game: "shooter", ID: "b"},
+		{Game: "shooter", ID: "c"},
+		{Game: "puzzle", ID: "d"},
+		{}, // Didn't say hello yet.
+	}
+	for _, p := range peers {
+		registry.Add(p)
+		if p.Game != "" {
+			registry.Identify(p)
+		}
+	}
+	registry.Join(peers[0], "one")
+	registry.Join(peers[1], "one")
+	registry.Join(peers[2], "two")
+	registry.Join(peers[3], "one")
+
+	node := &Node{
+		Drainer:        &Drainer{registry: registry},
+		id:             "node-1",
+		maxConnections: 100,
+		connections:    &sync.WaitGroup{},
+	}
+	load := node.Load()
+	if load.Version != LoadSchemaVersion || load.Node != "node-1" || load.MaxConnections != 100 || load.Draining {
+		t.Fatalf("unexpected node info %+v", load)
+	}
+	if load.Connections != 5 || load.Lobbies != 3 {
+		t.Fatalf("expected 5 connections in 3 lobbies, got %d in %d", load.Connections, load.Lobbies)
+	}
+	if load.Games["shooter"] != (GameLoad{Connections: 3, Lobbies: 2}) || load.Games["puzzle"] != (GameLoad{Connections: 1, Lobbies: 1}) || len(load.Games) != 2 {
+		t.Fatalf("unexpected games %+v", load.Games)
+	}
+	if load.MemoryBytes == 0 || load.Goroutines == 0 {
+		t.Fatalf("expected the runtime stats, got %+v", load)
+	}
+
+	node.closing = true
+	if !node.Load().Draining {
+		t.Fatal("expected a closing node to be draining")
+	}
+}
+
+func TestParseProcCPU(t *testing.T) {
+	raw := []byte("1234 (netlib (x) y) S 1 1234 1234 0 -1 4194560 2500 0 0 0 250 75 0 0 20 0 12 0 100 1000000 500\n")
+	seconds, ok := parseProcCPU(raw)
+	if !ok || seconds != 3.25 {
+		t.Fatalf("expected 3.25 seconds, got %v (%v)", seconds, ok)
+	}
+	if _, ok := parseProcCPU([]byte("garbage")); ok {
+		t.Fatal("expected garbage not to parse")
+	}
+}
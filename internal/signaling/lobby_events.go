@@ -0,0 +1,25 @@
+package signaling
+
+import (
+	"context"
+
+	"github.com/poki/netlib/internal/util"
+	"github.com/poki/netlib/internal/webhook"
+)
+
+// Lobby lifecycle events sent to the webhook.
+const (
+	LobbyCreated = "lobby.created"
+	LobbyStarted = "lobby.started"
+	LobbyClosed  = "lobby.closed"
+)
+
+func emitLobbyEvent(ctx context.Context, hook *webhook.Client, typ, game, lobby, peer string) {
+	hook.Emit(ctx, webhook.Event{
+		Type:  typ,
+		Time:  util.Now(ctx).UnixMilli(),
+		Game:  game,
+		Lobby: lobby,
+		Peer:  peer,
+	})
+}
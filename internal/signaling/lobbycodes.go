@@ -0,0 +1,25 @@
+package signaling
+
+import (
+	"context"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+// generateLobbyCode returns a code for a lobby created without a code format,
+// codes are mixed case when they're case sensitive.
+func generateLobbyCode(ctx context.Context, caseSensitive bool) string {
+	if caseSensitive {
+		return util.GenerateCaseSensitiveLobbyCode(ctx)
+	}
+	return util.GenerateLobbyCode(ctx)
+}
+
+// normalizeLobbyCode normalizes a code sent by a peer the way codes are
+// generated, the store only finds lobbies by their exact code.
+func (c *Config) normalizeLobbyCode(code string) string {
+	if c.CaseSensitiveLobbyCodes {
+		return util.NormalizeCaseSensitiveLobbyCode(code)
+	}
+	return util.NormalizeLobbyCode(code)
+}
@@ -0,0 +1,56 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestJoinPastLobbyLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		// Without a store any attempt to join, by code or invite, would panic.
+		p := &Peer{conn: conn, config: &Config{}, ID: "peerA", Game: "game", Lobby: "lobbyA"}
+		if err := p.HandleJoinPacket(r.Context(), JoinPacket{RequestID: "rid", Lobby: "lobbyB", Invite: "token"}); err != nil {
+			t.Error(err)
+		}
+		if p.Lobby != "lobbyA" {
+			t.Errorf("expected the peer to stay in its lobby, got %q", p.Lobby)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	_, raw, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := struct {
+		Type      string
+		RequestID string `json:"rid"`
+		Code      string
+		Params    map[string]any
+	}{}
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.RequestID != "rid" || reply.Code != "lobby-limit" || reply.Params["max"] != float64(1) || reply.Params["lobby"] != "lobbyA" {
+		t.Fatalf("expected a lobby-limit error, got %s", raw)
+	}
+}
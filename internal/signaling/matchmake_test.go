@@ -0,0 +1,72 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// reserveStore fails every reservation after it might have been made.
+type reserveStore struct {
+	*shutdownStore
+
+	released chan string
+}
+
+func (s *reserveStore) ReserveSlot(ctx context.Context, game, id string, maxPlayers, limit int, ttl time.Duration) (string, error) {
+	return "", errors.New("connection reset")
+}
+
+func (s *reserveStore) ReleaseSlot(ctx context.Context, game, id string) error {
+	s.released <- id
+	return nil
+}
+
+func TestMatchmakeReleasesSlotOnDisconnect(t *testing.T) {
+	ctx := context.Background()
+	store := &reserveStore{
+		shutdownStore: &shutdownStore{t: t, timeouts: make(map[string]string)},
+		released:      make(chan string, 1),
+	}
+	_, handler, _ := Handler(ctx, store, nil, Config{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readServerInfo(ctx, t, conn)
+	if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: "4307bd86-e1df-41b8-b9df-e22afcf084bd"}); err != nil {
+		t.Fatal(err)
+	}
+	welcome := WelcomePacket{}
+	if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+		t.Fatal(err)
+	}
+	if err := wsjson.Write(ctx, conn, MatchmakePacket{Type: "matchmake", MaxPlayers: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed reservation disconnects the peer, reading completes the close.
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			break
+		}
+	}
+	select {
+	case id := <-store.released:
+		if id != welcome.ID {
+			t.Fatalf("expected the slot of %s to be released, got %s", welcome.ID, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the slot to be released when the peer disconnected")
+	}
+}
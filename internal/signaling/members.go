@@ -0,0 +1,143 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// membersSubscription forwards the membership changes of a lobby to a peer.
+// Deltas can arrive before the roster was read, those are held back until
+// the roster is queued and dropped when the roster already includes them.
+type membersSubscription struct {
+	lobby  string
+	cancel context.CancelFunc
+
+	mutex   sync.Mutex
+	version int64 // -1 until the roster is queued.
+	pending []stores.MembersDelta
+	stopped bool
+}
+
+// HandleSubscribeMembersPacket replies with the members of the lobby and the
+// membership version, and from then on sends a members-delta packet for every
+// change. Subscribing again resyncs, the subscription ends when the peer
+// leaves the lobby or sends unsubscribe-members.
+func (p *Peer) HandleSubscribeMembersPacket(ctx context.Context, packet SubscribeMembersPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		p.ReplyError(ctx, packet.RequestID, stores.ErrNotInLobby)
+		return nil
+	}
+	p.unsubscribeMembers()
+
+	// Subscribe before reading the roster so no change falls in between.
+	sctx, cancel := context.WithCancel(p.connCtx)
+	sub := &membersSubscription{lobby: p.Lobby, cancel: cancel, version: -1}
+	p.store.Subscribe(sctx, stores.MembersTopic(p.Game, p.Lobby), func(_ context.Context, data []byte) {
+		delta := stores.MembersDelta{}
+		if err := json.Unmarshal(data, &delta); err != nil {
+			logger.Error("failed to unmarshal members delta", zap.Error(err))
+			return
+		}
+		sub.deliver(p, delta)
+	})
+
+	members, err := p.store.GetMembers(ctx, p.Game, p.Lobby)
+	if err != nil {
+		cancel()
+		return err
+	}
+	p.members = sub
+
+	roster := MembersPacket{
+		RequestID: packet.RequestID,
+		Type:      "members",
+		Lobby:     sub.lobby,
+		Version:   members.Version,
+		Members:   make([]Member, 0, len(members.Peers)),
+	}
+	spectators := make(map[string]bool, len(members.Spectators))
+	for _, id := range members.Spectators {
+		spectators[id] = true
+	}
+	for _, id := range members.Peers {
+		role := stores.RolePlayer
+		if spectators[id] {
+			role = stores.RoleSpectator
+		}
+		roster.Members = append(roster.Members, Member{ID: id, Data: members.PeerData[id], Player: members.Players[id], Role: role})
+	}
+	sort.Slice(roster.Members, func(i, j int) bool {
+		return roster.Members[i].ID < roster.Members[j].ID
+	})
+	sub.start(p, roster)
+	return nil
+}
+
+// start queues the roster followed by the deltas held back while it was read.
+func (s *membersSubscription) start(p *Peer, roster MembersPacket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.version = roster.Version
+	p.Enqueue(roster, nil)
+	for _, delta := range s.pending {
+		s.forward(p, delta)
+	}
+	s.pending = nil
+}
+
+func (s *membersSubscription) deliver(p *Peer, delta stores.MembersDelta) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return
+	} else if s.version < 0 {
+		s.pending = append(s.pending, delta)
+		return
+	}
+	s.forward(p, delta)
+}
+
+func (s *membersSubscription) forward(p *Peer, delta stores.MembersDelta) {
+	if delta.Version <= s.version {
+		return
+	}
+	p.Enqueue(MembersDeltaPacket{
+		Type:    "members-delta",
+		Lobby:   s.lobby,
+		Version: delta.Version,
+		Op:      delta.Op,
+		ID:      delta.ID,
+		Data:    delta.Data,
+		Player:  delta.Player,
+		Role:    delta.Role,
+	}, nil)
+}
+
+func (p *Peer) unsubscribeMembers() {
+	if p.members != nil {
+		p.members.cancel()
+		p.members.mutex.Lock()
+		p.members.stopped = true
+		p.members.mutex.Unlock()
+		p.members = nil
+	}
+}
+
+// syncMembersSubscription ends the subscription once the peer left its
+// lobby, it must be called from the goroutine handling p.
+func (p *Peer) syncMembersSubscription() {
+	if p.members != nil && p.members.lobby != p.Lobby {
+		p.unsubscribeMembers()
+	}
+}
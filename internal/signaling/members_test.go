@@ -0,0 +1,68 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+func TestMembersSubscriptionOrder(t *testing.T) {
+	p := &Peer{
+		config: &Config{MaxQueuedMessages: 8, MaxQueuedBytes: 4096},
+		queues: newQueues(8),
+	}
+	sub := &membersSubscription{lobby: "lobby", cancel: func() {}, version: -1}
+
+	// Deltas that arrive while the roster is read are held back, the ones
+	// the roster already includes are dropped.
+	sub.deliver(p, stores.MembersDelta{Version: 3, Op: "add", ID: "a"})
+	sub.deliver(p, stores.MembersDelta{Version: 4, Op: "add", ID: "b"})
+	sub.start(p, MembersPacket{Type: "members", Lobby: "lobby", Version: 3, Members: []Member{{ID: "a"}}})
+	sub.deliver(p, stores.MembersDelta{Version: 5, Op: "remove", ID: "a"})
+
+	p.members = sub
+	p.unsubscribeMembers()
+	sub.deliver(p, stores.MembersDelta{Version: 6, Op: "add", ID: "c"})
+
+	var got []string
+	for {
+		select {
+		case q := <-p.queues[PriorityControl]:
+			packet := struct {
+				Type    string
+				Version int64
+				ID      string
+			}{}
+			if err := json.Unmarshal(q.packet, &packet); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, packet.Type+":"+packet.ID)
+			if packet.Type == "members" && packet.Version != 3 {
+				t.Fatalf("unexpected roster version %d", packet.Version)
+			}
+			continue
+		default:
+		}
+		break
+	}
+	want := []string{"members:", "members-delta:b", "members-delta:a"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestSyncMembersSubscription(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Peer{Lobby: "b", members: &membersSubscription{lobby: "a", cancel: cancel}}
+	p.syncMembersSubscription()
+	if p.members != nil || ctx.Err() == nil {
+		t.Fatal("expected the subscription to end after leaving the lobby")
+	}
+}
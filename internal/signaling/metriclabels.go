@@ -0,0 +1,19 @@
+package signaling
+
+// otherLabel is the metric label of the values that aren't allowed.
+const otherLabel = "other"
+
+// metricLabel bounds a label that comes from clients or the CDN to the
+// allowed values, everything else is labelled "other" so the number of
+// series can't grow without bound.
+func metricLabel(allowed []string, value string) string {
+	if value == "" {
+		return ""
+	}
+	for _, v := range allowed {
+		if v == value {
+			return value
+		}
+	}
+	return otherLabel
+}
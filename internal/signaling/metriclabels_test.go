@@ -0,0 +1,21 @@
+package signaling
+
+import "testing"
+
+func TestMetricLabel(t *testing.T) {
+	allowed := []string{"AMS", "FRA"}
+	for value, expected := range map[string]string{
+		"AMS":  "AMS",
+		"FRA":  "FRA",
+		"ams":  otherLabel,
+		"XYZ1": otherLabel,
+		"":     "",
+	} {
+		if got := metricLabel(allowed, value); got != expected {
+			t.Errorf("expected %q to be labelled %q, got %q", value, expected, got)
+		}
+	}
+	if got := metricLabel(nil, "AMS"); got != otherLabel {
+		t.Errorf("expected nothing to be allowed without an allow-list, got %q", got)
+	}
+}
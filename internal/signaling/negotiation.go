@@ -0,0 +1,143 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// negotiationLimiter caps the offers and answers a peer sends to each of its
+// lobbymates, so a client stuck in a renegotiation loop can't flood the lobby.
+// Candidates aren't counted, a single negotiation can have many of them.
+type negotiationLimiter struct {
+	limit  int
+	window time.Duration
+
+	mutex sync.Mutex
+	pairs map[string]*negotiationPair
+}
+
+// negotiationPair holds the times of the negotiations forwarded to a single
+// recipient within the window, oldest first.
+type negotiationPair struct {
+	sent    []time.Time
+	dropped int
+}
+
+func newNegotiationLimiter(config *Config) *negotiationLimiter {
+	if config.MaxNegotiations <= 0 {
+		return nil
+	}
+	return &negotiationLimiter{
+		limit:  config.MaxNegotiations,
+		window: config.NegotiationWindow,
+		pairs:  make(map[string]*negotiationPair),
+	}
+}
+
+// setNegotiationLimit changes the negotiation limit of the peer, see
+// syncLimits. Negotiations already counted are kept.
+func (p *Peer) setNegotiationLimit(limit int) {
+	switch {
+	case limit <= 0:
+		p.negotiations = nil
+	case p.negotiations == nil:
+		p.negotiations = &negotiationLimiter{
+			limit:  limit,
+			window: p.config.NegotiationWindow,
+			pairs:  make(map[string]*negotiationPair),
+		}
+	default:
+		p.negotiations.mutex.Lock()
+		p.negotiations.limit = limit
+		p.negotiations.mutex.Unlock()
+	}
+}
+
+// allow records a negotiation sent to recipient, it returns false when the
+// pair is over its limit and the negotiation must be dropped. dropped is the
+// number of negotiations dropped in a row including this one.
+func (l *negotiationLimiter) allow(recipient string, now time.Time) (ok bool, dropped int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	pair, found := l.pairs[recipient]
+	if !found {
+		pair = &negotiationPair{}
+		l.pairs[recipient] = pair
+	}
+	pair.sent = expire(pair.sent, now.Add(-l.window))
+	if len(pair.sent) >= l.limit {
+		pair.dropped++
+		return false, pair.dropped
+	}
+	pair.sent = append(pair.sent, now)
+	pair.dropped = 0
+
+	// Forget the lobbymates that went quiet, e.g. after leaving the lobby.
+	for id, other := range l.pairs {
+		if other.dropped == 0 && len(expire(other.sent, now.Add(-l.window))) == 0 {
+			delete(l.pairs, id)
+		}
+	}
+	return true, 0
+}
+
+// expire drops the times up to cutoff from sent.
+func expire(sent []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(sent) && !sent[i].After(cutoff) {
+		i++
+	}
+	return sent[i:]
+}
+
+// isNegotiation reports whether the packet is a description that starts or
+// answers a negotiation, rollbacks aren't counted.
+func isNegotiation(typ string, raw []byte) bool {
+	if typ != "description" {
+		return false
+	}
+	packet := struct {
+		Description *struct {
+			Type string `json:"type"`
+		} `json:"description"`
+	}{}
+	if err := json.Unmarshal(raw, &packet); err != nil || packet.Description == nil {
+		return false
+	}
+	switch packet.Description.Type {
+	case "offer", "answer", "pranswer":
+		return true
+	}
+	return false
+}
+
+// negotiationThrottled checks the negotiation limit of the pair, dropped
+// negotiations are counted and the first one in a row is logged.
+func (p *Peer) negotiationThrottled(ctx context.Context, recipient string) bool {
+	if p.negotiations == nil {
+		return false
+	}
+	ok, dropped := p.negotiations.allow(recipient, time.Now())
+	if ok {
+		return false
+	}
+	metrics.Inc("netlib_negotiations_throttled_total")
+	if dropped == 1 {
+		logging.GetLogger(ctx).Warn("throttling negotiations",
+			zap.String("game", p.Game),
+			zap.String("lobby", p.Lobby),
+			zap.String("peer", p.ID),
+			zap.String("recipient", recipient),
+			zap.Int("max", p.negotiations.limit),
+			zap.Duration("window", p.negotiations.window),
+		)
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+func TestNegotiationLimiter(t *testing.T) {
+	limiter := newNegotiationLimiter(&Config{MaxNegotiations: 3, NegotiationWindow: 10 * time.Second})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow("b", now); !ok {
+			t.Fatalf("expected negotiation %d to pass", i)
+		}
+	}
+	if ok, dropped := limiter.allow("b", now); ok || dropped != 1 {
+		t.Fatalf("expected the negotiation over the limit to be dropped, got %v %d", ok, dropped)
+	}
+	if ok, _ := limiter.allow("c", now); !ok {
+		t.Fatal("expected other pairs to have their own limit")
+	}
+	if ok, _ := limiter.allow("b", now.Add(10*time.Second)); !ok {
+		t.Fatal("expected the pair to recover after the window")
+	}
+
+	if newNegotiationLimiter(&Config{}) != nil {
+		t.Fatal("expected no limiter without MaxNegotiations")
+	}
+}
+
+// publishStore records the published packets per topic, its lobby holds a,
+// b and c.
+type publishStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	published map[string]int
+}
+
+func (s *publishStore) Publish(ctx context.Context, topic string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.published[topic]++
+	return nil
+}
+
+func (s *publishStore) GetLobby(context.Context, string, string) ([]string, error) {
+	return []string{"a", "b", "c"}, nil
+}
+
+func TestRenegotiationLoopThrottled(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{MaxNegotiations: 5, NegotiationWindow: time.Minute}
+	store := &publishStore{published: make(map[string]int)}
+	newPeer := func(id string) *Peer {
+		return &Peer{
+			ID:           id,
+			Game:         "game",
+			Lobby:        "lobby",
+			store:        store,
+			config:       config,
+			negotiations: newNegotiationLimiter(config),
+		}
+	}
+	a, b, c := newPeer("a"), newPeer("b"), newPeer("c")
+	description := func(from *Peer, to, typ string) {
+		raw := fmt.Sprintf(`{"type":"description","source":%q,"recipient":%q,"description":{"type":%q,"sdp":"v=0"}}`, from.ID, to, typ)
+		if err := from.HandlePacket(ctx, "description", []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A normal negotiation with an ICE restart, and its candidates.
+	for i := 0; i < 2; i++ {
+		description(a, "c", "offer")
+		description(c, "a", "answer")
+	}
+	for i := 0; i < 20; i++ {
+		raw := `{"type":"candidate","source":"a","recipient":"c","candidate":{"candidate":""}}`
+		if err := a.HandlePacket(ctx, "candidate", []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.published["gamelobbyc"] != 22 || store.published["gamelobbya"] != 2 {
+		t.Fatalf("expected the negotiation to pass unimpeded, got %v", store.published)
+	}
+
+	// b is stuck in a renegotiation loop with a.
+	for i := 0; i < 100; i++ {
+		description(b, "a", "offer")
+	}
+	if got := store.published["gamelobbya"]; got != 2+config.MaxNegotiations {
+		t.Fatalf("expected the offer loop to be throttled to %d, got %d", config.MaxNegotiations, got-2)
+	}
+
+	// The loop doesn't affect the other pairs.
+	description(a, "c", "offer")
+	description(c, "b", "offer")
+	if store.published["gamelobbyc"] != 23 || store.published["gamelobbyb"] != 1 {
+		t.Fatalf("expected the other pairs to pass, got %v", store.published)
+	}
+}
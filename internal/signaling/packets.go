@@ -0,0 +1,287 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+// CompactSubprotocol is the websocket subprotocol clients can negotiate to
+// send and receive packet types as the integers below instead of strings.
+const CompactSubprotocol = "netlib.compact.v0"
+
+// Packet type identifiers used by the compact subprotocol. These values are
+// part of the protocol, never renumber them, only append new ones.
+const (
+	PacketHello = iota + 1
+	PacketWelcome
+	PacketPing
+	PacketPong
+	PacketList
+	PacketLobbies
+	PacketCreate
+	PacketJoin
+	PacketJoined
+	PacketLeave
+	PacketClose
+	PacketConnect
+	PacketDisconnect
+	PacketConnected
+	PacketDisconnected
+	PacketCandidate
+	PacketDescription
+	PacketCredentials
+	PacketEvent
+	PacketError
+	PacketSetVisibility
+	PacketVisibility
+	PacketSetPeerData
+	PacketPeerData
+	PacketMatchmake
+	PacketChunk
+	PacketAck
+	PacketNack
+	PacketSetReady
+	PacketResetReady
+	PacketReady
+	PacketAllReady
+	PacketStart
+	PacketReconnect
+	PacketReconnected
+	PacketCreateInvite
+	PacketInvite
+	PacketGetLobby
+	PacketLobbyInfo
+	PacketPeerReconnecting
+	PacketPeerReconnected
+	PacketDrain
+	PacketTransferLeader
+	PacketLeader
+	PacketConnectionResult
+	PacketSwitchLobby
+	PacketUpdateLobby
+	PacketLobbyUpdated
+	PacketLobbyClosed
+	PacketSubscribeMembers
+	PacketUnsubscribeMembers
+	PacketMembers
+	PacketMembersDelta
+	PacketKVSet
+	PacketKVCompareAndSet
+	PacketKVIncrement
+	PacketKVGet
+	PacketKV
+	PacketKVChanged
+	PacketConnectionExpiring
+	PacketUpdateCustomData
+	PacketCustomDataChanged
+	PacketGetCustomData
+	PacketCustomData
+	PacketServerInfo
+	PacketGetStats
+	PacketStats
+	PacketBatch
+	PacketBatchResult
+	PacketSetLobbyState
+	PacketLobbyState
+	PacketMatchmakingTicket
+	PacketTicket
+	PacketCancelTicket
+	PacketTicketCancelled
+	PacketTicketExpired
+	PacketTicketMatched
+	PacketSubscribePresence
+	PacketUnsubscribePresence
+	PacketPresence
+	PacketPresenceChanged
+)
+
+// PacketTypeIDs maps every packet type to its compact identifier, it also
+// keeps the cardinality of metric labels bounded.
+var PacketTypeIDs = map[string]int{
+	"hello":             PacketHello,
+	"welcome":           PacketWelcome,
+	"ping":              PacketPing,
+	"pong":              PacketPong,
+	"list":              PacketList,
+	"lobbies":           PacketLobbies,
+	"create":            PacketCreate,
+	"join":              PacketJoin,
+	"joined":            PacketJoined,
+	"leave":             PacketLeave,
+	"close":             PacketClose,
+	"connect":           PacketConnect,
+	"disconnect":        PacketDisconnect,
+	"connected":         PacketConnected,
+	"disconnected":      PacketDisconnected,
+	"candidate":         PacketCandidate,
+	"description":       PacketDescription,
+	"credentials":       PacketCredentials,
+	"event":             PacketEvent,
+	"error":             PacketError,
+	"set-visibility":    PacketSetVisibility,
+	"visibility":        PacketVisibility,
+	"set-peer-data":     PacketSetPeerData,
+	"peer-data":         PacketPeerData,
+	"matchmake":         PacketMatchmake,
+	"chunk":             PacketChunk,
+	"ack":               PacketAck,
+	"nack":              PacketNack,
+	"set-ready":         PacketSetReady,
+	"reset-ready":       PacketResetReady,
+	"ready":             PacketReady,
+	"all-ready":         PacketAllReady,
+	"start":             PacketStart,
+	"reconnect":         PacketReconnect,
+	"reconnected":       PacketReconnected,
+	"create-invite":     PacketCreateInvite,
+	"invite":            PacketInvite,
+	"get-lobby":         PacketGetLobby,
+	"lobby-info":        PacketLobbyInfo,
+	"peer-reconnecting": PacketPeerReconnecting,
+	"peer-reconnected":  PacketPeerReconnected,
+	"drain":             PacketDrain,
+	"transfer-leader":   PacketTransferLeader,
+	"leader":            PacketLeader,
+	"connection-result": PacketConnectionResult,
+	"switch-lobby":      PacketSwitchLobby,
+	"update-lobby":      PacketUpdateLobby,
+	"lobby-updated":     PacketLobbyUpdated,
+	"lobby-closed":      PacketLobbyClosed,
+
+	"subscribe-members":   PacketSubscribeMembers,
+	"unsubscribe-members": PacketUnsubscribeMembers,
+	"members":             PacketMembers,
+	"members-delta":       PacketMembersDelta,
+
+	"kv-set":       PacketKVSet,
+	"kv-cas":       PacketKVCompareAndSet,
+	"kv-increment": PacketKVIncrement,
+	"kv-get":       PacketKVGet,
+	"kv":           PacketKV,
+	"kv-changed":   PacketKVChanged,
+
+	"connection-expiring": PacketConnectionExpiring,
+
+	"update-custom-data":  PacketUpdateCustomData,
+	"custom-data-changed": PacketCustomDataChanged,
+	"get-custom-data":     PacketGetCustomData,
+	"custom-data":         PacketCustomData,
+
+	"server-info": PacketServerInfo,
+
+	"get-stats": PacketGetStats,
+	"stats":     PacketStats,
+
+	"batch":        PacketBatch,
+	"batch-result": PacketBatchResult,
+
+	"set-lobby-state": PacketSetLobbyState,
+	"lobby-state":     PacketLobbyState,
+
+	"matchmaking-ticket": PacketMatchmakingTicket,
+	"ticket":             PacketTicket,
+	"cancel-ticket":      PacketCancelTicket,
+	"ticket-cancelled":   PacketTicketCancelled,
+	"ticket-expired":     PacketTicketExpired,
+	"ticket-matched":     PacketTicketMatched,
+
+	"subscribe-presence":   PacketSubscribePresence,
+	"unsubscribe-presence": PacketUnsubscribePresence,
+	"presence":             PacketPresence,
+	"presence-changed":     PacketPresenceChanged,
+}
+
+var packetTypeNames = func() map[int]string {
+	names := make(map[int]string, len(PacketTypeIDs))
+	for name, id := range PacketTypeIDs {
+		names[id] = name
+	}
+	return names
+}()
+
+// decodeCompactPacket replaces an integer packet type with its string name so
+// the rest of the handler doesn't need to know about the compact subprotocol.
+func decodeCompactPacket(raw []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	var id int
+	if err := json.Unmarshal(fields["type"], &id); err != nil {
+		return raw, nil // Not an integer type, leave the packet as is.
+	}
+	name, ok := packetTypeNames[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown compact packet type %d", id)
+	}
+	fields["type"], _ = json.Marshal(name)
+	return json.Marshal(fields)
+}
+
+// encodeCompactPacket replaces the string packet type with its integer
+// identifier, types without an identifier are left as strings.
+func encodeCompactPacket(raw []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	var name string
+	if err := json.Unmarshal(fields["type"], &name); err != nil {
+		return raw, nil
+	}
+	id, ok := PacketTypeIDs[name]
+	if !ok {
+		return raw, nil
+	}
+	fields["type"], _ = json.Marshal(id)
+	return json.Marshal(fields)
+}
+
+// MatchmakingReservationTTL is how long a slot reserved during matchmaking is
+// held for a peer before it expires and is given to someone else.
+const MatchmakingReservationTTL = 10 * time.Second
+
+// MaxPeerDataSize is the maximum size of the peer data blob in bytes when encoded as JSON.
+const MaxPeerDataSize = 1024
+
+var ErrPeerDataTooLarge = util.NewError("peer-data-too-large", fmt.Sprintf("peer data exceeds %d bytes", MaxPeerDataSize)).WithParams("max", MaxPeerDataSize)
+
+// validatePeerData validates the peer data sent by a client and returns the
+// peer data to store: data with publicKey, or else the public key of the
+// current peer data. The size limit includes the public key.
+func validatePeerData(data map[string]any, publicKey string, current map[string]any) (map[string]any, error) {
+	if err := validatePublicKey(publicKey); err != nil {
+		return nil, err
+	}
+	if publicKey != "" {
+		data = withPublicKey(data, publicKey)
+	} else if data != nil {
+		data = keepPublicKey(data, current)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	if key, found := data[PublicKeyField]; found {
+		if key, ok := key.(string); !ok || validatePublicKey(key) != nil {
+			return nil, ErrInvalidPublicKey
+		}
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > MaxPeerDataSize {
+		return nil, ErrPeerDataTooLarge
+	}
+	return data, nil
+}
+
+func packetTypeLabel(typ string) string {
+	if _, ok := PacketTypeIDs[typ]; ok {
+		return typ
+	}
+	return "unknown"
+}
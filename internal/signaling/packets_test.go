@@ -0,0 +1,97 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestCompactPacketRoundTrip(t *testing.T) {
+	raw, err := json.Marshal(ConnectPacket{Type: "connect", ID: "peerA", Polite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compact, err := encodeCompactPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typeOnly := struct{ Type int }{}
+	if err := json.Unmarshal(compact, &typeOnly); err != nil {
+		t.Fatal(err)
+	}
+	if typeOnly.Type != PacketConnect {
+		t.Fatalf("expected type %d, got %d", PacketConnect, typeOnly.Type)
+	}
+
+	decoded, err := decodeCompactPacket(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := ConnectPacket{}
+	if err := json.Unmarshal(decoded, &packet); err != nil {
+		t.Fatal(err)
+	}
+	if packet.Type != "connect" || packet.ID != "peerA" || !packet.Polite {
+		t.Fatalf("unexpected packet after round trip: %+v", packet)
+	}
+}
+
+func TestDecodeCompactPacketUnknownType(t *testing.T) {
+	if _, err := decodeCompactPacket([]byte(`{"type":9999}`)); err == nil {
+		t.Fatal("expected an error for an unknown packet type")
+	}
+	raw := []byte(`{"type":"pong"}`)
+	if decoded, err := decodeCompactPacket(raw); err != nil || string(decoded) != string(raw) {
+		t.Fatalf("string types should pass through unchanged, got %s (%v)", decoded, err)
+	}
+}
+
+func TestReplyErrorEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{conn: conn, config: &Config{}, compact: true}
+		p.enableDictionary(p.negotiate([]string{DictionaryCapability}, ProtocolVersion), ProtocolVersion)
+		p.ReplyError(r.Context(), "rid", ErrHandshakeRequired)
+		conn.Read(r.Context()) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	typ, raw, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.MessageBinary {
+		t.Fatal("expected the error to be compressed with the dictionary")
+	}
+	if raw, err = compressionDictionaries[ProtocolVersion].Decompress(raw); err != nil {
+		t.Fatal(err)
+	}
+	packet := struct {
+		Type      int
+		RequestID string `json:"rid"`
+		Code      string
+	}{}
+	if err := json.Unmarshal(raw, &packet); err != nil {
+		t.Fatal(err)
+	}
+	if packet.Type != PacketError || packet.RequestID != "rid" || packet.Code != ErrHandshakeRequired.Code {
+		t.Fatalf("expected a compact error packet, got %s", raw)
+	}
+}
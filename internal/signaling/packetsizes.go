@@ -0,0 +1,71 @@
+package signaling
+
+import (
+	"github.com/poki/netlib/internal/metrics"
+)
+
+// packetSizeBuckets are the buckets (in bytes) of the packet size histogram,
+// from a ping up to the read limit.
+var packetSizeBuckets = []float64{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+// observePacketSize records the size of a packet as it went over the
+// websocket, direction is "in" or "out".
+func observePacketSize(direction, typ string, size int) {
+	metrics.ObserveBuckets("netlib_packet_size_bytes", float64(size), packetSizeBuckets, "type", packetTypeLabel(typ), "direction", direction)
+}
+
+// packetType returns the type of a JSON packet without decoding it, only the
+// "type" key of the outer object counts. It returns "" when there is none.
+func packetType(raw []byte) string {
+	depth := 0
+	key := false // Whether the string at depth 1 that's being read is a key.
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '{', '[':
+			depth++
+			key = depth == 1 && raw[i] == '{'
+		case '}', ']':
+			depth--
+		case ',':
+			key = depth == 1
+		case '"':
+			end := i + 1
+			for end < len(raw) && raw[end] != '"' {
+				if raw[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(raw) {
+				return ""
+			}
+			if key && string(raw[i+1:end]) == "type" {
+				return stringValue(raw[end+1:])
+			}
+			key = false
+			i = end
+		}
+	}
+	return ""
+}
+
+// stringValue returns the string after the colon that starts raw, "" when
+// the value isn't a plain string.
+func stringValue(raw []byte) string {
+	i := 0
+	for i < len(raw) && (raw[i] == ' ' || raw[i] == '\t' || raw[i] == '\n' || raw[i] == '\r' || raw[i] == ':') {
+		i++
+	}
+	if i >= len(raw) || raw[i] != '"' {
+		return ""
+	}
+	for end := i + 1; end < len(raw); end++ {
+		switch raw[end] {
+		case '\\':
+			return ""
+		case '"':
+			return string(raw[i+1 : end])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,169 @@
+package signaling
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/metrics"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestPacketType(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{`{"type":"ping"}`, "ping"},
+		{`{ "rid" : "1", "type" : "join" }`, "join"},
+		{`{"description":{"type":"offer","sdp":"v=0"},"type":"description"}`, "description"},
+		{`{"data":["type",{"type":"x"}],"note":"a \"type\": \"y\"","type":"candidate"}`, "candidate"},
+		{`{"type":1}`, ""},
+		{`{"id":"a"}`, ""},
+		{`{"type":"trunc`, ""},
+		{``, ""},
+	}
+	for _, test := range tests {
+		if got := packetType([]byte(test.raw)); got != test.want {
+			t.Errorf("packetType(%s) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+// scrapePacketSizes returns the count and sum of the packet size histogram
+// per direction and type.
+func scrapePacketSizes(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "netlib_packet_size_bytes_count") && !strings.HasPrefix(line, "netlib_packet_size_bytes_sum") {
+			continue
+		}
+		series, value, _ := strings.Cut(line, " ")
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values[series] = f
+	}
+	return values
+}
+
+func packetSizeSeries(suffix, direction, typ string) string {
+	return fmt.Sprintf(`netlib_packet_size_bytes_%s{type="%s",direction="%s"}`, suffix, typ, direction)
+}
+
+func TestPacketSizes(t *testing.T) {
+	ctx := context.Background()
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	_, handler, _ := Handler(ctx, store, nil, Config{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	before := scrapePacketSizes(t)
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readServerInfo(ctx, t, conn)
+	hello, _ := json.Marshal(HelloPacket{Type: "hello", Game: "4307bd86-e1df-41b8-b9df-e22afcf084bd"})
+	if err := conn.Write(ctx, websocket.MessageText, hello); err != nil {
+		t.Fatal(err)
+	}
+	_, welcome, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wsjson.Write(ctx, conn, map[string]string{"type": "no-such-packet"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wsjson.Write(ctx, conn, PingPacket{Type: "pong"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither packet is answered, wait for the pong to be recorded.
+	pong := packetSizeSeries("count", "in", "pong")
+	for deadline := time.Now().Add(5 * time.Second); scrapePacketSizes(t)[pong] == before[pong]; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the pong to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	after := scrapePacketSizes(t)
+	for _, want := range []struct {
+		direction, typ string
+		size           int
+	}{
+		{"in", "hello", len(hello)},
+		{"out", "welcome", len(welcome)},
+		{"out", "server-info", -1},
+		{"in", "unknown", -1},
+		{"in", "pong", -1},
+	} {
+		count := packetSizeSeries("count", want.direction, want.typ)
+		if after[count]-before[count] != 1 {
+			t.Errorf("expected a single %s packet %s, got %v", want.typ, want.direction, after[count]-before[count])
+		}
+		sum := packetSizeSeries("sum", want.direction, want.typ)
+		if want.size >= 0 && after[sum]-before[sum] != float64(want.size) {
+			t.Errorf("expected the %s packet to be %d bytes, got %v", want.typ, want.size, after[sum]-before[sum])
+		}
+	}
+}
+
+func TestPacketSizesPerType(t *testing.T) {
+	types := make([]string, 0, len(PacketTypeIDs))
+	for typ := range PacketTypeIDs {
+		types = append(types, typ)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{conn: conn, config: &Config{}}
+		for _, typ := range types {
+			if err := p.Send(r.Context(), json.RawMessage(`{"type":"`+typ+`"}`)); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	before := scrapePacketSizes(t)
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	for range types {
+		if _, _, err := conn.Read(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after := scrapePacketSizes(t)
+	for _, typ := range types {
+		sum := packetSizeSeries("sum", "out", typ)
+		if got, want := after[sum]-before[sum], float64(len(`{"type":"`+typ+`"}`)); got != want {
+			t.Errorf("expected %v bytes of %s packets, got %v", want, typ, got)
+		}
+	}
+}
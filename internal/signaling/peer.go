@@ -3,7 +3,10 @@ package signaling
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/koenbollen/logging"
@@ -12,71 +15,325 @@ import (
 	"github.com/poki/netlib/internal/util"
 	"go.uber.org/zap"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 type Peer struct {
-	store stores.Store
-	conn  *websocket.Conn
+	store  stores.Store
+	conn   *websocket.Conn
+	config *Config
+	quotas *quotaTracker
 
 	closedPacketReceived bool
+	countedForQuota      bool
+
+	// registry is used to take over the lobby membership of an older socket
+	// of the same peer, superseded is set on the socket that was taken over.
+	registry   *peerRegistry
+	superseded atomic.Bool
+	// draining is set when the Drainer closes the connection, the peer keeps
+	// its lobby membership to reconnect elsewhere.
+	draining atomic.Bool
+
+	// candidates tallies relayed candidates, nil when disabled.
+	candidates *CandidateTally
+	// negotiations caps the offers and answers sent per lobbymate, nil when
+	// unlimited.
+	negotiations *negotiationLimiter
+	// limiter throttles the reads of the connection, limitsLobby is the lobby
+	// the limits of limiter and negotiations are for, see syncLimits.
+	limiter     *readLimiter
+	limitsLobby lobbyKey
+
+	// traffic counts the bytes of the peer for its current lobby,
+	// trafficCounter is the counter of that lobby, see syncTraffic.
+	traffic        *LobbyTraffic
+	trafficCounter atomic.Pointer[trafficCounter]
+
+	// storeOps counts the store operations caused by the packets of the
+	// peer, nil when the peer isn't created by the Handler.
+	storeOps *storeOps
+
+	// members is the membership subscription of the peer, see
+	// HandleSubscribeMembersPacket.
+	members *membersSubscription
+	// presence is the presence subscription of the peer, see
+	// HandleSubscribePresencePacket. presenceOnline and presenceLobby are the
+	// presence last recorded for the peer itself, see syncPresence.
+	presence       *presenceSubscription
+	presenceOnline bool
+	presenceLobby  string
+
+	// ticketsSubscribed is set once the peer is subscribed to the
+	// notifications of its matchmaking tickets.
+	ticketsSubscribed bool
+
+	// slotReserved is set while matchmaking might hold a reserved slot for the
+	// peer, see releaseSlot.
+	slotReserved bool
+
+	// closedLobby is the lobby of the last lobby-closed packet forwarded to
+	// the peer, see leaveClosedLobby.
+	closedLobby atomic.Pointer[string]
+
+	// compact is set when the client negotiated the CompactSubprotocol.
+	compact bool
+	// urlGame is the GameQueryParam of the signaling URL, see checkGame.
+	urlGame string
+
+	// negotiated is how packets are encoded for the client, see encoding.
+	negotiated  atomic.Pointer[peerEncoding]
+	nextChunkID atomic.Uint64
+
+	// replyErr holds the error replied while handling the current packet, to
+	// nack it for clients with the AcksCapability.
+	replyErr error
+
+	// lookups counts get-lobby packets per client IP to prevent enumerating
+	// lobby codes, ip is the IP of the client.
+	lookups *lobbyLookups
+	ip      string
+
+	// stats caches the stats of the games on this node, statsRequests counts
+	// get-stats packets in the current window.
+	stats         *statsCache
+	statsRequests int
+	statsWindow   time.Time
+
+	// connCtx lives as long as the connection, packet handlers get a shorter
+	// lived context so subscriptions have to use this one.
+	connCtx context.Context
+	// unsubscribeLobby ends the subscription to the topic of the peer in its
+	// current lobby, see subscribeLobby.
+	unsubscribeLobby context.CancelFunc
+
+	// queues hold packets sent asynchronously with Enqueue per Priority,
+	// queuedMessages and queuedBytes are the number and size of the packets
+	// in them, queuedBulk the bulk packets per sender. slow is set once the
+	// peer was disconnected for not keeping up.
+	queues         [priorityCount]chan queuedPacket
+	queueMutex     sync.Mutex
+	queuedMessages int
+	queuedBulk     map[string]int
+	queuedBytes    atomic.Int64
+	slow           atomic.Bool
 
 	retrievedIDCallback func(context.Context, *Peer) (bool, error)
 
-	ID     string
-	Secret string
-	Game   string
-	Lobby  string
+	ID       string
+	Secret   string
+	Game     string
+	Lobby    string
+	PeerData map[string]any
+
+	// ClientIdentity is the identity of the verified TLS client certificate,
+	// empty for regular (browser) peers.
+	ClientIdentity string
+	// AuthIdentity is the identity returned by Config.Auth, empty without it.
+	AuthIdentity string
+	// PlayerID identifies the player behind the peer across connections and
+	// sessions, unlike ID which only lives as long as a session and routes
+	// signaling. Bans and moderation should key on it. It's the AuthIdentity,
+	// or assigned by the server and kept with a player token, see
+	// identifyPlayer.
+	PlayerID    string
+	playerToken string
+
+	// sessionStart is when the hello that generated ID and Secret was
+	// handled, reconnects continue the session, see Config.MaxSessionLifetime.
+	sessionStart time.Time
+	// Edge is the CDN edge the connection came through, see Config.EdgeHeader.
+	Edge string
 }
 
-func (p *Peer) Close(ctx context.Context) {
-	logger := logging.GetLogger(ctx)
-	logger.Info("closing peer", zap.String("peer", p.ID))
-	if p.ID != "" && p.Game != "" && p.Lobby != "" {
-		packet := DisconnectPacket{
-			Type: "disconnect",
-			ID:   p.ID,
+// peerEncoding is what the client negotiated in the hello or reconnect
+// packet. Packets are sent from other goroutines than the one handling the
+// negotiation, so it's never modified but replaced as a whole.
+type peerEncoding struct {
+	// capabilities are the opt-in features of the client.
+	capabilities capabilitySet
+	// codec converts packets for clients that speak an older protocol
+	// version, nil for clients on the current version.
+	codec *protocolCodec
+	// dictionary compresses packets for clients with the DictionaryCapability,
+	// nil for other clients.
+	dictionary *dictionary
+}
+
+// encoding returns how packets are encoded for the client, nothing is
+// negotiated before the hello or reconnect packet so it speaks version 0.
+func (p *Peer) encoding() *peerEncoding {
+	if encoding := p.negotiated.Load(); encoding != nil {
+		return encoding
+	}
+	return &peerEncoding{codec: codecFor(0)}
+}
+
+// negotiate sets the capabilities and codec of the client, the dictionary is
+// only enabled after the reply to the negotiation, see enableDictionary.
+func (p *Peer) negotiate(capabilities []string, version int) *peerEncoding {
+	encoding := &peerEncoding{
+		capabilities: negotiateCapabilities(capabilities, version),
+		codec:        codecFor(version),
+	}
+	p.negotiated.Store(encoding)
+	return encoding
+}
+
+func (p *Peer) Send(ctx context.Context, packet interface{}) error {
+	raw, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	typ := packetType(raw)
+	encoding := p.encoding()
+	if encoding.codec != nil {
+		if raw, err = encoding.codec.Encode(raw); err != nil {
+			return err
 		}
-		data, err := json.Marshal(packet)
-		if err == nil {
-			ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
-			defer cancel()
+	}
+	if p.compact {
+		if raw, err = encodeCompactPacket(raw); err != nil {
+			return err
+		}
+	}
+	observePacketSize("out", typ, len(raw))
+	return p.write(ctx, encoding, raw)
+}
 
-			others, err := p.store.LeaveLobby(ctx, p.Game, p.Lobby, p.ID)
-			if err != nil {
-				logger.Warn("failed to leave lobby", zap.Error(err))
-			} else {
-				for _, id := range others {
-					if id != p.ID {
-						err := p.store.Publish(ctx, p.Game+p.Lobby+id, data)
-						if err != nil {
-							logger.Error("failed to publish disconnect packet", zap.Error(err))
-						}
-					}
-				}
+// ReplyError sends err to the client without disconnecting it, the error is
+// remembered so the packet being handled can be negatively acknowledged.
+func (p *Peer) ReplyError(ctx context.Context, requestID string, err error) {
+	p.replyErr = err
+	if err := p.Send(ctx, util.RequestErrorPacket(requestID, err)); err != nil && !util.IsPipeError(err) {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("uncaught server error", zap.Error(err), zap.Stack("stack"))
+	}
+}
+
+// decode turns an incoming packet in the format the client negotiated into a
+// regular packet.
+func (p *Peer) decode(raw []byte) ([]byte, error) {
+	var err error
+	if p.compact {
+		if raw, err = decodeCompactPacket(raw); err != nil {
+			return nil, err
+		}
+	}
+	if codec := p.encoding().codec; codec != nil {
+		if raw, err = codec.Decode(raw); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// errorCode returns the code of a replied error, "error" when it has none.
+func errorCode(err error) string {
+	if cerr, ok := err.(interface{ ErrorCode() string }); ok {
+		return cerr.ErrorCode()
+	}
+	return "error"
+}
+
+// acknowledge replies with an ack or nack for the packet that was just handled
+// if the client asked for acknowledgements and the packet has a message ID.
+func (p *Peer) acknowledge(ctx context.Context, messageID string) error {
+	err := p.replyErr
+	p.replyErr = nil
+	if !p.encoding().capabilities.Has(capAcks) || messageID == "" {
+		return nil
+	}
+	if err != nil {
+		return p.Send(ctx, NackPacket{
+			Type:      "nack",
+			MessageID: messageID,
+			Code:      errorCode(err),
+			Message:   err.Error(),
+		})
+	}
+	return p.Send(ctx, AckPacket{
+		Type:      "ack",
+		MessageID: messageID,
+	})
+}
+
+// write sends an encoded packet, splitting it into chunks when it's too large.
+func (p *Peer) write(ctx context.Context, encoding *peerEncoding, raw []byte) error {
+	if !encoding.capabilities.Has(capChunking) || len(raw) <= p.config.ChunkThreshold {
+		return p.writeMessage(ctx, encoding, raw)
+	}
+	chunks, err := splitChunks(p.nextChunkID.Add(1), raw, p.config.ChunkThreshold)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if p.compact {
+			if data, err = encodeCompactPacket(data); err != nil {
+				return err
 			}
 		}
+		if err := p.writeMessage(ctx, encoding, data); err != nil {
+			return err
+		}
 	}
-	p.conn.Close(websocket.StatusInternalError, "error")
+	return nil
 }
 
-func (p *Peer) Send(ctx context.Context, packet interface{}) error {
-	return wsjson.Write(ctx, p.conn, packet)
+// writeMessage writes a single websocket message, compressed with the
+// dictionary when the client negotiated one.
+func (p *Peer) writeMessage(ctx context.Context, encoding *peerEncoding, raw []byte) error {
+	if encoding.dictionary == nil {
+		p.countWritten(len(raw))
+		return p.conn.Write(ctx, websocket.MessageText, raw)
+	}
+	compressed, err := encoding.dictionary.Compress(raw)
+	if err != nil {
+		return err
+	}
+	p.countWritten(len(compressed))
+	metrics.Add("netlib_dictionary_saved_bytes_total", float64(len(raw)-len(compressed)))
+	return p.conn.Write(ctx, websocket.MessageBinary, compressed)
+}
+
+// broadcast publishes packet to all peers in the lobby except this peer itself.
+func (p *Peer) broadcast(ctx context.Context, peers []string, packet any) error {
+	logger := logging.GetLogger(ctx)
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	for _, id := range peers {
+		if id != p.ID {
+			err := p.store.Publish(ctx, p.Game+p.Lobby+id, data)
+			if err != nil {
+				logger.Error("failed to publish packet", zap.Error(err), zap.String("recipient", id))
+			}
+		}
+	}
+	return nil
 }
 
-func (p *Peer) RequestConnection(ctx context.Context, otherID string) error {
+func (p *Peer) RequestConnection(ctx context.Context, otherID string, otherData map[string]any, seats map[string]int) error {
 	toMe := ConnectPacket{
-		Type:   "connect",
-		ID:     otherID,
-		Polite: true,
+		Type:     "connect",
+		ID:       otherID,
+		Polite:   true,
+		PeerData: otherData,
+		Seat:     seats[otherID],
 	}
 	toThem := ConnectPacket{
-		Type:   "connect",
-		ID:     p.ID,
-		Polite: false,
+		Type:     "connect",
+		ID:       p.ID,
+		Polite:   false,
+		PeerData: p.PeerData,
+		Seat:     seats[p.ID],
 	}
 
-	err := wsjson.Write(ctx, p.conn, toMe)
+	err := p.Send(ctx, toMe)
 	if err != nil {
 		return err
 	}
@@ -91,25 +348,47 @@ func (p *Peer) RequestConnection(ctx context.Context, otherID string) error {
 		return err
 	}
 
-	go metrics.Record(ctx, "rtc", "attempt", p.Game, p.ID, p.Lobby, "target", otherID)
-	go metrics.Record(ctx, "rtc", "attempt", p.Game, otherID, p.Lobby, "target", p.ID)
+	metrics.Record(ctx, "rtc", "attempt", p.Game, p.ID, p.Lobby, "target", otherID)
+	metrics.Record(ctx, "rtc", "attempt", p.Game, otherID, p.Lobby, "target", p.ID)
 
 	return nil
 }
 
-func (p *Peer) ForwardMessage(ctx context.Context, raw []byte) {
-	logger := logging.GetLogger(ctx)
-	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
-	defer cancel()
-	err := p.conn.Write(ctx, websocket.MessageText, raw)
-	if err != nil && !util.IsPipeError(err) {
-		logger.Warn("failed to forward message", zap.Error(err))
+// subscribeLobby forwards the messages published to the peer in its current
+// lobby until it leaves the lobby, see leftLobby.
+func (p *Peer) subscribeLobby() {
+	if p.unsubscribeLobby != nil {
+		p.unsubscribeLobby()
 	}
+	ctx, cancel := context.WithCancel(p.connCtx)
+	p.unsubscribeLobby = cancel
+	p.store.Subscribe(ctx, p.Game+p.Lobby+p.ID, p.ForwardMessage)
+	p.registry.Join(p, p.Lobby)
+}
+
+// leftLobby ends the subscription of the peer to its lobby and forgets the
+// lobby, it must be called once the peer left it.
+func (p *Peer) leftLobby() {
+	if p.unsubscribeLobby != nil {
+		p.unsubscribeLobby()
+		p.unsubscribeLobby = nil
+	}
+	p.registry.Leave(p, p.Lobby)
+	p.Lobby = ""
+}
+
+// ForwardMessage queues a message published to this peer, relayed signals
+// are queued as bulk so they don't delay control packets.
+func (p *Peer) ForwardMessage(ctx context.Context, raw []byte) {
+	p.noteLobbyClosed(raw)
+	priority, sender := packetPriority(raw)
+	p.enqueue(raw, priority, sender, nil)
 }
 
 func (p *Peer) HandlePacket(ctx context.Context, typ string, raw []byte) error {
 	logger := logging.GetLogger(ctx).With(zap.String("peer", p.ID))
 	logger.Debug("handling packet", zap.String("type", typ), zap.ByteString("data", raw))
+	p.leaveClosedLobby()
 
 	var err error
 	switch typ {
@@ -165,6 +444,269 @@ func (p *Peer) HandlePacket(ctx context.Context, typ string, raw []byte) error {
 			return fmt.Errorf("unable to handle packet: %w", err)
 		}
 
+	case "update-lobby":
+		packet := UpdateLobbyPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleUpdateLobbyPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "set-visibility":
+		packet := SetVisibilityPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleSetVisibilityPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "matchmake":
+		packet := MatchmakePacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleMatchmakePacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "set-peer-data":
+		packet := SetPeerDataPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleSetPeerDataPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "set-ready":
+		packet := SetReadyPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleSetReadyPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "reset-ready":
+		packet := ResetReadyPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleResetReadyPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "reconnect":
+		packet := ReconnectPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleReconnectPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "get-lobby":
+		packet := GetLobbyPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleGetLobbyPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "create-invite":
+		packet := CreateInvitePacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleCreateInvitePacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "start":
+		packet := StartPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleStartPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "set-lobby-state":
+		packet := SetLobbyStatePacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleSetLobbyStatePacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "matchmaking-ticket":
+		packet := MatchmakingTicketPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleMatchmakingTicketPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "cancel-ticket":
+		packet := CancelTicketPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleCancelTicketPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "subscribe-presence":
+		packet := SubscribePresencePacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleSubscribePresencePacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "unsubscribe-presence":
+		packet := UnsubscribePresencePacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleUnsubscribePresencePacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "connection-result":
+		packet := ConnectionResultPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleConnectionResultPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "transfer-leader":
+		packet := TransferLeaderPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleTransferLeaderPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "subscribe-members":
+		packet := SubscribeMembersPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleSubscribeMembersPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "unsubscribe-members":
+		p.unsubscribeMembers()
+
+	case "kv-set":
+		packet := KVSetPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleKVSetPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "kv-cas":
+		packet := KVCompareAndSetPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleKVCompareAndSetPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "kv-increment":
+		packet := KVIncrementPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleKVIncrementPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "kv-get":
+		packet := KVGetPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleKVGetPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "update-custom-data":
+		packet := UpdateCustomDataPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleUpdateCustomDataPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "get-custom-data":
+		packet := GetCustomDataPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleGetCustomDataPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "get-stats":
+		packet := GetStatsPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleGetStatsPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
+	case "switch-lobby":
+		packet := SwitchLobbyPacket{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		err = p.HandleSwitchLobbyPacket(ctx, packet)
+		if err != nil {
+			return fmt.Errorf("unable to handle packet: %w", err)
+		}
+
 	// case "leave":
 
 	case "connected": // TODO: Do we want to keep track of connections between peers?
@@ -178,11 +720,32 @@ func (p *Peer) HandlePacket(ctx context.Context, typ string, raw []byte) error {
 			util.ErrorAndDisconnect(ctx, p.conn, err)
 		}
 		if routing.Source != p.ID {
-			util.ErrorAndDisconnect(ctx, p.conn, fmt.Errorf("invalid source set"))
+			util.ErrorAndDisconnect(ctx, p.conn, fmt.Errorf("%w: invalid source set", util.ErrProtocol))
+		}
+		if p.config.ValidateSignals {
+			if reason, ok := validateSignal(typ, raw, p.config.MaxSignalSize); !ok {
+				metrics.Inc("netlib_signal_rejections_total", "type", typ, "reason", reason)
+				p.ReplyError(ctx, "", ErrInvalidSignal.WithParams("reason", reason))
+				return nil
+			}
+		}
+		if typ == "candidate" && p.candidates != nil {
+			p.candidates.Observe(p.Game, p.Lobby, raw)
+		}
+		if routing.Broadcast || len(routing.Recipients) > 0 {
+			return p.forwardToRecipients(ctx, typ, routing, raw)
+		}
+		// Publishing only fails when the topic doesn't exist, so make sure
+		// the recipient is another member of the lobby first.
+		if recipients, err := p.resolveRecipients(ctx, typ, routing); err != nil || recipients == nil {
+			return err
+		}
+		if p.negotiations != nil && isNegotiation(typ, raw) && p.negotiationThrottled(ctx, routing.Recipient) {
+			return nil
 		}
 		err = p.store.Publish(ctx, p.Game+p.Lobby+routing.Recipient, raw)
 		if err == stores.ErrNoSuchTopic {
-			util.ReplyError(ctx, p.conn, &MissingRecipientError{
+			p.ReplyError(ctx, "", &MissingRecipientError{
 				Recipient: routing.Recipient,
 				Cause:     err,
 			})
@@ -205,7 +768,18 @@ func (p *Peer) HandleHelloPacket(ctx context.Context, packet HelloPacket) error
 	if !util.IsUUID(packet.Game) {
 		return fmt.Errorf("no game id supplied")
 	}
+	if err := p.checkGame(packet.Game); err != nil {
+		return err
+	}
+	if err := p.quotas.AcquirePeer(packet.Game); err != nil {
+		return err
+	}
+	p.countedForQuota = true
 	p.Game = packet.Game
+	p.registry.Identify(p)
+
+	version := negotiateProtocolVersion(packet.ProtocolVersion)
+	encoding := p.negotiate(packet.Capabilities, version)
 
 	hasReconnected := false
 	clientIsReconnecting := false
@@ -217,9 +791,12 @@ func (p *Peer) HandleHelloPacket(ctx context.Context, packet HelloPacket) error
 	} else {
 		p.ID = util.GeneratePeerID(ctx)
 		p.Secret = util.GenerateSecret(ctx)
+		p.sessionStart = util.Now(ctx)
 		logger.Info("peer connecting", zap.String("game", p.Game), zap.String("peer", p.ID))
 	}
-	if clientIsReconnecting {
+	if clientIsReconnecting && p.takeover(ctx, packet.Lobby) {
+		hasReconnected = true
+	} else if clientIsReconnecting {
 		var err error
 		hasReconnected, err = p.retrievedIDCallback(ctx, p)
 		if err != nil {
@@ -230,17 +807,28 @@ func (p *Peer) HandleHelloPacket(ctx context.Context, packet HelloPacket) error
 		}
 	}
 
+	if err := p.identifyPlayer(ctx, packet.PlayerToken); err != nil {
+		return err
+	}
+
+	var closedLobby *LobbyClosure
 	if packet.Lobby != "" {
 		inLobby, err := p.store.IsPeerInLobby(ctx, p.Game, packet.Lobby, p.ID)
 		if err != nil {
 			return err
 		}
+		if hasReconnected && !inLobby {
+			// Joining a closed lobby again would recreate it.
+			if closedLobby, err = p.lobbyClosure(ctx, packet.Lobby); err != nil {
+				return err
+			}
+		}
 		if hasReconnected && inLobby {
 			logger.Info("peer rejoining lobby", zap.String("game", p.Game), zap.String("peer", p.ID), zap.String("lobby", p.Lobby))
 			p.Lobby = packet.Lobby
-			p.store.Subscribe(ctx, p.Game+p.Lobby+p.ID, p.ForwardMessage)
-			go metrics.Record(ctx, "lobby", "reconnected", p.Game, p.ID, p.Lobby)
-		} else {
+			p.subscribeLobby()
+			metrics.Record(ctx, "lobby", "reconnected", p.Game, p.ID, p.Lobby)
+		} else if closedLobby == nil {
 			fakeJoinPacket := JoinPacket{
 				Type:  "join",
 				Lobby: packet.Lobby,
@@ -249,51 +837,63 @@ func (p *Peer) HandleHelloPacket(ctx context.Context, packet HelloPacket) error
 			if err != nil {
 				return err
 			}
-			go metrics.Record(ctx, "lobby", "joined", p.Game, p.ID, p.Lobby)
+			metrics.Record(ctx, "lobby", "joined", p.Game, p.ID, p.Lobby)
 		}
 	}
 
-	return p.Send(ctx, WelcomePacket{
+	err := p.Send(ctx, WelcomePacket{
 		Type:   "welcome",
 		ID:     p.ID,
 		Secret: p.Secret,
+
+		Capabilities:    encoding.capabilities.Names(),
+		ProtocolVersion: version,
+
+		Node: p.config.NodeID,
+
+		PlayerID:    p.PlayerID,
+		PlayerToken: p.playerToken,
+
+		ClosedLobby: closedLobby,
 	})
+	if err != nil {
+		return err
+	}
+	p.enableDictionary(encoding, version)
+	return nil
+}
+
+// enableDictionary starts compressing packets when the client negotiated the
+// DictionaryCapability, the welcome itself isn't compressed so the client
+// learns the protocol version, and so the dictionary, first.
+func (p *Peer) enableDictionary(encoding *peerEncoding, version int) {
+	if encoding.capabilities.Has(capDictionary) {
+		p.negotiated.Store(&peerEncoding{
+			capabilities: encoding.capabilities,
+			codec:        encoding.codec,
+			dictionary:   compressionDictionaries[version],
+		})
+	}
 }
 
 func (p *Peer) HandleClosePacket(ctx context.Context, packet ClosePacket) error {
 	logger := logging.GetLogger(ctx)
-	go metrics.Record(ctx, "client", "close", p.Game, p.ID, p.Lobby)
+	metrics.Record(ctx, "client", "close", p.Game, p.ID, p.Lobby)
 
 	p.closedPacketReceived = true
 
 	logger.Info("client closed",
 		zap.String("game", p.Game),
 		zap.String("peer", p.ID),
+		zap.String("player", p.PlayerID),
 		zap.String("lobby", p.Lobby),
 		zap.String("reason", packet.Reason),
 	)
 
 	if p.Lobby != "" {
-		others, err := p.store.LeaveLobby(ctx, p.Game, p.Lobby, p.ID)
-		if err != nil {
+		if err := p.leaveLobby(ctx); err != nil {
 			return fmt.Errorf("unable to leave lobby: %w", err)
 		}
-		packet := DisconnectPacket{
-			Type: "disconnect",
-			ID:   p.ID,
-		}
-		data, err := json.Marshal(packet)
-		if err == nil {
-			for _, id := range others {
-				if id != p.ID {
-					err := p.store.Publish(ctx, p.Game+p.Lobby+id, data)
-					if err != nil {
-						logger.Error("failed to publish disconnect packet", zap.Error(err))
-					}
-				}
-			}
-		}
-		p.Lobby = ""
 	}
 
 	return nil
@@ -304,8 +904,17 @@ func (p *Peer) HandleListPacket(ctx context.Context, packet ListPacket) error {
 	if p.ID == "" {
 		return fmt.Errorf("peer not connected")
 	}
+	sort, err := lobbySort(packet.Sort, p.config)
+	if err != nil {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	}
 	logger.Debug("listing lobbies", zap.String("game", p.Game), zap.String("peer", p.ID))
-	lobbies, err := p.store.ListLobbies(ctx, p.Game, packet.Filter)
+	lobbies, err := p.store.ListLobbies(ctx, p.Game, stores.ListOptions{
+		Filter:   packet.Filter,
+		HideFull: packet.HideFull,
+		Sort:     sort,
+	})
 	if err != nil {
 		return err
 	}
@@ -324,17 +933,63 @@ func (p *Peer) HandleCreatePacket(ctx context.Context, packet CreatePacket) erro
 	if p.Lobby != "" {
 		return fmt.Errorf("already in a lobby %s:%s as %s", p.Game, p.Lobby, p.ID)
 	}
+	peerData, err := validatePeerData(packet.PeerData, packet.PublicKey, nil)
+	if err != nil {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	}
+	packet.PeerData = peerData
+	if packet.AutoStart && !p.config.Features.Enabled(p.Game, FeatureAutoStart) {
+		metrics.Inc("netlib_feature_rejections_total", "feature", FeatureAutoStart)
+		p.ReplyError(ctx, packet.RequestID, ErrFeatureDisabled.WithParams("feature", FeatureAutoStart))
+		return nil
+	}
+	if err := p.quotas.CheckLobby(ctx, p.store, p.Game); err != nil {
+		if err == ErrGameQuotaExceeded {
+			p.ReplyError(ctx, packet.RequestID, err)
+			return nil
+		}
+		return err
+	}
+
+	var cooldown time.Duration
+	if p.config.ReuseLobbyCodes {
+		cooldown = p.config.LobbyCodeCooldown
+	}
+	var closeAt time.Time
+	if packet.CloseAt != nil {
+		closeAt = capCloseAt(util.Now(ctx), *packet.CloseAt, p.config.MaxCloseDelay)
+	}
 
 	attempts := 20
 	for ; attempts > 0; attempts-- {
 		switch packet.CodeFormat {
 		case "short":
-			p.Lobby = util.GenerateShortLobbyCode(ctx)
+			p.Lobby = ""
+			if p.config.ReuseLobbyCodes && attempts == 20 {
+				code, err := p.store.ClaimReleasedCode(ctx, cooldown)
+				if err != nil {
+					return err
+				}
+				p.Lobby = code
+			}
+			if p.Lobby == "" {
+				p.Lobby = util.GenerateShortLobbyCode(ctx)
+			}
 		default:
-			p.Lobby = util.GenerateLobbyCode(ctx)
+			p.Lobby = generateLobbyCode(ctx, p.config.CaseSensitiveLobbyCodes)
 		}
 
-		err := p.store.CreateLobby(ctx, p.Game, p.Lobby, p.ID)
+		err := p.store.CreateLobby(ctx, p.Game, p.Lobby, p.ID, stores.LobbyOptions{
+			MaxPlayers:    packet.MaxPlayers,
+			MaxSpectators: packet.MaxSpectators,
+			AutoStart:     packet.AutoStart,
+			CodeCooldown:  cooldown,
+			CloseAt:       closeAt,
+			Node:          p.config.NodeID,
+			NodeEndpoint:  p.config.NodeEndpoint,
+			Limits:        p.config.clampLobbyLimits(packet.Limits),
+		})
 		if err != nil {
 			if err == stores.ErrLobbyExists {
 				continue
@@ -347,69 +1002,312 @@ func (p *Peer) HandleCreatePacket(ctx context.Context, packet CreatePacket) erro
 		return fmt.Errorf("unable to create lobby, too many attempts to find a unique code")
 	}
 
-	p.store.Subscribe(ctx, p.Game+p.Lobby+p.ID, p.ForwardMessage)
+	p.subscribeLobby()
 
 	// TODO: Move joining of lobby in the CreateLobby
-	_, err := p.store.JoinLobby(ctx, p.Game, p.Lobby, p.ID)
+	_, err = p.store.JoinLobby(ctx, p.Game, p.Lobby, p.ID, stores.RolePlayer)
 	if err != nil {
 		return err
 	}
+	observeLobbyFilled(ctx, p.store, p.config.MetricGames, p.Game, p.Lobby)
+	if len(packet.PeerData) > 0 {
+		if _, err := p.store.SetPeerData(ctx, p.Game, p.Lobby, p.ID, packet.PeerData); err != nil {
+			return err
+		}
+	}
+	p.PeerData = packet.PeerData
 
 	logger.Info("created lobby", zap.String("game", p.Game), zap.String("lobby", p.Lobby), zap.String("peer", p.ID))
-	go metrics.Record(ctx, "lobby", "created", p.Game, p.ID, p.Lobby)
+	emitLobbyEvent(ctx, p.config.Webhook, LobbyCreated, p.Game, p.Lobby, p.ID)
+	metrics.Record(ctx, "lobby", "created", p.Game, p.ID, p.Lobby)
 
-	return p.Send(ctx, JoinedPacket{
+	err = p.Send(ctx, JoinedPacket{
 		RequestID: packet.RequestID,
 		Type:      "joined",
 		Lobby:     p.Lobby,
+		Seats:     map[string]int{p.ID: 0}, // The creator is always the first to join.
+		Affinity:  p.localAffinity(),
 	})
+	if err != nil {
+		return err
+	}
+	return p.autoStart(ctx)
 }
 
+var ErrLobbyLimit = util.NewError("lobby-limit", "already in the maximum number of lobbies")
+var ErrInvalidRole = util.NewError("invalid-role", "role must be player or spectator, invites are for players only")
+
 func (p *Peer) HandleJoinPacket(ctx context.Context, packet JoinPacket) error {
-	logger := logging.GetLogger(ctx)
+	packet.Lobby = p.config.normalizeLobbyCode(packet.Lobby)
+	if p.ID != "" && p.Lobby != "" {
+		// Checked before the invite is consumed so the rejected join doesn't use it up.
+		metrics.Inc("netlib_lobby_limit_rejections_total")
+		p.ReplyError(ctx, packet.RequestID, ErrLobbyLimit.WithParams("max", MaxLobbiesPerConnection, "lobby", p.Lobby))
+		return nil
+	}
+	if packet.Role == "" {
+		packet.Role = stores.RolePlayer
+	}
+	if (packet.Role != stores.RolePlayer && packet.Role != stores.RoleSpectator) || (packet.Invite != "" && packet.Role != stores.RolePlayer) {
+		p.ReplyError(ctx, packet.RequestID, ErrInvalidRole.WithParams("role", packet.Role))
+		return nil
+	}
+	peerData, err := validatePeerData(packet.PeerData, packet.PublicKey, nil)
+	if err != nil {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	}
+	packet.PeerData = peerData
+	err = p.joinLobby(ctx, packet)
+	var joinErr *util.Error
+	if err == stores.ErrInvalidInvite {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if (err == stores.ErrLobbyFull || err == stores.ErrSpectatorsFull || errors.Is(err, stores.ErrLobbyNotJoinable)) && errors.As(err, &joinErr) {
+		if packet.Invite == "" { // Don't reveal the code of lobbies joined by invite.
+			joinErr = joinErr.WithParams("lobby", packet.Lobby)
+		}
+		p.ReplyError(ctx, packet.RequestID, joinErr)
+		return nil
+	}
+	return err
+}
+
+func (p *Peer) joinLobby(ctx context.Context, packet JoinPacket) error {
 	if p.ID == "" {
 		return fmt.Errorf("peer not connected")
 	}
 	if p.Lobby != "" {
 		return fmt.Errorf("already in a lobby %s:%s as %s", p.Game, p.Lobby, p.ID)
 	}
-	if packet.Lobby == "" {
+	if packet.Invite == "" && packet.Lobby == "" {
 		return fmt.Errorf("no lobby code supplied")
 	}
 	if len(packet.Lobby) > 20 {
 		return fmt.Errorf("lobby code too long")
 	}
 
-	others, err := p.store.JoinLobby(ctx, p.Game, packet.Lobby, p.ID)
+	var others []string
+	var err error
+	if packet.Invite != "" {
+		// The invite is only used up when the join succeeds.
+		packet.Lobby, others, err = p.store.JoinLobbyByInvite(ctx, p.Game, packet.Invite, p.ID)
+	} else {
+		others, err = p.store.JoinLobby(ctx, p.Game, packet.Lobby, p.ID, packet.Role)
+	}
+	if err != nil {
+		return err
+	}
+	return p.enterLobby(ctx, packet, others)
+}
+
+// enterLobby finishes joining the lobby of packet after the peer was added to
+// it in the store, others are the peers that were already in it.
+func (p *Peer) enterLobby(ctx context.Context, packet JoinPacket, others []string) error {
+	logger := logging.GetLogger(ctx)
+	observeLobbyFilled(ctx, p.store, p.config.MetricGames, p.Game, packet.Lobby)
+	if len(packet.PeerData) > 0 {
+		if _, err := p.store.SetPeerData(ctx, p.Game, packet.Lobby, p.ID, packet.PeerData); err != nil {
+			return err
+		}
+	}
+	peerData, err := p.store.GetPeerData(ctx, p.Game, packet.Lobby)
+	if err != nil {
+		return err
+	}
+	seats, err := p.store.GetSeats(ctx, p.Game, packet.Lobby)
 	if err != nil {
 		return err
 	}
 
 	p.Lobby = packet.Lobby
-	p.store.Subscribe(ctx, p.Game+p.Lobby+p.ID, p.ForwardMessage)
+	p.PeerData = packet.PeerData
+	p.subscribeLobby()
 
+	current := map[string]int{p.ID: seats[p.ID]}
+	for _, id := range others {
+		current[id] = seats[id]
+	}
 	err = p.Send(ctx, JoinedPacket{
 		RequestID: packet.RequestID,
 		Type:      "joined",
 		Lobby:     p.Lobby,
+		Seats:     current,
+		Affinity:  p.lobbyAffinity(ctx),
 	})
 	if err != nil {
 		return err
 	}
 
 	for _, otherID := range others {
-		err := p.RequestConnection(ctx, otherID)
+		err := p.RequestConnection(ctx, otherID, peerData[otherID], seats)
 		if err != nil {
 			return err
 		}
 	}
+	// Joining cleared the ready states of the others.
+	if err := p.broadcast(ctx, others, readyReset(len(others)+1)); err != nil {
+		return err
+	}
 
 	logger.Info("joined lobby",
 		zap.String("game", p.Game),
 		zap.String("lobby", p.Lobby),
 		zap.String("peer", p.ID),
 		zap.Strings("others", others))
-	go metrics.Record(ctx, "lobby", "joined", p.Game, p.ID, p.Lobby)
+	metrics.Record(ctx, "lobby", "joined", p.Game, p.ID, p.Lobby)
 
-	return nil
+	return p.autoStart(ctx)
+}
+
+func (p *Peer) HandleSetVisibilityPacket(ctx context.Context, packet SetVisibilityPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	// Private lobbies are only hidden from listings, members can still
+	// reconnect and others can still join using the lobby code.
+	others, err := p.store.SetLobbyVisibility(ctx, p.Game, p.Lobby, p.ID, packet.Public)
+	if err == stores.ErrNotLeader {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logger.Info("lobby visibility changed",
+		zap.String("game", p.Game),
+		zap.String("lobby", p.Lobby),
+		zap.String("peer", p.ID),
+		zap.Bool("public", packet.Public))
+
+	update := VisibilityPacket{
+		Type:   "visibility",
+		Lobby:  p.Lobby,
+		Public: packet.Public,
+	}
+	if err := p.broadcast(ctx, others, update); err != nil {
+		return err
+	}
+
+	update.RequestID = packet.RequestID
+	return p.Send(ctx, update)
+}
+
+func (p *Peer) HandleSetPeerDataPacket(ctx context.Context, packet SetPeerDataPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+	if packet.PeerData == nil {
+		packet.PeerData = map[string]any{}
+	}
+	peerData, err := validatePeerData(packet.PeerData, "", p.PeerData)
+	if err != nil {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	}
+	packet.PeerData = peerData
+
+	others, err := p.store.SetPeerData(ctx, p.Game, p.Lobby, p.ID, packet.PeerData)
+	if err != nil {
+		return err
+	}
+	p.PeerData = packet.PeerData
+
+	update := PeerDataPacket{
+		Type:     "peer-data",
+		ID:       p.ID,
+		PeerData: packet.PeerData,
+	}
+	if err := p.broadcast(ctx, others, update); err != nil {
+		return err
+	}
+
+	update.RequestID = packet.RequestID
+	return p.Send(ctx, update)
+}
+
+// releaseSlot releases the slot reserved by matchmaking. The reservation would
+// expire by itself, but releasing it right away gives the slot back to other
+// matchmakers. The peer might be gone already so its context isn't used.
+func (p *Peer) releaseSlot(ctx context.Context) {
+	if !p.slotReserved {
+		return
+	}
+	p.slotReserved = false
+	logger := logging.GetLogger(ctx)
+	rctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), logger), 10*time.Second)
+	defer cancel()
+	if err := p.store.ReleaseSlot(rctx, p.Game, p.ID); err != nil {
+		logger.Warn("failed to release slot", zap.Error(err))
+	}
+}
+
+func (p *Peer) HandleMatchmakePacket(ctx context.Context, packet MatchmakePacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby != "" {
+		return fmt.Errorf("already in a lobby %s:%s as %s", p.Game, p.Lobby, p.ID)
+	}
+	if packet.MaxPlayers <= 0 {
+		return fmt.Errorf("maxPlayers is required for matchmaking")
+	}
+	peerData, err := validatePeerData(packet.PeerData, packet.PublicKey, nil)
+	if err != nil {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	}
+	packet.PeerData = peerData
+
+	for attempts := 3; attempts > 0; attempts-- {
+		// Set before reserving, a failed reservation might have gone through.
+		p.slotReserved = true
+		code, err := p.store.ReserveSlot(ctx, p.Game, p.ID, packet.MaxPlayers, p.config.MatchmakingCandidates, MatchmakingReservationTTL)
+		if err == stores.ErrNotFound {
+			p.slotReserved = false
+			break
+		} else if err != nil {
+			return err
+		}
+
+		err = p.joinLobby(ctx, JoinPacket{
+			RequestID: packet.RequestID,
+			Type:      "join",
+			Lobby:     code,
+			PeerData:  packet.PeerData,
+			PublicKey: packet.PublicKey,
+			Role:      stores.RolePlayer,
+		})
+		if err == nil {
+			// Joining consumed the reservation.
+			p.slotReserved = false
+			metrics.Record(ctx, "lobby", "matchmade", p.Game, p.ID, p.Lobby)
+			return nil
+		}
+		p.releaseSlot(ctx)
+
+		if err != stores.ErrLobbyFull && err != stores.ErrNotFound && !errors.Is(err, stores.ErrLobbyNotJoinable) {
+			return err
+		}
+		logger.Debug("matchmaking join failed, retrying", zap.String("lobby", code), zap.Error(err))
+	}
+
+	// No lobby with room was found, start a new one for others to join.
+	return p.HandleCreatePacket(ctx, CreatePacket{
+		RequestID:  packet.RequestID,
+		Type:       "create",
+		Public:     true,
+		MaxPlayers: packet.MaxPlayers,
+		PeerData:   packet.PeerData,
+		PublicKey:  packet.PublicKey,
+	})
 }
@@ -0,0 +1,32 @@
+package signaling
+
+import (
+	"context"
+	"time"
+)
+
+// PingInterval is how often a ping is sent to check if the tcp connection is
+// still alive, a ping that can't be written within PingTimeout is abandoned.
+const PingInterval = 30 * time.Second
+const PingTimeout = 5 * time.Second
+
+// pingLoop calls ping every interval until ctx is done. Each ping gets its own
+// deadline so a slow client blocking the write can't keep the loop alive
+// after the connection is torn down.
+func pingLoop(ctx context.Context, interval, timeout time.Duration, ping func(context.Context) error, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			err := ping(pctx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package signaling
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPingLoopExitsWithBlockedWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	writing := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pingLoop(ctx, time.Millisecond, time.Hour, func(ctx context.Context) error {
+			select {
+			case writing <- struct{}{}:
+			default:
+			}
+			<-ctx.Done() // A slow client, the write only returns when its context is done.
+			return ctx.Err()
+		}, func(err error) {
+			t.Errorf("unexpected error after cancel: %v", err)
+		})
+	}()
+
+	<-writing
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ping loop didn't exit after the context was cancelled")
+	}
+}
+
+func TestPingLoopTimesOutWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go pingLoop(ctx, time.Millisecond, 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked ping write wasn't abandoned")
+	}
+}
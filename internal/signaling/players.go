@@ -0,0 +1,75 @@
+package signaling
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+// MaxPlayerIDLength is the longest PlayerID, longer identities from Auth are
+// replaced by their hash.
+const MaxPlayerIDLength = 128
+
+// playerToken signs player for game with secret, the signature is appended
+// to the player so verifyPlayerToken doesn't need to store anything.
+func playerToken(secret, game, player string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(game + "." + player)) //nolint:errcheck
+	return player + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPlayerToken returns the player of token, empty when token wasn't
+// signed for game with secret.
+func verifyPlayerToken(secret, game, token string) string {
+	i := strings.LastIndexByte(token, '.')
+	if i <= 0 {
+		return ""
+	}
+	player := token[:i]
+	if !hmac.Equal([]byte(token), []byte(playerToken(secret, game, player))) {
+		return ""
+	}
+	return player
+}
+
+// identifyPlayer sets the PlayerID of the peer: the identity from Auth, or
+// the player of a token from an earlier session, or a new player when the
+// token is missing or invalid. Without Auth and Config.PlayerTokenSecret the
+// peer has no PlayerID.
+func (p *Peer) identifyPlayer(ctx context.Context, token string) error {
+	logger := logging.GetLogger(ctx)
+	switch {
+	case p.AuthIdentity != "":
+		p.PlayerID = p.AuthIdentity
+		if len(p.PlayerID) > MaxPlayerIDLength {
+			sum := sha256.Sum256([]byte(p.AuthIdentity))
+			p.PlayerID = hex.EncodeToString(sum[:])
+		}
+
+	case p.config.PlayerTokenSecret == "":
+		return nil
+
+	default:
+		p.PlayerID = verifyPlayerToken(p.config.PlayerTokenSecret, p.Game, token)
+		if p.PlayerID == "" {
+			if token != "" {
+				// Tokens of another game or from before the secret was rotated.
+				metrics.Inc("netlib_player_tokens_rejected_total")
+				logger.Info("invalid player token", zap.String("game", p.Game), zap.String("peer", p.ID))
+			}
+			p.PlayerID = util.GeneratePeerID(ctx)
+		}
+		p.playerToken = playerToken(p.config.PlayerTokenSecret, p.Game, p.PlayerID)
+	}
+
+	logger.Info("peer identified", zap.String("game", p.Game), zap.String("peer", p.ID), zap.String("player", p.PlayerID))
+	return p.store.SetPlayer(ctx, p.Game, p.ID, p.PlayerID)
+}
@@ -0,0 +1,130 @@
+package signaling
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// playersStore records the player of every peer.
+type playersStore struct {
+	*shutdownStore
+
+	mutex   sync.Mutex
+	players map[string]string
+}
+
+func (s *playersStore) SetPlayer(ctx context.Context, game, id, player string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.players[id] = player
+	return nil
+}
+
+func TestPlayerToken(t *testing.T) {
+	game := "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+	token := playerToken("secret", game, "player-1")
+	if player := verifyPlayerToken("secret", game, token); player != "player-1" {
+		t.Fatalf("expected the player of the token, got %q", player)
+	}
+
+	for name, token := range map[string]string{
+		"empty":        "",
+		"unsigned":     "player-1",
+		"other player": "player-2" + strings.TrimPrefix(token, "player-1"),
+		"tampered":     token[:len(token)-1] + "x",
+		"other game":   playerToken("secret", "c99c8d81-4a3d-4d4e-9d4e-1d0a5b1a7c2e", "player-1"),
+		"other secret": playerToken("rotated", game, "player-1"),
+	} {
+		if player := verifyPlayerToken("secret", game, token); player != "" {
+			t.Fatalf("expected %s token to be rejected, got %q", name, player)
+		}
+	}
+}
+
+// TestPlayerAcrossSessions connects twice, the second session presents the
+// player token of the first and is correlated to the same player.
+func TestPlayerAcrossSessions(t *testing.T) {
+	ctx := context.Background()
+	store := &playersStore{
+		shutdownStore: &shutdownStore{t: t, timeouts: make(map[string]string)},
+		players:       make(map[string]string),
+	}
+	_, handler, _ := Handler(ctx, store, nil, Config{PlayerTokenSecret: "secret"})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	session := func(token string) WelcomePacket {
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		readServerInfo(ctx, t, conn)
+		if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: "4307bd86-e1df-41b8-b9df-e22afcf084bd", PlayerToken: token}); err != nil {
+			t.Fatal(err)
+		}
+		welcome := WelcomePacket{}
+		if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+			t.Fatal(err)
+		}
+		return welcome
+	}
+
+	first := session("")
+	if first.PlayerID == "" || first.PlayerToken == "" {
+		t.Fatalf("expected a new player, got %+v", first)
+	}
+	second := session(first.PlayerToken)
+	if second.ID == first.ID {
+		t.Fatalf("expected a new peer for the second session, got %s", second.ID)
+	}
+	if second.PlayerID != first.PlayerID {
+		t.Fatalf("expected the second session to be player %s, got %s", first.PlayerID, second.PlayerID)
+	}
+	if other := session("forged.token"); other.PlayerID == first.PlayerID {
+		t.Fatalf("expected a forged token to get a new player, got %s", other.PlayerID)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.players[first.ID] != first.PlayerID || store.players[second.ID] != first.PlayerID {
+		t.Fatalf("expected both peers to be stored as the player, got %v", store.players)
+	}
+}
+
+func TestPlayerFromAuth(t *testing.T) {
+	ctx := context.Background()
+	store := &playersStore{
+		shutdownStore: &shutdownStore{t: t, timeouts: make(map[string]string)},
+		players:       make(map[string]string),
+	}
+	p := &Peer{store: store, config: &Config{PlayerTokenSecret: "secret"}, ID: "peer", Game: "game", AuthIdentity: "account-1"}
+	if err := p.identifyPlayer(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if p.PlayerID != "account-1" || p.playerToken != "" {
+		t.Fatalf("expected the identity from auth without a token, got %q %q", p.PlayerID, p.playerToken)
+	}
+
+	p = &Peer{store: store, config: &Config{}, ID: "anonymous", Game: "game"}
+	if err := p.identifyPlayer(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if p.PlayerID != "" {
+		t.Fatalf("expected no player without auth and secret, got %q", p.PlayerID)
+	}
+
+	p = &Peer{store: store, config: &Config{}, ID: "long", Game: "game", AuthIdentity: strings.Repeat("x", MaxPlayerIDLength+1)}
+	if err := p.identifyPlayer(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.PlayerID) != 64 {
+		t.Fatalf("expected a long identity to be hashed, got %q", p.PlayerID)
+	}
+}
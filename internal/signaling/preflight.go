@@ -0,0 +1,54 @@
+package signaling
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// originAllowed reports whether origin matches one of the AllowedOrigins host
+// patterns, these use the same syntax as websocket.AcceptOptions.OriginPatterns.
+func (c *Config) originAllowed(origin string) bool {
+	if len(c.AllowedOrigins) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.AllowedOrigins {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(u.Host)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePreflight answers CORS preflight requests, some proxies and fetch based
+// fallbacks send these before connecting and they shouldn't be upgraded.
+func handlePreflight(w http.ResponseWriter, r *http.Request, config *Config) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !config.originAllowed(origin) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	if len(config.AllowedOrigins) == 0 {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	h.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	if len(config.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	h.Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+}
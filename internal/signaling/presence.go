@@ -0,0 +1,210 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxPresenceSubscriptions is how many players a peer can follow the
+// presence of at once.
+const DefaultMaxPresenceSubscriptions = 100
+
+var ErrPresenceLimit = util.NewError("presence-limit", "too many players to subscribe to")
+
+// presenceSubscription forwards the presence changes of players to a peer.
+// Changes can arrive before the presence was read, those are held back
+// until it's queued and dropped when they're older than what was read.
+type presenceSubscription struct {
+	cancel context.CancelFunc
+
+	mutex   sync.Mutex
+	started bool
+	updated map[string]time.Time
+	pending []stores.Presence
+	stopped bool
+}
+
+// HandleSubscribePresencePacket replies with the presence of the players and
+// from then on sends a presence-changed packet whenever one of them connects,
+// disconnects or changes lobby. Subscribing again replaces the players.
+func (p *Peer) HandleSubscribePresencePacket(ctx context.Context, packet SubscribePresencePacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	players := make([]string, 0, len(packet.Players))
+	seen := make(map[string]bool, len(packet.Players))
+	for _, player := range packet.Players {
+		if player != "" && len(player) <= MaxPlayerIDLength && !seen[player] {
+			seen[player] = true
+			players = append(players, player)
+		}
+	}
+	if len(players) > p.config.MaxPresenceSubscriptions {
+		p.ReplyError(ctx, packet.RequestID, ErrPresenceLimit.WithParams("max", p.config.MaxPresenceSubscriptions))
+		return nil
+	}
+	p.unsubscribePresence()
+
+	// Subscribe before reading the presence so no change falls in between.
+	sctx, cancel := context.WithCancel(p.connCtx)
+	sub := &presenceSubscription{cancel: cancel, updated: make(map[string]time.Time, len(players))}
+	for _, player := range players {
+		p.store.Subscribe(sctx, stores.PresenceTopic(p.Game, player), func(_ context.Context, data []byte) {
+			presence := stores.Presence{}
+			if err := json.Unmarshal(data, &presence); err != nil {
+				logger.Error("failed to unmarshal presence", zap.Error(err))
+				return
+			}
+			sub.deliver(p, presence)
+		})
+	}
+
+	presence, err := p.store.GetPresence(ctx, p.Game, players, p.presenceOnlineAfter(ctx))
+	if err != nil {
+		cancel()
+		return err
+	}
+	p.presence = sub
+
+	reply := PresencePacket{
+		RequestID: packet.RequestID,
+		Type:      "presence",
+		Players:   make([]PlayerPresence, 0, len(players)),
+	}
+	for _, player := range players {
+		current, ok := presence[player]
+		if !ok {
+			current = stores.Presence{Player: player}
+		}
+		sub.updated[player] = current.UpdatedAt
+		reply.Players = append(reply.Players, PlayerPresence{Player: player, Online: current.Online, Lobby: current.Lobby})
+	}
+	sub.start(p, reply)
+	return nil
+}
+
+func (p *Peer) HandleUnsubscribePresencePacket(ctx context.Context, packet UnsubscribePresencePacket) error {
+	p.unsubscribePresence()
+	return nil
+}
+
+// start queues the presence followed by the changes held back while it was read.
+func (s *presenceSubscription) start(p *Peer, reply PresencePacket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.started = true
+	p.Enqueue(reply, nil)
+	for _, presence := range s.pending {
+		s.forward(p, presence)
+	}
+	s.pending = nil
+}
+
+func (s *presenceSubscription) deliver(p *Peer, presence stores.Presence) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return
+	} else if !s.started {
+		s.pending = append(s.pending, presence)
+		return
+	}
+	s.forward(p, presence)
+}
+
+func (s *presenceSubscription) forward(p *Peer, presence stores.Presence) {
+	if !presence.UpdatedAt.After(s.updated[presence.Player]) {
+		return
+	}
+	s.updated[presence.Player] = presence.UpdatedAt
+	p.Enqueue(PresenceChangedPacket{
+		Type: "presence-changed",
+		PlayerPresence: PlayerPresence{
+			Player: presence.Player,
+			Online: presence.Online,
+			Lobby:  presence.Lobby,
+		},
+	}, nil)
+}
+
+func (p *Peer) unsubscribePresence() {
+	if p.presence != nil {
+		p.presence.cancel()
+		p.presence.mutex.Lock()
+		p.presence.stopped = true
+		p.presence.mutex.Unlock()
+		p.presence = nil
+	}
+}
+
+// syncPresence records the presence of the peer once it's identified as a
+// player and whenever it changed lobby, and tells the subscribers of the
+// player. It must be called from the goroutine handling p.
+func (p *Peer) syncPresence(ctx context.Context) {
+	if p.PlayerID == "" || (p.presenceOnline && p.presenceLobby == p.Lobby) {
+		return
+	}
+	p.presenceOnline = true
+	p.presenceLobby = p.Lobby
+	p.publishPresence(ctx, true)
+}
+
+// stopPresence marks the peer offline when its connection closed, a peer
+// that reconnects is marked online again by its new connection.
+func (p *Peer) stopPresence(ctx context.Context) {
+	if !p.presenceOnline || p.superseded.Load() {
+		return
+	}
+	p.presenceOnline = false
+	p.publishPresence(ctx, false)
+}
+
+// presenceOnlineAfter is when an online session recorded its presence at
+// the latest. Connections last at most MaxConnectionTime, so older presence
+// was left behind by a node that went down without marking its peers
+// offline. Without a connection cap presence doesn't expire.
+func (p *Peer) presenceOnlineAfter(ctx context.Context) time.Time {
+	if p.config.MaxConnectionTime <= 0 {
+		return time.Time{}
+	}
+	return util.Now(ctx).Add(-p.config.MaxConnectionTime - DefaultDisconnectThreshold)
+}
+
+func (p *Peer) publishPresence(ctx context.Context, online bool) {
+	logger := logging.GetLogger(ctx)
+	lobby := ""
+	if online {
+		lobby = p.Lobby
+	}
+	if err := p.store.SetPresence(ctx, p.Game, p.ID, online, lobby); err != nil {
+		logger.Warn("failed to set presence", zap.Error(err))
+		return
+	}
+	// Another session of the player might still be online, publish the
+	// presence of the player rather than that of this peer.
+	presence, err := p.store.GetPresence(ctx, p.Game, []string{p.PlayerID}, p.presenceOnlineAfter(ctx))
+	if err != nil {
+		logger.Warn("failed to get presence", zap.Error(err))
+		return
+	}
+	current, ok := presence[p.PlayerID]
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(current)
+	if err != nil {
+		return
+	}
+	if err := p.store.Publish(ctx, stores.PresenceTopic(p.Game, p.PlayerID), data); err != nil {
+		logger.Error("failed to publish presence", zap.Error(err))
+	}
+}
@@ -0,0 +1,217 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// presenceStore keeps the players and their presence in memory and delivers
+// published messages to its subscribers.
+type presenceStore struct {
+	*shutdownStore
+
+	mutex       sync.Mutex
+	players     map[string]string // peer to player
+	presence    map[string]stores.Presence
+	changes     int
+	subscribers map[string][]presenceSubscriber
+	onlineAfter time.Time
+}
+
+type presenceSubscriber struct {
+	ctx      context.Context
+	callback stores.SubscriptionCallback
+}
+
+func newPresenceStore(t *testing.T) *presenceStore {
+	return &presenceStore{
+		shutdownStore: &shutdownStore{t: t, timeouts: make(map[string]string)},
+		players:       make(map[string]string),
+		presence:      make(map[string]stores.Presence),
+		subscribers:   make(map[string][]presenceSubscriber),
+	}
+}
+
+func (s *presenceStore) SetPlayer(ctx context.Context, game, id, player string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.players[id] = player
+	return nil
+}
+
+func (s *presenceStore) SetPresence(ctx context.Context, game, id string, online bool, lobby string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changes++
+	player := s.players[id]
+	s.presence[player] = stores.Presence{Player: player, Online: online, Lobby: lobby, UpdatedAt: time.Unix(int64(s.changes), 0)}
+	return nil
+}
+
+func (s *presenceStore) GetPresence(ctx context.Context, game string, players []string, onlineAfter time.Time) (map[string]stores.Presence, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onlineAfter = onlineAfter
+	presence := make(map[string]stores.Presence)
+	for _, player := range players {
+		if current, ok := s.presence[player]; ok {
+			presence[player] = current
+		}
+	}
+	return presence, nil
+}
+
+func (s *presenceStore) Subscribe(ctx context.Context, topic string, callback stores.SubscriptionCallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribers[topic] = append(s.subscribers[topic], presenceSubscriber{ctx, callback})
+}
+
+func (s *presenceStore) Publish(ctx context.Context, topic string, data []byte) error {
+	s.mutex.Lock()
+	subscribers := s.subscribers[topic]
+	s.mutex.Unlock()
+	for _, subscriber := range subscribers {
+		if subscriber.ctx.Err() == nil {
+			subscriber.callback(subscriber.ctx, data)
+		}
+	}
+	return nil
+}
+
+func TestPresence(t *testing.T) {
+	ctx := context.Background()
+	game := "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+	store := newPresenceStore(t)
+	_, handler, _ := Handler(ctx, store, nil, Config{PlayerTokenSecret: "secret", MaxPresenceSubscriptions: 2})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	connect := func(token string) *websocket.Conn {
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readServerInfo(ctx, t, conn)
+		if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: game, PlayerToken: token}); err != nil {
+			t.Fatal(err)
+		}
+		welcome := WelcomePacket{}
+		if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	subscriber := connect("")
+	defer subscriber.Close(websocket.StatusNormalClosure, "")
+	if err := wsjson.Write(ctx, subscriber, SubscribePresencePacket{Type: "subscribe-presence", RequestID: "many", Players: []string{"a", "b", "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	limited := struct {
+		Type   string
+		Code   string
+		Params map[string]any
+	}{}
+	if err := wsjson.Read(ctx, subscriber, &limited); err != nil {
+		t.Fatal(err)
+	}
+	if limited.Code != "presence-limit" || limited.Params["max"] != float64(2) {
+		t.Fatalf("expected the subscription to be limited, got %+v", limited)
+	}
+
+	if err := wsjson.Write(ctx, subscriber, SubscribePresencePacket{Type: "subscribe-presence", RequestID: "friends", Players: []string{"friend", "friend"}}); err != nil {
+		t.Fatal(err)
+	}
+	presence := PresencePacket{}
+	if err := wsjson.Read(ctx, subscriber, &presence); err != nil {
+		t.Fatal(err)
+	}
+	if presence.RequestID != "friends" || len(presence.Players) != 1 || presence.Players[0] != (PlayerPresence{Player: "friend"}) {
+		t.Fatalf("expected the friend to be offline, got %+v", presence)
+	}
+
+	expect := func(expected PlayerPresence) {
+		t.Helper()
+		changed := PresenceChangedPacket{}
+		if err := wsjson.Read(ctx, subscriber, &changed); err != nil {
+			t.Fatal(err)
+		}
+		if changed.Type != "presence-changed" || changed.PlayerPresence != expected {
+			t.Fatalf("expected %+v, got %+v", expected, changed)
+		}
+	}
+
+	friend := connect(playerToken("secret", game, "friend"))
+	expect(PlayerPresence{Player: "friend", Online: true})
+	friend.Close(websocket.StatusNormalClosure, "") //nolint:errcheck
+	expect(PlayerPresence{Player: "friend", Online: false})
+}
+
+func TestPresenceLobbyChange(t *testing.T) {
+	ctx := context.Background()
+	store := newPresenceStore(t)
+	var published []stores.Presence
+	store.Subscribe(ctx, stores.PresenceTopic("game", "friend"), func(_ context.Context, data []byte) {
+		presence := stores.Presence{}
+		if err := json.Unmarshal(data, &presence); err != nil {
+			t.Fatal(err)
+		}
+		published = append(published, presence)
+	})
+
+	p := &Peer{store: store, config: &Config{}, ID: "peer", Game: "game", PlayerID: "friend"}
+	store.players["peer"] = "friend"
+	p.syncPresence(ctx)
+	p.syncPresence(ctx) // Nothing changed.
+	p.Lobby = "lobby"
+	p.syncPresence(ctx)
+	p.Lobby = ""
+	p.syncPresence(ctx)
+	p.stopPresence(ctx)
+
+	expected := []PlayerPresence{
+		{Player: "friend", Online: true},
+		{Player: "friend", Online: true, Lobby: "lobby"},
+		{Player: "friend", Online: true},
+		{Player: "friend", Online: false},
+	}
+	if len(published) != len(expected) {
+		t.Fatalf("expected %d changes, got %+v", len(expected), published)
+	}
+	for i, presence := range published {
+		if (PlayerPresence{Player: presence.Player, Online: presence.Online, Lobby: presence.Lobby}) != expected[i] {
+			t.Fatalf("expected change %d to be %+v, got %+v", i, expected[i], presence)
+		}
+	}
+}
+
+func TestPresenceExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := newPresenceStore(t)
+	store.players["peer"] = "friend"
+	p := &Peer{store: store, config: &Config{MaxConnectionTime: time.Hour}, ID: "peer", Game: "game", PlayerID: "friend"}
+
+	p.syncPresence(ctx)
+	expected := time.Now().Add(-time.Hour - DefaultDisconnectThreshold)
+	if d := store.onlineAfter.Sub(expected); d < -time.Second || d > time.Second {
+		t.Fatalf("expected presence to expire after the connection cap, got %s", store.onlineAfter)
+	}
+
+	// Without a connection cap sessions can last forever.
+	p.config.MaxConnectionTime = -1
+	p.stopPresence(ctx)
+	if !store.onlineAfter.IsZero() {
+		t.Fatalf("expected presence not to expire, got %s", store.onlineAfter)
+	}
+}
@@ -0,0 +1,101 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// ProtocolVersion is the current version of the packet format. Clients send
+// the version they speak in their hello, clients that don't are assumed to
+// speak version 0.
+const ProtocolVersion = 1
+
+// renamedFields maps a protocol version to the fields that had a different
+// name in that version, keyed by their current name. When renaming a field,
+// add its old name to every version before the rename.
+var renamedFields = map[int]map[string]string{
+	// Version 1 spelled out the ID of acknowledged packets, see AckPacket.
+	0: {"messageId": "mid"},
+}
+
+// negotiateProtocolVersion returns the version to use with a client that
+// speaks requested, newer clients are served the current version.
+func negotiateProtocolVersion(requested int) int {
+	if requested < 0 {
+		return 0
+	}
+	if requested > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return requested
+}
+
+// protocolCodec converts packets between the current field names and the
+// field names of an older protocol version. Only top-level fields are renamed.
+type protocolCodec struct {
+	// toClient maps current names to the names the client uses, fromClient
+	// the other way around.
+	toClient   map[string]string
+	fromClient map[string]string
+}
+
+// codecFor returns the codec for version, or nil when the version uses the
+// current field names.
+func codecFor(version int) *protocolCodec {
+	return newProtocolCodec(renamedFields[version])
+}
+
+func newProtocolCodec(renames map[string]string) *protocolCodec {
+	if len(renames) == 0 {
+		return nil
+	}
+	c := &protocolCodec{
+		toClient:   renames,
+		fromClient: make(map[string]string, len(renames)),
+	}
+	for current, old := range renames {
+		c.fromClient[old] = current
+	}
+	return c
+}
+
+// Encode renames the fields of an outgoing packet.
+func (c *protocolCodec) Encode(raw []byte) ([]byte, error) {
+	return c.rename(raw, c.toClient)
+}
+
+// Decode normalizes the fields of an incoming packet to the current names.
+func (c *protocolCodec) Decode(raw []byte) ([]byte, error) {
+	return c.rename(raw, c.fromClient)
+}
+
+func (c *protocolCodec) rename(raw []byte, names map[string]string) ([]byte, error) {
+	// Most packets have none of the fields, skip decoding those.
+	found := false
+	for from := range names {
+		if bytes.Contains(raw, []byte(strconv.Quote(from))) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return raw, nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	renamed := false
+	for from, to := range names {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+			renamed = true
+		}
+	}
+	if !renamed {
+		return raw, nil
+	}
+	return json.Marshal(fields)
+}
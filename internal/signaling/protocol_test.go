@@ -0,0 +1,126 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	tests := []struct {
+		requested int
+		expected  int
+	}{
+		{-1, 0},
+		{0, 0},
+		{ProtocolVersion, ProtocolVersion},
+		{ProtocolVersion + 1, ProtocolVersion},
+	}
+	for _, test := range tests {
+		if got := negotiateProtocolVersion(test.requested); got != test.expected {
+			t.Errorf("expected version %d for %d, got %d", test.expected, test.requested, got)
+		}
+	}
+}
+
+func TestProtocolCodecRoundTrip(t *testing.T) {
+	packet := AckPacket{Type: "ack", MessageID: "m1"}
+	for _, test := range []struct {
+		version int
+		field   string
+	}{
+		{0, "mid"},
+		{ProtocolVersion, "messageId"},
+	} {
+		raw, err := json.Marshal(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := codecFor(test.version)
+		if codec != nil {
+			if raw, err = codec.Encode(raw); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fields := map[string]any{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if len(fields) != 2 || fields[test.field] != "m1" {
+			t.Fatalf("expected version %d to send %s, got %s", test.version, test.field, raw)
+		}
+
+		if codec != nil {
+			if raw, err = codec.Decode(raw); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out := AckPacket{}
+		if err := json.Unmarshal(raw, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out != packet {
+			t.Fatalf("expected version %d to decode %+v, got %+v", test.version, packet, out)
+		}
+	}
+}
+
+func TestPeerSpeaksNegotiatedVersion(t *testing.T) {
+	for _, test := range []struct {
+		version int
+		field   string
+	}{
+		{0, "mid"},
+		{ProtocolVersion, "messageId"},
+	} {
+		t.Run(test.field, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+				p := &Peer{conn: conn, config: &Config{}}
+				p.negotiate([]string{AcksCapability}, test.version)
+
+				// The client sends the ID of the packet with the name of its version.
+				raw, err := p.decode([]byte(`{"type": "ping", "` + test.field + `": "m1"}`))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				typeOnly := struct {
+					MessageID string `json:"messageId"`
+				}{}
+				if err := json.Unmarshal(raw, &typeOnly); err != nil || typeOnly.MessageID != "m1" {
+					t.Errorf("expected the message ID to be decoded, got %s (%v)", raw, err)
+				}
+				if err := p.acknowledge(r.Context(), typeOnly.MessageID); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			reply := map[string]any{}
+			if err := wsjson.Read(ctx, conn, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply["type"] != "ack" || reply[test.field] != "m1" {
+				t.Fatalf("expected the ack to use %s, got %v", test.field, reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package signaling
+
+import (
+	"encoding/base64"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+// PublicKeyField is the peer data entry holding the public key a peer set
+// when it joined, for games that end-to-end encrypt what they relay. The
+// server only stores and distributes it.
+const PublicKeyField = "publicKey"
+
+// MaxPublicKeySize is the maximum length of a base64 encoded public key,
+// enough for a P-256 key in SPKI form.
+const MaxPublicKeySize = 256
+
+var ErrInvalidPublicKey = util.NewError("invalid-public-key", "public key must be base64").WithParams("max", MaxPublicKeySize)
+
+func validatePublicKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	if len(key) > MaxPublicKeySize {
+		return ErrInvalidPublicKey
+	}
+	if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+		return ErrInvalidPublicKey
+	}
+	return nil
+}
+
+// withPublicKey returns data with the public key in PublicKeyField, data
+// itself isn't modified. The key must have been validated.
+func withPublicKey(data map[string]any, key string) map[string]any {
+	if key == "" {
+		return data
+	}
+	merged := make(map[string]any, len(data)+1)
+	for k, v := range data {
+		merged[k] = v
+	}
+	merged[PublicKeyField] = key
+	return merged
+}
+
+// keepPublicKey carries the public key over from the current peer data when
+// data doesn't replace it, so set-peer-data doesn't drop it.
+func keepPublicKey(data, current map[string]any) map[string]any {
+	if _, found := data[PublicKeyField]; found {
+		return data
+	}
+	key, _ := current[PublicKeyField].(string)
+	return withPublicKey(data, key)
+}
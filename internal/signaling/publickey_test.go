@@ -0,0 +1,187 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+)
+
+func TestValidatePublicKey(t *testing.T) {
+	for _, key := range []string{"", "MCowBQYDK2VuAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE="} {
+		if err := validatePublicKey(key); err != nil {
+			t.Errorf("expected %q to be valid, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"not base64!", strings.Repeat("A", MaxPublicKeySize+4)} {
+		if err := validatePublicKey(key); !errors.Is(err, ErrInvalidPublicKey) {
+			t.Errorf("expected %q to be invalid, got %v", key, err)
+		}
+	}
+	if _, err := validatePeerData(map[string]any{PublicKeyField: 12}, "", nil); !errors.Is(err, ErrInvalidPublicKey) {
+		t.Errorf("expected a public key in the peer data to be validated, got %v", err)
+	}
+	if _, err := validatePeerData(nil, "not base64!", nil); !errors.Is(err, ErrInvalidPublicKey) {
+		t.Errorf("expected the public key of the packet to be validated, got %v", err)
+	}
+}
+
+func TestValidatePeerData(t *testing.T) {
+	key := "MCowBQYDK2VuAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE="
+	if data, err := validatePeerData(nil, "", nil); err != nil || data != nil {
+		t.Fatalf("expected no peer data, got %v (%v)", data, err)
+	}
+	data, err := validatePeerData(map[string]any{"name": "a"}, key, nil)
+	if err != nil || data["name"] != "a" || data[PublicKeyField] != key {
+		t.Fatalf("expected the peer data with the key, got %v (%v)", data, err)
+	}
+
+	// Data that only fits without the public key is rejected, whether the key
+	// comes with the packet or is kept from the current peer data.
+	name := strings.Repeat("a", MaxPeerDataSize-len(`{"name":""}`))
+	if _, err := validatePeerData(map[string]any{"name": name}, "", nil); err != nil {
+		t.Fatalf("expected data of the max size to be valid, got %v", err)
+	}
+	if _, err := validatePeerData(map[string]any{"name": name}, key, nil); !errors.Is(err, ErrPeerDataTooLarge) {
+		t.Fatalf("expected the key to count towards the size, got %v", err)
+	}
+	if _, err := validatePeerData(map[string]any{"name": name}, "", data); !errors.Is(err, ErrPeerDataTooLarge) {
+		t.Fatalf("expected the kept key to count towards the size, got %v", err)
+	}
+}
+
+func TestKeepPublicKey(t *testing.T) {
+	current := map[string]any{"name": "a", PublicKeyField: "AAAA"}
+	if data := keepPublicKey(map[string]any{"name": "b"}, current); data[PublicKeyField] != "AAAA" || data["name"] != "b" {
+		t.Fatalf("expected the key to be kept, got %v", data)
+	}
+	if data := keepPublicKey(map[string]any{PublicKeyField: "BBBB"}, current); data[PublicKeyField] != "BBBB" {
+		t.Fatalf("expected the key to be replaced, got %v", data)
+	}
+}
+
+// joinStore is a lobby holding peerA, methods the test doesn't need panic.
+type joinStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	peerData  map[string]map[string]any
+	published map[string][][]byte
+}
+
+func (s *joinStore) MarkLobbyFilled(context.Context, string, string) (*stores.LobbyLifetime, error) {
+	return nil, nil
+}
+
+func (s *joinStore) JoinLobby(context.Context, string, string, string, stores.Role) ([]string, error) {
+	return []string{"peerA"}, nil
+}
+
+func (s *joinStore) SetPeerData(ctx context.Context, game, lobby, id string, data map[string]any) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.peerData[id] = data
+	return nil, nil
+}
+
+func (s *joinStore) GetPeerData(context.Context, string, string) (map[string]map[string]any, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.peerData, nil
+}
+
+func (s *joinStore) GetSeats(context.Context, string, string) (map[string]int, error) {
+	return map[string]int{"peerA": 0, "peerB": 1}, nil
+}
+
+func (s *joinStore) Subscribe(context.Context, string, stores.SubscriptionCallback) {}
+
+func (s *joinStore) Publish(ctx context.Context, topic string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.published[topic] = append(s.published[topic], data)
+	return nil
+}
+
+func (s *joinStore) LockLobby(ctx context.Context, _, _ string, _ time.Duration, fn func(context.Context) error) error {
+	return fn(ctx)
+}
+
+func (s *joinStore) AutoStartLobby(context.Context, string, string, string, time.Time) ([]string, bool, error) {
+	return nil, false, nil
+}
+
+func TestPublicKeyDistributedOnJoin(t *testing.T) {
+	store := &joinStore{
+		peerData:  map[string]map[string]any{"peerA": {PublicKeyField: "AAAA"}},
+		published: make(map[string][][]byte),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{store: store, conn: conn, config: &Config{}, registry: newPeerRegistry(), connCtx: r.Context(), ID: "peerB", Game: "game"}
+		packet := JoinPacket{Type: "join", Lobby: "lobby", PeerData: map[string]any{"name": "b"}, PublicKey: "BBBB"}
+		if err := p.HandleJoinPacket(r.Context(), packet); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	var toMe ConnectPacket
+	for toMe.Type != "connect" {
+		_, raw, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(raw, &toMe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if toMe.ID != "peerA" || toMe.PeerData[PublicKeyField] != "AAAA" {
+		t.Fatalf("expected the key of the member, got %+v", toMe)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if data := store.peerData["peerB"]; data[PublicKeyField] != "BBBB" || data["name"] != "b" {
+		t.Fatalf("expected the key to be stored with the peer data, got %v", data)
+	}
+	published := store.published["gamelobbypeerA"]
+	if len(published) != 2 {
+		t.Fatalf("expected a connect and ready packet for the member, got %d packets", len(published))
+	}
+	toThem := ConnectPacket{}
+	if err := json.Unmarshal(published[0], &toThem); err != nil {
+		t.Fatal(err)
+	}
+	if toThem.ID != "peerB" || toThem.PeerData[PublicKeyField] != "BBBB" {
+		t.Fatalf("expected the member to get the key of the new peer, got %+v", toThem)
+	}
+	// Joining cleared the ready states of the lobby.
+	ready := ReadyPacket{}
+	if err := json.Unmarshal(published[1], &ready); err != nil {
+		t.Fatal(err)
+	}
+	if ready.Type != "ready" || len(ready.Ready) != 0 || ready.Total != 2 {
+		t.Fatalf("expected the member to get the ready reset, got %+v", ready)
+	}
+}
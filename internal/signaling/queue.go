@@ -0,0 +1,217 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// DefaultMaxQueuedMessages and DefaultMaxQueuedBytes bound the packets queued
+// for a peer with Enqueue, a peer that falls further behind is disconnected.
+const DefaultMaxQueuedMessages = 64
+const DefaultMaxQueuedBytes = 1024 * 1024
+
+// QueueWriteTimeout is the write deadline of a single queued packet. While a
+// write is blocked on a slow peer the queue fills up, so a peer is
+// disconnected either when a write takes longer than this or when it can't
+// keep up with the rate packets are queued at, whichever comes first.
+const QueueWriteTimeout = 10 * time.Second
+
+// Priority is the class of a queued packet, control packets are written
+// before bulk packets that were queued earlier by other senders.
+type Priority int
+
+const (
+	PriorityControl Priority = iota
+	PriorityBulk
+
+	priorityCount
+)
+
+// bulkPacketTypes are the relayed signals, a client trickling candidates
+// can queue dozens of them at once for each of its peers. They share a
+// priority so the signals of a peer arrive in the order it sent them.
+var bulkPacketTypes = map[string]struct{}{
+	"candidate":   {},
+	"description": {},
+}
+
+// packetHeader is what the queue needs to know of a packet.
+type packetHeader struct {
+	Type string `json:"type"`
+	// Source is the sender of relayed packets, ID the peer other packets
+	// are about, like the one that left for a disconnect.
+	Source string `json:"source"`
+	ID     string `json:"id"`
+}
+
+// packetPriority returns the priority of a packet by its type and the peer
+// that caused it, empty for packets of the server itself.
+func packetPriority(raw []byte) (Priority, string) {
+	header := packetHeader{}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return PriorityControl, ""
+	}
+	sender := header.Source
+	if sender == "" {
+		sender = header.ID
+	}
+	if _, bulk := bulkPacketTypes[header.Type]; bulk {
+		return PriorityBulk, sender
+	}
+	return PriorityControl, sender
+}
+
+func newQueues(size int) [priorityCount]chan queuedPacket {
+	var queues [priorityCount]chan queuedPacket
+	for i := range queues {
+		queues[i] = make(chan queuedPacket, size)
+	}
+	return queues
+}
+
+type queuedPacket struct {
+	packet   json.RawMessage
+	priority Priority
+	sender   string
+	onResult func(error)
+}
+
+// Enqueue queues packet to be sent by the peer's writer without blocking, with
+// the priority of its type. When the queue is over its message or byte limit
+// the peer is disconnected as too slow and false is returned. onResult, if not
+// nil, is called with the result of the write.
+func (p *Peer) Enqueue(packet any, onResult func(error)) bool {
+	raw, err := json.Marshal(packet)
+	if err != nil {
+		if onResult != nil {
+			onResult(err)
+		}
+		return false
+	}
+	priority, sender := packetPriority(raw)
+	return p.enqueue(raw, priority, sender, onResult)
+}
+
+// EnqueuePriority is like Enqueue with an explicit priority.
+func (p *Peer) EnqueuePriority(packet any, priority Priority, onResult func(error)) bool {
+	raw, err := json.Marshal(packet)
+	if err != nil {
+		if onResult != nil {
+			onResult(err)
+		}
+		return false
+	}
+	_, sender := packetPriority(raw)
+	return p.enqueue(raw, priority, sender, onResult)
+}
+
+// enqueue queues raw, the message and byte limits are shared by both
+// priorities. A control packet of a sender that still has bulk packets queued
+// is queued as bulk, so the packets of a sender are always written in order.
+func (p *Peer) enqueue(raw json.RawMessage, priority Priority, sender string, onResult func(error)) bool {
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	if p.queuedMessages >= p.config.MaxQueuedMessages {
+		p.tooSlow("messages")
+		return false
+	}
+	if p.queuedBytes.Add(int64(len(raw))) > int64(p.config.MaxQueuedBytes) {
+		p.queuedBytes.Add(-int64(len(raw)))
+		p.tooSlow("bytes")
+		return false
+	}
+	if priority == PriorityControl && p.queuedBulk[sender] > 0 {
+		priority = PriorityBulk
+	}
+	if priority == PriorityBulk && sender != "" {
+		if p.queuedBulk == nil {
+			p.queuedBulk = make(map[string]int)
+		}
+		p.queuedBulk[sender]++
+	}
+	p.queuedMessages++
+	// Each queue holds MaxQueuedMessages, so this never blocks.
+	p.queues[priority] <- queuedPacket{packet: raw, priority: priority, sender: sender, onResult: onResult}
+	return true
+}
+
+// dequeued releases the room q took in the queue.
+func (p *Peer) dequeued(q queuedPacket) {
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	p.queuedMessages--
+	if q.priority == PriorityBulk && q.sender != "" {
+		if p.queuedBulk[q.sender]--; p.queuedBulk[q.sender] <= 0 {
+			delete(p.queuedBulk, q.sender)
+		}
+	}
+}
+
+// tooSlow disconnects a peer that can't keep up with its queue.
+func (p *Peer) tooSlow(limit string) {
+	if !p.slow.CompareAndSwap(false, true) {
+		return
+	}
+	metrics.Inc("netlib_slow_peer_disconnects_total", "limit", limit)
+	go p.conn.Close(websocket.StatusPolicyViolation, "too slow") //nolint:errcheck
+}
+
+// runQueue writes queued packets until ctx is done, a slow peer only delays
+// its own queue. Queued control packets always go first, so at most the bulk
+// packet being written is sent ahead of them. Packets of the same sender keep
+// their order, see enqueue.
+func (p *Peer) runQueue(ctx context.Context) {
+	for {
+		q, ok := p.nextQueued(ctx)
+		if !ok {
+			return
+		}
+		p.writeQueued(ctx, q)
+	}
+}
+
+// nextQueued waits for the next packet to write, it returns false when ctx is
+// done.
+func (p *Peer) nextQueued(ctx context.Context) (queuedPacket, bool) {
+	control, bulk := p.queues[PriorityControl], p.queues[PriorityBulk]
+	select {
+	case q := <-control:
+		p.dequeued(q)
+		return q, true
+	default:
+	}
+	select {
+	case q := <-control:
+		p.dequeued(q)
+		return q, true
+	case q := <-bulk:
+		p.dequeued(q)
+		return q, true
+	case <-ctx.Done():
+		return queuedPacket{}, false
+	}
+}
+
+func (p *Peer) writeQueued(ctx context.Context, q queuedPacket) {
+	logger := logging.GetLogger(ctx)
+	wctx, cancel := context.WithTimeout(ctx, QueueWriteTimeout)
+	err := p.Send(wctx, q.packet)
+	timedOut := wctx.Err() == context.DeadlineExceeded
+	cancel()
+	p.queuedBytes.Add(-int64(len(q.packet)))
+	if timedOut && ctx.Err() == nil {
+		p.tooSlow("write")
+	} else if err != nil && !util.IsPipeError(err) && ctx.Err() == nil {
+		logger.Warn("failed to send queued packet", zap.String("peer", p.ID), zap.Error(err))
+	}
+	if q.onResult != nil {
+		q.onResult(err)
+	}
+}
@@ -0,0 +1,82 @@
+package signaling
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQueuePriorities(t *testing.T) {
+	p := &Peer{
+		config: &Config{MaxQueuedMessages: 8, MaxQueuedBytes: 1024},
+		queues: newQueues(8),
+	}
+	for _, packet := range []string{
+		`{"type":"candidate","source":"a","candidate":1}`,
+		`{"type":"description","source":"c"}`,
+		`{"type":"leader","leader":"a"}`,
+		`{"type":"candidate","source":"a","candidate":2}`,
+		`{"type":"disconnect","id":"b"}`,
+		`{"type":"disconnect","id":"c"}`,
+	} {
+		p.ForwardMessage(context.Background(), []byte(packet))
+	}
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		q, ok := p.nextQueued(context.Background())
+		if !ok {
+			t.Fatal("expected a queued packet")
+		}
+		got = append(got, string(q.packet))
+	}
+	// The disconnect of c waits for the description c sent before it.
+	want := []string{
+		`{"type":"leader","leader":"a"}`,
+		`{"type":"disconnect","id":"b"}`,
+		`{"type":"candidate","source":"a","candidate":1}`,
+		`{"type":"description","source":"c"}`,
+		`{"type":"candidate","source":"a","candidate":2}`,
+		`{"type":"disconnect","id":"c"}`,
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected order:\n got %v\nwant %v", got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := p.nextQueued(ctx); ok {
+		t.Fatal("expected no packet from an empty queue after cancel")
+	}
+}
+
+func TestQueueSharedLimit(t *testing.T) {
+	p := &Peer{
+		config: &Config{MaxQueuedMessages: 4, MaxQueuedBytes: 1024},
+		queues: newQueues(4),
+	}
+	p.slow.Store(true) // There's no connection to close.
+	for i := 0; i < 2; i++ {
+		if !p.enqueue([]byte(`{"type":"candidate","source":"a"}`), PriorityBulk, "a", nil) {
+			t.Fatal("expected room for bulk packets")
+		}
+		if !p.enqueue([]byte(`{"type":"leader"}`), PriorityControl, "", nil) {
+			t.Fatal("expected room for control packets")
+		}
+	}
+	if p.enqueue([]byte(`{"type":"leader"}`), PriorityControl, "", nil) {
+		t.Fatal("expected the limit to be shared by both priorities")
+	}
+	for i := 0; i < 4; i++ {
+		if _, ok := p.nextQueued(context.Background()); !ok {
+			t.Fatal("expected a queued packet")
+		}
+	}
+	if p.queuedMessages != 0 || len(p.queuedBulk) != 0 {
+		t.Fatalf("expected an empty queue, got %d messages and %v", p.queuedMessages, p.queuedBulk)
+	}
+	if !p.enqueue([]byte(`{"type":"leader"}`), PriorityControl, "", nil) {
+		t.Fatal("expected room after the queue drained")
+	}
+}
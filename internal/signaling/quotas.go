@@ -0,0 +1,81 @@
+package signaling
+
+import (
+	"context"
+	"sync"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrGameQuotaExceeded = util.NewError("game-quota-exceeded", "game quota exceeded")
+
+// quotaTracker enforces the per game quotas from the Config. Connected peers
+// are counted on this node, active lobbies are counted in the store. Only the
+// games with a quota get metrics, so clients can't grow the number of series.
+type quotaTracker struct {
+	limits map[string]Quota
+
+	mutex sync.Mutex
+	peers map[string]int
+}
+
+func newQuotaTracker(limits map[string]Quota) *quotaTracker {
+	return &quotaTracker{
+		limits: limits,
+		peers:  make(map[string]int),
+	}
+}
+
+// AcquirePeer counts a new connected peer for game, it returns
+// ErrGameQuotaExceeded when the game has no room for more peers.
+func (q *quotaTracker) AcquirePeer(game string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if limit := q.limits[game].MaxPeers; limit > 0 && q.peers[game] >= limit {
+		metrics.Inc("netlib_game_quota_exceeded_total", "game", game, "resource", "peers")
+		return ErrGameQuotaExceeded
+	}
+	q.peers[game]++
+	q.setPeersMetric(game)
+	return nil
+}
+
+func (q *quotaTracker) ReleasePeer(game string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.peers[game]--
+	q.setPeersMetric(game)
+	if q.peers[game] <= 0 {
+		delete(q.peers, game)
+	}
+}
+
+// setPeersMetric updates the connected peers of game when it has a quota,
+// q.mutex must be held.
+func (q *quotaTracker) setPeersMetric(game string) {
+	if _, ok := q.limits[game]; ok {
+		metrics.Set("netlib_game_peers", float64(q.peers[game]), "game", game)
+	}
+}
+
+// CheckLobby returns ErrGameQuotaExceeded when game can't create another lobby.
+func (q *quotaTracker) CheckLobby(ctx context.Context, store stores.Store, game string) error {
+	limit := q.limits[game].MaxLobbies
+	if limit <= 0 {
+		return nil
+	}
+	count, err := store.CountActiveLobbies(ctx, game)
+	if err != nil {
+		return err
+	}
+	metrics.Set("netlib_game_lobbies", float64(count), "game", game)
+	if count >= limit {
+		metrics.Inc("netlib_game_quota_exceeded_total", "game", game, "resource", "lobbies")
+		return ErrGameQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestQuotaPeers(t *testing.T) {
+	quotas := newQuotaTracker(map[string]Quota{"quota-limited": {MaxPeers: 1}})
+
+	if err := quotas.AcquirePeer("quota-limited"); err != nil {
+		t.Fatal(err)
+	}
+	if err := quotas.AcquirePeer("quota-limited"); err != ErrGameQuotaExceeded {
+		t.Fatalf("expected ErrGameQuotaExceeded, got %v", err)
+	}
+	quotas.ReleasePeer("quota-limited")
+	if err := quotas.AcquirePeer("quota-limited"); err != nil {
+		t.Fatalf("expected room after a release, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := quotas.AcquirePeer("quota-unlimited"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `netlib_game_peers{game="quota-limited"} 1`) {
+		t.Fatalf("expected the peers of the game with a quota, got %s", body)
+	}
+	// Games without a quota are whatever ID a client sends.
+	if strings.Contains(body, "quota-unlimited") {
+		t.Fatalf("expected no series for a game without a quota, got %s", body)
+	}
+}
+
+// activeStore has two active lobbies for every game.
+type activeStore struct {
+	stores.Store
+}
+
+func (s *activeStore) CountActiveLobbies(context.Context, string) (int, error) {
+	return 2, nil
+}
+
+func TestQuotaLobbies(t *testing.T) {
+	ctx := context.Background()
+	quotas := newQuotaTracker(map[string]Quota{"two-lobbies": {MaxLobbies: 2}, "three-lobbies": {MaxLobbies: 3}})
+	if err := quotas.CheckLobby(ctx, &activeStore{}, "three-lobbies"); err != nil {
+		t.Fatalf("expected room for a third lobby, got %v", err)
+	}
+	if err := quotas.CheckLobby(ctx, &activeStore{}, "unlimited"); err != nil {
+		t.Fatalf("expected no limit without a quota, got %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{store: &activeStore{}, conn: conn, config: &Config{}, quotas: quotas, ID: "peer", Game: "two-lobbies"}
+		if err := p.HandleCreatePacket(r.Context(), CreatePacket{Type: "create", RequestID: "create"}); err != nil {
+			t.Error(err)
+		}
+		if p.Lobby != "" {
+			t.Errorf("expected no lobby over the quota, got %q", p.Lobby)
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	reply := map[string]any{}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply["rid"] != "create" || reply["code"] != "game-quota-exceeded" {
+		t.Fatalf("expected the create to be rejected, got %v", reply)
+	}
+}
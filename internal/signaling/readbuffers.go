@@ -0,0 +1,68 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// readBuffers pools the buffers the read loop reads packets into, so a busy
+// node doesn't allocate a fresh buffer for every packet. A buffer is only
+// taken once a packet arrives, idle connections don't hold one.
+//
+// The packet read into a buffer is only valid until the buffer is put back,
+// which happens once the packet is handled. Handlers must copy what they
+// keep, json.Unmarshal already does. When a handler needs to keep the raw
+// packet, Config.PoolReadBuffers must be disabled.
+type readBuffers struct {
+	pool sync.Pool
+	// size is the capacity of the buffers, the read limit plus the room
+	// bytes.Buffer wants free to read into. Buffers that grew beyond it aren't
+	// pooled.
+	size int
+}
+
+func newReadBuffers(config *Config) *readBuffers {
+	if !config.PoolReadBuffers {
+		return nil
+	}
+	limit := config.MaxPacketSize
+	if limit <= 0 {
+		limit = defaultReadLimit
+	}
+	b := &readBuffers{size: limit + bytes.MinRead}
+	b.pool.New = func() any {
+		return bytes.NewBuffer(make([]byte, 0, b.size))
+	}
+	return b
+}
+
+func (b *readBuffers) put(buf *bytes.Buffer) {
+	if b == nil || buf == nil || buf.Cap() > b.size {
+		return
+	}
+	buf.Reset()
+	b.pool.Put(buf)
+}
+
+// read reads the next packet like conn.Read. With pooling the packet is read
+// into a pooled buffer, which the caller must put back when it's done with
+// the packet, buf is nil without pooling.
+func (b *readBuffers) read(ctx context.Context, conn *websocket.Conn) (typ websocket.MessageType, raw []byte, buf *bytes.Buffer, err error) {
+	if b == nil {
+		typ, raw, err = conn.Read(ctx)
+		return typ, raw, nil, err
+	}
+	typ, r, err := conn.Reader(ctx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	buf = b.pool.Get().(*bytes.Buffer)
+	if _, err := buf.ReadFrom(r); err != nil {
+		b.put(buf)
+		return 0, nil, nil, err
+	}
+	return typ, buf.Bytes(), buf, nil
+}
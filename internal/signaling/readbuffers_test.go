@@ -0,0 +1,192 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestReadBuffersReuse(t *testing.T) {
+	// Every packet reuses the buffer of the one before it.
+	packets := []string{
+		`{"type":"candidate","candidate":{"candidate":"` + strings.Repeat("x", 900) + `"}}`,
+		`{"type":"ping"}`,
+		strings.Repeat("y", 1000),
+	}
+	received := make(chan []string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		buffers := newReadBuffers(&Config{PoolReadBuffers: true, MaxPacketSize: 1024})
+		conn.SetReadLimit(1024)
+		var got []string
+		for {
+			_, raw, buf, err := buffers.read(r.Context(), conn)
+			if err != nil {
+				break
+			}
+			got = append(got, string(raw))
+			if buf.Cap() > buffers.size {
+				t.Errorf("expected the buffer to fit the read limit, got %d", buf.Cap())
+			}
+			buffers.put(buf)
+		}
+		received <- got
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	for _, packet := range packets {
+		if err := conn.Write(ctx, websocket.MessageText, []byte(packet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A packet over the limit closes the connection like without pooling.
+	conn.Write(ctx, websocket.MessageText, []byte(strings.Repeat("z", 2000))) //nolint:errcheck
+
+	got := <-received
+	if len(got) != len(packets) {
+		t.Fatalf("expected the %d packets below the limit, got %d", len(packets), len(got))
+	}
+	for i := range packets {
+		if got[i] != packets[i] {
+			t.Fatalf("expected packet %d to be read intact, got %q", i, got[i])
+		}
+	}
+}
+
+func TestReadBuffersDisabled(t *testing.T) {
+	if newReadBuffers(&Config{}) != nil {
+		t.Fatal("expected no pool when disabled")
+	}
+	var buffers *readBuffers
+	buffers.put(nil) // Putting back without a pool is harmless.
+	buffers.put(&bytes.Buffer{})
+}
+
+func TestHandlerWithPooledReadBuffers(t *testing.T) {
+	ctx := context.Background()
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	_, handler, _ := Handler(ctx, store, nil, Config{PoolReadBuffers: true})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readServerInfo(ctx, t, conn)
+	if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: "4307bd86-e1df-41b8-b9df-e22afcf084bd"}); err != nil {
+		t.Fatal(err)
+	}
+	welcome := WelcomePacket{}
+	if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Type != "welcome" || welcome.ID == "" {
+		t.Fatalf("expected a welcome, got %+v", welcome)
+	}
+}
+
+// BenchmarkReadBuffers reads packets on many connections at once, compare
+// the allocations and GC pauses with and without pooling:
+//
+//	go test ./internal/signaling -run - -bench ReadBuffers -benchmem
+func BenchmarkReadBuffers(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmarkReadBuffers(b, newReadBuffers(&Config{PoolReadBuffers: pooled}))
+		})
+	}
+}
+
+func benchmarkReadBuffers(b *testing.B, buffers *readBuffers) {
+	const connections = 1000
+	packet := []byte(`{"type":"candidate","source":"a","recipient":"b","candidate":{"candidate":"` + strings.Repeat("x", 200) + `"}}`)
+
+	var read sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		for {
+			_, raw, buf, err := buffers.read(r.Context(), conn)
+			if err != nil {
+				return
+			}
+			_ = bytes.IndexByte(raw, ',')
+			buffers.put(buf)
+			read.Done()
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conns := make([]*websocket.Conn, connections)
+	for i := range conns {
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		conns[i] = conn
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	read.Add(b.N)
+	var written sync.WaitGroup
+	for c := 0; c < connections; c++ {
+		n := b.N / connections
+		if c < b.N%connections {
+			n++
+		}
+		written.Add(1)
+		go func(conn *websocket.Conn, n int) {
+			defer written.Done()
+			for i := 0; i < n; i++ {
+				if err := conn.Write(ctx, websocket.MessageText, packet); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(conns[c], n)
+	}
+	written.Wait()
+	read.Wait()
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(time.Since(start).Seconds())/1e6, "gc-pause-ms/s")
+	b.ReportMetric(float64(after.NumGC-before.NumGC), "gcs")
+}
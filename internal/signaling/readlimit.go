@@ -0,0 +1,130 @@
+package signaling
+
+import (
+	"context"
+	"time"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/util"
+)
+
+// MaxReadThrottle is the longest the read loop is paused to bring a
+// connection back under its read limits, connections that are further over
+// their budget are disconnected.
+const MaxReadThrottle = time.Second
+
+var ErrReadRateExceeded = util.NewError("rate-limited", "connection is sending too fast")
+
+// readBucket is a token bucket refilled at rate per second holding at most one
+// second worth of tokens. Taking more than available puts the bucket in debt,
+// the debt is the time the caller should wait before reading again.
+type readBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newReadBucket(rate int, now time.Time) *readBucket {
+	return &readBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+func (b *readBucket) take(n int, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// withRate returns the bucket refilling at rate, a nil bucket when rate is
+// zero. An existing bucket keeps its tokens, so a peer can't get a fresh burst
+// by changing lobbies.
+func (b *readBucket) withRate(rate int, now time.Time) *readBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if b == nil {
+		return newReadBucket(rate, now)
+	}
+	b.take(0, now)
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	return b
+}
+
+// readLimiter enforces the packets/sec and bytes/sec limits of a single
+// connection, either bucket is nil when its limit is disabled.
+type readLimiter struct {
+	packets *readBucket
+	bytes   *readBucket
+}
+
+func newReadLimiter(config *Config) *readLimiter {
+	now := time.Now()
+	l := &readLimiter{}
+	if config.MaxPacketRate > 0 {
+		l.packets = newReadBucket(config.MaxPacketRate, now)
+	}
+	if config.MaxReadRate > 0 {
+		l.bytes = newReadBucket(config.MaxReadRate, now)
+	}
+	return l
+}
+
+// setRates changes the limits of the connection, see Peer.syncLimits.
+func (l *readLimiter) setRates(packetRate, readRate int, now time.Time) {
+	l.packets = l.packets.withRate(packetRate, now)
+	l.bytes = l.bytes.withRate(readRate, now)
+}
+
+// wait accounts for a frame of size bytes and throttles the read loop when
+// the connection is over its limits, which also pushes back on the client
+// through tcp flow control.
+func (l *readLimiter) wait(ctx context.Context, size int) error {
+	return l.waitFor(ctx, 1, size)
+}
+
+// waitFor is wait for a frame holding several packets, see HandleBatchPacket.
+func (l *readLimiter) waitFor(ctx context.Context, packets, size int) error {
+	now := time.Now()
+	var delay time.Duration
+	if l.packets != nil && packets > 0 {
+		if d := l.packets.take(packets, now); d > 0 {
+			metrics.Inc("netlib_read_throttled_total", "limit", "packets")
+			delay = d
+		}
+	}
+	if l.bytes != nil && size > 0 {
+		if d := l.bytes.take(size, now); d > 0 {
+			metrics.Inc("netlib_read_throttled_total", "limit", "bytes")
+			if d > delay {
+				delay = d
+			}
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	if delay > MaxReadThrottle {
+		metrics.Inc("netlib_read_throttle_disconnects_total")
+		return ErrReadRateExceeded
+	}
+	metrics.Observe("netlib_read_throttle_seconds", delay.Seconds())
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/metrics"
+)
+
+func TestReadBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newReadBucket(1000, now)
+
+	if wait := bucket.take(1000, now); wait != 0 {
+		t.Fatalf("a full second of budget should pass, got wait %s", wait)
+	}
+	if wait := bucket.take(500, now); wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms for the debt, got %s", wait)
+	}
+
+	// After a second the debt is paid off and half the budget is back.
+	now = now.Add(time.Second)
+	if wait := bucket.take(500, now); wait != 0 {
+		t.Fatalf("expected the debt to be paid off, got wait %s", wait)
+	}
+
+	// Being idle for a long time doesn't build up more than a second of budget.
+	now = now.Add(time.Hour)
+	if wait := bucket.take(2000, now); wait != time.Second {
+		t.Fatalf("expected the burst to be capped, got wait %s", wait)
+	}
+}
+
+func TestReadLimiterObservesThrottling(t *testing.T) {
+	throttled := func() int {
+		rec := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if count, ok := strings.CutPrefix(line, "netlib_read_throttle_seconds_count "); ok {
+				n, _ := strconv.Atoi(count)
+				return n
+			}
+		}
+		return 0
+	}
+	before := throttled()
+
+	limiter := newReadLimiter(&Config{MaxPacketRate: 100})
+	for i := 0; i < 101; i++ {
+		if err := limiter.wait(context.Background(), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the throttled packet counts, the read loop times the rest.
+	if got := throttled() - before; got != 1 {
+		t.Fatalf("expected one throttled read, got %d", got)
+	}
+}
@@ -0,0 +1,90 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"go.uber.org/zap"
+)
+
+// readyReset is the ready packet sent when the ready states of a lobby of
+// total peers were cleared, by the leader or because a peer joined or left.
+func readyReset(total int) ReadyPacket {
+	return ReadyPacket{
+		Type:  "ready",
+		Ready: []string{},
+		Total: total,
+	}
+}
+
+func (p *Peer) HandleSetReadyPacket(ctx context.Context, packet SetReadyPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	peers, ready, changed, err := p.store.SetPeerReady(ctx, p.Game, p.Lobby, p.ID, packet.Ready)
+	if err != nil {
+		return err
+	}
+
+	update := ReadyPacket{
+		Type:  "ready",
+		Ready: ready,
+		Total: len(peers),
+	}
+	if err := p.broadcast(ctx, peers, update); err != nil {
+		return err
+	}
+	update.RequestID = packet.RequestID
+	if err := p.Send(ctx, update); err != nil {
+		return err
+	}
+
+	// Only the update that made the last peer ready announces it, the store
+	// serializes ready updates so this happens exactly once per ready check.
+	if changed && packet.Ready && len(ready) == len(peers) {
+		logger.Info("all peers ready", zap.String("game", p.Game), zap.String("lobby", p.Lobby))
+		metrics.Record(ctx, "lobby", "all-ready", p.Game, p.ID, p.Lobby)
+
+		allReady := AllReadyPacket{
+			Type:  "all-ready",
+			Lobby: p.Lobby,
+		}
+		if err := p.broadcast(ctx, peers, allReady); err != nil {
+			return err
+		}
+		return p.Send(ctx, allReady)
+	}
+	return nil
+}
+
+func (p *Peer) HandleResetReadyPacket(ctx context.Context, packet ResetReadyPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	peers, err := p.store.ResetReady(ctx, p.Game, p.Lobby, p.ID)
+	if err == stores.ErrNotLeader {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	update := readyReset(len(peers))
+	if err := p.broadcast(ctx, peers, update); err != nil {
+		return err
+	}
+	update.RequestID = packet.RequestID
+	return p.Send(ctx, update)
+}
@@ -0,0 +1,193 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+var ErrReconnectExpired = util.NewError("reconnect-expired", "reconnect window expired")
+
+// LobbyClosure tells a reconnecting peer that its lobby no longer exists, so
+// it can go back to matchmaking instead of retrying. Reason is the reason of
+// the lobby-closed packet the peer missed, empty when it isn't known.
+type LobbyClosure struct {
+	Lobby  string `json:"lobby"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// HandleReconnectPacket reclaims the identity of a peer that lost its socket
+// and came back on a new connection within the disconnect threshold. The
+// pending disconnect is cancelled and the client receives the lobby state so
+// it can resync.
+func (p *Peer) HandleReconnectPacket(ctx context.Context, packet ReconnectPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.Game != "" {
+		return fmt.Errorf("already introduced %s for game %s", p.ID, p.Game)
+	}
+	if !util.IsUUID(packet.Game) {
+		return fmt.Errorf("no game id supplied")
+	}
+	if packet.ID == "" || packet.Secret == "" {
+		return fmt.Errorf("no peer id or secret supplied")
+	}
+	if err := p.checkGame(packet.Game); err != nil {
+		return err
+	}
+	// Checked before the identity is claimed, so a rejected reconnect doesn't
+	// use up the pending disconnect.
+	if err := p.quotas.AcquirePeer(packet.Game); err != nil {
+		return err
+	}
+	p.countedForQuota = true
+
+	p.Game = packet.Game
+	p.ID = packet.ID
+	p.Secret = packet.Secret
+	logger.Info("peer reconnecting", zap.String("game", p.Game), zap.String("peer", p.ID), zap.String("lobby_in_packet", packet.Lobby))
+
+	reconnected := p.takeover(ctx, packet.Lobby)
+	if !reconnected {
+		var err error
+		reconnected, err = p.retrievedIDCallback(ctx, p)
+		if errors.Is(err, stores.ErrSessionExpired) {
+			// The secret is valid but too old, the client has to say hello
+			// again and the disconnect times out as usual.
+			logger.Info("peer session expired", zap.String("game", p.Game), zap.String("peer", p.ID))
+			metrics.Inc("netlib_expired_session_reconnects_total")
+			p.resetReconnect()
+			p.ReplyError(ctx, packet.RequestID, err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to reconnect: %w", err)
+		}
+	}
+	if !reconnected {
+		p.resetReconnect()
+		p.ReplyError(ctx, packet.RequestID, ErrReconnectExpired)
+		return nil
+	}
+
+	// The secret was sent over a connection that's gone, it's replaced so it
+	// can't be used again.
+	p.Secret = util.GenerateSecret(ctx)
+	version := negotiateProtocolVersion(packet.ProtocolVersion)
+	encoding := p.negotiate(packet.Capabilities, version)
+
+	p.registry.Identify(p)
+	if err := p.identifyPlayer(ctx, packet.PlayerToken); err != nil {
+		return err
+	}
+
+	reply := ReconnectedPacket{
+		RequestID:   packet.RequestID,
+		Type:        "reconnected",
+		ID:          p.ID,
+		Secret:      p.Secret,
+		PlayerID:    p.PlayerID,
+		PlayerToken: p.playerToken,
+
+		Capabilities: encoding.capabilities.Names(),
+	}
+	if packet.Lobby != "" {
+		inLobby, err := p.store.IsPeerInLobby(ctx, p.Game, packet.Lobby, p.ID)
+		if err != nil {
+			return err
+		}
+		if inLobby {
+			p.Lobby = packet.Lobby
+			p.subscribeLobby()
+			metrics.Record(ctx, "lobby", "reconnected", p.Game, p.ID, p.Lobby)
+
+			peers, err := p.store.GetLobby(ctx, p.Game, p.Lobby)
+			if err != nil {
+				return err
+			}
+			peerData, err := p.store.GetPeerData(ctx, p.Game, p.Lobby)
+			if err != nil {
+				return err
+			}
+			seats, err := p.store.GetSeats(ctx, p.Game, p.Lobby)
+			if err != nil {
+				return err
+			}
+			reply.Lobby = p.Lobby
+			reply.Peers = peers
+			reply.PeerData = peerData
+			p.PeerData = peerData[p.ID]
+			reply.Seats = make(map[string]int, len(peers))
+			for _, id := range peers {
+				reply.Seats[id] = seats[id]
+			}
+			reply.Affinity = p.lobbyAffinity(ctx)
+		} else if reply.ClosedLobby, err = p.lobbyClosure(ctx, packet.Lobby); err != nil {
+			return err
+		}
+	}
+
+	if err := p.Send(ctx, reply); err != nil {
+		return err
+	}
+	p.enableDictionary(encoding, version)
+	return nil
+}
+
+// resetReconnect undoes a failed reconnect so the client can still introduce
+// itself as a new peer.
+func (p *Peer) resetReconnect() {
+	p.quotas.ReleasePeer(p.Game)
+	p.countedForQuota = false
+	p.Game, p.ID, p.Secret = "", "", ""
+}
+
+// lobbyClosure returns the closure of lobby when the reconnecting peer isn't
+// in it because it was closed, nil when it wasn't.
+func (p *Peer) lobbyClosure(ctx context.Context, lobby string) (*LobbyClosure, error) {
+	logger := logging.GetLogger(ctx)
+	closed, reason, err := p.store.GetLobbyClosure(ctx, p.Game, lobby, util.Now(ctx).Add(-p.config.ClosedLobbyRetention))
+	if err != nil || !closed {
+		return nil, err
+	}
+	logger.Info("peer reconnected to a closed lobby", zap.String("game", p.Game), zap.String("peer", p.ID), zap.String("lobby", lobby), zap.String("reason", reason))
+	metrics.Inc("netlib_reconnects_to_closed_lobbies_total")
+	return &LobbyClosure{Lobby: lobby, Reason: reason}, nil
+}
+
+// sessionStartedAfter is when the oldest session that can still reconnect
+// started, zero when any session can.
+func (p *Peer) sessionStartedAfter(ctx context.Context) time.Time {
+	if p.config.MaxSessionLifetime <= 0 {
+		return time.Time{}
+	}
+	return util.Now(ctx).Add(-p.config.MaxSessionLifetime)
+}
+
+// takeover replaces an older socket of this peer that is still connected to
+// this node and a member of lobby, this happens when a flaky client opens a new
+// connection before the old one is detected as dead. The old socket is closed
+// without leaving the lobby so the membership moves over to this socket.
+func (p *Peer) takeover(ctx context.Context, lobby string) bool {
+	if lobby == "" {
+		return false
+	}
+	old := p.registry.Takeover(p, lobby, p.sessionStartedAfter(ctx))
+	if old == nil {
+		return false
+	}
+	logger := logging.GetLogger(ctx)
+	logger.Info("peer superseded by a new connection", zap.String("game", p.Game), zap.String("peer", p.ID), zap.String("lobby", lobby))
+	metrics.Inc("netlib_superseded_peers_total")
+
+	old.superseded.Store(true)
+	// Closing waits for the close handshake which a half-open socket never completes.
+	go old.conn.Close(websocket.StatusPolicyViolation, "superseded") //nolint:errcheck
+	return true
+}
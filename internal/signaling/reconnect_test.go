@@ -0,0 +1,373 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// closureStore has no members, the lobby "kicked" is still open and
+// "scheduled" was closed by the server, all other lobbies don't exist.
+type closureStore struct {
+	stores.Store
+}
+
+func (s *closureStore) IsPeerInLobby(ctx context.Context, game, lobby, id string) (bool, error) {
+	return false, nil
+}
+
+func (s *closureStore) GetLobbyClosure(ctx context.Context, game, lobby string, since time.Time) (bool, string, error) {
+	switch lobby {
+	case "kicked":
+		return false, "", nil
+	case "scheduled":
+		return true, stores.CloseReasonScheduled, nil
+	}
+	return true, "", nil
+}
+
+func TestReconnectToClosedLobby(t *testing.T) {
+	tests := []struct {
+		lobby string
+		want  *LobbyClosure
+	}{
+		{"scheduled", &LobbyClosure{Lobby: "scheduled", Reason: "scheduled"}},
+		{"reaped", &LobbyClosure{Lobby: "reaped"}},
+		{"kicked", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.lobby, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+				p := &Peer{
+					store:    &closureStore{},
+					conn:     conn,
+					config:   &Config{ClosedLobbyRetention: time.Hour},
+					quotas:   newQuotaTracker(nil),
+					registry: newPeerRegistry(),
+
+					retrievedIDCallback: func(context.Context, *Peer) (bool, error) { return true, nil },
+				}
+				err = p.HandleReconnectPacket(r.Context(), ReconnectPacket{
+					Type:   "reconnect",
+					Game:   "4307bd86-e1df-41b8-b9df-e22afcf084bd",
+					ID:     "peer",
+					Secret: "secret",
+					Lobby:  test.lobby,
+				})
+				if err != nil {
+					t.Error(err)
+				}
+				if p.Lobby != "" {
+					t.Errorf("expected the peer not to be in a lobby, got %q", p.Lobby)
+				}
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			reply := ReconnectedPacket{}
+			if err := wsjson.Read(ctx, conn, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Type != "reconnected" || reply.ID != "peer" || reply.Lobby != "" {
+				t.Fatalf("expected a reconnect without lobby, got %+v", reply)
+			}
+			if (reply.ClosedLobby == nil) != (test.want == nil) || (test.want != nil && *reply.ClosedLobby != *test.want) {
+				t.Fatalf("expected closed lobby %+v, got %+v", test.want, reply.ClosedLobby)
+			}
+		})
+	}
+}
+
+func TestHelloRejoinClosedLobby(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{
+			store:    &closureStore{},
+			conn:     conn,
+			config:   &Config{ClosedLobbyRetention: time.Hour},
+			quotas:   newQuotaTracker(nil),
+			registry: newPeerRegistry(),
+
+			retrievedIDCallback: func(context.Context, *Peer) (bool, error) { return true, nil },
+		}
+		// Joining would fail on the store without lobbies.
+		err = p.HandleHelloPacket(r.Context(), HelloPacket{
+			Type:   "hello",
+			Game:   "4307bd86-e1df-41b8-b9df-e22afcf084bd",
+			ID:     "peer",
+			Secret: "secret",
+			Lobby:  "scheduled",
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if p.Lobby != "" {
+			t.Errorf("expected the peer not to be in a lobby, got %q", p.Lobby)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	reply := WelcomePacket{}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	want := LobbyClosure{Lobby: "scheduled", Reason: "scheduled"}
+	if reply.Type != "welcome" || reply.ClosedLobby == nil || *reply.ClosedLobby != want {
+		t.Fatalf("expected a welcome with closed lobby %+v, got %+v", want, reply)
+	}
+}
+
+// sessionStore holds the timeout of a single session that started at started.
+type sessionStore struct {
+	stores.Store
+	started time.Time
+}
+
+func (s *sessionStore) ReconnectPeer(ctx context.Context, peerID, secret, gameID string, startedAfter time.Time) (bool, time.Time, []string, error) {
+	if s.started.Before(startedAfter) {
+		return false, time.Time{}, nil, stores.ErrSessionExpired
+	}
+	return true, s.started, nil, nil
+}
+
+func TestReconnectSessionLifetime(t *testing.T) {
+	tests := []struct {
+		name string
+		age  time.Duration
+		want string
+	}{
+		{"young", 30 * time.Minute, "reconnected"},
+		{"too old", 2 * time.Hour, "session-expired"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := time.Now().Add(-test.age)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+				store := &sessionStore{started: started}
+				manager := &TimeoutManager{Store: store, MaxSessionLifetime: time.Hour}
+				quotas := newQuotaTracker(nil)
+				p := &Peer{
+					store:    store,
+					conn:     conn,
+					config:   &Config{MaxSessionLifetime: time.Hour},
+					quotas:   quotas,
+					registry: newPeerRegistry(),
+
+					retrievedIDCallback: manager.Reconnected,
+				}
+				// The secret is valid either way, only the age of the session differs.
+				err = p.HandleReconnectPacket(r.Context(), ReconnectPacket{
+					Type:   "reconnect",
+					Game:   "4307bd86-e1df-41b8-b9df-e22afcf084bd",
+					ID:     "peer",
+					Secret: "old-secret",
+				})
+				if err != nil {
+					t.Error(err)
+				}
+				if test.want == "reconnected" && !p.sessionStart.Equal(started) {
+					t.Errorf("expected the session to continue from %s, got %s", started, p.sessionStart)
+				}
+				if test.want != "reconnected" && p.ID != "" {
+					t.Errorf("expected the peer to be reset, got %q", p.ID)
+				}
+				if test.want != "reconnected" && (p.countedForQuota || len(quotas.peers) != 0) {
+					t.Errorf("expected the peer to not be counted, got %v", quotas.peers)
+				}
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			reply := map[string]any{}
+			if err := wsjson.Read(ctx, conn, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply["type"] != test.want && reply["code"] != test.want {
+				t.Fatalf("expected %s, got %v", test.want, reply)
+			}
+			if secret, _ := reply["secret"].(string); test.want == "reconnected" && (secret == "" || secret == "old-secret") {
+				t.Fatalf("expected a new secret, got %q", secret)
+			}
+		})
+	}
+}
+
+// countingStore counts the reconnects that reached the store.
+type countingStore struct {
+	stores.Store
+	reconnects int
+}
+
+func (s *countingStore) ReconnectPeer(ctx context.Context, peerID, secret, gameID string, startedAfter time.Time) (bool, time.Time, []string, error) {
+	s.reconnects++
+	return true, time.Now(), nil, nil
+}
+
+func TestReconnectOverQuota(t *testing.T) {
+	game := "4307bd86-e1df-41b8-b9df-e22afcf084bd"
+	quotas := newQuotaTracker(map[string]Quota{game: {MaxPeers: 1}})
+	if err := quotas.AcquirePeer(game); err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{}
+	manager := &TimeoutManager{Store: store}
+	p := &Peer{
+		store:    store,
+		config:   &Config{},
+		quotas:   quotas,
+		registry: newPeerRegistry(),
+
+		retrievedIDCallback: manager.Reconnected,
+	}
+	err := p.HandleReconnectPacket(context.Background(), ReconnectPacket{Type: "reconnect", Game: game, ID: "peer", Secret: "secret"})
+	if err != ErrGameQuotaExceeded {
+		t.Fatalf("expected ErrGameQuotaExceeded, got %v", err)
+	}
+	// The pending disconnect is left alone, the peer can still reconnect
+	// once there's room.
+	if store.reconnects != 0 || p.ID != "" {
+		t.Fatalf("expected the identity to not be claimed, got %d reconnects as %q", store.reconnects, p.ID)
+	}
+}
+
+// flakyStore keeps the timeouts of disconnected peers in memory and records
+// the packets published to the lobby.
+type flakyStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	timeouts  map[string]*flakyTimeout
+	published []string
+}
+
+type flakyTimeout struct {
+	lastSeen time.Time
+	lobbies  []string
+	notified bool
+}
+
+func (s *flakyStore) TimeoutPeer(ctx context.Context, peerID, secret, gameID string, lobbies []string, sessionStartedAt time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timeouts[peerID] = &flakyTimeout{lastSeen: time.Now(), lobbies: lobbies}
+	return nil
+}
+
+func (s *flakyStore) ReconnectPeer(ctx context.Context, peerID, secret, gameID string, startedAfter time.Time) (bool, time.Time, []string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	timeout, ok := s.timeouts[peerID]
+	if !ok {
+		return false, time.Time{}, nil, nil
+	}
+	delete(s.timeouts, peerID)
+	if !timeout.notified {
+		return true, time.Time{}, nil, nil
+	}
+	return true, time.Time{}, timeout.lobbies, nil
+}
+
+func (s *flakyStore) MarkReconnectingPeers(ctx context.Context, window time.Duration, callback func(peerID, gameID string, lobbies []string)) error {
+	s.mutex.Lock()
+	var marked []string
+	for peerID, timeout := range s.timeouts {
+		if !timeout.notified && timeout.lastSeen.Before(time.Now().Add(-window)) {
+			timeout.notified = true
+			marked = append(marked, peerID)
+		}
+	}
+	s.mutex.Unlock()
+	for _, peerID := range marked {
+		callback(peerID, "game", []string{"lobby"})
+	}
+	return nil
+}
+
+func (s *flakyStore) GetLobby(ctx context.Context, game, lobby string) ([]string, error) {
+	return []string{"flaky", "other"}, nil
+}
+
+func (s *flakyStore) Publish(ctx context.Context, topic string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.published = append(s.published, string(data))
+	return nil
+}
+
+func TestReconnectDebounce(t *testing.T) {
+	ctx := context.Background()
+	store := &flakyStore{timeouts: make(map[string]*flakyTimeout)}
+	manager := &TimeoutManager{Store: store, SeamlessWindow: time.Hour}
+	p := &Peer{ID: "flaky", Secret: "secret", Game: "game", Lobby: "lobby"}
+
+	// Dropping and returning within the window, over and over, is invisible.
+	for i := 0; i < 10; i++ {
+		manager.Disconnected(ctx, p)
+		manager.notifyReconnecting(ctx)
+		if reconnected, err := manager.Reconnected(ctx, p); err != nil || !reconnected {
+			t.Fatalf("expected the peer to reconnect, got %v (%v)", reconnected, err)
+		}
+	}
+	if len(store.published) != 0 {
+		t.Fatalf("expected no status packets, got %v", store.published)
+	}
+
+	// A gap longer than the window is told once and undone once.
+	manager.SeamlessWindow = time.Nanosecond
+	manager.Disconnected(ctx, p)
+	time.Sleep(time.Millisecond)
+	manager.notifyReconnecting(ctx)
+	manager.notifyReconnecting(ctx)
+	if _, err := manager.Reconnected(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`{"type":"peer-reconnecting","id":"flaky"}`,
+		`{"type":"peer-reconnected","id":"flaky"}`,
+	}
+	if !reflect.DeepEqual(store.published, want) {
+		t.Fatalf("expected %v, got %v", want, store.published)
+	}
+}
@@ -0,0 +1,172 @@
+package signaling
+
+import (
+	"sync"
+	"time"
+)
+
+// peerRegistry tracks the peers connected to this node and the lobby
+// memberships they hold.
+type peerRegistry struct {
+	mutex   sync.RWMutex
+	peers   map[*Peer]peerEntry
+	members map[memberKey]member
+}
+
+type peerEntry struct {
+	game        string
+	connectedAt time.Time
+}
+
+type memberKey struct {
+	game, lobby, id string
+}
+
+type member struct {
+	peer         *Peer
+	secret       string
+	sessionStart time.Time
+}
+
+func newPeerRegistry() *peerRegistry {
+	return &peerRegistry{
+		peers:   make(map[*Peer]peerEntry),
+		members: make(map[memberKey]member),
+	}
+}
+
+func (r *peerRegistry) Add(p *Peer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.peers[p] = peerEntry{connectedAt: time.Now()}
+}
+
+// Identify records the game of p once it introduced itself, it must be called
+// from the goroutine handling p.
+func (r *peerRegistry) Identify(p *Peer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry, found := r.peers[p]; found {
+		entry.game = p.Game
+		r.peers[p] = entry
+	}
+}
+
+func (r *peerRegistry) Remove(p *Peer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.peers, p)
+	for key, m := range r.members {
+		if m.peer == p {
+			delete(r.members, key)
+		}
+	}
+}
+
+// Join records that p holds the membership of its identity in lobby, it
+// must be called from the goroutine handling p.
+func (r *peerRegistry) Join(p *Peer, lobby string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.members[memberKey{p.Game, lobby, p.ID}] = member{peer: p, secret: p.Secret, sessionStart: p.sessionStart}
+}
+
+// Leave removes the membership of p in lobby, unless another peer took it over.
+func (r *peerRegistry) Leave(p *Peer, lobby string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := memberKey{p.Game, lobby, p.ID}
+	if m, found := r.members[key]; found && m.peer == p {
+		delete(r.members, key)
+	}
+}
+
+// Takeover hands the membership of the identity in lobby over to p when
+// another live peer with the same secret holds it, the previous holder is
+// returned so it can be closed. It returns nil when there's nothing to take
+// over, or when the session started before startedAfter. p continues the
+// session of the previous holder, it must be called from the goroutine
+// handling p.
+func (r *peerRegistry) Takeover(p *Peer, lobby string, startedAfter time.Time) *Peer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := memberKey{p.Game, lobby, p.ID}
+	m, found := r.members[key]
+	if !found || m.peer == p || m.secret != p.Secret || m.sessionStart.Before(startedAfter) {
+		return nil
+	}
+	p.sessionStart = m.sessionStart
+	r.members[key] = member{peer: p, secret: p.Secret, sessionStart: m.sessionStart}
+	return m.peer
+}
+
+// registeredConn is a connected peer as seen by the registry, the fields of
+// the Peer itself are owned by its own goroutine.
+type registeredConn struct {
+	peer        *Peer
+	id          string
+	game        string
+	lobby       string
+	connectedAt time.Time
+}
+
+// Connections returns the connected peers with the game and lobby they're in,
+// the ID of a peer is only known while it's in a lobby.
+func (r *peerRegistry) Connections() []registeredConn {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	lobbies := make(map[*Peer]memberKey, len(r.members))
+	for key, m := range r.members {
+		lobbies[m.peer] = key
+	}
+	conns := make([]registeredConn, 0, len(r.peers))
+	for p, entry := range r.peers {
+		conns = append(conns, registeredConn{
+			peer:        p,
+			id:          lobbies[p].id,
+			game:        entry.game,
+			lobby:       lobbies[p].lobby,
+			connectedAt: entry.connectedAt,
+		})
+	}
+	return conns
+}
+
+// Load counts the connected peers and the lobbies they're in, in total and
+// per game.
+func (r *peerRegistry) Load() (connections, lobbies int, games map[string]GameLoad) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	games = make(map[string]GameLoad)
+	for _, entry := range r.peers {
+		if entry.game != "" {
+			game := games[entry.game]
+			game.Connections++
+			games[entry.game] = game
+		}
+	}
+	seen := make(map[lobbyKey]bool)
+	for key := range r.members {
+		lobby := lobbyKey{key.game, key.lobby}
+		if seen[lobby] {
+			continue
+		}
+		seen[lobby] = true
+		game := games[key.game]
+		game.Lobbies++
+		games[key.game] = game
+	}
+	return len(r.peers), len(seen), games
+}
+
+// Snapshot returns the currently connected peers, the registry isn't locked
+// while the caller iterates them.
+func (r *peerRegistry) Snapshot() []*Peer {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	peers := make([]*Peer, 0, len(r.peers))
+	for p := range r.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
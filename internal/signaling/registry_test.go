@@ -0,0 +1,93 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistryTakeoverOnDoubleJoin(t *testing.T) {
+	registry := newPeerRegistry()
+	first := &Peer{Game: "game", ID: "peer", Secret: "secret", Lobby: "lobby"}
+	registry.Add(first)
+	registry.Join(first, first.Lobby)
+
+	// The same client connects again and claims the same lobby.
+	second := &Peer{Game: "game", ID: "peer", Secret: "secret"}
+	registry.Add(second)
+	if old := registry.Takeover(second, "lobby", time.Time{}); old != first {
+		t.Fatalf("expected the first socket to be taken over, got %v", old)
+	}
+	registry.Join(second, "lobby")
+
+	// A third attempt takes over from the second socket, not the first.
+	third := &Peer{Game: "game", ID: "peer", Secret: "secret"}
+	if old := registry.Takeover(third, "lobby", time.Time{}); old != second {
+		t.Fatalf("expected the second socket to be taken over, got %v", old)
+	}
+
+	// The first socket going away must not drop the membership of the new one.
+	registry.Remove(first)
+	if _, found := registry.members[memberKey{"game", "lobby", "peer"}]; !found {
+		t.Fatal("membership was removed by the superseded socket")
+	}
+}
+
+func TestRegistryTakeoverRequiresSameIdentity(t *testing.T) {
+	registry := newPeerRegistry()
+	first := &Peer{Game: "game", ID: "peer", Secret: "secret"}
+	registry.Join(first, "lobby")
+
+	tests := map[string]*Peer{
+		"wrong secret": {Game: "game", ID: "peer", Secret: "guess"},
+		"other peer":   {Game: "game", ID: "other", Secret: "secret"},
+		"other game":   {Game: "other", ID: "peer", Secret: "secret"},
+	}
+	for name, p := range tests {
+		if old := registry.Takeover(p, "lobby", time.Time{}); old != nil {
+			t.Errorf("%s: unexpected takeover", name)
+		}
+	}
+	if old := registry.Takeover(&Peer{Game: "game", ID: "peer", Secret: "secret"}, "other-lobby", time.Time{}); old != nil {
+		t.Error("other lobby: unexpected takeover")
+	}
+	if old := registry.Takeover(first, "lobby", time.Time{}); old != nil {
+		t.Error("a peer can't take over from itself")
+	}
+}
+
+func TestRegistryTakeoverRespectsSessionLifetime(t *testing.T) {
+	registry := newPeerRegistry()
+	started := time.Now().Add(-2 * time.Hour)
+	first := &Peer{Game: "game", ID: "peer", Secret: "secret", sessionStart: started}
+	registry.Join(first, "lobby")
+
+	// The secret matches but the session is older than the cap.
+	if old := registry.Takeover(&Peer{Game: "game", ID: "peer", Secret: "secret"}, "lobby", time.Now().Add(-time.Hour)); old != nil {
+		t.Fatal("expected an expired session not to be taken over")
+	}
+	second := &Peer{Game: "game", ID: "peer", Secret: "secret"}
+	if old := registry.Takeover(second, "lobby", started.Add(-time.Minute)); old != first {
+		t.Fatalf("expected the first socket to be taken over, got %v", old)
+	}
+	if !second.sessionStart.Equal(started) {
+		t.Fatalf("expected the session to continue from %s, got %s", started, second.sessionStart)
+	}
+}
+
+func TestRegistryConnections(t *testing.T) {
+	registry := newPeerRegistry()
+	member := &Peer{Game: "game", ID: "a"}
+	idle := &Peer{Game: "game", ID: "b"}
+	registry.Add(member)
+	registry.Add(idle)
+	registry.Identify(member)
+	registry.Join(member, "lobby")
+
+	lobbies := map[*Peer]string{}
+	for _, c := range registry.Connections() {
+		lobbies[c.peer] = c.lobby
+	}
+	if len(lobbies) != 2 || lobbies[member] != "lobby" || lobbies[idle] != "" {
+		t.Fatalf("unexpected connections: %v", lobbies)
+	}
+}
@@ -0,0 +1,145 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxCloseDelay is how far in the future a lobby can be scheduled to
+// close, later times are capped to it so a lobby can't be reserved forever.
+const DefaultMaxCloseDelay = 24 * time.Hour
+
+// LobbyClosedPacket is sent to all peers of a lobby that was closed by the
+// server, the peers are no longer in the lobby.
+type LobbyClosedPacket struct {
+	Type string `json:"type"`
+
+	Lobby  string `json:"lobby"`
+	Reason string `json:"reason"`
+}
+
+// capCloseAt limits closeAt to maxDelay from now, the zero time (no
+// scheduled close) is kept. Clients can send any offset, the result is in
+// the location of now so it's stored like the times of util.Now.
+func capCloseAt(now, closeAt time.Time, maxDelay time.Duration) time.Time {
+	if closeAt.IsZero() {
+		return closeAt
+	}
+	if latest := now.Add(maxDelay); closeAt.After(latest) {
+		return latest
+	}
+	return closeAt.In(now.Location())
+}
+
+func (p *Peer) HandleUpdateLobbyPacket(ctx context.Context, packet UpdateLobbyPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	var closeAt time.Time
+	if packet.CloseAt != nil {
+		closeAt = capCloseAt(util.Now(ctx), *packet.CloseAt, p.config.MaxCloseDelay)
+	}
+	others, err := p.store.SetLobbyCloseAt(ctx, p.Game, p.Lobby, p.ID, closeAt)
+	if err == stores.ErrNotLeader {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logger.Info("lobby close scheduled",
+		zap.String("game", p.Game),
+		zap.String("lobby", p.Lobby),
+		zap.String("peer", p.ID),
+		zap.Time("closeAt", closeAt))
+
+	update := LobbyUpdatedPacket{
+		Type:  "lobby-updated",
+		Lobby: p.Lobby,
+	}
+	if !closeAt.IsZero() {
+		update.CloseAt = &closeAt
+	}
+	if err := p.broadcast(ctx, others, update); err != nil {
+		return err
+	}
+
+	update.RequestID = packet.RequestID
+	return p.Send(ctx, update)
+}
+
+// closeScheduled closes the lobbies whose scheduled close time passed, unlike
+// reaping this also closes lobbies that are still in use. It's safe to run on
+// multiple nodes, every lobby is closed by one of them.
+func (i *TimeoutManager) closeScheduled(ctx context.Context) {
+	logger := logging.GetLogger(ctx)
+
+	lobbies, err := i.Store.CloseScheduledLobbies(ctx, i.ReapBatchSize)
+	if err != nil {
+		logger.Error("failed to close scheduled lobbies", zap.Error(err))
+		return
+	}
+	var short []string
+	for _, lobby := range lobbies {
+		logger.Info("closed scheduled lobby", zap.String("game", lobby.Game), zap.String("lobby", lobby.Code), zap.Int("peers", len(lobby.Peers)))
+		metrics.Inc("netlib_scheduled_lobby_closures_total")
+		observeLobbyClosed(lobby.LobbyLifetime, i.MetricGames)
+		emitLobbyEvent(ctx, i.Webhook, LobbyClosed, lobby.Game, lobby.Code, "")
+
+		data, _ := json.Marshal(LobbyClosedPacket{
+			Type:   "lobby-closed",
+			Lobby:  lobby.Code,
+			Reason: stores.CloseReasonScheduled,
+		})
+		for _, id := range lobby.Peers {
+			if err := i.Store.Publish(ctx, lobby.Game+lobby.Code+id, data); err != nil && err != stores.ErrNoSuchTopic {
+				logger.Error("failed to publish lobby-closed packet", zap.Error(err))
+			}
+		}
+		if i.ReuseCodes && util.IsShortLobbyCode(lobby.Code) {
+			short = append(short, lobby.Code)
+		}
+	}
+	if len(short) > 0 {
+		if err := i.Store.ReleaseLobbyCodes(ctx, short); err != nil {
+			logger.Error("failed to release lobby codes", zap.Error(err))
+		}
+	}
+}
+
+// noteLobbyClosed remembers a lobby-closed packet forwarded to the peer, so
+// the handling goroutine can leave the lobby with leaveClosedLobby.
+func (p *Peer) noteLobbyClosed(raw []byte) {
+	if !bytes.Contains(raw, []byte(`"lobby-closed"`)) {
+		return
+	}
+	packet := LobbyClosedPacket{}
+	if err := json.Unmarshal(raw, &packet); err != nil || packet.Type != "lobby-closed" {
+		return
+	}
+	p.closedLobby.Store(&packet.Lobby)
+}
+
+// leaveClosedLobby forgets the lobby of the peer when it was closed by the
+// server, so it can create or join another one.
+func (p *Peer) leaveClosedLobby() {
+	closed := p.closedLobby.Swap(nil)
+	if closed == nil || *closed != p.Lobby || p.Lobby == "" {
+		return
+	}
+	p.leftLobby()
+}
@@ -0,0 +1,48 @@
+package signaling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCapCloseAt(t *testing.T) {
+	now := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		closeAt time.Time
+		want    time.Time
+	}{
+		{"none", time.Time{}, time.Time{}},
+		{"past", now.Add(-time.Hour), now.Add(-time.Hour)}, // Closed on the next tick.
+		{"soon", now.Add(time.Hour), now.Add(time.Hour)},
+		{"far future", now.AddDate(10, 0, 0), now.Add(DefaultMaxCloseDelay)},
+	} {
+		if got := capCloseAt(now, test.closeAt, DefaultMaxCloseDelay); !got.Equal(test.want) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, got)
+		}
+	}
+
+	// A client in another timezone gets the same instant in the location of now.
+	amsterdam := time.FixedZone("CEST", 2*60*60)
+	closeAt := time.Date(2023, 8, 1, 15, 0, 0, 0, amsterdam)
+	got := capCloseAt(now, closeAt, DefaultMaxCloseDelay)
+	if !got.Equal(now.Add(time.Hour)) || got.Location() != time.UTC || got.Hour() != 13 {
+		t.Fatalf("expected 13:00 UTC, got %s", got)
+	}
+}
+
+func TestLeaveClosedLobby(t *testing.T) {
+	p := &Peer{Game: "game", ID: "peer", Lobby: "a", registry: newPeerRegistry()}
+
+	p.noteLobbyClosed([]byte(`{"type":"lobby-closed","lobby":"b","reason":"scheduled"}`))
+	p.leaveClosedLobby()
+	if p.Lobby != "a" {
+		t.Fatalf("closing another lobby shouldn't leave %s", p.Lobby)
+	}
+
+	p.noteLobbyClosed([]byte(`{"type":"lobby-closed","lobby":"a","reason":"scheduled"}`))
+	p.leaveClosedLobby()
+	if p.Lobby != "" {
+		t.Fatalf("expected the peer to have left its closed lobby, still in %s", p.Lobby)
+	}
+}
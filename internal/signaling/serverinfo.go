@@ -0,0 +1,72 @@
+package signaling
+
+// Version is the version of the server sent to clients in the server-info
+// packet, set at build time with
+// -ldflags "-X github.com/poki/netlib/internal/signaling.Version=v1.2.3"
+// or per Handler with Config.ServerVersion.
+var Version = "dev"
+
+// defaultReadLimit is the packet size limit of the websocket library, used
+// when Config.MaxPacketSize isn't set.
+const defaultReadLimit = 32768
+
+// ServerInfoPacket is sent as soon as the connection is accepted, before the
+// client sent anything, so clients can detect features and know the limits
+// they're held to. Capabilities are the ones the server supports, the welcome
+// holds the ones negotiated for the connection.
+type ServerInfoPacket struct {
+	Type string `json:"type"`
+
+	Version          string           `json:"version"`
+	ProtocolVersions ProtocolVersions `json:"protocolVersions"`
+	Capabilities     []string         `json:"capabilities"`
+	Limits           ServerLimits     `json:"limits"`
+}
+
+// ProtocolVersions is the range of protocol versions the server speaks.
+type ProtocolVersions struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// ServerLimits are the limits of a connection, zero rates are unlimited.
+type ServerLimits struct {
+	MaxPacketSize   int `json:"maxPacketSize"`
+	MaxPacketRate   int `json:"maxPacketRate,omitempty"`
+	MaxReadRate     int `json:"maxReadRate,omitempty"`
+	MaxPeerDataSize int `json:"maxPeerDataSize"`
+	MaxLobbies      int `json:"maxLobbies"`
+	// MaxPlayers is the capacity of a lobby created without one, zero is unlimited.
+	MaxPlayers int `json:"maxPlayers"`
+}
+
+func serverInfo(config *Config) ServerInfoPacket {
+	version := config.ServerVersion
+	if version == "" {
+		version = Version
+	}
+	capabilities := make([]string, 0, len(knownCapabilities))
+	for _, known := range knownCapabilities {
+		capabilities = append(capabilities, known.name)
+	}
+	maxPacketSize := config.MaxPacketSize
+	if maxPacketSize <= 0 {
+		maxPacketSize = defaultReadLimit
+	}
+	return ServerInfoPacket{
+		Type:    "server-info",
+		Version: version,
+		ProtocolVersions: ProtocolVersions{
+			Min: 0,
+			Max: ProtocolVersion,
+		},
+		Capabilities: capabilities,
+		Limits: ServerLimits{
+			MaxPacketSize:   maxPacketSize,
+			MaxPacketRate:   config.MaxPacketRate,
+			MaxReadRate:     config.MaxReadRate,
+			MaxPeerDataSize: MaxPeerDataSize,
+			MaxLobbies:      MaxLobbiesPerConnection,
+		},
+	}
+}
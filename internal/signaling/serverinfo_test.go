@@ -0,0 +1,63 @@
+package signaling
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// readServerInfo reads the server-info packet every connection starts with.
+func readServerInfo(ctx context.Context, t *testing.T, conn *websocket.Conn) ServerInfoPacket {
+	t.Helper()
+	info := ServerInfoPacket{}
+	if err := wsjson.Read(ctx, conn, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != "server-info" {
+		t.Fatalf("expected a server-info packet first, got %q", info.Type)
+	}
+	return info
+}
+
+func TestServerInfoOnConnect(t *testing.T) {
+	ctx := context.Background()
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	_, handler, _ := Handler(ctx, store, nil, Config{ServerVersion: "v1.2.3", MaxPacketRate: 20})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	// Sent without the client sending anything first.
+	info := readServerInfo(ctx, t, conn)
+	if info.Version != "v1.2.3" || info.ProtocolVersions.Max != ProtocolVersion {
+		t.Fatalf("unexpected version info %+v", info)
+	}
+	if !reflect.DeepEqual(info.Capabilities, []string{ChunkingCapability, AcksCapability, DictionaryCapability}) {
+		t.Fatalf("unexpected capabilities %v", info.Capabilities)
+	}
+	expected := ServerLimits{
+		MaxPacketSize:   defaultReadLimit,
+		MaxPacketRate:   20,
+		MaxPeerDataSize: MaxPeerDataSize,
+		MaxLobbies:      1,
+	}
+	if info.Limits != expected {
+		t.Fatalf("unexpected limits %+v", info.Limits)
+	}
+}
+
+func TestServerInfoDefaultVersion(t *testing.T) {
+	if info := serverInfo(&Config{MaxPacketSize: 1024}); info.Version != Version || info.Limits.MaxPacketSize != 1024 {
+		t.Fatalf("unexpected server info %+v", info)
+	}
+}
@@ -0,0 +1,70 @@
+package signaling
+
+import (
+	"context"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"go.uber.org/zap"
+)
+
+// shutdownRetryAfter spreads the reconnects of the clients of a node that
+// shuts down, see DrainPacket.
+const shutdownRetryAfter = 5 * time.Second
+
+// enter counts a new connection, it returns false once Shutdown started.
+func (n *Node) enter() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if n.closing {
+		return false
+	}
+	n.connections.Add(1)
+	return true
+}
+
+func (n *Node) isClosing() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.closing
+}
+
+// Shutdown stops the node in order: new connections are refused, the open
+// connections are drained and, once their disconnects are recorded in the
+// store, the TimeoutManager is stopped. Drained peers keep their lobby
+// membership for the usual reconnect window so they can reconnect to another
+// node. When ctx is done before all connections closed the TimeoutManager is
+// stopped anyway and the error of ctx is returned.
+func (n *Node) Shutdown(ctx context.Context) error {
+	logger := logging.GetLogger(ctx)
+
+	n.mutex.Lock()
+	n.closing = true
+	n.mutex.Unlock()
+
+	drained, err := n.Drainer.Drain(ctx, DrainFilter{}, shutdownRetryAfter)
+	if err != nil {
+		logger.Error("failed to drain connections", zap.Error(err))
+	}
+	logger.Info("waiting for connections to close", zap.Int("drained", drained))
+
+	closed := make(chan struct{})
+	go func() {
+		n.connections.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		err = ctx.Err()
+		logger.Warn("connections still open at the shutdown deadline", zap.Error(err))
+	}
+
+	n.stopManager()
+	select {
+	case <-n.managerDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// shutdownStore records the disconnects and fails the test when it's used
+// after the node shut down. Methods the test doesn't need panic.
+type shutdownStore struct {
+	stores.Store
+	t *testing.T
+
+	mutex    sync.Mutex
+	timeouts map[string]string
+	stopped  bool
+}
+
+func (s *shutdownStore) use() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		s.t.Error("store used after shutdown")
+	}
+}
+
+func (s *shutdownStore) Subscribe(context.Context, string, stores.SubscriptionCallback) {}
+
+func (s *shutdownStore) TimeoutPeer(ctx context.Context, peerID, secret, gameID string, lobbies []string, sessionStartedAt time.Time) error {
+	s.use()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timeouts[peerID] = secret
+	return nil
+}
+
+func (s *shutdownStore) CloseScheduledLobbies(context.Context, int) ([]stores.ClosedLobby, error) {
+	s.use()
+	return nil, nil
+}
+
+func (s *shutdownStore) PruneClosedLobbies(context.Context, time.Time, int) (int, error) {
+	s.use()
+	return 0, nil
+}
+
+func (s *shutdownStore) PruneStaleLobbies(context.Context, time.Duration, int) ([]stores.LobbyLifetime, error) {
+	s.use()
+	return nil, nil
+}
+
+func (s *shutdownStore) MarkReconnectingPeers(context.Context, time.Duration, func(peerID, gameID string, lobbies []string)) error {
+	s.use()
+	return nil
+}
+
+func (s *shutdownStore) ClaimNextTimedOutPeer(context.Context, time.Duration, func(peerID, gameID string, lobbies []string) error) (bool, error) {
+	s.use()
+	return false, nil
+}
+
+func (s *shutdownStore) ExpireTickets(context.Context, int) ([]stores.Ticket, error) {
+	s.use()
+	return nil, nil
+}
+
+func (s *shutdownStore) MatchTickets(context.Context, int, func(context.Context, []stores.Ticket) ([]stores.Ticket, error)) error {
+	s.use()
+	return nil
+}
+
+func (s *shutdownStore) SetPresence(context.Context, string, string, bool, string) error {
+	s.use()
+	return nil
+}
+
+func (s *shutdownStore) GetPresence(context.Context, string, []string, time.Time) (map[string]stores.Presence, error) {
+	s.use()
+	return nil, nil
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &shutdownStore{t: t, timeouts: make(map[string]string)}
+	_, handler, node := Handler(ctx, store, nil, Config{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readServerInfo(ctx, t, conn)
+	if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: "4307bd86-e1df-41b8-b9df-e22afcf084bd"}); err != nil {
+		t.Fatal(err)
+	}
+	welcome := WelcomePacket{}
+	if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like the signal in main, the context is done before the shutdown.
+	cancel()
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			_, raw, err := conn.Read(context.Background())
+			if err != nil {
+				close(received)
+				return
+			}
+			packet := struct{ Type string }{}
+			if json.Unmarshal(raw, &packet) == nil && packet.Type != "ping" {
+				received <- packet.Type
+			}
+		}
+	}()
+
+	sctx, scancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer scancel()
+	if err := node.Shutdown(sctx); err != nil {
+		t.Fatal(err)
+	}
+	store.mutex.Lock()
+	store.stopped = true
+	secret, found := store.timeouts[welcome.ID]
+	store.mutex.Unlock()
+
+	if typ := <-received; typ != "drain" {
+		t.Fatalf("expected a drain packet, got %q", typ)
+	}
+	if !found || secret != welcome.Secret {
+		t.Fatal("expected the disconnect to be recorded before the shutdown returned")
+	}
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected new connections to be refused, got %d", resp.StatusCode)
+	}
+
+	// Give a TimeoutManager that's still running the chance to use the store.
+	time.Sleep(100 * time.Millisecond)
+}
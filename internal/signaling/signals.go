@@ -0,0 +1,89 @@
+package signaling
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+// DefaultMaxSignalSize is the largest description or candidate packet that is
+// forwarded when signal validation is enabled.
+const DefaultMaxSignalSize = 64 * 1024
+
+var ErrInvalidSignal = util.NewError("invalid-signal", "malformed description or candidate")
+
+// validateSignal does a lightweight syntax check of a description or candidate
+// packet so a buggy or malicious peer can't relay garbage to the WebRTC stack of
+// its lobbymates. It is deliberately loose, only clearly malformed payloads are
+// rejected. The returned reason is used as metric label.
+func validateSignal(typ string, raw []byte, maxSize int) (reason string, ok bool) {
+	if len(raw) > maxSize {
+		return "size", false
+	}
+	switch typ {
+	case "description":
+		packet := struct {
+			Description *struct {
+				Type string `json:"type"`
+				SDP  string `json:"sdp"`
+			} `json:"description"`
+		}{}
+		if err := json.Unmarshal(raw, &packet); err != nil || packet.Description == nil {
+			return "json", false
+		}
+		switch packet.Description.Type {
+		case "offer", "answer", "pranswer":
+			if !validSDP(packet.Description.SDP) {
+				return "sdp", false
+			}
+		case "rollback":
+		default:
+			return "sdp-type", false
+		}
+	case "candidate":
+		packet := struct {
+			Candidate *struct {
+				Candidate string `json:"candidate"`
+			} `json:"candidate"`
+		}{}
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			return "json", false
+		}
+		// A null or empty candidate signals the end of candidates.
+		if packet.Candidate != nil && packet.Candidate.Candidate != "" && !validCandidate(packet.Candidate.Candidate) {
+			return "candidate", false
+		}
+	}
+	return "", true
+}
+
+// validSDP checks the session description starts with a version line and
+// that every line has the <type>=<value> form from RFC 8866.
+func validSDP(sdp string) bool {
+	if !strings.HasPrefix(sdp, "v=0") {
+		return false
+	}
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' || line[0] < 'a' || line[0] > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// validCandidate checks the candidate attribute from RFC 8839 has at least
+// its mandatory fields: foundation, component, transport, priority, address,
+// port and type.
+func validCandidate(candidate string) bool {
+	candidate = strings.TrimPrefix(candidate, "a=")
+	if !strings.HasPrefix(candidate, "candidate:") {
+		return false
+	}
+	fields := strings.Fields(strings.TrimPrefix(candidate, "candidate:"))
+	return len(fields) >= 8 && fields[6] == "typ"
+}
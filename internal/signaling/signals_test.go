@@ -0,0 +1,33 @@
+package signaling
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSignal(t *testing.T) {
+	tests := []struct {
+		name   string
+		typ    string
+		raw    string
+		reason string
+	}{
+		{"offer", "description", `{"description":{"type":"offer","sdp":"v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"}}`, ""},
+		{"rollback", "description", `{"description":{"type":"rollback","sdp":""}}`, ""},
+		{"garbage sdp", "description", `{"description":{"type":"answer","sdp":"hello world"}}`, "sdp"},
+		{"missing description", "description", `{"type":"description"}`, "json"},
+		{"unknown sdp type", "description", `{"description":{"type":"bogus","sdp":"v=0\r\n"}}`, "sdp-type"},
+		{"candidate", "candidate", `{"candidate":{"candidate":"candidate:842163049 1 udp 1677729535 1.2.3.4 55066 typ srflx raddr 0.0.0.0 rport 0","sdpMid":"0"}}`, ""},
+		{"end of candidates", "candidate", `{"candidate":null}`, ""},
+		{"garbage candidate", "candidate", `{"candidate":{"candidate":"candidate:1 2 3"}}`, "candidate"},
+		{"too large", "candidate", `{"candidate":null,"padding":"` + strings.Repeat("x", 1024) + `"}`, "size"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason, ok := validateSignal(test.typ, []byte(test.raw), 1024)
+			if reason != test.reason || ok != (test.reason == "") {
+				t.Fatalf("expected reason %q, got %q (ok=%v)", test.reason, reason, ok)
+			}
+		})
+	}
+}
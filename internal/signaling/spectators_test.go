@@ -0,0 +1,99 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+)
+
+// spectatorsFullStore is a lobby without room for spectators.
+type spectatorsFullStore struct {
+	stores.Store
+
+	mutex sync.Mutex
+	roles []stores.Role
+}
+
+func (s *spectatorsFullStore) JoinLobby(_ context.Context, _, _, _ string, role stores.Role) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.roles = append(s.roles, role)
+	return nil, stores.ErrSpectatorsFull
+}
+
+func TestJoinRoles(t *testing.T) {
+	tests := []struct {
+		packet JoinPacket
+		code   string
+		params map[string]any
+	}{
+		{JoinPacket{Lobby: "lobby", Role: stores.RoleSpectator}, "spectators-full", map[string]any{"lobby": "lobby"}},
+		{JoinPacket{Lobby: "lobby", Role: "referee"}, "invalid-role", map[string]any{"role": "referee"}},
+		{JoinPacket{Invite: "token", Role: stores.RoleSpectator}, "invalid-role", map[string]any{"role": "spectator"}},
+	}
+	for _, test := range tests {
+		store := &spectatorsFullStore{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			p := &Peer{store: store, conn: conn, config: &Config{}, ID: "peer", Game: "game"}
+			test.packet.RequestID = "join"
+			if err := p.HandleJoinPacket(r.Context(), test.packet); err != nil {
+				t.Error(err)
+			}
+			if p.Lobby != "" {
+				t.Errorf("expected the peer not to join, got %q", p.Lobby)
+			}
+		}))
+
+		ctx := context.Background()
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, raw, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+		server.Close()
+
+		reply := struct {
+			Type      string
+			RequestID string `json:"rid"`
+			Code      string
+			Params    map[string]any
+		}{}
+		if err := json.Unmarshal(raw, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != "error" || reply.RequestID != "join" || reply.Code != test.code {
+			t.Fatalf("expected a %s error, got %s", test.code, raw)
+		}
+		for key, value := range test.params {
+			if reply.Params[key] != value {
+				t.Fatalf("expected %s to be %v, got %s", key, value, raw)
+			}
+		}
+
+		// Only valid roles reach the store.
+		store.mutex.Lock()
+		if test.code == "invalid-role" && len(store.roles) != 0 {
+			t.Fatalf("expected %s not to be joined, got %v", test.packet.Role, store.roles)
+		} else if test.code != "invalid-role" && (len(store.roles) != 1 || store.roles[0] != test.packet.Role) {
+			t.Fatalf("expected to join as %s, got %v", test.packet.Role, store.roles)
+		}
+		store.mutex.Unlock()
+	}
+}
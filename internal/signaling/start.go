@@ -0,0 +1,133 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidLobbyState = util.NewError("invalid-lobby-state", "lobby state must be waiting or closed")
+
+func (p *Peer) HandleStartPacket(ctx context.Context, packet StartPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+
+	seed := util.GenerateSeed(ctx)
+	now := util.Now(ctx)
+	peers, err := p.store.StartLobby(ctx, p.Game, p.Lobby, p.ID, seed, now)
+	if err == stores.ErrNotLeader || err == stores.ErrAlreadyStarted {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logger.Info("lobby started", zap.String("game", p.Game), zap.String("lobby", p.Lobby), zap.String("peer", p.ID))
+	metrics.Record(ctx, "lobby", "started", p.Game, p.ID, p.Lobby)
+	emitLobbyEvent(ctx, p.config.Webhook, LobbyStarted, p.Game, p.Lobby, p.ID)
+
+	return p.sendStart(ctx, packet.RequestID, peers, seed, now)
+}
+
+// autoStart starts the lobby if it was created with autoStart and this peer
+// filled the last slot. It's a critical section of the lobby, so a leave or
+// scheduled close can't interleave with the start.
+func (p *Peer) autoStart(ctx context.Context) error {
+	logger := logging.GetLogger(ctx)
+
+	seed := util.GenerateSeed(ctx)
+	now := util.Now(ctx)
+	start := p.startPacket(seed, now)
+	started := false
+	err := p.store.LockLobby(ctx, p.Game, p.Lobby, LobbyLockTTL, func(ctx context.Context) error {
+		var peers []string
+		var err error
+		peers, started, err = p.store.AutoStartLobby(ctx, p.Game, p.Lobby, seed, now)
+		if err != nil || !started {
+			return err
+		}
+		return p.broadcast(ctx, peers, start)
+	})
+	if err != nil || !started {
+		return err
+	}
+
+	logger.Info("lobby auto started", zap.String("game", p.Game), zap.String("lobby", p.Lobby), zap.String("peer", p.ID))
+	metrics.Record(ctx, "lobby", "auto-started", p.Game, p.ID, p.Lobby)
+	emitLobbyEvent(ctx, p.config.Webhook, LobbyStarted, p.Game, p.Lobby, p.ID)
+
+	return p.Send(ctx, start)
+}
+
+func (p *Peer) startPacket(seed string, startedAt time.Time) LobbyStartPacket {
+	return LobbyStartPacket{
+		Type:      "start",
+		Lobby:     p.Lobby,
+		Seed:      seed,
+		StartedAt: startedAt.UnixMilli(),
+	}
+}
+
+func (p *Peer) sendStart(ctx context.Context, requestID string, peers []string, seed string, startedAt time.Time) error {
+	start := p.startPacket(seed, startedAt)
+	if err := p.broadcast(ctx, peers, start); err != nil {
+		return err
+	}
+	start.RequestID = requestID
+	return p.Send(ctx, start)
+}
+
+// HandleSetLobbyStatePacket lets the leader close the lobby to new peers, e.g.
+// during a ready check, or reopen it, e.g. to let peers drop into a match
+// that already started. Starting the lobby also closes it.
+func (p *Peer) HandleSetLobbyStatePacket(ctx context.Context, packet SetLobbyStatePacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		return fmt.Errorf("not in a lobby")
+	}
+	if packet.State != stores.LobbyStateWaiting && packet.State != stores.LobbyStateClosed {
+		p.ReplyError(ctx, packet.RequestID, ErrInvalidLobbyState.WithParams("state", packet.State))
+		return nil
+	}
+
+	others, err := p.store.SetLobbyState(ctx, p.Game, p.Lobby, p.ID, packet.State)
+	if err == stores.ErrNotLeader {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logger.Info("lobby state changed",
+		zap.String("game", p.Game),
+		zap.String("lobby", p.Lobby),
+		zap.String("peer", p.ID),
+		zap.String("state", packet.State))
+	metrics.Record(ctx, "lobby", "state-changed", p.Game, p.ID, p.Lobby, "state", packet.State)
+
+	update := LobbyStatePacket{
+		Type:  "lobby-state",
+		Lobby: p.Lobby,
+		State: packet.State,
+	}
+	if err := p.broadcast(ctx, others, update); err != nil {
+		return err
+	}
+
+	update.RequestID = packet.RequestID
+	return p.Send(ctx, update)
+}
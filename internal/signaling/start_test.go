@@ -0,0 +1,294 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// startedStore holds a single lobby that already started.
+type startedStore struct {
+	stores.Store
+}
+
+func (s *startedStore) JoinLobby(ctx context.Context, game, lobby, id string, _ stores.Role) ([]string, error) {
+	return nil, stores.ErrLobbyNotJoinable.WithParams("state", stores.LobbyStateStarted)
+}
+
+func TestLobbyState(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		p := &Peer{store: &startedStore{}, conn: conn, config: &Config{}, ID: "peer", Game: "game"}
+		if err := p.HandleJoinPacket(ctx, JoinPacket{RequestID: "join", Lobby: "lobby"}); err != nil {
+			t.Error(err)
+		}
+		if p.Lobby != "" {
+			t.Errorf("expected the peer not to join a started lobby, got %q", p.Lobby)
+		}
+
+		// Lobbies can only be closed and reopened, starting takes a start packet.
+		p.Lobby = "lobby"
+		if err := p.HandleSetLobbyStatePacket(ctx, SetLobbyStatePacket{RequestID: "state", State: stores.LobbyStateStarted}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	for _, expected := range []struct {
+		rid, code string
+		params    map[string]any
+	}{
+		{"join", "lobby-not-joinable", map[string]any{"lobby": "lobby", "state": "started"}},
+		{"state", "invalid-lobby-state", map[string]any{"state": "started"}},
+	} {
+		_, raw, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := struct {
+			Type      string
+			RequestID string `json:"rid"`
+			Code      string
+			Params    map[string]any
+		}{}
+		if err := json.Unmarshal(raw, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != "error" || reply.RequestID != expected.rid || reply.Code != expected.code {
+			t.Fatalf("expected a %s error, got %s", expected.code, raw)
+		}
+		for k, v := range expected.params {
+			if reply.Params[k] != v {
+				t.Fatalf("expected %s to be %v, got %s", k, v, raw)
+			}
+		}
+	}
+}
+
+// seedStore holds a lobby of a and b with a as its leader.
+type seedStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	seed      string
+	startedAt time.Time
+	published map[string][]LobbyStartPacket
+}
+
+func (s *seedStore) StartLobby(_ context.Context, _, _, id, seed string, startedAt time.Time) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id != "a" {
+		return nil, stores.ErrNotLeader
+	}
+	if s.seed != "" {
+		return nil, stores.ErrAlreadyStarted
+	}
+	s.seed, s.startedAt = seed, startedAt
+	return []string{"a", "b"}, nil
+}
+
+func (s *seedStore) Publish(_ context.Context, topic string, data []byte) error {
+	packet := LobbyStartPacket{}
+	if err := json.Unmarshal(data, &packet); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.published == nil {
+		s.published = make(map[string][]LobbyStartPacket)
+	}
+	s.published[topic] = append(s.published[topic], packet)
+	return nil
+}
+
+func TestStartBroadcastsSeed(t *testing.T) {
+	store := &seedStore{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		for _, start := range []struct{ id, rid string }{{"b", "b"}, {"a", "a"}, {"a", "again"}} {
+			p := &Peer{store: store, conn: conn, config: &Config{}, ID: start.id, Game: "game", Lobby: "lobby"}
+			if err := p.HandleStartPacket(r.Context(), StartPacket{Type: "start", RequestID: start.rid}); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	reply := struct {
+		LobbyStartPacket
+		Code string `json:"code"`
+	}{}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.RequestID != "b" || reply.Type != "error" || reply.Code != "not-leader" {
+		t.Fatalf("expected only the leader to start the lobby, got %+v", reply)
+	}
+
+	start := LobbyStartPacket{}
+	if err := wsjson.Read(ctx, conn, &start); err != nil {
+		t.Fatal(err)
+	}
+	store.mutex.Lock()
+	seed, startedAt, published := store.seed, store.startedAt, store.published["gamelobbyb"]
+	store.mutex.Unlock()
+	if len(seed) != 32 {
+		t.Fatalf("expected a 128 bit hex seed, got %q", seed)
+	}
+	if start.RequestID != "a" || start.Type != "start" || start.Lobby != "lobby" || start.Seed != seed || start.StartedAt != startedAt.UnixMilli() {
+		t.Fatalf("expected the leader to get the stored seed and start time, got %+v", start)
+	}
+	// The other peers get the same seed, without the request ID of the leader.
+	if len(published) != 1 || published[0].Seed != seed || published[0].StartedAt != start.StartedAt || published[0].RequestID != "" {
+		t.Fatalf("expected b to get the same start, got %+v", published)
+	}
+
+	reply.Code = ""
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.RequestID != "again" || reply.Code != "already-started" {
+		t.Fatalf("expected starting twice to be rejected, got %+v", reply)
+	}
+}
+
+// autoStartStore holds a lobby of a and b that starts once it's full.
+type autoStartStore struct {
+	seedStore
+
+	full    bool
+	locked  bool
+	started int
+}
+
+func (s *autoStartStore) LockLobby(ctx context.Context, _, _ string, _ time.Duration, fn func(context.Context) error) error {
+	s.mutex.Lock()
+	s.locked = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.locked = false
+		s.mutex.Unlock()
+	}()
+	return fn(ctx)
+}
+
+func (s *autoStartStore) AutoStartLobby(_ context.Context, _, _, seed string, startedAt time.Time) ([]string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.locked {
+		return nil, false, errors.New("started outside of a critical section")
+	}
+	if !s.full || s.seed != "" {
+		return nil, false, nil
+	}
+	s.seed, s.startedAt = seed, startedAt
+	s.started++
+	return []string{"a", "b"}, true, nil
+}
+
+func TestAutoStart(t *testing.T) {
+	store := &autoStartStore{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+
+		features, err := NewFeatures(FeatureFlags{Games: map[string]map[string]bool{"game": {FeatureAutoStart: false}}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p := &Peer{store: store, conn: conn, config: &Config{Features: features}, ID: "a", Game: "game"}
+		if err := p.HandleCreatePacket(ctx, CreatePacket{Type: "create", RequestID: "create", AutoStart: true, MaxPlayers: 2}); err != nil {
+			t.Error(err)
+		}
+
+		// Joining a lobby that isn't full doesn't start it, b filling the
+		// last slot does, only once.
+		p = &Peer{store: store, conn: conn, config: &Config{}, ID: "b", Game: "game", Lobby: "lobby"}
+		for _, full := range []bool{false, true, true} {
+			store.mutex.Lock()
+			store.full = full
+			store.mutex.Unlock()
+			if err := p.autoStart(ctx); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	reply := map[string]any{}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply["rid"] != "create" || reply["code"] != "feature-disabled" {
+		t.Fatalf("expected autoStart to be rejected for the game, got %v", reply)
+	}
+
+	start := LobbyStartPacket{}
+	if err := wsjson.Read(ctx, conn, &start); err != nil {
+		t.Fatal(err)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if start.Type != "start" || start.Lobby != "lobby" || start.Seed != store.seed || start.StartedAt != store.startedAt.UnixMilli() {
+		t.Fatalf("expected the peer filling the lobby to get the start, got %+v", start)
+	}
+	if store.started != 1 {
+		t.Fatalf("expected the lobby to start once, got %d", store.started)
+	}
+	if got := store.published["gamelobbya"]; len(got) != 1 || got[0].Seed != start.Seed {
+		t.Fatalf("expected a to get the same start, got %+v", got)
+	}
+	if got := store.published["gamelobbyb"]; len(got) != 0 {
+		t.Fatalf("expected b not to be sent its own start, got %+v", got)
+	}
+}
@@ -0,0 +1,134 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+)
+
+// StatsRefreshInterval is how long the stats of a game are cached, they're
+// cosmetic so every node queries the store at most once per interval per game.
+const StatsRefreshInterval = 5 * time.Second
+
+// MaxStatsRequests is the number of get-stats packets a peer can send per
+// StatsRequestWindow, a menu doesn't need to refresh faster than the cache.
+const MaxStatsRequests = 6
+const StatsRequestWindow = time.Minute
+
+var ErrTooManyStatsRequests = util.NewError("rate-limited", "too many stats requests")
+
+type GetStatsPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+// StatsPacket holds the aggregate counts of the game of the peer as of
+// UpdatedAt, at most StatsRefreshInterval ago.
+type StatsPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	stores.GameStats
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// statsCache holds the stats per game on this node.
+type statsCache struct {
+	ttl time.Duration
+
+	mutex sync.Mutex
+	games map[string]*cachedStats
+}
+
+type cachedStats struct {
+	// mutex is held while the stats are fetched, so concurrent requests for a
+	// stale game wait for a single query.
+	mutex     sync.Mutex
+	stats     stores.GameStats
+	fetchedAt time.Time
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{
+		ttl:   ttl,
+		games: make(map[string]*cachedStats),
+	}
+}
+
+// get returns the cached stats of game, or fetches them from the store when
+// they're older than the ttl.
+func (c *statsCache) get(ctx context.Context, store stores.Store, game string, now time.Time) (stores.GameStats, time.Time, error) {
+	c.mutex.Lock()
+	entry, ok := c.games[game]
+	if !ok {
+		c.evictStale(now)
+		entry = &cachedStats{}
+		c.games[game] = entry
+	}
+	c.mutex.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if !entry.fetchedAt.IsZero() && now.Sub(entry.fetchedAt) < c.ttl {
+		metrics.Inc("netlib_stats_requests_total", "cache", "hit")
+		return entry.stats, entry.fetchedAt, nil
+	}
+	metrics.Inc("netlib_stats_requests_total", "cache", "miss")
+	stats, err := store.GetGameStats(ctx, game)
+	if err != nil {
+		return stores.GameStats{}, time.Time{}, err
+	}
+	entry.stats = *stats
+	entry.fetchedAt = now
+	return entry.stats, entry.fetchedAt, nil
+}
+
+// evictStale forgets the games whose stats are older than the ttl, so the
+// cache only holds the games requested recently. Entries being fetched are
+// kept. c.mutex must be held.
+func (c *statsCache) evictStale(now time.Time) {
+	for game, entry := range c.games {
+		if !entry.mutex.TryLock() {
+			continue
+		}
+		if now.Sub(entry.fetchedAt) >= c.ttl {
+			delete(c.games, game)
+		}
+		entry.mutex.Unlock()
+	}
+}
+
+// HandleGetStatsPacket returns the number of players and lobbies of the game
+// of the peer, for menus to show how busy the game is.
+func (p *Peer) HandleGetStatsPacket(ctx context.Context, packet GetStatsPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+
+	now := util.Now(ctx)
+	if now.Sub(p.statsWindow) > StatsRequestWindow {
+		p.statsWindow = now
+		p.statsRequests = 0
+	}
+	p.statsRequests++
+	if p.statsRequests > MaxStatsRequests {
+		p.ReplyError(ctx, packet.RequestID, ErrTooManyStatsRequests.WithParams("max", MaxStatsRequests, "window", StatsRequestWindow.Seconds()))
+		return nil
+	}
+
+	stats, updatedAt, err := p.stats.get(ctx, p.store, p.Game, now)
+	if err != nil {
+		return err
+	}
+	return p.Send(ctx, StatsPacket{
+		RequestID: packet.RequestID,
+		Type:      "stats",
+		GameStats: stats,
+		UpdatedAt: updatedAt,
+	})
+}
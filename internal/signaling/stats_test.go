@@ -0,0 +1,154 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// statsStore counts the stats queries, every query sees one more player.
+type statsStore struct {
+	stores.Store
+
+	mutex   sync.Mutex
+	queries int
+}
+
+func (s *statsStore) GetGameStats(ctx context.Context, game string) (*stores.GameStats, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries++
+	return &stores.GameStats{Players: s.queries, PublicLobbies: 2, JoinableLobbies: 1}, nil
+}
+
+func TestStatsCacheFreshness(t *testing.T) {
+	ctx := context.Background()
+	store := &statsStore{}
+	cache := newStatsCache(5 * time.Second)
+	start := time.Now()
+
+	stats, updatedAt, err := cache.get(ctx, store, "game", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Players != 1 || !updatedAt.Equal(start) {
+		t.Fatalf("expected fresh stats, got %+v at %s", stats, updatedAt)
+	}
+
+	// Within the window the cached stats are returned without a query.
+	stats, updatedAt, _ = cache.get(ctx, store, "game", start.Add(4*time.Second))
+	if stats.Players != 1 || !updatedAt.Equal(start) || store.queries != 1 {
+		t.Fatalf("expected the cached stats, got %+v after %d queries", stats, store.queries)
+	}
+
+	// Other games are cached separately.
+	if _, _, err := cache.get(ctx, store, "other", start.Add(4*time.Second)); err != nil || store.queries != 2 {
+		t.Fatalf("expected a query for another game, got %d queries", store.queries)
+	}
+
+	// Once the window passed the stats are refreshed.
+	refreshed := start.Add(5 * time.Second)
+	stats, updatedAt, _ = cache.get(ctx, store, "game", refreshed)
+	if stats.Players != 3 || !updatedAt.Equal(refreshed) {
+		t.Fatalf("expected refreshed stats, got %+v at %s", stats, updatedAt)
+	}
+}
+
+func TestStatsCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	store := &statsStore{}
+	cache := newStatsCache(5 * time.Second)
+	start := time.Now()
+
+	if _, _, err := cache.get(ctx, store, "game", start); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.get(ctx, store, "other", start.Add(4*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new game evicts the games whose stats went stale.
+	if _, _, err := cache.get(ctx, store, "third", start.Add(6*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.games["game"]; ok {
+		t.Fatal("expected the stale game to be evicted")
+	}
+	if len(cache.games) != 2 {
+		t.Fatalf("expected 2 cached games, got %d", len(cache.games))
+	}
+}
+
+func TestStatsCacheSingleQuery(t *testing.T) {
+	ctx := context.Background()
+	store := &statsStore{}
+	cache := newStatsCache(time.Minute)
+	now := time.Now()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := cache.get(ctx, store, "game", now); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if store.queries != 1 {
+		t.Fatalf("expected concurrent requests to share a query, got %d", store.queries)
+	}
+}
+
+func TestGetStatsRateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		p := &Peer{store: &statsStore{}, conn: conn, config: &Config{}, stats: newStatsCache(time.Minute), ID: "peer", Game: "game"}
+		for i := 0; i <= MaxStatsRequests; i++ {
+			if err := p.HandleGetStatsPacket(ctx, GetStatsPacket{RequestID: strconv.Itoa(i)}); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	for i := 0; i <= MaxStatsRequests; i++ {
+		packet := struct {
+			Type      string `json:"type"`
+			RequestID string `json:"rid"`
+			Code      string `json:"code"`
+			Players   int    `json:"players"`
+		}{}
+		if err := wsjson.Read(ctx, conn, &packet); err != nil {
+			t.Fatal(err)
+		}
+		if i < MaxStatsRequests && (packet.Type != "stats" || packet.Players != 1) {
+			t.Fatalf("expected request %d to be answered from the cache, got %+v", i, packet)
+		}
+		if i == MaxStatsRequests && packet.Code != "rate-limited" {
+			t.Fatalf("expected the request over the limit to be rate limited, got %+v", packet)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrStoreBudgetExceeded = util.NewError("store-budget-exceeded", "connection caused too many store operations")
+
+// storeOps counts the store operations caused by the packets of a single
+// connection. The budget is checked over a sliding window estimated from
+// the current and the previous fixed window.
+type storeOps struct {
+	limit  int
+	window time.Duration
+
+	total atomic.Uint64
+
+	mutex       sync.Mutex
+	windowStart time.Time
+	current     int
+	previous    int
+}
+
+func newStoreOps(config *Config) *storeOps {
+	return &storeOps{
+		limit:  config.MaxStoreOps,
+		window: config.StoreOpsWindow,
+	}
+}
+
+func (o *storeOps) add(now time.Time) {
+	o.total.Add(1)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.rotate(now)
+	o.current++
+}
+
+// rotate moves on to a new window when the current one is over, the caller
+// must hold the mutex.
+func (o *storeOps) rotate(now time.Time) {
+	switch elapsed := now.Sub(o.windowStart); {
+	case elapsed >= 2*o.window:
+		o.previous, o.current = 0, 0
+		o.windowStart = now
+	case elapsed >= o.window:
+		o.previous, o.current = o.current, 0
+		o.windowStart = o.windowStart.Add(o.window)
+	}
+}
+
+// inWindow returns the number of operations in the window ending at now, the
+// previous window counts for the part of it that still overlaps.
+func (o *storeOps) inWindow(now time.Time) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.rotate(now)
+	overlap := 1 - float64(now.Sub(o.windowStart))/float64(o.window)
+	return o.current + int(float64(o.previous)*overlap)
+}
+
+// exceeded reports whether the connection went over its budget.
+func (o *storeOps) exceeded(now time.Time) bool {
+	return o.limit > 0 && o.inWindow(now) > o.limit
+}
+
+type storeOpsKey struct{}
+
+// withStoreOps makes the store operations done with ctx count towards ops,
+// only the context of a packet handler should carry it so work a connection
+// does on behalf of others isn't counted.
+func withStoreOps(ctx context.Context, ops *storeOps) context.Context {
+	return context.WithValue(ctx, storeOpsKey{}, ops)
+}
+
+func countStoreOp(ctx context.Context) {
+	if ops, ok := ctx.Value(storeOpsKey{}).(*storeOps); ok {
+		ops.add(time.Now())
+	}
+}
+
+// meteredStore counts the operations peers do on the store, see
+// withStoreOps. Subscribe and the background operations of the
+// TimeoutManager aren't counted.
+type meteredStore struct {
+	stores.Store
+}
+
+func (s meteredStore) CreateLobby(ctx context.Context, game, lobby, id string, options stores.LobbyOptions) error {
+	countStoreOp(ctx)
+	return s.Store.CreateLobby(ctx, game, lobby, id, options)
+}
+
+func (s meteredStore) JoinLobby(ctx context.Context, game, lobby, id string, role stores.Role) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.JoinLobby(ctx, game, lobby, id, role)
+}
+
+func (s meteredStore) SwitchLobby(ctx context.Context, game, from, to, id string) ([]string, []string, error) {
+	countStoreOp(ctx)
+	return s.Store.SwitchLobby(ctx, game, from, to, id)
+}
+
+func (s meteredStore) IsPeerInLobby(ctx context.Context, game, lobby, id string) (bool, error) {
+	countStoreOp(ctx)
+	return s.Store.IsPeerInLobby(ctx, game, lobby, id)
+}
+
+func (s meteredStore) LeaveLobby(ctx context.Context, game, lobby, id string) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.LeaveLobby(ctx, game, lobby, id)
+}
+
+func (s meteredStore) GetLobby(ctx context.Context, game, lobby string) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.GetLobby(ctx, game, lobby)
+}
+
+func (s meteredStore) GetLobbyInfo(ctx context.Context, game, lobby string) (*stores.Lobby, error) {
+	countStoreOp(ctx)
+	return s.Store.GetLobbyInfo(ctx, game, lobby)
+}
+
+func (s meteredStore) GetLobbyNode(ctx context.Context, game, lobby string) (string, string, error) {
+	countStoreOp(ctx)
+	return s.Store.GetLobbyNode(ctx, game, lobby)
+}
+
+func (s meteredStore) GetLobbyClosure(ctx context.Context, game, lobby string, since time.Time) (bool, string, error) {
+	countStoreOp(ctx)
+	return s.Store.GetLobbyClosure(ctx, game, lobby, since)
+}
+
+func (s meteredStore) GetLobbyLimits(ctx context.Context, game, lobby string) (stores.LobbyLimits, error) {
+	countStoreOp(ctx)
+	return s.Store.GetLobbyLimits(ctx, game, lobby)
+}
+
+func (s meteredStore) MemberCount(ctx context.Context, game, lobby string) (int, int, error) {
+	countStoreOp(ctx)
+	return s.Store.MemberCount(ctx, game, lobby)
+}
+
+func (s meteredStore) GetSeats(ctx context.Context, game, lobby string) (map[string]int, error) {
+	countStoreOp(ctx)
+	return s.Store.GetSeats(ctx, game, lobby)
+}
+
+func (s meteredStore) SetPeerData(ctx context.Context, game, lobby, id string, data map[string]any) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.SetPeerData(ctx, game, lobby, id, data)
+}
+
+func (s meteredStore) GetPeerData(ctx context.Context, game, lobby string) (map[string]map[string]any, error) {
+	countStoreOp(ctx)
+	return s.Store.GetPeerData(ctx, game, lobby)
+}
+
+func (s meteredStore) SetPresence(ctx context.Context, game, id string, online bool, lobby string) error {
+	countStoreOp(ctx)
+	return s.Store.SetPresence(ctx, game, id, online, lobby)
+}
+
+func (s meteredStore) GetPresence(ctx context.Context, game string, players []string, onlineAfter time.Time) (map[string]stores.Presence, error) {
+	countStoreOp(ctx)
+	return s.Store.GetPresence(ctx, game, players, onlineAfter)
+}
+
+func (s meteredStore) SetPlayer(ctx context.Context, game, id, player string) error {
+	countStoreOp(ctx)
+	return s.Store.SetPlayer(ctx, game, id, player)
+}
+
+func (s meteredStore) GetMembers(ctx context.Context, game, lobby string) (*stores.Members, error) {
+	countStoreOp(ctx)
+	return s.Store.GetMembers(ctx, game, lobby)
+}
+
+func (s meteredStore) SetPeerReady(ctx context.Context, game, lobby, id string, ready bool) ([]string, []string, bool, error) {
+	countStoreOp(ctx)
+	return s.Store.SetPeerReady(ctx, game, lobby, id, ready)
+}
+
+func (s meteredStore) ResetReady(ctx context.Context, game, lobby, id string) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.ResetReady(ctx, game, lobby, id)
+}
+
+func (s meteredStore) StartLobby(ctx context.Context, game, lobby, id, seed string, startedAt time.Time) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.StartLobby(ctx, game, lobby, id, seed, startedAt)
+}
+
+func (s meteredStore) AutoStartLobby(ctx context.Context, game, lobby, seed string, startedAt time.Time) ([]string, bool, error) {
+	countStoreOp(ctx)
+	return s.Store.AutoStartLobby(ctx, game, lobby, seed, startedAt)
+}
+
+func (s meteredStore) TransferOwnership(ctx context.Context, game, lobby, from, to string) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.TransferOwnership(ctx, game, lobby, from, to)
+}
+
+func (s meteredStore) LockLobby(ctx context.Context, game, lobby string, ttl time.Duration, fn func(context.Context) error) error {
+	countStoreOp(ctx)
+	return s.Store.LockLobby(ctx, game, lobby, ttl, fn)
+}
+
+func (s meteredStore) ListLobbies(ctx context.Context, game string, options stores.ListOptions) ([]stores.Lobby, error) {
+	countStoreOp(ctx)
+	return s.Store.ListLobbies(ctx, game, options)
+}
+
+func (s meteredStore) CountActiveLobbies(ctx context.Context, game string) (int, error) {
+	countStoreOp(ctx)
+	return s.Store.CountActiveLobbies(ctx, game)
+}
+
+func (s meteredStore) GetGameStats(ctx context.Context, game string) (*stores.GameStats, error) {
+	countStoreOp(ctx)
+	return s.Store.GetGameStats(ctx, game)
+}
+
+func (s meteredStore) SetLobbyState(ctx context.Context, game, lobby, id, state string) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.SetLobbyState(ctx, game, lobby, id, state)
+}
+
+func (s meteredStore) SetLobbyVisibility(ctx context.Context, game, lobby, id string, public bool) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.SetLobbyVisibility(ctx, game, lobby, id, public)
+}
+
+func (s meteredStore) UpdateLobbyKV(ctx context.Context, game, lobby, id string, update stores.KVUpdate) (json.RawMessage, []string, error) {
+	countStoreOp(ctx)
+	return s.Store.UpdateLobbyKV(ctx, game, lobby, id, update)
+}
+
+func (s meteredStore) GetLobbyKV(ctx context.Context, game, lobby string) (map[string]json.RawMessage, error) {
+	countStoreOp(ctx)
+	return s.Store.GetLobbyKV(ctx, game, lobby)
+}
+
+func (s meteredStore) UpdateLobbyCustomData(ctx context.Context, game, lobby, id string, patch map[string]any, maxSize int) (int64, []string, error) {
+	countStoreOp(ctx)
+	return s.Store.UpdateLobbyCustomData(ctx, game, lobby, id, patch, maxSize)
+}
+
+func (s meteredStore) GetLobbyCustomData(ctx context.Context, game, lobby string) (map[string]any, int64, error) {
+	countStoreOp(ctx)
+	return s.Store.GetLobbyCustomData(ctx, game, lobby)
+}
+
+func (s meteredStore) CreateInvite(ctx context.Context, game, lobby, id, token string, maxUses int, expiresAt time.Time) error {
+	countStoreOp(ctx)
+	return s.Store.CreateInvite(ctx, game, lobby, id, token, maxUses, expiresAt)
+}
+
+func (s meteredStore) JoinLobbyByInvite(ctx context.Context, game, token, id string) (string, []string, error) {
+	countStoreOp(ctx)
+	return s.Store.JoinLobbyByInvite(ctx, game, token, id)
+}
+
+func (s meteredStore) ReserveSlot(ctx context.Context, game, id string, maxPlayers, limit int, ttl time.Duration) (string, error) {
+	countStoreOp(ctx)
+	return s.Store.ReserveSlot(ctx, game, id, maxPlayers, limit, ttl)
+}
+
+func (s meteredStore) ReleaseSlot(ctx context.Context, game, id string) error {
+	countStoreOp(ctx)
+	return s.Store.ReleaseSlot(ctx, game, id)
+}
+
+func (s meteredStore) EnqueueTicket(ctx context.Context, ticket stores.Ticket, ttl time.Duration, max int) (time.Time, error) {
+	countStoreOp(ctx)
+	return s.Store.EnqueueTicket(ctx, ticket, ttl, max)
+}
+
+func (s meteredStore) CancelTicket(ctx context.Context, game, id, ticket string) error {
+	countStoreOp(ctx)
+	return s.Store.CancelTicket(ctx, game, id, ticket)
+}
+
+func (s meteredStore) CancelPeerTickets(ctx context.Context, game, id string) (int, error) {
+	countStoreOp(ctx)
+	return s.Store.CancelPeerTickets(ctx, game, id)
+}
+
+func (s meteredStore) Publish(ctx context.Context, topic string, data []byte) error {
+	countStoreOp(ctx)
+	return s.Store.Publish(ctx, topic, data)
+}
+
+func (s meteredStore) MarkLobbyEmptied(ctx context.Context, game, lobby string) (*stores.LobbyLifetime, error) {
+	countStoreOp(ctx)
+	return s.Store.MarkLobbyEmptied(ctx, game, lobby)
+}
+
+func (s meteredStore) MarkLobbyFilled(ctx context.Context, game, lobby string) (*stores.LobbyLifetime, error) {
+	countStoreOp(ctx)
+	return s.Store.MarkLobbyFilled(ctx, game, lobby)
+}
+
+func (s meteredStore) SetLobbyCloseAt(ctx context.Context, game, lobby, id string, closeAt time.Time) ([]string, error) {
+	countStoreOp(ctx)
+	return s.Store.SetLobbyCloseAt(ctx, game, lobby, id, closeAt)
+}
+
+func (s meteredStore) ClaimReleasedCode(ctx context.Context, cooldown time.Duration) (string, error) {
+	countStoreOp(ctx)
+	return s.Store.ClaimReleasedCode(ctx, cooldown)
+}
+
+func (s meteredStore) ReconnectPeer(ctx context.Context, peerID, secret, gameID string, sessionStartedAfter time.Time) (bool, time.Time, []string, error) {
+	countStoreOp(ctx)
+	return s.Store.ReconnectPeer(ctx, peerID, secret, gameID, sessionStartedAfter)
+}
+
+// ConnectionStoreOps is the store usage of a connection on this node.
+type ConnectionStoreOps struct {
+	Peer  string `json:"peer,omitempty"`
+	Game  string `json:"game"`
+	Lobby string `json:"lobby,omitempty"`
+	// Total counts all operations since the connection opened, InWindow those
+	// within the budget window.
+	Total    uint64 `json:"total"`
+	InWindow int    `json:"inWindow"`
+}
+
+// StoreOps returns the store usage of the connections of game, or of all
+// games when game is empty, the busiest connections first.
+func (n *Node) StoreOps(game string) []ConnectionStoreOps {
+	now := time.Now()
+	list := []ConnectionStoreOps{}
+	for _, c := range n.Drainer.registry.Connections() {
+		if c.peer.storeOps == nil || (game != "" && c.game != game) {
+			continue
+		}
+		list = append(list, ConnectionStoreOps{
+			Peer:     c.id,
+			Game:     c.game,
+			Lobby:    c.lobby,
+			Total:    c.peer.storeOps.total.Load(),
+			InWindow: c.peer.storeOps.inWindow(now),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].InWindow != list[j].InWindow {
+			return list[i].InWindow > list[j].InWindow
+		}
+		return list[i].Total > list[j].Total
+	})
+	return list
+}
@@ -0,0 +1,147 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+)
+
+func TestStoreOpsSlidingWindow(t *testing.T) {
+	ops := newStoreOps(&Config{MaxStoreOps: 10, StoreOpsWindow: time.Minute})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		ops.add(start)
+	}
+	if ops.exceeded(start) {
+		t.Fatal("expected the budget to be reached, not exceeded")
+	}
+	ops.add(start)
+	if !ops.exceeded(start) {
+		t.Fatal("expected the budget to be exceeded")
+	}
+
+	// Halfway through the next window half of the previous one still counts.
+	later := start.Add(90 * time.Second)
+	if n := ops.inWindow(later); n != 5 {
+		t.Fatalf("expected 5 operations in the window, got %d", n)
+	}
+	if ops.exceeded(later) {
+		t.Fatal("expected the budget to have recovered")
+	}
+	if n := ops.inWindow(start.Add(3 * time.Minute)); n != 0 || ops.total.Load() != 11 {
+		t.Fatalf("expected an empty window and 11 in total, got %d and %d", n, ops.total.Load())
+	}
+}
+
+// lobbyCycleStore lets a peer create and leave lobbies forever.
+type lobbyCycleStore struct {
+	stores.Store
+}
+
+func (lobbyCycleStore) CreateLobby(context.Context, string, string, string, stores.LobbyOptions) error {
+	return nil
+}
+
+func (lobbyCycleStore) JoinLobby(context.Context, string, string, string, stores.Role) ([]string, error) {
+	return []string{"peerA"}, nil
+}
+
+func (lobbyCycleStore) MarkLobbyFilled(context.Context, string, string) (*stores.LobbyLifetime, error) {
+	return nil, nil
+}
+
+func (lobbyCycleStore) MarkLobbyEmptied(context.Context, string, string) (*stores.LobbyLifetime, error) {
+	return nil, nil
+}
+
+func (lobbyCycleStore) LockLobby(ctx context.Context, _, _ string, _ time.Duration, fn func(context.Context) error) error {
+	return fn(ctx)
+}
+
+func (lobbyCycleStore) AutoStartLobby(context.Context, string, string, string, time.Time) ([]string, bool, error) {
+	return nil, false, nil
+}
+
+func (lobbyCycleStore) LeaveLobby(context.Context, string, string, string) ([]string, error) {
+	return nil, nil
+}
+
+func (lobbyCycleStore) Subscribe(context.Context, string, stores.SubscriptionCallback) {}
+
+func TestCreateLeaveLoopExceedsStoreBudget(t *testing.T) {
+	config := &Config{MaxStoreOps: 50}
+	config.setDefaults()
+	ops := newStoreOps(config)
+	cycles := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tripped := 0
+		defer func() { cycles <- tripped }()
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		p := &Peer{
+			store:    meteredStore{lobbyCycleStore{}},
+			conn:     conn,
+			config:   config,
+			quotas:   newQuotaTracker(nil),
+			registry: newPeerRegistry(),
+			storeOps: ops,
+			connCtx:  ctx,
+			ID:       "peerA",
+			Game:     "game",
+		}
+		for i := 1; i <= 100; i++ {
+			for _, typ := range []string{"create", "leave"} {
+				if err := p.HandlePacket(withStoreOps(ctx, ops), typ, []byte(`{"type": "`+typ+`"}`)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if ops.exceeded(time.Now()) {
+				tripped = i
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	go func() {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Every cycle creates, joins, marks the lobby filled, checks for an auto
+	// start, leaves and marks the lobby emptied, the auto start and leave each
+	// in a critical section of the lobby.
+	if n := <-cycles; n != 7 {
+		t.Fatalf("expected the budget to be exceeded in cycle 7, got %d", n)
+	}
+	if ops.total.Load() != 56 {
+		t.Fatalf("expected 56 counted operations, got %d", ops.total.Load())
+	}
+
+	// Work done outside of a packet handler isn't counted.
+	meteredStore{lobbyCycleStore{}}.LeaveLobby(ctx, "game", "lobby", "peerA") //nolint:errcheck
+	if ops.total.Load() != 56 {
+		t.Fatalf("expected operations without a budget in the context to be ignored, got %d", ops.total.Load())
+	}
+}
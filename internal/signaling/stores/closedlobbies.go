@@ -0,0 +1,57 @@
+package stores
+
+import (
+	"context"
+	"time"
+)
+
+// CloseReasonScheduled is the reason of lobbies closed by
+// CloseScheduledLobbies.
+const CloseReasonScheduled = "scheduled"
+
+func (s *PostgresStore) GetLobbyClosure(ctx context.Context, game, lobbyCode string, since time.Time) (bool, string, error) {
+	var open bool
+	var reason *string
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT
+			EXISTS (
+				SELECT 1
+				FROM lobbies
+				WHERE code = $1
+				AND game = $2
+			),
+			(
+				SELECT reason
+				FROM closed_lobbies
+				WHERE code = $1
+				AND game = $2
+				AND closed_at >= $3
+			)
+	`, lobbyCode, game, since).Scan(&open, &reason)
+	if err != nil {
+		return false, "", err
+	}
+	if reason != nil {
+		// The code may have been reused by a new lobby since.
+		return true, *reason, nil
+	}
+	return !open, "", nil
+}
+
+func (s *PostgresStore) PruneClosedLobbies(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := s.db(ctx).Exec(ctx, `
+		DELETE FROM closed_lobbies
+		WHERE code IN (
+			SELECT code
+			FROM closed_lobbies
+			WHERE closed_at < $1
+			ORDER BY closed_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+	`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
+}
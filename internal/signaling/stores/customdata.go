@@ -0,0 +1,30 @@
+package stores
+
+import (
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrCustomDataTooLarge = util.NewError("custom-data-too-large", "custom data of the lobby is too large")
+
+// ApplyMergePatch applies patch to doc as a JSON merge patch (RFC 7396): null
+// values remove the field, objects are merged recursively and everything else
+// replaces the field. It returns the patched document, doc itself is modified
+// when it isn't nil.
+func ApplyMergePatch(doc, patch map[string]any) map[string]any {
+	if doc == nil {
+		doc = make(map[string]any, len(patch))
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(doc, key)
+			continue
+		}
+		if object, ok := value.(map[string]any); ok {
+			current, _ := doc[key].(map[string]any)
+			doc[key] = ApplyMergePatch(current, object)
+			continue
+		}
+		doc[key] = value
+	}
+	return doc
+}
@@ -0,0 +1,35 @@
+package stores
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, expected string
+	}{
+		{`null`, `{"map": "desert"}`, `{"map": "desert"}`},
+		{`{"map": "desert", "mode": "ffa"}`, `{"map": "city"}`, `{"map": "city", "mode": "ffa"}`},
+		{`{"map": "desert", "mode": "ffa"}`, `{"mode": null}`, `{"map": "desert"}`},
+		{`{"rules": {"time": 60, "teams": 2}}`, `{"rules": {"time": 90, "teams": null}}`, `{"rules": {"time": 90}}`},
+		{`{"rules": "classic"}`, `{"rules": {"time": 90}}`, `{"rules": {"time": 90}}`},
+		{`{"tags": ["a", "b"]}`, `{"tags": ["c"]}`, `{"tags": ["c"]}`},
+		{`{"map": "desert"}`, `{"unknown": null}`, `{"map": "desert"}`},
+	}
+	for _, test := range tests {
+		doc, patch, expected := decodeObject(t, test.doc), decodeObject(t, test.patch), decodeObject(t, test.expected)
+		if result := ApplyMergePatch(doc, patch); !reflect.DeepEqual(result, expected) {
+			t.Errorf("patching %s with %s: expected %v, got %v", test.doc, test.patch, expected, result)
+		}
+	}
+}
+
+func decodeObject(t *testing.T, raw string) map[string]any {
+	var v map[string]any
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
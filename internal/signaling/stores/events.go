@@ -0,0 +1,136 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Event is a client analytics event persisted with AppendEvents, the same
+// event that is otherwise sent to the metrics backend.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Game    string    `json:"game"`
+	Client  string    `json:"client,omitempty"`
+	Version string    `json:"version,omitempty"`
+
+	Category string `json:"category"`
+	Action   string `json:"action"`
+	Peer     string `json:"peer,omitempty"`
+	Lobby    string `json:"lobby,omitempty"`
+
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// EventQuery selects events for QueryEvents, empty fields match everything.
+type EventQuery struct {
+	Game     string
+	Category string
+	Action   string
+	Peer     string
+	Lobby    string
+	// Since and Until bound the time of the events, Until is exclusive.
+	Since time.Time
+	Until time.Time
+	// Limit caps the number of events returned, the newest first.
+	Limit int
+}
+
+// MaxEventQueryLimit caps EventQuery.Limit, zero uses it as well.
+const MaxEventQueryLimit = 1000
+
+// AppendEvents stores the events in a single round trip.
+func (s *PostgresStore) AppendEvents(ctx context.Context, events []Event) error {
+	rows := make([][]any, 0, len(events))
+	for _, e := range events {
+		var data map[string]string
+		if len(e.Data) > 0 {
+			data = e.Data
+		}
+		rows = append(rows, []any{e.Time, e.Game, e.Category, e.Action, e.Peer, e.Lobby, e.Client, e.Version, data})
+	}
+	_, err := s.DB.CopyFrom(ctx,
+		pgx.Identifier{"events"},
+		[]string{"time", "game", "category", "action", "peer", "lobby", "client", "version", "data"},
+		pgx.CopyFromRows(rows),
+	)
+	return err
+}
+
+func (s *PostgresStore) QueryEvents(ctx context.Context, query EventQuery) ([]Event, error) {
+	var conditions []string
+	var args []any
+	match := func(column string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	for column, value := range map[string]string{
+		"game":     query.Game,
+		"category": query.Category,
+		"action":   query.Action,
+		"peer":     query.Peer,
+		"lobby":    query.Lobby,
+	} {
+		if value != "" {
+			match(column, value)
+		}
+	}
+	if !query.Since.IsZero() {
+		args = append(args, query.Since)
+		conditions = append(conditions, fmt.Sprintf("time >= $%d", len(args)))
+	}
+	if !query.Until.IsZero() {
+		args = append(args, query.Until)
+		conditions = append(conditions, fmt.Sprintf("time < $%d", len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	limit := query.Limit
+	if limit <= 0 || limit > MaxEventQueryLimit {
+		limit = MaxEventQueryLimit
+	}
+	args = append(args, limit)
+
+	rows, err := s.db(ctx).Query(ctx, `
+		SELECT time, game, category, action, peer, lobby, client, version, data
+		FROM events
+		`+where+`
+		ORDER BY time DESC, id DESC
+		LIMIT $`+fmt.Sprint(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Time, &e.Game, &e.Category, &e.Action, &e.Peer, &e.Lobby, &e.Client, &e.Version, &e.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *PostgresStore) PruneEvents(ctx context.Context, before time.Time, limit int) (int, error) {
+	tag, err := s.db(ctx).Exec(ctx, `
+		DELETE FROM events
+		WHERE id IN (
+			SELECT id
+			FROM events
+			WHERE time < $1
+			ORDER BY time ASC
+			LIMIT $2
+		)
+	`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
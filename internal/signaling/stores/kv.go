@@ -0,0 +1,99 @@
+package stores
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrKVConflict = util.NewError("kv-conflict", "value doesn't match the expected value")
+var ErrKVTooManyKeys = util.NewError("kv-too-many-keys", "too many keys in the lobby")
+var ErrKVNotANumber = util.NewError("kv-not-a-number", "value is not a number")
+
+// LeaderKeyPrefix marks the keys of the lobby key-value storage that only the
+// leader can write, all other keys can be written by every member.
+const LeaderKeyPrefix = "leader:"
+
+type KVOp int
+
+const (
+	// KVSet replaces the value of the key, a null value deletes it.
+	KVSet KVOp = iota
+	// KVCompareAndSet is KVSet when the current value equals Expected, a
+	// null Expected means the key must not exist.
+	KVCompareAndSet
+	// KVIncrement adds By to the numeric value of the key, a missing key
+	// counts as 0.
+	KVIncrement
+)
+
+// KVUpdate is a change to the key-value storage of a lobby.
+type KVUpdate struct {
+	Op       KVOp
+	Key      string
+	Value    json.RawMessage
+	Expected json.RawMessage
+	By       float64
+	// MaxKeys bounds the number of keys in the lobby, 0 is unlimited.
+	MaxKeys int
+}
+
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var av, bv any
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// applyKVUpdate applies update to kv and returns the new value of the key,
+// which is nil when the key was deleted.
+func applyKVUpdate(kv map[string]json.RawMessage, update KVUpdate) (json.RawMessage, error) {
+	current, exists := kv[update.Key]
+
+	var value json.RawMessage
+	switch update.Op {
+	case KVSet:
+		value = update.Value
+	case KVCompareAndSet:
+		matches := !exists && isNull(update.Expected) || exists && !isNull(update.Expected) && jsonEqual(current, update.Expected)
+		if !matches {
+			return nil, ErrKVConflict.WithParams("key", update.Key, "value", current)
+		}
+		value = update.Value
+	case KVIncrement:
+		var n float64
+		if exists {
+			if err := json.Unmarshal(current, &n); err != nil {
+				return nil, ErrKVNotANumber.WithParams("key", update.Key)
+			}
+		}
+		n += update.By
+		if math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil, ErrKVNotANumber.WithParams("key", update.Key)
+		}
+		value, _ = json.Marshal(n)
+	}
+
+	if isNull(value) {
+		delete(kv, update.Key)
+		return nil, nil
+	}
+	if !exists && update.MaxKeys > 0 && len(kv) >= update.MaxKeys {
+		return nil, ErrKVTooManyKeys.WithParams("max", update.MaxKeys)
+	}
+	kv[update.Key] = value
+	return value, nil
+}
+
+// isLeaderKey reports whether only the leader can write key.
+func isLeaderKey(key string) bool {
+	return strings.HasPrefix(key, LeaderKeyPrefix)
+}
@@ -0,0 +1,40 @@
+package stores
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestApplyKVUpdate(t *testing.T) {
+	kv := map[string]json.RawMessage{}
+	steps := []struct {
+		update KVUpdate
+		value  string
+		err    error
+	}{
+		{KVUpdate{Op: KVIncrement, Key: "votes", By: 1}, "1", nil},
+		{KVUpdate{Op: KVIncrement, Key: "votes", By: 2.5}, "3.5", nil},
+		{KVUpdate{Op: KVSet, Key: "map", Value: json.RawMessage(`"desert"`)}, `"desert"`, nil},
+		{KVUpdate{Op: KVIncrement, Key: "map", By: 1}, "", ErrKVNotANumber},
+		{KVUpdate{Op: KVCompareAndSet, Key: "map", Expected: json.RawMessage(`"forest"`), Value: json.RawMessage(`"city"`)}, "", ErrKVConflict},
+		{KVUpdate{Op: KVCompareAndSet, Key: "map", Expected: json.RawMessage(` "desert" `), Value: json.RawMessage(`"city"`)}, `"city"`, nil},
+		{KVUpdate{Op: KVCompareAndSet, Key: "owner", Value: json.RawMessage(`"a"`)}, `"a"`, nil},
+		{KVUpdate{Op: KVCompareAndSet, Key: "owner", Value: json.RawMessage(`"b"`)}, "", ErrKVConflict},
+		{KVUpdate{Op: KVSet, Key: "extra", Value: json.RawMessage(`true`), MaxKeys: 3}, "", ErrKVTooManyKeys},
+		{KVUpdate{Op: KVSet, Key: "owner", Value: json.RawMessage(`null`)}, "", nil},
+		{KVUpdate{Op: KVSet, Key: "extra", Value: json.RawMessage(`true`), MaxKeys: 3}, "true", nil},
+	}
+	for i, step := range steps {
+		value, err := applyKVUpdate(kv, step.update)
+		if !errors.Is(err, step.err) {
+			t.Fatalf("step %d: expected error %v, got %v", i, step.err, err)
+		}
+		if string(value) != step.value {
+			t.Fatalf("step %d: expected value %q, got %q", i, step.value, value)
+		}
+	}
+	if _, found := kv["owner"]; found || len(kv) != 3 {
+		t.Fatalf("unexpected storage %v", kv)
+	}
+}
@@ -0,0 +1,49 @@
+package stores
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// LobbyLimits are the rate limits a lobby was created with, they override the
+// limits of the node for the peers in the lobby. Zero keeps the limit of the
+// node.
+type LobbyLimits struct {
+	// PacketRate and ReadRate are the packets and bytes per second a peer may
+	// send, see signaling.Config.MaxPacketRate.
+	PacketRate int `json:"packetRate,omitempty"`
+	ReadRate   int `json:"readRate,omitempty"`
+	// Negotiations is the number of offers and answers a peer may send to a
+	// lobbymate, see signaling.Config.MaxNegotiations.
+	Negotiations int `json:"negotiations,omitempty"`
+}
+
+// orNil returns nil for a lobby without limits, so no limits are stored.
+func (l LobbyLimits) orNil() *LobbyLimits {
+	if l == (LobbyLimits{}) {
+		return nil
+	}
+	return &l
+}
+
+func (s *PostgresStore) GetLobbyLimits(ctx context.Context, game, lobbyCode string) (LobbyLimits, error) {
+	var limits *LobbyLimits
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT limits
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&limits)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return LobbyLimits{}, ErrNotFound
+		}
+		return LobbyLimits{}, err
+	}
+	if limits == nil {
+		return LobbyLimits{}, nil
+	}
+	return *limits, nil
+}
@@ -0,0 +1,68 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// lockTxKey is the context key of the transaction of a lobby critical
+// section, see LockLobby, or of a match, see MatchTickets.
+type lockTxKey struct{}
+
+// dbtx is what the queries of the store need, implemented by both the pool
+// and the transaction of a lobby critical section.
+type dbtx interface {
+	querier
+	execer
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// db returns the transaction of the critical section ctx belongs to, or the
+// pool outside of one. Transactions started on it inside a critical section
+// are savepoints of the section.
+func (s *PostgresStore) db(ctx context.Context) dbtx {
+	if tx, ok := ctx.Value(lockTxKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return s.DB
+}
+
+// LockLobby runs fn in a transaction that holds a transaction level Postgres
+// advisory lock on the lobby. All store calls made with the context passed to
+// fn run in that same transaction, so the lock doesn't take a connection
+// besides the one the mutations use, and their notifications are delivered
+// together when fn returns without error. An error rolls everything back.
+//
+// Waiters queue in the lock manager of Postgres, which grants the lock in the
+// order it was requested. Waiting and holding are together bounded by ttl and
+// ctx, when the holding node crashes its session ends and releases the lock
+// with it. A holder that hangs outside of a query has its session terminated
+// by Postgres once it was idle for ttl. Locking a lobby again inside fn is
+// free, locking other lobbies inside fn should be done in a fixed order.
+func (s *PostgresStore) LockLobby(ctx context.Context, game, lobbyCode string, ttl time.Duration, fn func(context.Context) error) error {
+	if tx, ok := ctx.Value(lockTxKey{}).(pgx.Tx); ok {
+		// Already in a critical section, advisory locks are reentrant.
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1), hashtext($2))`, game, lobbyCode); err != nil {
+			return err
+		}
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ttl)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.DB, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `SELECT set_config('idle_in_transaction_session_timeout', $1, true)`, fmt.Sprint(ttl.Milliseconds()))
+		if err != nil {
+			return err
+		}
+		// The two key form doesn't overlap with the single key locks of the migrations.
+		_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1), hashtext($2))`, game, lobbyCode)
+		if err != nil {
+			return err
+		}
+		return fn(context.WithValue(ctx, lockTxKey{}, tx))
+	})
+}
@@ -0,0 +1,94 @@
+package stores
+
+import (
+	"context"
+	"time"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+func (s *PostgresStore) SetPlayer(ctx context.Context, game, peerID, player string) error {
+	_, err := s.db(ctx).Exec(ctx, `
+		INSERT INTO players (game, peer, player, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (game, peer) DO UPDATE
+		SET
+			player = EXCLUDED.player,
+			updated_at = EXCLUDED.updated_at
+	`, game, peerID, player, util.Now(ctx))
+	return err
+}
+
+func (s *PostgresStore) GetPlayerPeers(ctx context.Context, game, player string) ([]string, error) {
+	rows, err := s.db(ctx).Query(ctx, `
+		SELECT peer
+		FROM players
+		WHERE game = $1
+		AND player = $2
+		ORDER BY updated_at ASC
+	`, game, player)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var peers []string
+	for rows.Next() {
+		var peer string
+		if err := rows.Scan(&peer); err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+	return peers, rows.Err()
+}
+
+func (s *PostgresStore) SetPresence(ctx context.Context, game, peerID string, online bool, lobby string) error {
+	_, err := s.db(ctx).Exec(ctx, `
+		UPDATE players
+		SET
+			online = $3,
+			lobby = NULLIF($4, ''),
+			updated_at = $5
+		WHERE game = $1
+		AND peer = $2
+	`, game, peerID, online, lobby, util.Now(ctx))
+	return err
+}
+
+func (s *PostgresStore) GetPresence(ctx context.Context, game string, players []string, onlineAfter time.Time) (map[string]Presence, error) {
+	// The online session changed last represents the player, the last
+	// session to go offline when none is online. Sessions that didn't update
+	// their presence since onlineAfter were left behind by a node that went
+	// down and count as offline. Private lobbies are left out.
+	rows, err := s.db(ctx).Query(ctx, `
+		SELECT DISTINCT ON (p.player)
+			p.player,
+			p.online AND p.updated_at >= $3,
+			COALESCE(l.code, ''),
+			MAX(p.updated_at) OVER (PARTITION BY p.player)
+		FROM players p
+		LEFT JOIN lobbies l
+		ON l.code = p.lobby
+		AND l.game = p.game
+		AND l.public
+		WHERE p.game = $1
+		AND p.player = ANY($2)
+		ORDER BY p.player, p.online AND p.updated_at >= $3 DESC, p.updated_at DESC
+	`, game, players, onlineAfter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	presence := make(map[string]Presence)
+	for rows.Next() {
+		var p Presence
+		if err := rows.Scan(&p.Player, &p.Online, &p.Lobby, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if !p.Online {
+			p.Lobby = ""
+		}
+		presence[p.Player] = p
+	}
+	return presence, rows.Err()
+}
@@ -3,6 +3,7 @@ package stores
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -10,9 +11,11 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/koenbollen/logging"
 	"github.com/poki/netlib/internal/util"
+	"github.com/poki/netlib/migrations"
 	"go.uber.org/zap"
 )
 
@@ -23,21 +26,70 @@ type notificationPayload struct {
 
 type PostgresStore struct {
 	DB *pgxpool.Pool
+	// Replica is an optional read replica for the browsing queries
+	// (ListLobbies, GetLobbyInfo and MemberCount), everything else uses DB.
+	Replica *pgxpool.Pool
 
 	mutex             sync.Mutex
-	callbacks         map[string]map[uint64]SubscriptionCallback
+	callbacks         map[string]map[uint64]*subscription
 	nextCallbackIndex uint64
 }
 
+// subscription delivers the notifications of a topic to its callback one at
+// a time, in the order they were received. Relayed signals depend on that,
+// a candidate that overtakes its description fails the negotiation. Every
+// subscription has its own goroutine so a slow callback only delays itself.
+type subscription struct {
+	callback SubscriptionCallback
+	wake     chan struct{}
+
+	mutex   sync.Mutex
+	pending []notification
+}
+
+type notification struct {
+	ctx  context.Context
+	data []byte
+}
+
+func (s *subscription) push(ctx context.Context, data []byte) {
+	s.mutex.Lock()
+	s.pending = append(s.pending, notification{ctx, data})
+	s.mutex.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) take() []notification {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
 func NewPostgresStore(ctx context.Context, db *pgxpool.Pool) (*PostgresStore, error) {
 	s := &PostgresStore{
 		DB:        db,
-		callbacks: make(map[string]map[uint64]SubscriptionCallback),
+		callbacks: make(map[string]map[uint64]*subscription),
 	}
 	go s.run(ctx)
 	return s, nil
 }
 
+// Migrate brings the database schema up to date, it's idempotent and is
+// called at startup.
+func (s *PostgresStore) Migrate(ctx context.Context) error {
+	return migrations.UpContext(ctx, s.DB.Config().ConnConfig)
+}
+
+// PendingMigrations returns the migration versions Migrate would apply.
+func (s *PostgresStore) PendingMigrations(ctx context.Context) ([]uint, error) {
+	return migrations.Pending(s.DB.Config().ConnConfig)
+}
+
 func (s *PostgresStore) run(ctx context.Context) {
 	logger := logging.GetLogger(ctx)
 
@@ -86,10 +138,8 @@ func (s *PostgresStore) notify(ctx context.Context, topic string, data []byte) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if callbacks, found := s.callbacks[topic]; found {
-		for _, callback := range callbacks {
-			go callback(ctx, data)
-		}
+	for _, sub := range s.callbacks[topic] {
+		sub.push(ctx, data)
 	}
 }
 
@@ -98,12 +148,13 @@ func (s *PostgresStore) Subscribe(ctx context.Context, topic string, callback Su
 	defer s.mutex.Unlock()
 
 	if _, found := s.callbacks[topic]; !found {
-		s.callbacks[topic] = make(map[uint64]SubscriptionCallback)
+		s.callbacks[topic] = make(map[uint64]*subscription)
 	}
 
 	id := s.nextCallbackIndex
 	s.nextCallbackIndex += 1
-	s.callbacks[topic][id] = callback
+	sub := &subscription{callback: callback, wake: make(chan struct{}, 1)}
+	s.callbacks[topic][id] = sub
 
 	go func() {
 		defer func() {
@@ -116,11 +167,34 @@ func (s *PostgresStore) Subscribe(ctx context.Context, topic string, callback Su
 			}
 		}()
 
-		<-ctx.Done()
+		for {
+			select {
+			case <-sub.wake:
+				for _, n := range sub.take() {
+					if ctx.Err() != nil {
+						return
+					}
+					sub.callback(n.ctx, n.data)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 }
 
 func (s *PostgresStore) Publish(ctx context.Context, topic string, data []byte) error {
+	return publish(ctx, s.db(ctx), topic, data)
+}
+
+// execer is implemented by both the pool and transactions.
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// publish sends a notification through db, notifications sent in a
+// transaction are only delivered once it commits, in commit order.
+func publish(ctx context.Context, db execer, topic string, data []byte) error {
 	if len(topic) > 76 {
 		return fmt.Errorf("topic too long")
 	}
@@ -133,14 +207,14 @@ func (s *PostgresStore) Publish(ctx context.Context, topic string, data []byte)
 	}
 	encoded := base64.StdEncoding.EncodeToString(data)
 	payload := topic + ":" + encoded
-	_, err := s.DB.Exec(ctx, `NOTIFY lobbies, '`+payload+`'`)
+	_, err := db.Exec(ctx, `NOTIFY lobbies, '`+payload+`'`)
 	if err != nil {
 		return fmt.Errorf("failed to publish to lobbies: %w", err)
 	}
 	return nil
 }
 
-func (s *PostgresStore) CreateLobby(ctx context.Context, game, lobbyCode, peerID string) error {
+func (s *PostgresStore) CreateLobby(ctx context.Context, game, lobbyCode, peerID string, options LobbyOptions) error {
 	if len(lobbyCode) > 20 {
 		logger := logging.GetLogger(ctx)
 		logger.Warn("lobby code too long", zap.String("lobbyCode", lobbyCode))
@@ -151,40 +225,79 @@ func (s *PostgresStore) CreateLobby(ctx context.Context, game, lobbyCode, peerID
 		logger.Warn("peer id too long", zap.String("peerID", peerID))
 		return ErrInvalidPeerID
 	}
-	res, err := s.DB.Exec(ctx, `
-		INSERT INTO lobbies (code, game, public)
-		VALUES ($1, $2, true)
+	if options.CodeCooldown > 0 {
+		var cooling bool
+		err := s.db(ctx).QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1
+				FROM released_codes
+				WHERE code = $1
+				AND released_at >= $2
+			)
+		`, lobbyCode, util.Now(ctx).Add(-options.CodeCooldown)).Scan(&cooling)
+		if err != nil {
+			return err
+		}
+		if cooling {
+			return ErrLobbyExists
+		}
+	}
+	res, err := s.db(ctx).Exec(ctx, `
+		INSERT INTO lobbies (code, game, public, leader, max_players, max_spectators, auto_start, close_at, node, node_endpoint, limits, created_at, updated_at)
+		VALUES ($1, $2, NOT $11, $3, $4, $12, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10, $10)
 		ON CONFLICT DO NOTHING
-	`, lobbyCode, game)
+	`, lobbyCode, game, peerID, options.MaxPlayers, options.AutoStart, nullTime(options.CloseAt), options.Node, options.NodeEndpoint, options.Limits.orNil(), util.Now(ctx), options.Private, options.MaxSpectators)
 	if err != nil {
 		return err
 	}
 	if res.RowsAffected() == 0 {
-		return ErrAlreadyInLobby
+		return ErrLobbyExists
 	}
 	return nil
 }
 
-func (s *PostgresStore) JoinLobby(ctx context.Context, game, lobbyCode, peerID string) ([]string, error) {
+func (s *PostgresStore) JoinLobby(ctx context.Context, game, lobbyCode, peerID string, role Role) ([]string, error) {
 	if len(peerID) > 20 {
 		logger := logging.GetLogger(ctx)
 		logger.Warn("peer id too long", zap.String("peerID", peerID))
 		return nil, ErrInvalidPeerID
 	}
-	tx, err := s.DB.Begin(ctx)
+	tx, err := s.db(ctx).Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback(context.Background()) //nolint:errcheck
 
-	var peerlist []string
-	err = tx.QueryRow(ctx, `
-		SELECT peers
+	peerlist, err := s.joinLobby(ctx, tx, game, lobbyCode, peerID, role)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return peerlist, nil
+}
+
+// joinLobby adds the peer to the lobby in role as part of tx, it returns the
+// peers that were in the lobby before. The capacity of the role is checked
+// under the row lock, so concurrent joins can't overfill it.
+func (s *PostgresStore) joinLobby(ctx context.Context, tx pgx.Tx, game, lobbyCode, peerID string, role Role) ([]string, error) {
+	if role != RolePlayer && role != RoleSpectator {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	var peerlist, spectators []string
+	var maxPlayers, maxSpectators int
+	var state string
+	err := tx.QueryRow(ctx, `
+		SELECT peers, spectators, max_players, max_spectators, state
 		FROM lobbies
 		WHERE code = $1
 		AND game = $2
 		FOR UPDATE
-	`, lobbyCode, game).Scan(&peerlist)
+	`, lobbyCode, game).Scan(&peerlist, &spectators, &maxPlayers, &maxSpectators, &state)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
@@ -197,18 +310,71 @@ func (s *PostgresStore) JoinLobby(ctx context.Context, game, lobbyCode, peerID s
 			return nil, ErrAlreadyInLobby
 		}
 	}
+	if state != LobbyStateWaiting {
+		return nil, ErrLobbyNotJoinable.WithParams("state", state)
+	}
+
+	if role == RoleSpectator {
+		if len(spectators) >= maxSpectators {
+			return nil, ErrSpectatorsFull
+		}
+	} else if maxPlayers > 0 {
+		// Slots reserved by other matchmaking peers count as taken.
+		var reserved int
+		err = tx.QueryRow(ctx, `
+			SELECT COUNT(*)
+			FROM reservations
+			WHERE game = $1
+			AND lobby = $2
+			AND peer != $3
+			AND expires_at > $4
+		`, game, lobbyCode, peerID, util.Now(ctx)).Scan(&reserved)
+		if err != nil {
+			return nil, err
+		}
+		if len(peerlist)-len(spectators)+reserved >= maxPlayers {
+			return nil, ErrLobbyFull
+		}
+	}
 
 	_, err = tx.Exec(ctx, `
 		UPDATE lobbies
-		SET peers = array_append(peers, $1)
+		SET
+			peers = array_append(peers, $1),
+			spectators = CASE WHEN $5 THEN array_append(spectators, $1) ELSE spectators END,
+			ready = '{}',
+			seats = CASE WHEN seats ? $1 THEN seats ELSE seats || jsonb_build_object($1::text, next_seat) END,
+			next_seat = CASE WHEN seats ? $1 THEN next_seat ELSE next_seat + 1 END,
+			updated_at = $4
 		WHERE code = $2
 		AND game = $3
-	`, peerID, lobbyCode, game)
+	`, peerID, lobbyCode, game, util.Now(ctx), role == RoleSpectator)
 	if err != nil {
 		return nil, err
 	}
 
-	err = tx.Commit(ctx)
+	_, err = tx.Exec(ctx, `
+		DELETE FROM reservations
+		WHERE game = $1
+		AND peer = $2
+	`, game, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := MembersDelta{Op: "add", ID: peerID, Role: role}
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE((
+			SELECT player
+			FROM players
+			WHERE game = $1
+			AND peer = $2
+		), '')
+	`, game, peerID).Scan(&delta.Player)
+	if err != nil {
+		return nil, err
+	}
+	err = s.publishMembersDelta(ctx, tx, game, lobbyCode, delta)
 	if err != nil {
 		return nil, err
 	}
@@ -216,9 +382,89 @@ func (s *PostgresStore) JoinLobby(ctx context.Context, game, lobbyCode, peerID s
 	return peerlist, nil
 }
 
+// publishMembersDelta increments the members version of the lobby and
+// publishes delta with it when tx commits. The lobby row is locked by the
+// change itself, so the deltas of a lobby are delivered in version order.
+func (s *PostgresStore) publishMembersDelta(ctx context.Context, tx pgx.Tx, game, lobbyCode string, delta MembersDelta) error {
+	err := tx.QueryRow(ctx, `
+		UPDATE lobbies
+		SET members_version = members_version + 1
+		WHERE code = $1
+		AND game = $2
+		RETURNING members_version
+	`, lobbyCode, game).Scan(&delta.Version)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return publish(ctx, tx, MembersTopic(game, lobbyCode), data)
+}
+
+func (s *PostgresStore) SwitchLobby(ctx context.Context, game, from, to, peerID string) (left, joined []string, err error) {
+	if from == to {
+		return nil, nil, ErrAlreadyInLobby
+	}
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	// Lock both lobbies in a fixed order so two peers switching between the
+	// same lobbies in opposite directions don't deadlock.
+	_, err = tx.Exec(ctx, `
+		SELECT 1
+		FROM lobbies
+		WHERE game = $1
+		AND code IN ($2, $3)
+		ORDER BY code
+		FOR UPDATE
+	`, game, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			peers = array_remove(peers, $1),
+			spectators = array_remove(spectators, $1),
+			peer_data = peer_data - $1,
+			ready = '{}',
+			updated_at = $4
+		WHERE code = $2
+		AND game = $3
+		AND $1 = ANY(peers)
+		RETURNING peers
+	`, peerID, from, game, util.Now(ctx)).Scan(&left)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, ErrNotInLobby
+		}
+		return nil, nil, err
+	}
+	err = s.publishMembersDelta(ctx, tx, game, from, MembersDelta{Op: "remove", ID: peerID})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	joined, err = s.joinLobby(ctx, tx, game, to, peerID, RolePlayer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+	return left, joined, nil
+}
+
 func (s *PostgresStore) IsPeerInLobby(ctx context.Context, game, lobbyCode, peerID string) (bool, error) {
 	var count int
-	err := s.DB.QueryRow(ctx, `
+	err := s.db(ctx).QueryRow(ctx, `
 		SELECT COUNT(*)
 		FROM lobbies
 		WHERE code = $1
@@ -232,124 +478,1246 @@ func (s *PostgresStore) IsPeerInLobby(ctx context.Context, game, lobbyCode, peer
 }
 
 func (s *PostgresStore) LeaveLobby(ctx context.Context, game, lobbyCode, peerID string) ([]string, error) {
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	var member bool
+	err = tx.QueryRow(ctx, `
+		SELECT $1 = ANY(peers)
+		FROM lobbies
+		WHERE code = $2
+		AND game = $3
+		FOR UPDATE
+	`, peerID, lobbyCode, game).Scan(&member)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
 	var peerlist []string
-	err := s.DB.QueryRow(ctx, `
+	err = tx.QueryRow(ctx, `
 		UPDATE lobbies
-		SET peers = array_remove(peers, $1)
+		SET
+			peers = array_remove(peers, $1),
+			spectators = array_remove(spectators, $1),
+			peer_data = peer_data - $1,
+			ready = '{}',
+			updated_at = $4
 		WHERE code = $2
 		AND game = $3
 		RETURNING peers
-	`, peerID, lobbyCode, game).Scan(&peerlist)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+	`, peerID, lobbyCode, game, util.Now(ctx)).Scan(&peerlist)
+	if err != nil {
+		return nil, err
+	}
+	if member {
+		err = s.publishMembersDelta(ctx, tx, game, lobbyCode, MembersDelta{Op: "remove", ID: peerID})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
 	return peerlist, nil
 }
 
-func (s *PostgresStore) GetLobby(ctx context.Context, game, lobbyCode string) ([]string, error) {
-	var peerlist []string
-	err := s.DB.QueryRow(ctx, `
-		SELECT peers
+func (s *PostgresStore) GetSeats(ctx context.Context, game, lobbyCode string) (map[string]int, error) {
+	var seats map[string]int
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT seats
 		FROM lobbies
 		WHERE code = $1
 		AND game = $2
-	`, lobbyCode, game).Scan(&peerlist)
+	`, lobbyCode, game).Scan(&seats)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
 		}
 		return nil, err
 	}
-	return peerlist, nil
+	return seats, nil
 }
 
-func (s *PostgresStore) ListLobbies(ctx context.Context, game, filter string) ([]Lobby, error) {
+func (s *PostgresStore) SetPeerData(ctx context.Context, game, lobbyCode, peerID string, data map[string]any) ([]string, error) {
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
 
-	// TODO: Filters
+	var peerlist []string
+	err = tx.QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			peer_data = jsonb_set(peer_data, ARRAY[$3::text], $4),
+			updated_at = $5
+		WHERE code = $1
+		AND game = $2
+		AND $3 = ANY(peers)
+		RETURNING peers
+	`, lobbyCode, game, peerID, data, util.Now(ctx)).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	err = s.publishMembersDelta(ctx, tx, game, lobbyCode, MembersDelta{Op: "update", ID: peerID, Data: data})
+	if err != nil {
+		return nil, err
+	}
 
-	var lobbies []Lobby
-	rows, err := s.DB.Query(ctx, `
-		SELECT code, peers, meta
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return peerlist, nil
+}
+
+func (s *PostgresStore) GetMembers(ctx context.Context, game, lobbyCode string) (*Members, error) {
+	members := &Members{}
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT members_version, peers, spectators, peer_data, COALESCE((
+			SELECT jsonb_object_agg(players.peer, players.player)
+			FROM players
+			WHERE players.game = lobbies.game
+			AND players.peer = ANY(lobbies.peers)
+		), '{}')
 		FROM lobbies
-		WHERE game = $1
-		AND public = true
-		ORDER BY created_at DESC
-		LIMIT 50
-	`, game)
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&members.Version, &members.Peers, &members.Spectators, &members.PeerData, &members.Players)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
-	defer rows.Close() //nolint:errcheck
+	return members, nil
+}
 
-	for rows.Next() {
-		var lobby Lobby
-		var peers []string
-		err = rows.Scan(&lobby.Code, &peers, &lobby.CustomData)
-		if err != nil {
-			return nil, err
+func (s *PostgresStore) GetPeerData(ctx context.Context, game, lobbyCode string) (map[string]map[string]any, error) {
+	var peerData map[string]map[string]any
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT peer_data
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&peerData)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
 		}
-		lobby.PlayerCount = len(peers)
-		lobbies = append(lobbies, lobby)
-	}
-	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-
-	return lobbies, nil
+	return peerData, nil
 }
 
-func (s *PostgresStore) TimeoutPeer(ctx context.Context, peerID, secret, gameID string, lobbies []string) error {
-	if len(peerID) > 20 {
-		logger := logging.GetLogger(ctx)
-		logger.Warn("peer id too long", zap.String("peerID", peerID))
-		return ErrInvalidPeerID
+func (s *PostgresStore) SetPeerReady(ctx context.Context, game, lobbyCode, peerID string, ready bool) (peers, readyPeers []string, changed bool, err error) {
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return nil, nil, false, err
 	}
-	for _, lobby := range lobbies {
-		if len(lobby) > 20 {
-			logger := logging.GetLogger(ctx)
-			logger.Warn("lobby code too long", zap.String("lobbyCode", lobby))
-			return ErrInvalidLobbyCode
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	var wasReady bool
+	err = tx.QueryRow(ctx, `
+		SELECT peers, $3 = ANY(ready)
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+		AND $3 = ANY(peers)
+		FOR UPDATE
+	`, lobbyCode, game, peerID).Scan(&peers, &wasReady)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, false, ErrNotFound
 		}
+		return nil, nil, false, err
 	}
 
-	now := util.Now(ctx)
-	_, err := s.DB.Exec(ctx, `
-		INSERT INTO timeouts (peer, secret, game, lobbies, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $5)
-		ON CONFLICT (peer) DO UPDATE
-		SET
-			secret = $2,
-			game = $3,
-			lobbies = $4,
-			last_seen = $5,
-			updated_at = $5
-	`, peerID, secret, gameID, lobbies, now)
+	err = tx.QueryRow(ctx, `
+		UPDATE lobbies
+		SET ready = CASE WHEN $4 THEN array_append(array_remove(ready, $3), $3) ELSE array_remove(ready, $3) END
+		WHERE code = $1
+		AND game = $2
+		RETURNING ready
+	`, lobbyCode, game, peerID, ready).Scan(&readyPeers)
 	if err != nil {
-		return err
+		return nil, nil, false, err
 	}
-	return nil
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, false, err
+	}
+	return peers, readyPeers, wasReady != ready, nil
 }
 
-func (s *PostgresStore) ReconnectPeer(ctx context.Context, peerID, secret, gameID string) (bool, error) {
-	res, err := s.DB.Exec(ctx, `
-		DELETE FROM timeouts
-		WHERE peer = $1
-		AND secret = $2
-		AND game = $3
-	`, peerID, secret, gameID)
+func (s *PostgresStore) ResetReady(ctx context.Context, game, lobbyCode, peerID string) ([]string, error) {
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET ready = '{}'
+		WHERE code = $1
+		AND game = $2
+		AND leader = $3
+		RETURNING peers
+	`, lobbyCode, game, peerID).Scan(&peerlist)
 	if err != nil {
-		return false, err
+		if errors.Is(err, pgx.ErrNoRows) {
+			if _, err := s.GetLobby(ctx, game, lobbyCode); err != nil {
+				return nil, err
+			}
+			return nil, ErrNotLeader
+		}
+		return nil, err
 	}
-	if res.RowsAffected() == 0 {
-		return false, nil
+	return peerlist, nil
+}
+
+func (s *PostgresStore) StartLobby(ctx context.Context, game, lobbyCode, peerID, seed string, startedAt time.Time) ([]string, error) {
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			seed = $4,
+			started_at = $5,
+			state = 'started',
+			updated_at = $5
+		WHERE code = $1
+		AND game = $2
+		AND leader = $3
+		AND started_at IS NULL
+		RETURNING peers
+	`, lobbyCode, game, peerID, seed, startedAt).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			var leader string
+			var started bool
+			err := s.db(ctx).QueryRow(ctx, `
+				SELECT COALESCE(leader, ''), started_at IS NOT NULL
+				FROM lobbies
+				WHERE code = $1
+				AND game = $2
+			`, lobbyCode, game).Scan(&leader, &started)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrNotFound
+			} else if err != nil {
+				return nil, err
+			}
+			if leader != peerID {
+				return nil, ErrNotLeader
+			}
+			return nil, ErrAlreadyStarted
+		}
+		return nil, err
+	}
+	return peerlist, nil
+}
+
+func (s *PostgresStore) TransferOwnership(ctx context.Context, game, lobbyCode, from, to string) ([]string, error) {
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			leader = $4,
+			updated_at = $5
+		WHERE code = $1
+		AND game = $2
+		AND leader = $3
+		AND $4 = ANY(peers)
+		AND NOT $4 = ANY(spectators)
+		RETURNING peers
+	`, lobbyCode, game, from, to, util.Now(ctx)).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			var leader string
+			var spectator bool
+			err := s.db(ctx).QueryRow(ctx, `
+				SELECT COALESCE(leader, ''), $3 = ANY(spectators)
+				FROM lobbies
+				WHERE code = $1
+				AND game = $2
+			`, lobbyCode, game, to).Scan(&leader, &spectator)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrNotFound
+			} else if err != nil {
+				return nil, err
+			}
+			if leader != from {
+				return nil, ErrNotLeader
+			}
+			if spectator {
+				return nil, ErrNotPlayer
+			}
+			return nil, ErrNotInLobby
+		}
+		return nil, err
+	}
+	return peerlist, nil
+}
+
+func (s *PostgresStore) AutoStartLobby(ctx context.Context, game, lobbyCode, seed string, startedAt time.Time) ([]string, bool, error) {
+	// Concurrent joins serialize on the row lock and the started_at condition is
+	// re-evaluated after waiting, so only one of them starts the lobby.
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			seed = $3,
+			started_at = $4,
+			state = 'started',
+			updated_at = $4
+		WHERE code = $1
+		AND game = $2
+		AND auto_start
+		AND started_at IS NULL
+		AND max_players > 0
+		AND cardinality(peers) - cardinality(spectators) >= max_players
+		RETURNING peers
+	`, lobbyCode, game, seed, startedAt).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return peerlist, true, nil
+}
+
+func (s *PostgresStore) CreateInvite(ctx context.Context, game, lobbyCode, peerID, token string, maxUses int, expiresAt time.Time) error {
+	res, err := s.db(ctx).Exec(ctx, `
+		INSERT INTO invites (game, token, lobby, uses_left, expires_at, created_at)
+		SELECT game, $4, code, $5, $6, $7
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+		AND leader = $3
+	`, lobbyCode, game, peerID, token, maxUses, expiresAt, util.Now(ctx))
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		if _, err := s.GetLobby(ctx, game, lobbyCode); err != nil {
+			return err
+		}
+		return ErrNotLeader
+	}
+	return nil
+}
+
+func (s *PostgresStore) JoinLobbyByInvite(ctx context.Context, game, token, peerID string) (string, []string, error) {
+	if len(peerID) > 20 {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("peer id too long", zap.String("peerID", peerID))
+		return "", nil, ErrInvalidPeerID
+	}
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	var lobby string
+	err = tx.QueryRow(ctx, `
+		UPDATE invites
+		SET uses_left = uses_left - 1
+		WHERE game = $1
+		AND token = $2
+		AND uses_left > 0
+		AND expires_at > $3
+		RETURNING lobby
+	`, game, token, util.Now(ctx)).Scan(&lobby)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", nil, ErrInvalidInvite
+		}
+		return "", nil, err
+	}
+
+	// A failed join rolls back the use of the invite with it.
+	peerlist, err := s.joinLobby(ctx, tx, game, lobby, peerID, RolePlayer)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return lobby, peerlist, nil
+}
+
+func (s *PostgresStore) GetLobby(ctx context.Context, game, lobbyCode string) ([]string, error) {
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT peers
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return peerlist, nil
+}
+
+func (s *PostgresStore) GetLobbyInfo(ctx context.Context, game, lobbyCode string) (*Lobby, error) {
+	return fromReplica(ctx, s, func(db querier) (*Lobby, error) {
+		return getLobbyInfo(ctx, db, game, lobbyCode)
+	})
+}
+
+func getLobbyInfo(ctx context.Context, db querier, game, lobbyCode string) (*Lobby, error) {
+	lobby := &Lobby{}
+	err := db.QueryRow(ctx, `
+		SELECT code, COALESCE(cardinality(peers) - cardinality(spectators), 0), cardinality(spectators), public, meta, max_players, max_spectators, started_at IS NOT NULL, state
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+		AND cardinality(peers) > 0
+	`, lobbyCode, game).Scan(&lobby.Code, &lobby.PlayerCount, &lobby.SpectatorCount, &lobby.Public, &lobby.CustomData, &lobby.MaxPlayers, &lobby.MaxSpectators, &lobby.Started, &lobby.State)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return lobby, nil
+}
+
+func (s *PostgresStore) GetLobbyNode(ctx context.Context, game, lobbyCode string) (string, string, error) {
+	var node, endpoint string
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT COALESCE(node, ''), COALESCE(node_endpoint, '')
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&node, &endpoint)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", ErrNotFound
+		}
+		return "", "", err
+	}
+	return node, endpoint, nil
+}
+
+func (s *PostgresStore) MemberCount(ctx context.Context, game, lobbyCode string) (int, int, error) {
+	counts, err := fromReplica(ctx, s, func(db querier) (memberCounts, error) {
+		return memberCount(ctx, db, game, lobbyCode)
+	})
+	return counts.players, counts.spectators, err
+}
+
+type memberCounts struct {
+	players    int
+	spectators int
+}
+
+func memberCount(ctx context.Context, db querier, game, lobbyCode string) (memberCounts, error) {
+	var counts memberCounts
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(cardinality(peers) - cardinality(spectators), 0), cardinality(spectators)
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&counts.players, &counts.spectators)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return counts, ErrNotFound
+		}
+		return counts, err
+	}
+	return counts, nil
+}
+
+func (s *PostgresStore) SetLobbyVisibility(ctx context.Context, game, lobbyCode, peerID string, public bool) ([]string, error) {
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			public = $4,
+			updated_at = $5
+		WHERE code = $1
+		AND game = $2
+		AND leader = $3
+		RETURNING peers
+	`, lobbyCode, game, peerID, public, util.Now(ctx)).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Either the lobby doesn't exist or the peer isn't its leader.
+			if _, err := s.GetLobby(ctx, game, lobbyCode); err != nil {
+				return nil, err
+			}
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	return peerlist, nil
+}
+
+func (s *PostgresStore) SetLobbyState(ctx context.Context, game, lobbyCode, peerID, state string) ([]string, error) {
+	// Reopening forgets the start so the lobby can be started again.
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			state = $4,
+			seed = CASE WHEN $4 = 'waiting' THEN NULL ELSE seed END,
+			started_at = CASE WHEN $4 = 'waiting' THEN NULL ELSE started_at END,
+			updated_at = $5
+		WHERE code = $1
+		AND game = $2
+		AND leader = $3
+		RETURNING peers
+	`, lobbyCode, game, peerID, state, util.Now(ctx)).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Either the lobby doesn't exist or the peer isn't its leader.
+			if _, err := s.GetLobby(ctx, game, lobbyCode); err != nil {
+				return nil, err
+			}
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	return peerlist, nil
+}
+
+func (s *PostgresStore) SetLobbyCloseAt(ctx context.Context, game, lobbyCode, peerID string, closeAt time.Time) ([]string, error) {
+	var peerlist []string
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET
+			close_at = $4,
+			updated_at = $5
+		WHERE code = $1
+		AND game = $2
+		AND leader = $3
+		RETURNING peers
+	`, lobbyCode, game, peerID, nullTime(closeAt), util.Now(ctx)).Scan(&peerlist)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Either the lobby doesn't exist or the peer isn't its leader.
+			if _, err := s.GetLobby(ctx, game, lobbyCode); err != nil {
+				return nil, err
+			}
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	return peerlist, nil
+}
+
+func (s *PostgresStore) UpdateLobbyKV(ctx context.Context, game, lobbyCode, peerID string, update KVUpdate) (json.RawMessage, []string, error) {
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	var peerlist []string
+	var leader string
+	var kv map[string]json.RawMessage
+	err = tx.QueryRow(ctx, `
+		SELECT peers, COALESCE(leader, ''), kv
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+		FOR UPDATE
+	`, lobbyCode, game).Scan(&peerlist, &leader, &kv)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	member := false
+	for _, id := range peerlist {
+		member = member || id == peerID
+	}
+	if !member {
+		return nil, nil, ErrNotInLobby
+	}
+	if isLeaderKey(update.Key) && leader != peerID {
+		return nil, nil, ErrNotLeader
+	}
+
+	value, err := applyKVUpdate(kv, update)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE lobbies
+		SET
+			kv = $3,
+			updated_at = $4
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game, kv, util.Now(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+	return value, peerlist, nil
+}
+
+func (s *PostgresStore) GetLobbyKV(ctx context.Context, game, lobbyCode string) (map[string]json.RawMessage, error) {
+	var kv map[string]json.RawMessage
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT kv
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&kv)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (s *PostgresStore) UpdateLobbyCustomData(ctx context.Context, game, lobbyCode, peerID string, patch map[string]any, maxSize int) (int64, []string, error) {
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	var peerlist []string
+	var leader string
+	var meta map[string]any
+	var version int64
+	err = tx.QueryRow(ctx, `
+		SELECT peers, COALESCE(leader, ''), meta, meta_version
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+		FOR UPDATE
+	`, lobbyCode, game).Scan(&peerlist, &leader, &meta, &version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil, ErrNotFound
+		}
+		return 0, nil, err
+	}
+	if leader != peerID {
+		return 0, nil, ErrNotLeader
+	}
+
+	meta = ApplyMergePatch(meta, patch)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return 0, nil, err
+	}
+	if maxSize > 0 && len(data) > maxSize {
+		return 0, nil, ErrCustomDataTooLarge.WithParams("max", maxSize)
+	}
+	version++
+	_, err = tx.Exec(ctx, `
+		UPDATE lobbies
+		SET
+			meta = $3,
+			meta_version = $4,
+			updated_at = $5
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game, data, version, util.Now(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, nil, err
+	}
+	return version, peerlist, nil
+}
+
+func (s *PostgresStore) GetLobbyCustomData(ctx context.Context, game, lobbyCode string) (map[string]any, int64, error) {
+	var meta map[string]any
+	var version int64
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT meta, meta_version
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+	`, lobbyCode, game).Scan(&meta, &version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, 0, ErrNotFound
+		}
+		return nil, 0, err
+	}
+	return meta, version, nil
+}
+
+func (s *PostgresStore) CloseScheduledLobbies(ctx context.Context, limit int) ([]ClosedLobby, error) {
+	now := util.Now(ctx)
+	rows, err := s.db(ctx).Query(ctx, `
+		WITH closed AS (
+			DELETE FROM lobbies
+			WHERE (game, code) IN (
+				SELECT game, code
+				FROM lobbies
+				WHERE close_at <= $1
+				-- Lobbies in a critical section are closed on the next run.
+				AND pg_try_advisory_xact_lock(hashtext(game), hashtext(code))
+				ORDER BY close_at ASC
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			AND close_at <= $1
+			RETURNING game, code, public, peers, created_at, filled_at, emptied_at
+		), recorded AS (
+			INSERT INTO closed_lobbies (code, game, reason, closed_at)
+			SELECT code, game, $3, $1
+			FROM closed
+			ON CONFLICT (code) DO UPDATE
+			SET game = EXCLUDED.game, reason = EXCLUDED.reason, closed_at = EXCLUDED.closed_at
+		)
+		SELECT game, code, public, peers, created_at, filled_at, emptied_at
+		FROM closed
+	`, now, limit, CloseReasonScheduled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var closed []ClosedLobby
+	for rows.Next() {
+		lobby := ClosedLobby{LobbyLifetime: LobbyLifetime{ClosedAt: now}}
+		var filledAt, emptiedAt *time.Time
+		if err := rows.Scan(&lobby.Game, &lobby.Code, &lobby.Public, &lobby.Peers, &lobby.CreatedAt, &filledAt, &emptiedAt); err != nil {
+			return nil, err
+		}
+		if filledAt != nil {
+			lobby.FilledAt = *filledAt
+		}
+		if emptiedAt != nil {
+			lobby.EmptiedAt = *emptiedAt
+		}
+		closed = append(closed, lobby)
+	}
+	return closed, rows.Err()
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (s *PostgresStore) CountActiveLobbies(ctx context.Context, game string) (int, error) {
+	var count int
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM lobbies
+		WHERE game = $1
+		AND cardinality(peers) > 0
+	`, game).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *PostgresStore) ListLobbies(ctx context.Context, game string, options ListOptions) ([]Lobby, error) {
+	return fromReplica(ctx, s, func(db querier) ([]Lobby, error) {
+		return listLobbies(ctx, db, game, options)
+	})
+}
+
+func listLobbies(ctx context.Context, db querier, game string, options ListOptions) ([]Lobby, error) {
+
+	// TODO: Filters
+
+	args := []any{game, options.HideFull, util.Now(ctx)}
+	if options.Sort.Field == SortMeta {
+		args = append(args, options.Sort.MetaKey)
+	}
+
+	var lobbies []Lobby
+	rows, err := db.Query(ctx, `
+		SELECT code, peers, spectators, meta, max_players, max_spectators, started_at IS NOT NULL, state
+		FROM lobbies
+		WHERE game = $1
+		AND public = true
+		AND (
+			NOT $2
+			OR max_players = 0
+			OR cardinality(peers) - cardinality(spectators) + (
+				SELECT COUNT(*)
+				FROM reservations
+				WHERE reservations.game = lobbies.game
+				AND reservations.lobby = lobbies.code
+				AND reservations.expires_at > $3
+			) < max_players
+		)
+		ORDER BY `+lobbyOrder(options.Sort)+`
+		LIMIT 50
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	for rows.Next() {
+		var lobby Lobby
+		var peers, spectators []string
+		err = rows.Scan(&lobby.Code, &peers, &spectators, &lobby.CustomData, &lobby.MaxPlayers, &lobby.MaxSpectators, &lobby.Started, &lobby.State)
+		if err != nil {
+			return nil, err
+		}
+		lobby.PlayerCount = len(peers) - len(spectators)
+		lobby.SpectatorCount = len(spectators)
+		lobbies = append(lobbies, lobby)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lobbies, nil
+}
+
+// lobbyOrder returns the ORDER BY clause of ListLobbies, the meta key of
+// SortMeta is passed as $4 so it never ends up in the query itself.
+func lobbyOrder(sort LobbySort) string {
+	direction := "DESC"
+	if sort.Ascending {
+		direction = "ASC"
+	}
+	switch sort.Field {
+	case SortPlayerCount:
+		return "(cardinality(peers) - cardinality(spectators)) " + direction + " NULLS LAST, created_at DESC, code"
+	case SortMeta:
+		return "CASE WHEN jsonb_typeof(meta->$4::text) = 'number' THEN (meta->>$4::text)::numeric END " + direction + " NULLS LAST, created_at DESC, code"
+	default:
+		return "created_at " + direction + ", code"
+	}
+}
+
+func (s *PostgresStore) ReserveSlot(ctx context.Context, game, peerID string, maxPlayers, limit int, ttl time.Duration) (string, error) {
+	now := util.Now(ctx)
+	var limitArg any // LIMIT NULL is no limit.
+	if limit > 0 {
+		limitArg = limit
+	}
+
+	// Find candidates without locking, each candidate is then locked and
+	// rechecked before the reservation is made. The conditions on the player
+	// count match the lobbies_matchmaking index so the scan stops at the limit.
+	rows, err := s.db(ctx).Query(ctx, `
+		SELECT code
+		FROM lobbies
+		WHERE game = $1
+		AND public = true
+		AND max_players = $2
+		AND state = 'waiting'
+		AND cardinality(peers) > 0
+		AND cardinality(peers) - cardinality(spectators) < max_players
+		AND cardinality(peers) - cardinality(spectators) + (
+			SELECT COUNT(*)
+			FROM reservations
+			WHERE reservations.game = lobbies.game
+			AND reservations.lobby = lobbies.code
+			AND reservations.expires_at > $3
+		) < max_players
+		ORDER BY cardinality(peers) - cardinality(spectators) DESC, created_at ASC
+		LIMIT $4
+	`, game, maxPlayers, now, limitArg)
+	if err != nil {
+		return "", err
+	}
+	var candidates []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return "", err
+		}
+		candidates = append(candidates, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	for _, code := range candidates {
+		reserved, err := s.reserveSlotInLobby(ctx, game, code, peerID, now, ttl)
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			return code, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (s *PostgresStore) reserveSlotInLobby(ctx context.Context, game, lobbyCode, peerID string, now time.Time, ttl time.Duration) (bool, error) {
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	// The lobby may have started since it was found.
+	var peers, spectators []string
+	var maxPlayers int
+	err = tx.QueryRow(ctx, `
+		SELECT peers, spectators, max_players
+		FROM lobbies
+		WHERE code = $1
+		AND game = $2
+		AND state = 'waiting'
+		FOR UPDATE
+	`, lobbyCode, game).Scan(&peers, &spectators, &maxPlayers)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var reserved int
+	err = tx.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM reservations
+		WHERE game = $1
+		AND lobby = $2
+		AND peer != $3
+		AND expires_at > $4
+	`, game, lobbyCode, peerID, now).Scan(&reserved)
+	if err != nil {
+		return false, err
+	}
+	if len(peers)-len(spectators)+reserved >= maxPlayers {
+		return false, nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO reservations (game, peer, lobby, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (game, peer) DO UPDATE
+		SET
+			lobby = $3,
+			expires_at = $4,
+			created_at = $5
+	`, game, peerID, lobbyCode, now.Add(ttl), now)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+func (s *PostgresStore) ReleaseSlot(ctx context.Context, game, peerID string) error {
+	_, err := s.db(ctx).Exec(ctx, `
+		DELETE FROM reservations
+		WHERE game = $1
+		AND (peer = $2 OR expires_at < $3)
+	`, game, peerID, util.Now(ctx))
+	return err
+}
+
+func (s *PostgresStore) TimeoutPeer(ctx context.Context, peerID, secret, gameID string, lobbies []string, sessionStartedAt time.Time) error {
+	if len(peerID) > 20 {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("peer id too long", zap.String("peerID", peerID))
+		return ErrInvalidPeerID
+	}
+	for _, lobby := range lobbies {
+		if len(lobby) > 20 {
+			logger := logging.GetLogger(ctx)
+			logger.Warn("lobby code too long", zap.String("lobbyCode", lobby))
+			return ErrInvalidLobbyCode
+		}
+	}
+
+	now := util.Now(ctx)
+	_, err := s.db(ctx).Exec(ctx, `
+		INSERT INTO timeouts (peer, secret, game, lobbies, session_started_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $6, $5, $5)
+		ON CONFLICT (peer) DO UPDATE
+		SET
+			secret = $2,
+			game = $3,
+			lobbies = $4,
+			session_started_at = $6,
+			last_seen = $5,
+			notified = false,
+			updated_at = $5
+	`, peerID, secret, gameID, lobbies, now, nullTime(sessionStartedAt))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) ReconnectPeer(ctx context.Context, peerID, secret, gameID string, sessionStartedAfter time.Time) (bool, time.Time, []string, error) {
+	var notified bool
+	var lobbies []string
+	var sessionStartedAt *time.Time
+	err := s.db(ctx).QueryRow(ctx, `
+		DELETE FROM timeouts
+		WHERE peer = $1
+		AND secret = $2
+		AND game = $3
+		AND (session_started_at IS NULL OR $4::TIMESTAMP IS NULL OR session_started_at >= $4)
+		RETURNING notified, lobbies, session_started_at
+	`, peerID, secret, gameID, nullTime(sessionStartedAfter)).Scan(&notified, &lobbies, &sessionStartedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The session is either unknown or too old.
+			var expired bool
+			err := s.db(ctx).QueryRow(ctx, `
+				SELECT EXISTS (
+					SELECT 1
+					FROM timeouts
+					WHERE peer = $1
+					AND secret = $2
+					AND game = $3
+				)
+			`, peerID, secret, gameID).Scan(&expired)
+			if err != nil {
+				return false, time.Time{}, nil, err
+			}
+			if expired {
+				return false, time.Time{}, nil, ErrSessionExpired
+			}
+			return false, time.Time{}, nil, nil
+		}
+		return false, time.Time{}, nil, err
+	}
+	if !notified {
+		lobbies = nil
+	}
+	var startedAt time.Time
+	if sessionStartedAt != nil {
+		startedAt = *sessionStartedAt
+	}
+
+	// Touch the lobbies of the peer, PruneStaleLobbies relies on lobbies with
+	// connected peers being updated at least once per connection lifetime.
+	_, err = s.db(ctx).Exec(ctx, `
+		UPDATE lobbies
+		SET updated_at = $3
+		WHERE game = $2
+		AND $1 = ANY(peers)
+	`, peerID, gameID, util.Now(ctx))
+	if err != nil {
+		return true, startedAt, lobbies, err
+	}
+	return true, startedAt, lobbies, nil
+}
+
+func (s *PostgresStore) MarkReconnectingPeers(ctx context.Context, window time.Duration, callback func(peerID, gameID string, lobbies []string)) error {
+	rows, err := s.db(ctx).Query(ctx, `
+		UPDATE timeouts
+		SET notified = true
+		WHERE NOT notified
+		AND last_seen < $1
+		RETURNING peer, game, lobbies
+	`, util.Now(ctx).Add(-window))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var peerID, gameID string
+		var lobbies []string
+		if err := rows.Scan(&peerID, &gameID, &lobbies); err != nil {
+			return err
+		}
+		callback(peerID, gameID, lobbies)
+	}
+	return rows.Err()
+}
+
+// AddDeadLetter stores a payload that couldn't be delivered so it can be
+// inspected or replayed later.
+func (s *PostgresStore) AddDeadLetter(ctx context.Context, kind string, payload []byte, reason error) error {
+	_, err := s.db(ctx).Exec(ctx, `
+		INSERT INTO dead_letters (kind, payload, error, created_at)
+		VALUES ($1, $2, $3, $4)
+	`, kind, payload, reason.Error(), util.Now(ctx))
+	return err
+}
+
+func (s *PostgresStore) PruneStaleLobbies(ctx context.Context, staleAfter time.Duration, limit int) ([]LobbyLifetime, error) {
+	now := util.Now(ctx)
+
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	// The conditions are repeated on the DELETE itself, a lobby that was joined
+	// after it was selected is updated and no longer matches.
+	rows, err := tx.Query(ctx, `
+		DELETE FROM lobbies
+		WHERE (game, code) IN (
+			SELECT game, code
+			FROM lobbies
+			WHERE updated_at < $1
+			AND NOT EXISTS (
+				SELECT 1
+				FROM timeouts
+				WHERE timeouts.game = lobbies.game
+				AND lobbies.code = ANY(timeouts.lobbies)
+			)
+			ORDER BY updated_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		AND updated_at < $1
+		AND NOT EXISTS (
+			SELECT 1
+			FROM timeouts
+			WHERE timeouts.game = lobbies.game
+			AND lobbies.code = ANY(timeouts.lobbies)
+		)
+		RETURNING game, code, public, created_at, filled_at, emptied_at, updated_at
+	`, now.Add(-staleAfter), limit)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []LobbyLifetime
+	for rows.Next() {
+		var lobby LobbyLifetime
+		var filledAt, emptiedAt *time.Time
+		// The lobby closed when the last peer left, which is the last update.
+		if err := rows.Scan(&lobby.Game, &lobby.Code, &lobby.Public, &lobby.CreatedAt, &filledAt, &emptiedAt, &lobby.ClosedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if filledAt != nil {
+			lobby.FilledAt = *filledAt
+		}
+		if emptiedAt != nil {
+			lobby.EmptiedAt = *emptiedAt
+		}
+		pruned = append(pruned, lobby)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM reservations WHERE expires_at < $1`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// A connection lasts at most a fraction of staleAfter, older players
+	// belong to peers that are gone.
+	_, err = tx.Exec(ctx, `DELETE FROM players WHERE updated_at < $1`, now.Add(-staleAfter))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM invites WHERE expires_at < $1 OR uses_left <= 0`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return pruned, tx.Commit(ctx)
+}
+
+func (s *PostgresStore) MarkLobbyFilled(ctx context.Context, game, lobbyCode string) (*LobbyLifetime, error) {
+	lobby := &LobbyLifetime{Game: game, Code: lobbyCode}
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET filled_at = $3
+		WHERE code = $1
+		AND game = $2
+		AND filled_at IS NULL
+		AND max_players > 0
+		AND cardinality(peers) - cardinality(spectators) >= max_players
+		RETURNING public, created_at, filled_at
+	`, lobbyCode, game, util.Now(ctx)).Scan(&lobby.Public, &lobby.CreatedAt, &lobby.FilledAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return lobby, nil
+}
+
+func (s *PostgresStore) MarkLobbyEmptied(ctx context.Context, game, lobbyCode string) (*LobbyLifetime, error) {
+	lobby := &LobbyLifetime{Game: game, Code: lobbyCode}
+	err := s.db(ctx).QueryRow(ctx, `
+		UPDATE lobbies
+		SET emptied_at = $3
+		WHERE code = $1
+		AND game = $2
+		AND emptied_at IS NULL
+		AND cardinality(peers) = 0
+		RETURNING public, created_at, emptied_at
+	`, lobbyCode, game, util.Now(ctx)).Scan(&lobby.Public, &lobby.CreatedAt, &lobby.EmptiedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	lobby.ClosedAt = lobby.EmptiedAt
+	return lobby, nil
+}
+
+func (s *PostgresStore) ReleaseLobbyCodes(ctx context.Context, codes []string) error {
+	_, err := s.db(ctx).Exec(ctx, `
+		INSERT INTO released_codes (code, released_at)
+		SELECT unnest($1::text[]), $2
+		ON CONFLICT (code) DO UPDATE
+		SET released_at = EXCLUDED.released_at
+	`, codes, util.Now(ctx))
+	return err
+}
+
+func (s *PostgresStore) ClaimReleasedCode(ctx context.Context, cooldown time.Duration) (string, error) {
+	var code string
+	err := s.db(ctx).QueryRow(ctx, `
+		DELETE FROM released_codes
+		WHERE code = (
+			SELECT code
+			FROM released_codes
+			WHERE released_at < $1
+			ORDER BY released_at ASC
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING code
+	`, util.Now(ctx).Add(-cooldown)).Scan(&code)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
 	}
-	return true, nil
+	return code, nil
 }
 
 func (s *PostgresStore) ClaimNextTimedOutPeer(ctx context.Context, threshold time.Duration, callback func(peerID, gameID string, lobbies []string) error) (more bool, err error) {
 	now := util.Now(ctx)
 
-	tx, err := s.DB.Begin(ctx)
+	tx, err := s.db(ctx).Begin(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,1782 @@
+package stores
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/poki/netlib/internal/ratelimit"
+)
+
+// testStore connects to the database of DATABASE_URL or starts one with
+// docker, tests using it are skipped when neither is available. CI always
+// has docker, so they fail there instead of passing without running.
+func testStore(t testing.TB) Store {
+	t.Helper()
+	_, hasURL := os.LookupEnv("DATABASE_URL")
+	_, hasDocker := os.LookupEnv("DOCKER_HOST")
+	if !hasURL && !hasDocker {
+		if _, ci := os.LookupEnv("CI"); ci {
+			t.Fatal("no database configured in CI, set DATABASE_URL or DOCKER_HOST")
+		}
+		t.Skip("no database configured, set DATABASE_URL or DOCKER_HOST")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	store, flushed, err := FromEnv(ctx)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		if flushed != nil {
+			<-flushed
+		}
+	})
+	return store
+}
+
+// testLobbies returns the store of testStore and a game of testGame, the
+// setup of most tests.
+func testLobbies(t testing.TB) (Store, context.Context, string) {
+	t.Helper()
+	return testStore(t), context.Background(), testGame(t)
+}
+
+// testGame returns a random game ID so tests don't see each other's lobbies.
+func testGame(t testing.TB) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func TestNotificationOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &PostgresStore{callbacks: make(map[string]map[uint64]*subscription)}
+
+	// A recipient that's stuck doesn't hold up the others.
+	stuck := make(chan struct{})
+	defer close(stuck)
+	s.Subscribe(ctx, "gamelobbyc", func(context.Context, []byte) {
+		<-stuck
+	})
+	received := make(chan string, 100)
+	s.Subscribe(ctx, "gamelobbyb", func(_ context.Context, data []byte) {
+		received <- string(data)
+	})
+
+	var sent []string
+	for i := 0; i < 50; i++ {
+		packet := fmt.Sprintf(`{"type":"candidate","candidate":%d}`, i)
+		if i%10 == 0 {
+			packet = fmt.Sprintf(`{"type":"description","description":%d}`, i)
+		}
+		sent = append(sent, packet)
+		s.notify(ctx, "gamelobbyc", []byte(packet))
+		s.notify(ctx, "gamelobbyb", []byte(packet))
+	}
+
+	for i, packet := range sent {
+		select {
+		case got := <-received:
+			if got != packet {
+				t.Fatalf("expected packet %d to be %s, got %s", i, packet, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected packet %d to be delivered", i)
+		}
+	}
+}
+
+func TestTransferOwnershipConcurrently(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "transfer", "leader", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := store.JoinLobby(ctx, game, "transfer", id, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two clients race to take over from the same leader, exactly one wins.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, to := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(i int, to string) {
+			defer wg.Done()
+			_, errs[i] = store.TransferOwnership(ctx, game, "transfer", "leader", to)
+		}(i, to)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("expected ErrNotLeader for the losing transfer, got %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one transfer to succeed, got %d", succeeded)
+	}
+}
+
+func TestTransferOwnershipToNonMember(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "transfer", "leader", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.TransferOwnership(ctx, game, "transfer", "leader", "stranger"); !errors.Is(err, ErrNotInLobby) {
+		t.Fatalf("expected ErrNotInLobby, got %v", err)
+	}
+	if _, err := store.TransferOwnership(ctx, game, "missing", "leader", "stranger"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestJoinLobbySeatsConcurrently(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "seats", "leader", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "seats", "leader", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ids := []string{"a", "b", "c", "d"}
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if _, err := store.JoinLobby(ctx, game, "seats", id, RolePlayer); err != nil {
+				t.Error(err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	seats, err := store.GetSeats(ctx, game, "seats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seats["leader"] != 0 {
+		t.Fatalf("expected the leader to have seat 0, got %d", seats["leader"])
+	}
+	taken := map[int]string{}
+	for _, id := range ids {
+		seat, found := seats[id]
+		if !found || seat < 1 || seat > len(ids) {
+			t.Fatalf("unexpected seat for %s: %v", id, seats)
+		}
+		if other, found := taken[seat]; found {
+			t.Fatalf("%s and %s got the same seat %d", id, other, seat)
+		}
+		taken[seat] = id
+	}
+
+	// Rejoining after leaving reclaims the original seat.
+	if _, err := store.LeaveLobby(ctx, game, "seats", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "seats", "a", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	rejoined, err := store.GetSeats(ctx, game, "seats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejoined["a"] != seats["a"] {
+		t.Fatalf("expected seat %d after rejoining, got %d", seats["a"], rejoined["a"])
+	}
+}
+
+func TestJoinLobbyRoleCapsConcurrently(t *testing.T) {
+	tests := []struct {
+		role  Role
+		other Role
+		full  error
+	}{
+		{RolePlayer, RoleSpectator, ErrLobbyFull},
+		{RoleSpectator, RolePlayer, ErrSpectatorsFull},
+	}
+	for _, test := range tests {
+		t.Run(string(test.role), func(t *testing.T) {
+			store, ctx, game := testLobbies(t)
+			code := game[:8] + "r"
+
+			// Both caps leave room for exactly two more peers of a role.
+			if err := store.CreateLobby(ctx, game, code, "leader", LobbyOptions{MaxPlayers: 3, MaxSpectators: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.JoinLobby(ctx, game, code, "leader", RolePlayer); err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make([]error, 8)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = store.JoinLobby(ctx, game, code, fmt.Sprintf("p%d", i), test.role)
+				}(i)
+			}
+			wg.Wait()
+
+			joined := 0
+			for _, err := range errs {
+				if err == nil {
+					joined++
+				} else if !errors.Is(err, test.full) {
+					t.Fatalf("expected %v for the rejected joins, got %v", test.full, err)
+				}
+			}
+			if joined != 2 {
+				t.Fatalf("expected 2 %ss to join, got %d", test.role, joined)
+			}
+
+			// The cap of the other role is unaffected.
+			if _, err := store.JoinLobby(ctx, game, code, "other", test.other); err != nil {
+				t.Fatalf("expected a %s to still join, got %v", test.other, err)
+			}
+			players, spectators, err := store.MemberCount(ctx, game, code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.role == RolePlayer && (players != 3 || spectators != 1) {
+				t.Fatalf("expected 3 players and 1 spectator, got %d and %d", players, spectators)
+			} else if test.role == RoleSpectator && (players != 2 || spectators != 2) {
+				t.Fatalf("expected 2 players and 2 spectators, got %d and %d", players, spectators)
+			}
+		})
+	}
+}
+
+func TestSpectators(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code, closed := game[:8]+"s", game[:8]+"c"
+
+	if err := store.CreateLobby(ctx, game, closed, "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, closed, "a", RoleSpectator); !errors.Is(err, ErrSpectatorsFull) {
+		t.Fatalf("expected a lobby without spectator slots to reject spectators, got %v", err)
+	}
+
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{MaxPlayers: 2, MaxSpectators: 1, AutoStart: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "a", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "s", RoleSpectator); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spectators don't fill the lobby and can't lead it.
+	if _, started, err := store.AutoStartLobby(ctx, game, code, "seed", time.Now()); err != nil || started {
+		t.Fatalf("expected spectators not to count towards the start, got %v (%v)", started, err)
+	}
+	if _, err := store.TransferOwnership(ctx, game, code, "a", "s"); !errors.Is(err, ErrNotPlayer) {
+		t.Fatalf("expected ErrNotPlayer, got %v", err)
+	}
+	info, err := store.GetLobbyInfo(ctx, game, code)
+	if err != nil || info.PlayerCount != 1 || info.SpectatorCount != 1 || info.MaxSpectators != 1 {
+		t.Fatalf("expected 1 player and 1 of 1 spectators, got %+v (%v)", info, err)
+	}
+	members, err := store.GetMembers(ctx, game, code)
+	if err != nil || len(members.Peers) != 2 || len(members.Spectators) != 1 || members.Spectators[0] != "s" {
+		t.Fatalf("expected s to be the only spectator, got %+v (%v)", members, err)
+	}
+
+	if _, err := store.JoinLobby(ctx, game, code, "b", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, started, err := store.AutoStartLobby(ctx, game, code, "seed", time.Now()); err != nil || !started {
+		t.Fatalf("expected the lobby to start once the players are in, got %v (%v)", started, err)
+	}
+}
+
+func TestReleasedCodeCooldown(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := fmt.Sprintf("T%x", testGame(t)[:8]) // Unique per run, not a real short code.
+
+	if err := store.ReleaseLobbyCodes(ctx, []string{code}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Within the cooldown the code is neither claimed nor accepted for a new lobby.
+	if claimed, err := store.ClaimReleasedCode(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if claimed == code {
+		t.Fatal("code was reused before its cooldown elapsed")
+	}
+	err := store.CreateLobby(ctx, game, code, "peer", LobbyOptions{CodeCooldown: time.Hour})
+	if !errors.Is(err, ErrLobbyExists) {
+		t.Fatalf("expected ErrLobbyExists for a cooling down code, got %v", err)
+	}
+
+	// Once the cooldown elapsed the code can be claimed, exactly once.
+	time.Sleep(10 * time.Millisecond)
+	claimed := ""
+	for {
+		c, err := store.ClaimReleasedCode(ctx, 5*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == "" || c == code {
+			claimed = c
+			break
+		}
+		// Codes released by other tests, skip them.
+	}
+	if claimed != code {
+		t.Fatalf("expected %s to be claimed after its cooldown, got %q", code, claimed)
+	}
+	if err := store.CreateLobby(ctx, game, code, "peer", LobbyOptions{CodeCooldown: 5 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateLobbyWithCollidingPooledCode(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := fmt.Sprintf("C%x", testGame(t)[:8])
+
+	// The code is pooled while a lobby still uses it.
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ReleaseLobbyCodes(ctx, []string{code}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for {
+		c, err := store.ClaimReleasedCode(ctx, 5*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == code {
+			break
+		}
+		if c == "" {
+			t.Fatalf("expected %s to be claimed", code)
+		}
+	}
+
+	// The create is told the code exists so it retries with another one.
+	err := store.CreateLobby(ctx, game, code, "b", LobbyOptions{CodeCooldown: 5 * time.Millisecond})
+	if !errors.Is(err, ErrLobbyExists) {
+		t.Fatalf("expected ErrLobbyExists for a colliding code, got %v", err)
+	}
+	if err := store.CreateLobby(ctx, game, code+"x", "b", LobbyOptions{CodeCooldown: 5 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMarkLobbyFilledOnce(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "fill", "a", LobbyOptions{MaxPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "fill", "a", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if filled, err := store.MarkLobbyFilled(ctx, game, "fill"); err != nil || filled != nil {
+		t.Fatalf("expected the lobby not to be full, got %v %v", filled, err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "fill", "b", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	filled, err := store.MarkLobbyFilled(ctx, game, "fill")
+	if err != nil || filled == nil {
+		t.Fatalf("expected the lobby to be filled, got %v %v", filled, err)
+	}
+	if filled.FilledAt.Before(filled.CreatedAt) {
+		t.Fatalf("filled before created: %+v", filled)
+	}
+
+	// Leaving and rejoining doesn't fill the lobby again.
+	if _, err := store.LeaveLobby(ctx, game, "fill", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "fill", "b", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if filled, err := store.MarkLobbyFilled(ctx, game, "fill"); err != nil || filled != nil {
+		t.Fatalf("expected the lobby to be filled only once, got %v %v", filled, err)
+	}
+}
+
+func TestMarkLobbyEmptiedOnce(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "empty", "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "empty", "a", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if emptied, err := store.MarkLobbyEmptied(ctx, game, "empty"); err != nil || emptied != nil {
+		t.Fatalf("expected the lobby not to be empty, got %v %v", emptied, err)
+	}
+	if _, err := store.LeaveLobby(ctx, game, "empty", "a"); err != nil {
+		t.Fatal(err)
+	}
+	emptied, err := store.MarkLobbyEmptied(ctx, game, "empty")
+	if err != nil || emptied == nil {
+		t.Fatalf("expected the lobby to be emptied, got %v %v", emptied, err)
+	}
+	if emptied.EmptiedAt.Before(emptied.CreatedAt) || !emptied.ClosedAt.Equal(emptied.EmptiedAt) {
+		t.Fatalf("unexpected lifetime: %+v", emptied)
+	}
+
+	// Rejoining and leaving again doesn't count the lobby again.
+	if _, err := store.JoinLobby(ctx, game, "empty", "a", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LeaveLobby(ctx, game, "empty", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if emptied, err := store.MarkLobbyEmptied(ctx, game, "empty"); err != nil || emptied != nil {
+		t.Fatalf("expected the lobby to be emptied only once, got %v %v", emptied, err)
+	}
+}
+
+func TestSwitchLobbyRollsBackWhenFull(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "from", "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateLobby(ctx, game, "full", "b", LobbyOptions{MaxPlayers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, join := range []struct{ lobby, peer string }{{"from", "a"}, {"from", "c"}, {"full", "b"}} {
+		if _, err := store.JoinLobby(ctx, game, join.lobby, join.peer, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := store.SwitchLobby(ctx, game, "from", "full", "a"); err != ErrLobbyFull {
+		t.Fatalf("expected ErrLobbyFull, got %v", err)
+	}
+	if _, _, err := store.SwitchLobby(ctx, game, "from", "missing", "a"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	peers, err := store.GetLobby(ctx, game, "from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0] != "a" {
+		t.Fatalf("expected a to still be in its lobby, got %v", peers)
+	}
+
+	if err := store.CreateLobby(ctx, game, "to", "d", LobbyOptions{MaxPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "to", "d", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	left, joined, err := store.SwitchLobby(ctx, game, "from", "to", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0] != "c" || len(joined) != 1 || joined[0] != "d" {
+		t.Fatalf("unexpected peers after switch: left %v joined %v", left, joined)
+	}
+}
+
+// TestJoinLobbyByInvite makes sure a use of the invite is only taken by a
+// join that succeeds.
+func TestJoinLobbyByInvite(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "i"
+
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{MaxPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range []string{"a", "b"} {
+		if _, err := store.JoinLobby(ctx, game, code, peer, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.CreateInvite(ctx, game, code, "b", "token", 1, time.Now().Add(time.Hour)); err != ErrNotLeader {
+		t.Fatalf("expected only the leader to create invites, got %v", err)
+	}
+	if err := store.CreateInvite(ctx, game, code, "a", "token", 1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateInvite(ctx, game, code, "a", "expired", 1, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.JoinLobbyByInvite(ctx, game, "token", "c"); err != ErrLobbyFull {
+		t.Fatalf("expected ErrLobbyFull, got %v", err)
+	}
+	if _, err := store.LeaveLobby(ctx, game, code, "b"); err != nil {
+		t.Fatal(err)
+	}
+	lobby, others, err := store.JoinLobbyByInvite(ctx, game, "token", "c")
+	if err != nil {
+		t.Fatalf("expected the full lobby to not use up the invite, got %v", err)
+	}
+	if lobby != code || len(others) != 1 || others[0] != "a" {
+		t.Fatalf("unexpected join by invite: lobby %s others %v", lobby, others)
+	}
+	if _, err := store.LeaveLobby(ctx, game, code, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.JoinLobbyByInvite(ctx, game, "token", "d"); err != ErrInvalidInvite {
+		t.Fatalf("expected an exhausted invite to be rejected, got %v", err)
+	}
+	if _, _, err := store.JoinLobbyByInvite(ctx, game, "expired", "d"); err != ErrInvalidInvite {
+		t.Fatalf("expected an expired invite to be rejected, got %v", err)
+	}
+	if _, _, err := store.JoinLobbyByInvite(ctx, testGame(t), "token", "d"); err != ErrInvalidInvite {
+		t.Fatalf("expected an invite of another game to be rejected, got %v", err)
+	}
+}
+
+func TestCloseScheduledLobbies(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "past", "a", LobbyOptions{CloseAt: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateLobby(ctx, game, "future", "b", LobbyOptions{CloseAt: time.Now().Add(24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, join := range []struct{ lobby, peer string }{{"past", "a"}, {"future", "b"}} {
+		if _, err := store.JoinLobby(ctx, game, join.lobby, join.peer, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed, err := store.CloseScheduledLobbies(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, lobby := range closed {
+		if lobby.Game != game {
+			continue // Left behind by another test.
+		}
+		if lobby.Code != "past" || len(lobby.Peers) != 1 || lobby.Peers[0] != "a" {
+			t.Fatalf("unexpected closed lobby %+v", lobby)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatal("expected the lobby with a deadline in the past to be closed")
+	}
+	if _, err := store.GetLobby(ctx, game, "past"); err != ErrNotFound {
+		t.Fatalf("expected the closed lobby to be gone, got %v", err)
+	}
+	if _, err := store.GetLobby(ctx, game, "future"); err != nil {
+		t.Fatalf("expected the far future lobby to stay open, got %v", err)
+	}
+
+	// Closing again doesn't return the same lobby twice.
+	closed, err = store.CloseScheduledLobbies(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lobby := range closed {
+		if lobby.Game == game {
+			t.Fatalf("lobby closed twice: %+v", lobby)
+		}
+	}
+}
+
+// createMatchmakingLobby creates a public lobby for 4 players with members peers.
+func createMatchmakingLobby(t testing.TB, store Store, game, code string, members int) {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.CreateLobby(ctx, game, code, code+"0", LobbyOptions{MaxPlayers: 4}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < members; i++ {
+		if _, err := store.JoinLobby(ctx, game, code, fmt.Sprintf("%s%d", code, i), RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReserveSlotConvergesWithLimit(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	full, fuller := game[:8]+"a", game[:8]+"b"
+	createMatchmakingLobby(t, store, game, full, 1)
+	createMatchmakingLobby(t, store, game, fuller, 2)
+
+	// Concurrent matchmakers considering only the fullest lobby all end up
+	// in it until its reservations fill it up.
+	var wg sync.WaitGroup
+	codes := make([]string, 3)
+	errs := make([]error, 3)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i], errs[i] = store.ReserveSlot(ctx, game, fmt.Sprintf("m%d", i), 4, 1, time.Minute)
+		}(i)
+	}
+	wg.Wait()
+
+	reserved := map[string]int{}
+	for i, err := range errs {
+		if err == nil {
+			reserved[codes[i]]++
+		} else if err != ErrNotFound {
+			t.Fatal(err)
+		}
+	}
+	if reserved[fuller] != 2 || reserved[full] > 1 {
+		t.Fatalf("expected the fullest lobby to be filled first, got %v", reserved)
+	}
+
+	// The next scan skips the lobby that is full with reservations.
+	code, err := store.ReserveSlot(ctx, game, "m3", 4, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != full {
+		t.Fatalf("expected a slot in %s, got %s", full, code)
+	}
+}
+
+func TestStartLobby(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "t"
+	createMatchmakingLobby(t, store, game, code, 2)
+	leader := code + "0"
+
+	if _, err := store.StartLobby(ctx, game, code, code+"1", "seed", time.Now()); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected only the leader to start the lobby, got %v", err)
+	}
+	if _, err := store.StartLobby(ctx, game, game[:8]+"x", leader, "seed", time.Now()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	peers, err := store.StartLobby(ctx, game, code, leader, "seed", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("expected the peers of the lobby, got %v", peers)
+	}
+	// A lobby only starts once, so all peers keep the first seed.
+	if _, err := store.StartLobby(ctx, game, code, leader, "other", time.Now()); !errors.Is(err, ErrAlreadyStarted) {
+		t.Fatalf("expected ErrAlreadyStarted, got %v", err)
+	}
+}
+
+func TestAutoStartLobby(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	auto, manual := game[:8]+"a", game[:8]+"m"
+	for _, code := range []string{auto, manual} {
+		if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{MaxPlayers: 2, AutoStart: code == auto}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.JoinLobby(ctx, game, code, "a", RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, started, err := store.AutoStartLobby(ctx, game, auto, "seed", time.Now()); err != nil || started {
+		t.Fatalf("expected a lobby with a free slot not to start, got %v (%v)", started, err)
+	}
+	for _, code := range []string{auto, manual} {
+		if _, err := store.JoinLobby(ctx, game, code, "b", RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, started, err := store.AutoStartLobby(ctx, game, manual, "seed", time.Now()); err != nil || started {
+		t.Fatalf("expected a lobby without autoStart not to start, got %v (%v)", started, err)
+	}
+	peers, started, err := store.AutoStartLobby(ctx, game, auto, "seed", time.Now())
+	if err != nil || !started || len(peers) != 2 {
+		t.Fatalf("expected the full lobby to start, got %v %v (%v)", peers, started, err)
+	}
+	if _, started, err := store.AutoStartLobby(ctx, game, auto, "other", time.Now()); err != nil || started {
+		t.Fatalf("expected the lobby to start only once, got %v (%v)", started, err)
+	}
+	if info, err := store.GetLobbyInfo(ctx, game, auto); err != nil || info.State != LobbyStateStarted {
+		t.Fatalf("expected the lobby to be started, got %+v (%v)", info, err)
+	}
+}
+
+func TestJoinLobbyState(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "s"
+	createMatchmakingLobby(t, store, game, code, 1)
+	leader := code + "0"
+
+	if _, err := store.StartLobby(ctx, game, code, leader, "seed", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "late", RolePlayer); !errors.Is(err, ErrLobbyNotJoinable) {
+		t.Fatalf("expected joining a started lobby to be rejected, got %v", err)
+	}
+	if info, err := store.GetLobbyInfo(ctx, game, code); err != nil || info.State != LobbyStateStarted {
+		t.Fatalf("expected the lobby to be started, got %+v (%v)", info, err)
+	}
+
+	if _, err := store.SetLobbyState(ctx, game, code, "late", LobbyStateWaiting); err != ErrNotLeader {
+		t.Fatalf("expected only the leader to reopen the lobby, got %v", err)
+	}
+	if _, err := store.SetLobbyState(ctx, game, code, leader, LobbyStateWaiting); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "late", RolePlayer); err != nil {
+		t.Fatalf("expected a reopened lobby to be joinable, got %v", err)
+	}
+	// Reopening forgets the start.
+	if _, err := store.StartLobby(ctx, game, code, leader, "seed", time.Now()); err != nil {
+		t.Fatalf("expected a reopened lobby to start again, got %v", err)
+	}
+
+	if _, err := store.SetLobbyState(ctx, game, code, leader, LobbyStateClosed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "later", RolePlayer); !errors.Is(err, ErrLobbyNotJoinable) {
+		t.Fatalf("expected joining a closed lobby to be rejected, got %v", err)
+	}
+}
+
+func TestReserveSlotSkipsStartedLobbies(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	waiting, started := game[:8]+"w", game[:8]+"t"
+	createMatchmakingLobby(t, store, game, waiting, 1)
+	createMatchmakingLobby(t, store, game, started, 2)
+	if _, err := store.StartLobby(ctx, game, started, started+"0", "seed", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The started lobby is the fullest but isn't a candidate.
+	code, err := store.ReserveSlot(ctx, game, "m", 4, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != waiting {
+		t.Fatalf("expected a slot in %s, got %s", waiting, code)
+	}
+}
+
+func BenchmarkReserveSlot(b *testing.B) {
+	store := testStore(b)
+	ctx := context.Background()
+	for _, size := range []int{100, 1000, 10000} {
+		game := testGame(b)
+		for i := 0; i < size; i++ {
+			createMatchmakingLobby(b, store, game, fmt.Sprintf("%s%d_", game[:8], i), 1+i%2)
+		}
+		for _, limit := range []int{10, 0} {
+			b.Run(fmt.Sprintf("lobbies=%d/limit=%d", size, limit), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					peer := fmt.Sprintf("bench%d", i)
+					if _, err := store.ReserveSlot(ctx, game, peer, 4, limit, time.Minute); err != nil {
+						b.Fatal(err)
+					}
+					if err := store.ReleaseSlot(ctx, game, peer); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMembersVersion(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "m"
+
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := store.JoinLobby(ctx, game, code, id, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.SetPeerData(ctx, game, code, "b", map[string]any{"name": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LeaveLobby(ctx, game, code, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// Leaving a lobby the peer isn't in doesn't change the members.
+	if _, err := store.LeaveLobby(ctx, game, code, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := store.GetMembers(ctx, game, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members.Version != 4 || len(members.Peers) != 1 || members.Peers[0] != "b" || members.PeerData["b"]["name"] != "b" {
+		t.Fatalf("unexpected members %+v", members)
+	}
+}
+
+func TestMemberCount(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "c"
+
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{MaxSpectators: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if players, spectators, err := store.MemberCount(ctx, game, code); err != nil || players != 0 || spectators != 0 {
+		t.Fatalf("expected an empty lobby, got %d and %d (%v)", players, spectators, err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := store.JoinLobby(ctx, game, code, id, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"s", "t"} {
+		if _, err := store.JoinLobby(ctx, game, code, id, RoleSpectator); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"b", "t"} {
+		if _, err := store.LeaveLobby(ctx, game, code, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if players, spectators, err := store.MemberCount(ctx, game, code); err != nil || players != 2 || spectators != 1 {
+		t.Fatalf("expected 2 players and 1 spectator, got %d and %d (%v)", players, spectators, err)
+	}
+	if _, _, err := store.MemberCount(ctx, game, game[:8]+"x"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCountActiveLobbies(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	for _, code := range []string{"a", "b", "empty"} {
+		if err := store.CreateLobby(ctx, game, game[:8]+code, "a", LobbyOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if code != "empty" {
+			if _, err := store.JoinLobby(ctx, game, game[:8]+code, "a", RolePlayer); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if count, err := store.CountActiveLobbies(ctx, game); err != nil || count != 2 {
+		t.Fatalf("expected 2 active lobbies, got %d (%v)", count, err)
+	}
+	if count, err := store.CountActiveLobbies(ctx, testGame(t)); err != nil || count != 0 {
+		t.Fatalf("expected no lobbies of another game, got %d (%v)", count, err)
+	}
+}
+
+func TestSetLobbyVisibility(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "v"
+
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := store.JoinLobby(ctx, game, code, id, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.SetLobbyVisibility(ctx, game, code, "b", true); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+	if _, err := store.SetLobbyVisibility(ctx, game, game[:8]+"x", "a", true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	peers, err := store.SetLobbyVisibility(ctx, game, code, "a", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("expected the peers of the lobby, got %v", peers)
+	}
+	if lobbies, err := store.ListLobbies(ctx, game, ListOptions{}); err != nil || len(lobbies) != 1 {
+		t.Fatalf("expected the public lobby to be listed, got %+v %v", lobbies, err)
+	}
+
+	// Private lobbies can still be found by their code.
+	if _, err := store.SetLobbyVisibility(ctx, game, code, "a", false); err != nil {
+		t.Fatal(err)
+	}
+	if lobbies, err := store.ListLobbies(ctx, game, ListOptions{}); err != nil || len(lobbies) != 0 {
+		t.Fatalf("expected the private lobby not to be listed, got %+v %v", lobbies, err)
+	}
+	if lobby, err := store.GetLobbyInfo(ctx, game, code); err != nil || lobby.Public {
+		t.Fatalf("expected the private lobby, got %+v %v", lobby, err)
+	}
+}
+
+func TestUpdateLobbyKVAuthorization(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "kv"
+
+	if err := store.CreateLobby(ctx, game, code, "leader", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"leader", "member"} {
+		if _, err := store.JoinLobby(ctx, game, code, id, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	increment := KVUpdate{Op: KVIncrement, Key: "votes", By: 1}
+	if _, _, err := store.UpdateLobbyKV(ctx, game, code, "stranger", increment); err != ErrNotInLobby {
+		t.Fatalf("expected ErrNotInLobby for a non-member, got %v", err)
+	}
+	leaderKey := KVUpdate{Op: KVSet, Key: LeaderKeyPrefix + "round", Value: []byte(`2`)}
+	if _, _, err := store.UpdateLobbyKV(ctx, game, code, "member", leaderKey); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader for a member writing a leader key, got %v", err)
+	}
+	if _, _, err := store.UpdateLobbyKV(ctx, game, code, "leader", leaderKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent increments are never lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := store.UpdateLobbyKV(ctx, game, code, "member", increment); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	kv, err := store.GetLobbyKV(ctx, game, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kv["votes"]) != "10" || string(kv[LeaderKeyPrefix+"round"]) != "2" {
+		t.Fatalf("unexpected values %v", kv)
+	}
+}
+
+func TestUpdateLobbyCustomDataVersions(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "cd"
+
+	if err := store.CreateLobby(ctx, game, code, "leader", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"leader", "member"} {
+		if _, err := store.JoinLobby(ctx, game, code, id, RolePlayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := store.UpdateLobbyCustomData(ctx, game, code, "member", map[string]any{"map": "city"}, 0); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader for a member, got %v", err)
+	}
+	for i, patch := range []map[string]any{{"map": "desert", "mode": "ffa"}, {"mode": nil}} {
+		version, _, err := store.UpdateLobbyCustomData(ctx, game, code, "leader", patch, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != int64(i+1) {
+			t.Fatalf("expected version %d, got %d", i+1, version)
+		}
+	}
+	if _, _, err := store.UpdateLobbyCustomData(ctx, game, code, "leader", map[string]any{"name": "a long name"}, 20); !errors.Is(err, ErrCustomDataTooLarge) {
+		t.Fatalf("expected ErrCustomDataTooLarge, got %v", err)
+	}
+
+	data, version, err := store.GetLobbyCustomData(ctx, game, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || len(data) != 1 || data["map"] != "desert" {
+		t.Fatalf("unexpected custom data %v at version %d", data, version)
+	}
+}
+
+func TestLockLobbyContention(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	// Goroutines on a pool behave like separate nodes, every critical section
+	// runs in its own transaction.
+	var mutex sync.Mutex
+	holders, overlaps, entered := 0, 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.LockLobby(ctx, game, "lobby", 10*time.Second, func(context.Context) error {
+				mutex.Lock()
+				holders++
+				entered++
+				if holders > 1 {
+					overlaps++
+				}
+				mutex.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mutex.Lock()
+				holders--
+				mutex.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if overlaps != 0 || entered != 8 {
+		t.Fatalf("expected 8 serialized critical sections, got %d with %d overlaps", entered, overlaps)
+	}
+
+	err := store.LockLobby(ctx, game, "lobby", time.Minute, func(ctx context.Context) error {
+		// Locking the same lobby again is reentrant, other lobbies aren't blocked.
+		if err := store.LockLobby(ctx, game, "lobby", time.Minute, func(context.Context) error { return nil }); err != nil {
+			return err
+		}
+		if err := store.LockLobby(context.Background(), game, "other", time.Minute, func(context.Context) error { return nil }); err != nil {
+			return err
+		}
+
+		// A waiter gives up when its context is done.
+		tctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := store.LockLobby(tctx, game, "lobby", time.Minute, func(context.Context) error { return nil }); err == nil {
+			t.Error("expected waiting for a held lock to time out")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockLobbyTransaction(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	if err := store.CreateLobby(ctx, game, "lobby", "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, "lobby", "b", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing critical section changes nothing.
+	failed := errors.New("failed")
+	err := store.LockLobby(ctx, game, "lobby", time.Minute, func(ctx context.Context) error {
+		if _, err := store.LeaveLobby(ctx, game, "lobby", "b"); err != nil {
+			return err
+		}
+		peers, err := store.GetLobby(ctx, game, "lobby")
+		if err != nil {
+			return err
+		}
+		if len(peers) != 1 {
+			t.Errorf("expected the section to see its own changes, got %v", peers)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("expected the error of the section, got %v", err)
+	}
+	peers, err := store.GetLobby(ctx, game, "lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("expected the leave to be rolled back, got %v", peers)
+	}
+}
+
+func TestLockLobbyExpires(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	// A holder that hangs without touching the database.
+	held := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	go store.LockLobby(ctx, game, "lobby", 200*time.Millisecond, func(context.Context) error { //nolint:errcheck
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := store.LockLobby(tctx, game, "lobby", time.Minute, func(context.Context) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("expected to wait for the ttl, waited %s", waited)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	err := store.AppendEvents(ctx, []Event{
+		{Time: now.Add(-2 * time.Hour), Game: game, Category: "lobby", Action: "create", Peer: "a"},
+		{Time: now.Add(-time.Minute), Game: game, Category: "lobby", Action: "join", Peer: "b", Data: map[string]string{"edge": "ams"}},
+		{Time: now, Game: game, Category: "connection", Action: "result", Peer: "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.QueryEvents(ctx, EventQuery{Game: game, Category: "lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Action != "join" || events[0].Data["edge"] != "ams" || events[1].Action != "create" {
+		t.Fatalf("expected the lobby events newest first, got %+v", events)
+	}
+	events, err = store.QueryEvents(ctx, EventQuery{Game: game, Since: now.Add(-time.Hour), Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != "result" {
+		t.Fatalf("expected only the newest event, got %+v", events)
+	}
+
+	// Events of other tests can be pruned as well, only check this game.
+	if _, err := store.PruneEvents(ctx, now.Add(-time.Hour), 1000); err != nil {
+		t.Fatal(err)
+	}
+	events, err = store.QueryEvents(ctx, EventQuery{Game: game})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected the old event to be pruned, got %+v", events)
+	}
+}
+
+func TestGetGameStats(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	// A full public lobby, an open public lobby and a private lobby.
+	lobbies := []struct {
+		code       string
+		maxPlayers int
+		peers      []string
+		public     bool
+	}{
+		{game[:8] + "f", 2, []string{"a", "b"}, true},
+		{game[:8] + "o", 4, []string{"c"}, true},
+		{game[:8] + "p", 0, []string{"d", "e"}, false},
+	}
+	for _, l := range lobbies {
+		if err := store.CreateLobby(ctx, game, l.code, l.peers[0], LobbyOptions{MaxPlayers: l.maxPlayers}); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range l.peers {
+			if _, err := store.JoinLobby(ctx, game, l.code, id, RolePlayer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := store.SetLobbyVisibility(ctx, game, l.code, l.peers[0], l.public); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := store.GetGameStats(ctx, game)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Players != 5 || stats.PublicLobbies != 2 || stats.JoinableLobbies != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLobbyLimits(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	limits := LobbyLimits{PacketRate: 50, Negotiations: 20}
+	if err := store.CreateLobby(ctx, game, game[:8]+"l", "a", LobbyOptions{Limits: limits}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateLobby(ctx, game, game[:8]+"n", "b", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetLobbyLimits(ctx, game, game[:8]+"l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != limits {
+		t.Fatalf("expected %+v, got %+v", limits, got)
+	}
+	if got, err := store.GetLobbyLimits(ctx, game, game[:8]+"n"); err != nil || got != (LobbyLimits{}) {
+		t.Fatalf("expected no limits, got %+v (%v)", got, err)
+	}
+	if _, err := store.GetLobbyLimits(ctx, game, game[:8]+"x"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestLobbyCodesCaseSensitive makes sure codes are matched exactly, codes
+// are folded before they reach the store when they're case insensitive.
+func TestLobbyCodesCaseSensitive(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	upper, lower := "C"+game[:8], "c"+game[:8]
+	if err := store.CreateLobby(ctx, game, upper, "a", LobbyOptions{MaxPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateLobby(ctx, game, lower, "b", LobbyOptions{MaxPlayers: 3}); err != nil {
+		t.Fatalf("expected a lobby whose code only differs in case to be created, got %v", err)
+	}
+	for code, maxPlayers := range map[string]int{upper: 2, lower: 3} {
+		lobby, err := store.GetLobbyInfo(ctx, game, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lobby.Code != code || lobby.MaxPlayers != maxPlayers {
+			t.Fatalf("expected lobby %s for %d players, got %+v", code, maxPlayers, lobby)
+		}
+	}
+}
+
+func TestLobbyClosure(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	start := time.Now().Add(-time.Second)
+
+	scheduled, open := game[:8]+"s", game[:8]+"o"
+	if err := store.CreateLobby(ctx, game, scheduled, "a", LobbyOptions{CloseAt: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateLobby(ctx, game, open, "b", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CloseScheduledLobbies(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if closed, reason, err := store.GetLobbyClosure(ctx, game, scheduled, start); err != nil || !closed || reason != CloseReasonScheduled {
+		t.Fatalf("expected the scheduled lobby to be closed, got %v %q (%v)", closed, reason, err)
+	}
+	if closed, _, err := store.GetLobbyClosure(ctx, game, open, start); err != nil || closed {
+		t.Fatalf("expected the open lobby not to be closed, got %v (%v)", closed, err)
+	}
+	if closed, reason, err := store.GetLobbyClosure(ctx, game, game[:8]+"x", start); err != nil || !closed || reason != "" {
+		t.Fatalf("expected an unknown lobby to be closed without reason, got %v %q (%v)", closed, reason, err)
+	}
+
+	// Once forgotten the reason isn't known anymore.
+	if _, err := store.PruneClosedLobbies(ctx, time.Now().Add(time.Minute), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if closed, reason, err := store.GetLobbyClosure(ctx, game, scheduled, start); err != nil || !closed || reason != "" {
+		t.Fatalf("expected a pruned lobby to be closed without reason, got %v %q (%v)", closed, reason, err)
+	}
+}
+
+func TestPlayers(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "p"
+
+	// Two sessions of the same player, and another player.
+	if err := store.SetPlayer(ctx, game, "a", "player-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPlayer(ctx, game, "b", "player-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPlayer(ctx, game, "c", "player-2"); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := store.GetPlayerPeers(ctx, game, "player-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0] != "a" || peers[1] != "b" {
+		t.Fatalf("expected both sessions of the player, got %v", peers)
+	}
+
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "c", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "d", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	members, err := store.GetMembers(ctx, game, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members.Players) != 2 || members.Players["a"] != "player-1" || members.Players["c"] != "player-2" {
+		t.Fatalf("expected the players of the members without one for d, got %v", members.Players)
+	}
+}
+
+func TestReconnectSessionLifetime(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	peer := game[:8] + "l"
+	started := time.Now().Add(-2 * time.Hour)
+
+	if err := store.TimeoutPeer(ctx, peer, "secret", game, nil, started); err != nil {
+		t.Fatal(err)
+	}
+	// The secret is valid but the session is older than allowed.
+	if _, _, _, err := store.ReconnectPeer(ctx, peer, "secret", game, time.Now().Add(-time.Hour)); err != ErrSessionExpired {
+		t.Fatalf("expected the session to be expired, got %v", err)
+	}
+	if reconnected, _, _, err := store.ReconnectPeer(ctx, peer, "guess", game, time.Now().Add(-time.Hour)); err != nil || reconnected {
+		t.Fatalf("expected a wrong secret not to reconnect, got %v (%v)", reconnected, err)
+	}
+
+	// The timeout is kept, so the peer still times out, without a cap it reconnects.
+	reconnected, startedAt, _, err := store.ReconnectPeer(ctx, peer, "secret", game, time.Time{})
+	if err != nil || !reconnected {
+		t.Fatalf("expected the peer to reconnect without a cap, got %v (%v)", reconnected, err)
+	}
+	if startedAt.Sub(started).Abs() > time.Second {
+		t.Fatalf("expected the session to have started at %s, got %s", started, startedAt)
+	}
+}
+
+func TestMarkReconnectingPeers(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	brief, long := game[:8]+"b", game[:8]+"l"
+
+	// Other tests have timeouts too, only the peers of this one count.
+	marked := func(window time.Duration) map[string][]string {
+		peers := map[string][]string{}
+		err := store.MarkReconnectingPeers(ctx, window, func(peerID, gameID string, lobbies []string) {
+			if gameID == game {
+				peers[peerID] = lobbies
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peers
+	}
+
+	// A peer back within the window was never announced as reconnecting.
+	if err := store.TimeoutPeer(ctx, brief, "secret", game, []string{"lobby"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := marked(time.Hour); len(got) != 0 {
+		t.Fatalf("expected no peers outside the window, got %v", got)
+	}
+	if reconnected, _, notified, err := store.ReconnectPeer(ctx, brief, "secret", game, time.Time{}); err != nil || !reconnected || len(notified) != 0 {
+		t.Fatalf("expected a seamless reconnect, got %v %v (%v)", reconnected, notified, err)
+	}
+
+	if err := store.TimeoutPeer(ctx, long, "secret", game, []string{"lobby"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got := marked(time.Millisecond); len(got) != 1 || len(got[long]) != 1 || got[long][0] != "lobby" {
+		t.Fatalf("expected the peer to be marked in its lobby, got %v", got)
+	}
+	if got := marked(time.Millisecond); len(got) != 0 {
+		t.Fatalf("expected peers to be marked once, got %v", got)
+	}
+	if reconnected, _, notified, err := store.ReconnectPeer(ctx, long, "secret", game, time.Time{}); err != nil || !reconnected || len(notified) != 1 || notified[0] != "lobby" {
+		t.Fatalf("expected the lobby to be told about the reconnect, got %v %v (%v)", reconnected, notified, err)
+	}
+}
+
+func TestReplicaFallsBackToPrimary(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "r"
+
+	pg := store.(*PostgresStore)
+	replica, err := pgxpool.NewWithConfig(ctx, pg.DB.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica.Close() // A replica that's down.
+	pg.Replica = replica
+	t.Cleanup(func() { pg.Replica = nil })
+
+	if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.JoinLobby(ctx, game, code, "a", RolePlayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetLobbyVisibility(ctx, game, code, "a", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if lobby, err := store.GetLobbyInfo(ctx, game, code); err != nil || lobby.PlayerCount != 1 {
+		t.Fatalf("expected the lobby from the primary, got %+v %v", lobby, err)
+	}
+	if count, _, err := store.MemberCount(ctx, game, code); err != nil || count != 1 {
+		t.Fatalf("expected 1 member, got %d %v", count, err)
+	}
+	if lobbies, err := store.ListLobbies(ctx, game, ListOptions{}); err != nil || len(lobbies) != 1 {
+		t.Fatalf("expected the lobby to be listed, got %+v %v", lobbies, err)
+	}
+	if _, err := store.GetLobbyInfo(ctx, game, game[:8]+"x"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestListLobbiesHideFull(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	// Lobby r is only full counting the slot reserved by a matchmaker.
+	for _, lobby := range []struct {
+		code         string
+		max, members int
+	}{
+		{"full", 2, 2},
+		{"open", 2, 1},
+		{"r", 3, 2},
+		{"unlimited", 0, 2},
+	} {
+		code := game[:8] + lobby.code
+		if err := store.CreateLobby(ctx, game, code, "p0", LobbyOptions{MaxPlayers: lobby.max}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < lobby.members; i++ {
+			if _, err := store.JoinLobby(ctx, game, code, fmt.Sprintf("p%d", i), RolePlayer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := store.SetLobbyVisibility(ctx, game, code, "p0", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, err := store.ReserveSlot(ctx, game, "matchmaker", 3, 0, time.Minute); err != nil || code != game[:8]+"r" {
+		t.Fatalf("expected a slot in r, got %q (%v)", code, err)
+	}
+
+	listed := func(hideFull bool) map[string]bool {
+		lobbies, err := store.ListLobbies(ctx, game, ListOptions{HideFull: hideFull})
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := map[string]bool{}
+		for _, lobby := range lobbies {
+			codes[lobby.Code[8:]] = true
+		}
+		return codes
+	}
+	if got := listed(false); len(got) != 4 {
+		t.Fatalf("expected all lobbies, got %v", got)
+	}
+	if got := listed(true); len(got) != 2 || !got["open"] || !got["unlimited"] {
+		t.Fatalf("expected only the lobbies with room, got %v", got)
+	}
+}
+
+func TestListLobbiesSort(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	// Created in order, so a is the oldest.
+	for i, code := range []string{"a", "b", "c"} {
+		code = game[:8] + code
+		if err := store.CreateLobby(ctx, game, code, "p0", LobbyOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j <= (i+1)%3; j++ {
+			if _, err := store.JoinLobby(ctx, game, code, fmt.Sprintf("p%d", j), RolePlayer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := store.SetLobbyVisibility(ctx, game, code, "p0", true); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	order := func(sort LobbySort) string {
+		lobbies, err := store.ListLobbies(ctx, game, ListOptions{Sort: sort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := ""
+		for _, lobby := range lobbies {
+			codes += lobby.Code[8:]
+		}
+		return codes
+	}
+	if got := order(LobbySort{}); got != "cba" {
+		t.Fatalf("expected the newest first, got %q", got)
+	}
+	if got := order(LobbySort{Field: SortPlayerCount}); got != "bac" {
+		t.Fatalf("expected the fullest first, got %q", got)
+	}
+	if got := order(LobbySort{Field: SortPlayerCount, Ascending: true}); got != "cab" {
+		t.Fatalf("expected the emptiest first, got %q", got)
+	}
+	if got := order(LobbySort{Field: SortMeta, MetaKey: "rating"}); got != "cba" {
+		t.Fatalf("expected lobbies without the field in the default order, got %q", got)
+	}
+}
+
+func TestTickets(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	for _, ticket := range []Ticket{
+		{ID: game[:8] + "t1", Game: game, Peer: "a", Skill: 10, MaxPlayers: 2, Preferences: map[string]string{"region": "eu"}},
+		{ID: game[:8] + "t2", Game: game, Peer: "b", Skill: 20, MaxPlayers: 2},
+		{ID: game[:8] + "t3", Game: game, Peer: "a", Skill: 10, MaxPlayers: 3},
+		{ID: game[:8] + "t4", Game: game, Peer: "c", Skill: 30, MaxPlayers: 2},
+	} {
+		if _, err := store.EnqueueTicket(ctx, ticket, time.Minute, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.EnqueueTicket(ctx, Ticket{ID: game[:8] + "t5", Game: game, Peer: "d", MaxPlayers: 2}, -time.Second, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CancelTicket(ctx, game, "b", game[:8]+"t4"); err != ErrTicketNotFound {
+		t.Fatalf("expected only c to cancel its ticket, got %v", err)
+	}
+	if err := store.CancelTicket(ctx, game, "c", game[:8]+"t4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other tests might have tickets as well, only match the ones of this game.
+	var seen []string
+	err := store.MatchTickets(ctx, 1000, func(_ context.Context, tickets []Ticket) ([]Ticket, error) {
+		var matched []Ticket
+		for _, ticket := range tickets {
+			if ticket.Game != game {
+				continue
+			}
+			seen = append(seen, ticket.ID)
+			if ticket.ID == game[:8]+"t1" {
+				if ticket.Preferences["region"] != "eu" {
+					t.Errorf("expected the preferences of the ticket, got %v", ticket.Preferences)
+				}
+				matched = append(matched, ticket)
+			}
+		}
+		return matched, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{game[:8] + "t1", game[:8] + "t2", game[:8] + "t3"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("expected the unexpired tickets oldest first %v, got %v", expected, seen)
+	}
+
+	// The other ticket of a is gone with the matched one.
+	if err := store.CancelTicket(ctx, game, "a", game[:8]+"t3"); err != ErrTicketNotFound {
+		t.Fatalf("expected the other ticket of a to be removed, got %v", err)
+	}
+	if err := store.CancelTicket(ctx, game, "b", game[:8]+"t2"); err != nil {
+		t.Fatalf("expected the ticket of b to be waiting, got %v", err)
+	}
+
+	expired, err := store.ExpireTickets(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, ticket := range expired {
+		found = found || ticket.ID == game[:8]+"t5"
+	}
+	if !found {
+		t.Fatalf("expected the ticket of d to expire, got %+v", expired)
+	}
+}
+
+func TestMatchTicketsRollsBack(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	code := game[:8] + "m"
+
+	if _, err := store.EnqueueTicket(ctx, Ticket{ID: game[:8] + "t1", Game: game, Peer: "a", MaxPlayers: 2}, time.Minute, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lobby created while matching is rolled back when the match fails.
+	failed := errors.New("failed")
+	err := store.MatchTickets(ctx, 1000, func(ctx context.Context, tickets []Ticket) ([]Ticket, error) {
+		if err := store.CreateLobby(ctx, game, code, "a", LobbyOptions{}); err != nil {
+			return nil, err
+		}
+		return tickets, failed
+	})
+	if err != failed {
+		t.Fatalf("expected the error of the match, got %v", err)
+	}
+	if _, err := store.GetLobby(ctx, game, code); err != ErrNotFound {
+		t.Fatalf("expected the lobby to be rolled back, got %v", err)
+	}
+	if err := store.CancelTicket(ctx, game, "a", game[:8]+"t1"); err != nil {
+		t.Fatalf("expected the ticket to be waiting, got %v", err)
+	}
+}
+
+func TestTicketLimit(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	// An expired ticket doesn't count towards the limit.
+	if _, err := store.EnqueueTicket(ctx, Ticket{ID: game[:8] + "t1", Game: game, Peer: "a", MaxPlayers: 2}, -time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.EnqueueTicket(ctx, Ticket{ID: game[:8] + "t2", Game: game, Peer: "a", MaxPlayers: 2}, time.Minute, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.EnqueueTicket(ctx, Ticket{ID: game[:8] + "t3", Game: game, Peer: "a", MaxPlayers: 2}, time.Minute, 1); err != ErrTicketLimit {
+		t.Fatalf("expected ErrTicketLimit, got %v", err)
+	}
+
+	// Only one of the concurrent tickets of b fits.
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	enqueued := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.EnqueueTicket(ctx, Ticket{ID: fmt.Sprintf("%sb%d", game[:8], i), Game: game, Peer: "b", MaxPlayers: 2}, time.Minute, 1)
+			if err == nil {
+				mutex.Lock()
+				enqueued++
+				mutex.Unlock()
+			} else if err != ErrTicketLimit {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if enqueued != 1 {
+		t.Fatalf("expected a single ticket of b, got %d", enqueued)
+	}
+
+	cancelled, err := store.CancelPeerTickets(ctx, game, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The expired ticket might already be removed by another test.
+	if cancelled < 1 || cancelled > 2 {
+		t.Fatalf("expected the tickets of a to be cancelled, got %d", cancelled)
+	}
+	if _, err := store.EnqueueTicket(ctx, Ticket{ID: game[:8] + "t4", Game: game, Peer: "a", MaxPlayers: 2}, time.Minute, 1); err != nil {
+		t.Fatalf("expected a to enqueue again after its tickets were cancelled, got %v", err)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+
+	// Two sessions of the same player.
+	for _, peer := range []string{"a", "b"} {
+		if err := store.SetPlayer(ctx, game, peer, "player-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	presence, err := store.GetPresence(ctx, game, []string{"player-1", "player-2"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presence) != 1 || presence["player-1"].Online {
+		t.Fatalf("expected only the known player, offline, got %+v", presence)
+	}
+
+	if err := store.CreateLobby(ctx, game, "lobby", "a", LobbyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetLobbyVisibility(ctx, game, "lobby", "a", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPresence(ctx, game, "a", true, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetPresence(ctx, game, "b", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	presence, err = store.GetPresence(ctx, game, []string{"player-1"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := presence["player-1"]
+	if !current.Online || current.Lobby != "lobby" {
+		t.Fatalf("expected the online session to represent the player, got %+v", current)
+	}
+
+	// Private lobbies aren't shared.
+	if _, err := store.SetLobbyVisibility(ctx, game, "lobby", "a", false); err != nil {
+		t.Fatal(err)
+	}
+	presence, err = store.GetPresence(ctx, game, []string{"player-1"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !presence["player-1"].Online || presence["player-1"].Lobby != "" {
+		t.Fatalf("expected the private lobby to be left out, got %+v", presence["player-1"])
+	}
+
+	// Presence that wasn't updated since onlineAfter was left behind.
+	presence, err = store.GetPresence(ctx, game, []string{"player-1"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presence["player-1"].Online {
+		t.Fatalf("expected stale presence to be offline, got %+v", presence["player-1"])
+	}
+
+	if err := store.SetPresence(ctx, game, "a", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	presence, err = store.GetPresence(ctx, game, []string{"player-1"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presence["player-1"].Online || !presence["player-1"].UpdatedAt.After(current.UpdatedAt) {
+		t.Fatalf("expected the player to go offline after %s, got %+v", current.UpdatedAt, presence["player-1"])
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	store, ctx, game := testLobbies(t)
+	pg, ok := store.(*PostgresStore)
+	if !ok {
+		t.Skip("not a postgres store")
+	}
+
+	// Nodes with their own limiter share the budget of the key.
+	a, b := pg.RateLimiter(game, 2, time.Hour), pg.RateLimiter(game, 2, time.Hour)
+	if remaining, err := a.Allow(ctx); err != nil || remaining != 1 {
+		t.Fatalf("expected 1 remaining, got %d (%v)", remaining, err)
+	}
+	if remaining, err := b.Allow(ctx); err != nil || remaining != 0 {
+		t.Fatalf("expected 0 remaining, got %d (%v)", remaining, err)
+	}
+	if _, err := a.Allow(ctx); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Fatalf("expected ErrLimited, got %v", err)
+	}
+	if _, err := pg.RateLimiter(game+"-other", 2, time.Hour).Allow(ctx); err != nil {
+		t.Fatalf("expected other keys to have their own budget, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/poki/netlib/internal/ratelimit"
+	"github.com/poki/netlib/internal/util"
+)
+
+// PostgresRateLimiter is a fixed window ratelimit.Limiter shared by all
+// nodes using the same database.
+type PostgresRateLimiter struct {
+	store  *PostgresStore
+	key    string
+	limit  int
+	window time.Duration
+}
+
+func (s *PostgresStore) RateLimiter(key string, limit int, window time.Duration) *PostgresRateLimiter {
+	return &PostgresRateLimiter{
+		store:  s,
+		key:    key,
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (l *PostgresRateLimiter) Allow(ctx context.Context) (int, error) {
+	now := util.Now(ctx)
+	windowStart := now.Truncate(l.window)
+
+	var count int
+	err := l.store.DB.QueryRow(ctx, `
+		INSERT INTO rate_limits (key, window_start, count, expires_at)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (key, window_start) DO UPDATE
+		SET count = rate_limits.count + 1
+		WHERE rate_limits.count < $4
+		RETURNING count
+	`, l.key, windowStart, windowStart.Add(l.window), l.limit).Scan(&count)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ratelimit.ErrLimited
+		}
+		return 0, err
+	}
+
+	if count == 1 {
+		// First event of a new window, clean up the old ones.
+		_, _ = l.store.DB.Exec(ctx, `DELETE FROM rate_limits WHERE key = $1 AND expires_at < $2`, l.key, now)
+	}
+	return l.limit - count, nil
+}
@@ -0,0 +1,37 @@
+package stores
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/koenbollen/logging"
+	"go.uber.org/zap"
+)
+
+// querier is what the read-only queries need, implemented by both the
+// primary and the replica pool.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// fromReplica runs query against PostgresStore.Replica when there is one. The
+// replica can lag behind, so when it fails or doesn't know the lobby (yet) the
+// query is repeated on the primary, a lobby that was just created is still
+// found that way. Other results can be slightly stale, only use it for
+// browsing queries whose results aren't written back.
+func fromReplica[T any](ctx context.Context, s *PostgresStore, query func(querier) (T, error)) (T, error) {
+	if s.Replica == nil {
+		return query(s.db(ctx))
+	}
+	v, err := query(s.Replica)
+	if err == nil || ctx.Err() != nil {
+		return v, err
+	}
+	if !errors.Is(err, ErrNotFound) {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("replica query failed, using the primary", zap.Error(err))
+	}
+	return query(s.db(ctx))
+}
@@ -7,9 +7,10 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/koenbollen/logging"
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
-	"github.com/poki/netlib/migrations"
+	"go.uber.org/zap"
 )
 
 func FromEnv(ctx context.Context) (Store, chan struct{}, error) {
@@ -18,13 +19,18 @@ func FromEnv(ctx context.Context) (Store, chan struct{}, error) {
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to connect: %w", err)
 		}
-		if err := migrations.Up(db.Config().ConnConfig); err != nil {
-			return nil, nil, fmt.Errorf("failed to migrate: %w", err)
-		}
 		store, err := NewPostgresStore(ctx, db)
 		if err != nil {
 			return nil, nil, err
 		}
+		if url, ok := os.LookupEnv("DATABASE_REPLICA_URL"); ok && url != "" {
+			if store.Replica, err = pgxpool.New(ctx, url); err != nil {
+				return nil, nil, fmt.Errorf("failed to connect to replica: %w", err)
+			}
+		}
+		if err := migrate(ctx, store); err != nil {
+			return nil, nil, err
+		}
 		return store, nil, nil
 
 	} else if _, hasDocker := os.LookupEnv("DOCKER_HOST"); hasDocker {
@@ -75,15 +81,42 @@ func FromEnv(ctx context.Context) (Store, chan struct{}, error) {
 			return nil, nil, err
 		}
 
-		if err := migrations.Up(db.Config().ConnConfig); err != nil {
-			return nil, nil, fmt.Errorf("failed to migrate: %w", err)
-		}
-
 		store, err := NewPostgresStore(ctx, db)
 		if err != nil {
 			return nil, nil, err
 		}
+		if err := migrate(ctx, store); err != nil {
+			return nil, nil, err
+		}
 		return store, flushed, nil
 	}
 	return nil, nil, fmt.Errorf("no database configured expost DATABASE_URL or DOCKER_HOST to run locally")
 }
+
+// MigrationsDryRun reports whether MIGRATIONS_DRY_RUN is set, FromEnv then
+// only logs the pending migrations and the server should exit after it.
+func MigrationsDryRun() bool {
+	_, dryRun := os.LookupEnv("MIGRATIONS_DRY_RUN")
+	return dryRun
+}
+
+// migrate applies the pending migrations, or only logs them when
+// MIGRATIONS_DRY_RUN is set.
+func migrate(ctx context.Context, store *PostgresStore) error {
+	logger := logging.GetLogger(ctx)
+	pending, err := store.PendingMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list pending migrations: %w", err)
+	}
+	if MigrationsDryRun() {
+		logger.Info("migrations dry run, not applying", zap.Uints("pending", pending))
+		return nil
+	}
+	if len(pending) > 0 {
+		logger.Info("applying migrations", zap.Uints("pending", pending))
+	}
+	if err := store.Migrate(ctx); err != nil {
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+	return nil
+}
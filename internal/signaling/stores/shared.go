@@ -2,56 +2,373 @@ package stores
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"time"
+
+	"github.com/poki/netlib/internal/util"
 )
 
-var ErrAlreadyInLobby = errors.New("peer already in lobby")
-var ErrLobbyExists = errors.New("lobby already exists")
-var ErrNotFound = errors.New("lobby not found")
-var ErrNoSuchTopic = errors.New("no such topic")
-var ErrInvalidLobbyCode = errors.New("invalid lobby code")
-var ErrInvalidPeerID = errors.New("invalid peer id")
+var ErrAlreadyInLobby = util.NewError("already-in-lobby", "peer already in lobby")
+var ErrLobbyExists = util.NewError("lobby-exists", "lobby already exists")
+var ErrNotFound = util.NewError("lobby-not-found", "lobby not found")
+var ErrNoSuchTopic = util.NewError("no-such-topic", "no such topic")
+var ErrInvalidLobbyCode = util.NewError("invalid-lobby-code", "invalid lobby code")
+var ErrInvalidPeerID = util.NewError("invalid-peer-id", "invalid peer id")
+var ErrNotLeader = util.NewError("not-leader", "peer is not the leader of the lobby")
+var ErrLobbyFull = util.NewError("lobby-full", "lobby is full")
+var ErrSpectatorsFull = util.NewError("spectators-full", "lobby has no room for more spectators")
+var ErrNotPlayer = util.NewError("not-a-player", "peer is a spectator of the lobby")
+var ErrAlreadyStarted = util.NewError("already-started", "lobby already started")
+var ErrNotInLobby = util.NewError("peer-not-in-lobby", "peer is not in the lobby")
+var ErrInvalidInvite = util.NewError("invalid-invite", "invite is invalid, expired or exhausted")
+var ErrLobbyNotJoinable = util.NewError("lobby-not-joinable", "lobby doesn't accept new peers")
+var ErrSessionExpired = util.NewError("session-expired", "session is too old to reconnect")
+
+// The states of a lobby, only waiting lobbies can be joined. A lobby is
+// started by the start packet and the leader can close or reopen it.
+const (
+	LobbyStateWaiting = "waiting"
+	LobbyStateStarted = "started"
+	LobbyStateClosed  = "closed"
+)
+
+// Role is the role of a peer in a lobby, every role has its own capacity.
+// Spectators are members of the lobby that don't take a player slot, they
+// can't lead or start the lobby.
+type Role string
+
+const (
+	RolePlayer    Role = "player"
+	RoleSpectator Role = "spectator"
+)
 
 type SubscriptionCallback func(context.Context, []byte)
 
 type Store interface {
-	CreateLobby(ctx context.Context, game, lobby, id string) error
-	JoinLobby(ctx context.Context, game, lobby, id string) ([]string, error)
+	CreateLobby(ctx context.Context, game, lobby, id string, options LobbyOptions) error
+	// JoinLobby adds the peer to the lobby in role, it fails with
+	// ErrLobbyNotJoinable when the lobby isn't waiting and with ErrLobbyFull
+	// or ErrSpectatorsFull when the capacity of the role is taken.
+	JoinLobby(ctx context.Context, game, lobby, id string, role Role) ([]string, error)
+	// SwitchLobby moves the peer from one lobby to another in a single
+	// transaction, when joining the target fails the peer stays in from. It
+	// returns the peers left behind and the peers that were in the target.
+	// The peer joins the target as a player.
+	SwitchLobby(ctx context.Context, game, from, to, id string) (left, joined []string, err error)
 	IsPeerInLobby(ctx context.Context, game, lobby, id string) (bool, error)
 	LeaveLobby(ctx context.Context, game, lobby, id string) ([]string, error)
 	GetLobby(ctx context.Context, game, lobby string) ([]string, error)
-	ListLobbies(ctx context.Context, game, filter string) ([]Lobby, error)
+	// GetLobbyInfo returns the public state of an open (non-empty) lobby.
+	GetLobbyInfo(ctx context.Context, game, lobby string) (*Lobby, error)
+	// GetLobbyNode returns the node the lobby was created on and its
+	// endpoint, both are empty when the node didn't have an identity.
+	GetLobbyNode(ctx context.Context, game, lobby string) (node, endpoint string, err error)
+	// GetLobbyLimits returns the limits the lobby was created with.
+	GetLobbyLimits(ctx context.Context, game, lobby string) (LobbyLimits, error)
+	// MemberCount returns the number of players and spectators in the lobby
+	// without fetching them.
+	MemberCount(ctx context.Context, game, lobby string) (players, spectators int, err error)
+	// GetSeats returns the join index of every peer that ever joined the
+	// lobby. Indexes are assigned in join order and kept when a peer leaves, so
+	// a peer rejoining with the same ID gets its old index back.
+	GetSeats(ctx context.Context, game, lobby string) (map[string]int, error)
+	SetPeerData(ctx context.Context, game, lobby, id string, data map[string]any) ([]string, error)
+	GetPeerData(ctx context.Context, game, lobby string) (map[string]map[string]any, error)
+	// GetMembers returns the peers of the lobby with their peer data, their
+	// players and the version of the membership, see MembersDelta.
+	GetMembers(ctx context.Context, game, lobby string) (*Members, error)
+	// SetPeerReady updates the ready state of a peer, changed is false when the
+	// peer already had the requested state. Joins and leaves clear all ready states.
+	SetPeerReady(ctx context.Context, game, lobby, id string, ready bool) (peers, readyPeers []string, changed bool, err error)
+	ResetReady(ctx context.Context, game, lobby, id string) ([]string, error)
+	// StartLobby records the seed and start time of the lobby, only the leader
+	// can start a lobby and only once.
+	StartLobby(ctx context.Context, game, lobby, id, seed string, startedAt time.Time) ([]string, error)
+	// AutoStartLobby starts the lobby when it was created with AutoStart and is
+	// full, started is true only for the one call that started it.
+	AutoStartLobby(ctx context.Context, game, lobby, seed string, startedAt time.Time) (peers []string, started bool, err error)
+	// TransferOwnership makes to the leader of the lobby if from is its current
+	// leader and to is a player, concurrent transfers from the same leader are
+	// compare-and-swapped so only one succeeds, the others get ErrNotLeader.
+	TransferOwnership(ctx context.Context, game, lobby, from, to string) ([]string, error)
+	// LockLobby runs fn as a critical section of the lobby, serialized across
+	// all nodes. Store calls made with the context passed to fn are part of
+	// the section and are rolled back when fn fails. Waiting for the lock and
+	// running fn are bounded by ttl.
+	LockLobby(ctx context.Context, game, lobby string, ttl time.Duration, fn func(context.Context) error) error
+	ListLobbies(ctx context.Context, game string, options ListOptions) ([]Lobby, error)
+	CountActiveLobbies(ctx context.Context, game string) (int, error)
+	// GetGameStats counts the players and open lobbies of the game, it can be
+	// slightly stale.
+	GetGameStats(ctx context.Context, game string) (*GameStats, error)
+	SetLobbyVisibility(ctx context.Context, game, lobby, id string, public bool) ([]string, error)
+	// SetLobbyState closes the lobby to new peers or reopens it, reopening a
+	// started lobby allows starting it again. Only the leader can change it.
+	SetLobbyState(ctx context.Context, game, lobby, id, state string) ([]string, error)
+
+	// UpdateLobbyKV applies update to the key-value storage of the lobby and
+	// returns the new value, nil when the key was deleted. Only members can
+	// write and only the leader can write keys with LeaderKeyPrefix.
+	UpdateLobbyKV(ctx context.Context, game, lobby, id string, update KVUpdate) (value json.RawMessage, peers []string, err error)
+	GetLobbyKV(ctx context.Context, game, lobby string) (map[string]json.RawMessage, error)
+
+	// UpdateLobbyCustomData applies patch to the custom data of the lobby as
+	// a JSON merge patch and returns the new version of the custom data. Only
+	// the leader can update it and the result can be at most maxSize bytes.
+	UpdateLobbyCustomData(ctx context.Context, game, lobby, id string, patch map[string]any, maxSize int) (version int64, peers []string, err error)
+	GetLobbyCustomData(ctx context.Context, game, lobby string) (map[string]any, int64, error)
+
+	// CreateInvite stores an invite token for the lobby that can be used
+	// maxUses times until expiresAt, only the leader can create invites.
+	CreateInvite(ctx context.Context, game, lobby, id, token string, maxUses int, expiresAt time.Time) error
+	// JoinLobbyByInvite uses up one use of the invite and joins its lobby as
+	// a player like JoinLobby, the use is only taken when the join succeeds.
+	JoinLobbyByInvite(ctx context.Context, game, token, id string) (lobby string, others []string, err error)
 
+	// ReserveSlot finds a public lobby with room for maxPlayers and reserves a
+	// slot in it for ttl, the reservation is consumed by JoinLobby. At most
+	// limit lobbies are considered, the fullest first, zero considers all.
+	ReserveSlot(ctx context.Context, game, id string, maxPlayers, limit int, ttl time.Duration) (string, error)
+	ReleaseSlot(ctx context.Context, game, id string) error
+
+	// EnqueueTicket stores the matchmaking ticket until it's matched or ttl
+	// passed, it returns when the ticket expires. ErrTicketLimit when the
+	// peer already has max tickets that didn't expire.
+	EnqueueTicket(ctx context.Context, ticket Ticket, ttl time.Duration, max int) (time.Time, error)
+	// CancelTicket removes a ticket of the peer, ErrTicketNotFound when it
+	// doesn't have the ticket (anymore).
+	CancelTicket(ctx context.Context, game, id, ticket string) error
+	// CancelPeerTickets removes all tickets of the peer and returns how many
+	// it had.
+	CancelPeerTickets(ctx context.Context, game, id string) (int, error)
+	// MatchTickets claims at most limit unexpired tickets, the oldest first,
+	// and passes them to match. Tickets claimed by a concurrent call are
+	// skipped so every ticket is only matched on a single node. All tickets
+	// of the peers of the tickets match returns are removed when it succeeds.
+	// Store calls made with the context passed to match run in the same
+	// transaction, so an error rolls back the lobbies it created as well.
+	MatchTickets(ctx context.Context, limit int, match func(ctx context.Context, tickets []Ticket) ([]Ticket, error)) error
+	// ExpireTickets removes at most limit tickets that expired, every ticket
+	// is only returned to a single caller.
+	ExpireTickets(ctx context.Context, limit int) ([]Ticket, error)
+
+	// Subscribe calls callback with the messages published to topic until ctx
+	// is done, one at a time and in the order they were published.
 	Subscribe(ctx context.Context, topic string, callback SubscriptionCallback)
 	Publish(ctx context.Context, topic string, data []byte) error
 
-	TimeoutPeer(ctx context.Context, peerID, secret, gameID string, lobbies []string) error
-	ReconnectPeer(ctx context.Context, peerID, secret, gameID string) (bool, error)
+	// TimeoutPeer starts the disconnect threshold of the peer, sessionStartedAt
+	// is when its session started and is returned by ReconnectPeer.
+	TimeoutPeer(ctx context.Context, peerID, secret, gameID string, lobbies []string, sessionStartedAt time.Time) error
+	// PruneStaleLobbies removes at most limit lobbies without activity for
+	// staleAfter that have no peers in their disconnect grace window, and
+	// other expired state.
+	PruneStaleLobbies(ctx context.Context, staleAfter time.Duration, limit int) ([]LobbyLifetime, error)
+	// MarkLobbyFilled records the first time the lobby reached its capacity.
+	// It returns nil when the lobby isn't full or was full before.
+	MarkLobbyFilled(ctx context.Context, game, lobby string) (*LobbyLifetime, error)
+	// MarkLobbyEmptied records the first time the last peer left the lobby.
+	// It returns nil when the lobby has peers or was empty before.
+	MarkLobbyEmptied(ctx context.Context, game, lobby string) (*LobbyLifetime, error)
+	// SetLobbyCloseAt schedules the lobby to close at closeAt, zero cancels
+	// it. Only the leader can change it, others get ErrNotLeader.
+	SetLobbyCloseAt(ctx context.Context, game, lobby, id string, closeAt time.Time) ([]string, error)
+	// CloseScheduledLobbies removes at most limit lobbies whose close time
+	// has passed and remembers them as closed with CloseReasonScheduled.
+	// Every lobby is only returned to a single caller.
+	CloseScheduledLobbies(ctx context.Context, limit int) ([]ClosedLobby, error)
+	// GetLobbyClosure reports whether a lobby is closed: it doesn't exist, or
+	// it was closed by the server after since and its code was reused. reason
+	// is why the server closed it, empty when that isn't known.
+	GetLobbyClosure(ctx context.Context, game, lobby string, since time.Time) (closed bool, reason string, err error)
+	// PruneClosedLobbies forgets at most limit closed lobbies that were closed
+	// before the given time.
+	PruneClosedLobbies(ctx context.Context, before time.Time, limit int) (int, error)
+	// SetPlayer records the durable player behind the peer, it's included in
+	// the members of the lobbies the peer is in.
+	SetPlayer(ctx context.Context, game, id, player string) error
+	// GetPlayerPeers returns the peers of the player that are still known,
+	// the oldest session first.
+	GetPlayerPeers(ctx context.Context, game, player string) ([]string, error)
+	// SetPresence records whether the peer is connected and the lobby it's
+	// in, peers without a player are ignored.
+	SetPresence(ctx context.Context, game, id string, online bool, lobby string) error
+	// GetPresence returns the presence of the players, players that were
+	// never seen are left out. Sessions that didn't record their presence
+	// since onlineAfter are offline, the lobby is only set for public lobbies.
+	GetPresence(ctx context.Context, game string, players []string, onlineAfter time.Time) (map[string]Presence, error)
+	// ReleaseLobbyCodes puts the codes of pruned lobbies in the reuse pool.
+	ReleaseLobbyCodes(ctx context.Context, codes []string) error
+	// ClaimReleasedCode takes the code released the longest ago, but at least
+	// cooldown ago, out of the reuse pool. It returns "" when there is none.
+	ClaimReleasedCode(ctx context.Context, cooldown time.Duration) (string, error)
+	// ReconnectPeer cancels the pending disconnect of the peer, notifiedLobbies
+	// are the lobbies that were told the peer is reconnecting. Sessions that
+	// started before sessionStartedAfter fail with ErrSessionExpired and keep
+	// timing out. sessionStartedAt is zero when it isn't known.
+	ReconnectPeer(ctx context.Context, peerID, secret, gameID string, sessionStartedAfter time.Time) (reconnected bool, sessionStartedAt time.Time, notifiedLobbies []string, err error)
+	// MarkReconnectingPeers calls callback once for every peer that has been
+	// disconnected for longer than window.
+	MarkReconnectingPeers(ctx context.Context, window time.Duration, callback func(peerID, gameID string, lobbies []string)) error
 	ClaimNextTimedOutPeer(ctx context.Context, threshold time.Duration, callback func(peerID, gameID string, lobbies []string) error) (bool, error)
+
+	// AppendEvents persists client analytics events, see metrics.NewStoreClient.
+	AppendEvents(ctx context.Context, events []Event) error
+	// QueryEvents returns the events matching query, the newest first.
+	QueryEvents(ctx context.Context, query EventQuery) ([]Event, error)
+	// PruneEvents removes at most limit events older than before and returns
+	// how many were removed.
+	PruneEvents(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+type LobbyOptions struct {
+	// MaxPlayers is the capacity of the lobby, 0 means unlimited.
+	MaxPlayers int
+	// MaxSpectators is the number of spectators on top of MaxPlayers, 0
+	// means the lobby can't be spectated.
+	MaxSpectators int
+	// AutoStart starts the lobby as soon as it reaches MaxPlayers.
+	AutoStart bool
+	// CodeCooldown rejects codes released to the reuse pool less than this
+	// long ago with ErrLobbyExists, so a reconnecting client doesn't end up in
+	// a new lobby that got the code of its old one.
+	CodeCooldown time.Duration
+	// CloseAt closes the lobby at this time regardless of activity, zero
+	// means never.
+	CloseAt time.Time
+	// Node and NodeEndpoint identify the node the lobby was created on, see
+	// GetLobbyNode.
+	Node         string
+	NodeEndpoint string
+	// Limits override the rate limits of the node for the peers in the lobby,
+	// see GetLobbyLimits.
+	Limits LobbyLimits
+	// Private lobbies aren't listed or matchmade into, like after
+	// SetLobbyVisibility with public false.
+	Private bool
+}
+
+// MembersTopic is the topic the MembersDelta of a lobby are published on.
+func MembersTopic(game, lobby string) string {
+	return "members" + game + lobby
+}
+
+// PresenceTopic is the topic the Presence of a player is published on.
+func PresenceTopic(game, player string) string {
+	return "presence" + game + player
+}
+
+// Presence is whether a player has a connected peer and the lobby it's in,
+// UpdatedAt orders the changes of a player.
+type Presence struct {
+	Player    string    `json:"player"`
+	Online    bool      `json:"online"`
+	Lobby     string    `json:"lobby,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Members is the membership of a lobby at Version.
+type Members struct {
+	Version  int64
+	Peers    []string
+	PeerData map[string]map[string]any
+	// Players maps peers to their player, peers without one are left out.
+	Players map[string]string
+	// Spectators are the peers that joined as a spectator, see Role.
+	Spectators []string
+}
+
+// MembersDelta is a single change to the members of a lobby, published on
+// MembersTopic when the change is committed. Every change increments the
+// version of the lobby by one so subscribers can detect missed deltas.
+type MembersDelta struct {
+	Version int64 `json:"version"`
+	// Op is "add", "remove" or "update", an update replaces the peer data.
+	Op   string         `json:"op"`
+	ID   string         `json:"id"`
+	Data map[string]any `json:"data,omitempty"`
+	// Player is the player of the peer, only set on add.
+	Player string `json:"player,omitempty"`
+	// Role is the role the peer joined with, only set on add.
+	Role Role `json:"role,omitempty"`
+}
+
+// ClosedLobby is a lobby closed on schedule with the peers that were in it.
+type ClosedLobby struct {
+	LobbyLifetime
+	Peers []string
+}
+
+// LobbyLifetime holds the moments in the life of a lobby, FilledAt is zero
+// for lobbies that never reached their capacity, EmptiedAt for lobbies the
+// last peer never left and ClosedAt for lobbies that are still open.
+type LobbyLifetime struct {
+	Game      string
+	Code      string
+	Public    bool
+	CreatedAt time.Time
+	FilledAt  time.Time
+	EmptiedAt time.Time
+	ClosedAt  time.Time
+}
+
+type ListOptions struct {
+	Filter string
+	// HideFull excludes lobbies that are full, counting the slots reserved
+	// by matchmaking.
+	HideFull bool
+	// Sort orders the lobbies before the limit is applied, the zero value
+	// lists the newest lobbies first.
+	Sort LobbySort
+}
+
+type LobbySortField string
+
+const (
+	SortCreatedAt   LobbySortField = "createdAt"
+	SortPlayerCount LobbySortField = "playerCount"
+	// SortMeta sorts on the numeric custom data field MetaKey, lobbies where
+	// it isn't a number come last.
+	SortMeta LobbySortField = "meta"
+)
+
+// LobbySort is the order of ListLobbies, ties are broken by creation time,
+// newest first.
+type LobbySort struct {
+	Field     LobbySortField
+	MetaKey   string
+	Ascending bool
 }
 
 type Lobby struct {
-	Code        string `json:"code"`
-	PlayerCount int    `json:"playerCount"`
+	Code           string `json:"code"`
+	PlayerCount    int    `json:"playerCount"`
+	SpectatorCount int    `json:"spectatorCount"`
 
-	Public     bool           `json:"public"`
-	MaxPlayers int            `json:"maxPlayers"`
-	Password   string         `json:"password"`
-	CustomData map[string]any `json:"customData"`
+	Public        bool           `json:"public"`
+	MaxPlayers    int            `json:"maxPlayers"`
+	MaxSpectators int            `json:"maxSpectators"`
+	Password      string         `json:"password"`
+	CustomData    map[string]any `json:"customData"`
+	Started       bool           `json:"started"`
+	State         string         `json:"state"`
 
 	peers map[string]struct{}
 }
 
 func (l *Lobby) Build() Lobby {
 	clone := Lobby{
-		Code:        l.Code,
-		PlayerCount: len(l.peers),
-		Public:      l.Public,
-		MaxPlayers:  l.MaxPlayers,
-		Password:    l.Password,
-		CustomData:  l.CustomData,
-		peers:       make(map[string]struct{}),
+		Code:           l.Code,
+		PlayerCount:    len(l.peers),
+		SpectatorCount: l.SpectatorCount,
+		Public:         l.Public,
+		MaxPlayers:     l.MaxPlayers,
+		MaxSpectators:  l.MaxSpectators,
+		Password:       l.Password,
+		CustomData:     l.CustomData,
+		Started:        l.Started,
+		State:          l.State,
+		peers:          make(map[string]struct{}),
 	}
 	for k, v := range l.CustomData {
 		clone.CustomData[k] = v
@@ -0,0 +1,57 @@
+package stores
+
+import (
+	"context"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+// GameStats are the aggregate counts of the open lobbies of a game.
+type GameStats struct {
+	// Players are the peers in a lobby as a player, peers that are connected
+	// but not in a lobby aren't counted.
+	Players int `json:"players"`
+	// Spectators are the peers in a lobby as a spectator.
+	Spectators    int `json:"spectators"`
+	PublicLobbies int `json:"publicLobbies"`
+	// JoinableLobbies are the public lobbies that didn't start and have room,
+	// counting the slots reserved by matchmaking.
+	JoinableLobbies int `json:"joinableLobbies"`
+}
+
+func (s *PostgresStore) GetGameStats(ctx context.Context, game string) (*GameStats, error) {
+	return fromReplica(ctx, s, func(db querier) (*GameStats, error) {
+		return getGameStats(ctx, db, game)
+	})
+}
+
+func getGameStats(ctx context.Context, db querier, game string) (*GameStats, error) {
+	stats := &GameStats{}
+	err := db.QueryRow(ctx, `
+		SELECT
+			COALESCE(SUM(cardinality(peers) - cardinality(spectators)), 0),
+			COALESCE(SUM(cardinality(spectators)), 0),
+			COUNT(*) FILTER (WHERE public),
+			COUNT(*) FILTER (
+				WHERE public
+				AND started_at IS NULL
+				AND (
+					max_players = 0
+					OR cardinality(peers) - cardinality(spectators) + (
+						SELECT COUNT(*)
+						FROM reservations
+						WHERE reservations.game = lobbies.game
+						AND reservations.lobby = lobbies.code
+						AND reservations.expires_at > $2
+					) < max_players
+				)
+			)
+		FROM lobbies
+		WHERE game = $1
+		AND cardinality(peers) > 0
+	`, game, util.Now(ctx)).Scan(&stats.Players, &stats.Spectators, &stats.PublicLobbies, &stats.JoinableLobbies)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
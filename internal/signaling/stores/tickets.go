@@ -0,0 +1,184 @@
+package stores
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/poki/netlib/internal/util"
+)
+
+var ErrTicketNotFound = util.NewError("ticket-not-found", "ticket not found")
+var ErrTicketLimit = util.NewError("ticket-limit", "too many pending tickets")
+
+// Ticket is a peer waiting to be matched into a new lobby, see Matcher.
+type Ticket struct {
+	ID   string
+	Game string
+	Peer string
+
+	Skill float64
+	// MaxPlayers is the size of the lobby the peer wants to be matched into,
+	// only tickets with the same MaxPlayers are grouped together.
+	MaxPlayers int
+	// Preferences have to be equal between tickets until the criteria are
+	// widened.
+	Preferences map[string]string
+
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (s *PostgresStore) EnqueueTicket(ctx context.Context, ticket Ticket, ttl time.Duration, max int) (time.Time, error) {
+	if ticket.Preferences == nil {
+		ticket.Preferences = map[string]string{}
+	}
+	now := util.Now(ctx)
+
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	// Concurrent tickets of the same peer are serialized on its lock so
+	// they're all counted.
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1), hashtext('tickets' || $2))`, ticket.Game, ticket.Peer)
+	if err != nil {
+		return time.Time{}, err
+	}
+	res, err := tx.Exec(ctx, `
+		INSERT INTO tickets (id, game, peer, skill, max_players, preferences, created_at, expires_at)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8
+		WHERE (
+			SELECT COUNT(*)
+			FROM tickets
+			WHERE game = $2
+			AND peer = $3
+			AND expires_at >= $7
+		) < $9
+	`, ticket.ID, ticket.Game, ticket.Peer, ticket.Skill, ticket.MaxPlayers, ticket.Preferences, now, now.Add(ttl), max)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if res.RowsAffected() == 0 {
+		return time.Time{}, ErrTicketLimit
+	}
+	return now.Add(ttl), tx.Commit(ctx)
+}
+
+func (s *PostgresStore) CancelTicket(ctx context.Context, game, peerID, ticketID string) error {
+	res, err := s.db(ctx).Exec(ctx, `
+		DELETE FROM tickets
+		WHERE id = $1
+		AND game = $2
+		AND peer = $3
+	`, ticketID, game, peerID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrTicketNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) CancelPeerTickets(ctx context.Context, game, peerID string) (int, error) {
+	res, err := s.db(ctx).Exec(ctx, `
+		DELETE FROM tickets
+		WHERE game = $1
+		AND peer = $2
+	`, game, peerID)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
+}
+
+func (s *PostgresStore) MatchTickets(ctx context.Context, limit int, match func(ctx context.Context, tickets []Ticket) ([]Ticket, error)) error {
+	now := util.Now(ctx)
+
+	tx, err := s.db(ctx).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, game, peer, skill, max_players, preferences, created_at, expires_at
+		FROM tickets
+		WHERE expires_at >= $1
+		ORDER BY created_at ASC, id ASC
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, now, limit)
+	if err != nil {
+		return err
+	}
+	tickets, err := scanTickets(rows)
+	if err != nil {
+		return err
+	}
+	if len(tickets) == 0 {
+		return nil
+	}
+
+	matched, err := match(context.WithValue(ctx, lockTxKey{}, tx), tickets)
+	if err != nil {
+		return err
+	}
+	if len(matched) > 0 {
+		// A matched peer doesn't need any of its other tickets anymore.
+		games := make([]string, len(matched))
+		peers := make([]string, len(matched))
+		for i, ticket := range matched {
+			games[i] = ticket.Game
+			peers[i] = ticket.Peer
+		}
+		_, err = tx.Exec(ctx, `
+			DELETE FROM tickets
+			USING unnest($1::uuid[], $2::text[]) AS m(game, peer)
+			WHERE tickets.game = m.game
+			AND tickets.peer = m.peer
+		`, games, peers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresStore) ExpireTickets(ctx context.Context, limit int) ([]Ticket, error) {
+	rows, err := s.db(ctx).Query(ctx, `
+		WITH d AS (
+			SELECT id
+			FROM tickets
+			WHERE expires_at < $1
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		DELETE FROM tickets
+		USING d
+		WHERE tickets.id = d.id
+		RETURNING tickets.id, tickets.game, tickets.peer, tickets.skill, tickets.max_players, tickets.preferences, tickets.created_at, tickets.expires_at
+	`, util.Now(ctx), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanTickets(rows)
+}
+
+func scanTickets(rows pgx.Rows) ([]Ticket, error) {
+	defer rows.Close()
+	var tickets []Ticket
+	for rows.Next() {
+		var ticket Ticket
+		err := rows.Scan(&ticket.ID, &ticket.Game, &ticket.Peer, &ticket.Skill, &ticket.MaxPlayers, &ticket.Preferences, &ticket.CreatedAt, &ticket.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
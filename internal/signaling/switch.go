@@ -0,0 +1,84 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+// HandleSwitchLobbyPacket moves the peer to another lobby without leaving it
+// in neither lobby in between. When the target can't be joined the peer stays
+// in its current lobby and gets an error.
+func (p *Peer) HandleSwitchLobbyPacket(ctx context.Context, packet SwitchLobbyPacket) error {
+	logger := logging.GetLogger(ctx)
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby == "" {
+		p.ReplyError(ctx, packet.RequestID, stores.ErrNotInLobby)
+		return nil
+	}
+	packet.Lobby = p.config.normalizeLobbyCode(packet.Lobby)
+	if packet.Lobby == "" {
+		return fmt.Errorf("no lobby code supplied")
+	}
+	if len(packet.Lobby) > 20 {
+		return fmt.Errorf("lobby code too long")
+	}
+	peerData, err := validatePeerData(packet.PeerData, packet.PublicKey, nil)
+	if err != nil {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	}
+	packet.PeerData = peerData
+
+	previous := p.Lobby
+	var left, others []string
+	err = p.store.LockLobby(ctx, p.Game, previous, LobbyLockTTL, func(ctx context.Context) error {
+		var err error
+		left, others, err = p.store.SwitchLobby(ctx, p.Game, previous, packet.Lobby, p.ID)
+		if err != nil {
+			return err
+		}
+		return announceLeave(ctx, p.store, p.Game, previous, p.ID, left)
+	})
+	var joinErr *util.Error
+	if err == stores.ErrLobbyFull {
+		p.ReplyError(ctx, packet.RequestID, stores.ErrLobbyFull.WithParams("lobby", packet.Lobby))
+		return nil
+	} else if errors.Is(err, stores.ErrLobbyNotJoinable) && errors.As(err, &joinErr) {
+		p.ReplyError(ctx, packet.RequestID, joinErr.WithParams("lobby", packet.Lobby))
+		return nil
+	} else if err == stores.ErrNotFound || err == stores.ErrAlreadyInLobby || err == stores.ErrNotInLobby {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logger.Info("switched lobby",
+		zap.String("game", p.Game),
+		zap.String("from", previous),
+		zap.String("to", packet.Lobby),
+		zap.String("peer", p.ID))
+	metrics.Record(ctx, "lobby", "left", p.Game, p.ID, previous, "reason", "switch")
+	p.leftLobby()
+	if len(left) == 0 {
+		observeLobbyEmptied(ctx, p.store, p.config.MetricGames, p.Game, previous)
+		emitLobbyEvent(ctx, p.config.Webhook, LobbyClosed, p.Game, previous, p.ID)
+	}
+
+	return p.enterLobby(ctx, JoinPacket{
+		RequestID: packet.RequestID,
+		Type:      "join",
+		Lobby:     packet.Lobby,
+		PeerData:  packet.PeerData,
+		PublicKey: packet.PublicKey,
+	}, others)
+}
@@ -0,0 +1,151 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+)
+
+// switchStore lets a peer switch between lobbies that hold peerA and keeps
+// track of its subscriptions.
+type switchStore struct {
+	*joinStore
+
+	mutex         sync.Mutex
+	subscriptions map[string][]context.Context
+}
+
+func (s *switchStore) SwitchLobby(context.Context, string, string, string, string) ([]string, []string, error) {
+	return []string{"peerA"}, []string{"peerA"}, nil
+}
+
+func (s *switchStore) TransferOwnership(context.Context, string, string, string, string) ([]string, error) {
+	return nil, stores.ErrNotLeader
+}
+
+func (s *switchStore) Subscribe(ctx context.Context, topic string, _ stores.SubscriptionCallback) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscriptions[topic] = append(s.subscriptions[topic], ctx)
+}
+
+// active counts the subscriptions per topic that weren't cancelled.
+func (s *switchStore) active() map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := make(map[string]int)
+	for topic, subs := range s.subscriptions {
+		for _, ctx := range subs {
+			if ctx.Err() == nil {
+				active[topic]++
+			}
+		}
+	}
+	return active
+}
+
+func TestSwitchLobbyUnsubscribes(t *testing.T) {
+	store := &switchStore{
+		joinStore: &joinStore{
+			peerData:  map[string]map[string]any{"peerA": {}},
+			published: make(map[string][][]byte),
+		},
+		subscriptions: make(map[string][]context.Context),
+	}
+	active := make(chan map[string]int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		p := &Peer{store: store, conn: conn, config: &Config{}, registry: newPeerRegistry(), connCtx: ctx, ID: "peerB", Game: "game", Lobby: "a"}
+		p.subscribeLobby()
+
+		// Switching back and forth must not leave subscriptions behind.
+		for _, lobby := range []string{"b", "a"} {
+			if err := p.HandleSwitchLobbyPacket(ctx, SwitchLobbyPacket{Type: "switch-lobby", Lobby: lobby}); err != nil {
+				t.Error(err)
+			}
+		}
+		active <- store.active()
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	go func() {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	}()
+
+	got := <-active
+	if len(got) != 1 || got["gameapeerB"] != 1 {
+		t.Fatalf("expected a single subscription in lobby a, got %v", got)
+	}
+}
+
+// notJoinableStore rejects switches with a wrapped ErrLobbyNotJoinable.
+type notJoinableStore struct {
+	*joinStore
+}
+
+func (s *notJoinableStore) SwitchLobby(context.Context, string, string, string, string) ([]string, []string, error) {
+	return nil, nil, fmt.Errorf("switch: %w", stores.ErrLobbyNotJoinable.WithParams("state", stores.LobbyStateStarted))
+}
+
+func TestSwitchLobbyWrappedError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		p := &Peer{store: &notJoinableStore{joinStore: &joinStore{}}, conn: conn, config: &Config{}, ID: "peerB", Game: "game", Lobby: "a"}
+		if err := p.HandleSwitchLobbyPacket(r.Context(), SwitchLobbyPacket{RequestID: "rid", Type: "switch-lobby", Lobby: "b"}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	_, raw, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := struct {
+		Type   string
+		Code   string
+		Params map[string]any
+	}{}
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.Code != "lobby-not-joinable" || reply.Params["lobby"] != "b" || reply.Params["state"] != stores.LobbyStateStarted {
+		t.Fatalf("expected a lobby-not-joinable error, got %s", raw)
+	}
+}
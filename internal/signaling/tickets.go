@@ -0,0 +1,304 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"go.uber.org/zap"
+)
+
+// DefaultMatchInterval is how often the Matcher groups tickets and
+// DefaultMatchBatchSize how many tickets it considers at once.
+const DefaultMatchInterval = time.Second
+const DefaultMatchBatchSize = 1000
+
+// ticketsTopic is the topic the Matcher notifies the peer of its tickets on.
+func ticketsTopic(game, peer string) string {
+	return "tickets" + game + peer
+}
+
+// Matcher groups matchmaking tickets into new lobbies, see
+// HandleMatchmakingTicketPacket. A ticket is matched with tickets of the same
+// game and MaxPlayers with the same preferences and a skill at most
+// SkillWindow away. Every WidenAfter a ticket waits its window grows by
+// SkillWindow and after the first its preferences are ignored, so a ticket
+// is eventually matched with anyone as long as enough players are waiting.
+type Matcher struct {
+	Store stores.Store
+
+	SkillWindow float64
+	WidenAfter  time.Duration
+
+	// CaseSensitiveCodes generates mixed case lobby codes, see
+	// Config.CaseSensitiveLobbyCodes.
+	CaseSensitiveCodes bool
+
+	// Interval is how often tickets are matched, at most BatchSize at a time.
+	Interval  time.Duration
+	BatchSize int
+}
+
+func (m *Matcher) Run(ctx context.Context) {
+	if m.Interval == 0 {
+		m.Interval = DefaultMatchInterval
+	}
+	if m.BatchSize == 0 {
+		m.BatchSize = DefaultMatchBatchSize
+	}
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		m.RunOnce(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type ticketMatch struct {
+	lobby   string
+	tickets []stores.Ticket
+}
+
+// RunOnce notifies the peers of expired tickets and matches the tickets that
+// are still waiting. The lobby of a match is created in the transaction that
+// removes its tickets, its peers are told the code of the lobby to join it
+// after it committed.
+func (m *Matcher) RunOnce(ctx context.Context) {
+	logger := logging.GetLogger(ctx)
+
+	expired, err := m.Store.ExpireTickets(ctx, m.BatchSize)
+	if err != nil {
+		logger.Error("failed to expire tickets", zap.Error(err))
+	}
+	for _, ticket := range expired {
+		metrics.Inc("netlib_tickets_expired_total")
+		m.notify(ctx, ticket, TicketPacket{Type: "ticket-expired", Ticket: ticket.ID})
+	}
+
+	var matches []ticketMatch
+	err = m.Store.MatchTickets(ctx, m.BatchSize, func(ctx context.Context, tickets []stores.Ticket) ([]stores.Ticket, error) {
+		matches = matches[:0]
+		var matched []stores.Ticket
+		for _, group := range groupTickets(tickets, util.Now(ctx), m.SkillWindow, m.WidenAfter) {
+			lobby, err := m.createLobby(ctx, group)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, ticketMatch{lobby: lobby, tickets: group})
+			matched = append(matched, group...)
+		}
+		return matched, nil
+	})
+	if err != nil {
+		logger.Error("failed to match tickets", zap.Error(err))
+		return
+	}
+
+	for _, match := range matches {
+		logger.Info("tickets matched", zap.String("game", match.tickets[0].Game), zap.String("lobby", match.lobby), zap.Int("tickets", len(match.tickets)))
+		for _, ticket := range match.tickets {
+			metrics.Inc("netlib_tickets_matched_total")
+			m.notify(ctx, ticket, TicketMatchedPacket{Type: "ticket-matched", Ticket: ticket.ID, Lobby: match.lobby})
+		}
+	}
+}
+
+// createLobby creates the private lobby of a match, the peer of the oldest
+// ticket is its leader. The code is derived from the tickets, so when a
+// concurrent matcher already created the lobby of the same match its peers
+// are sent to that lobby instead of a second one.
+func (m *Matcher) createLobby(ctx context.Context, group []stores.Ticket) (string, error) {
+	ids := make([]string, len(group))
+	for i, ticket := range group {
+		ids[i] = ticket.ID
+	}
+	sort.Strings(ids)
+	lobby := util.DeriveLobbyCode(group[0].Game+":"+strings.Join(ids, ","), m.CaseSensitiveCodes)
+	err := m.Store.CreateLobby(ctx, group[0].Game, lobby, group[0].Peer, stores.LobbyOptions{
+		MaxPlayers: group[0].MaxPlayers,
+		Private:    true,
+	})
+	if err == stores.ErrLobbyExists {
+		metrics.Inc("netlib_tickets_lobby_exists_total")
+		return lobby, nil
+	} else if err != nil {
+		return "", err
+	}
+	return lobby, nil
+}
+
+func (m *Matcher) notify(ctx context.Context, ticket stores.Ticket, packet any) {
+	data, _ := json.Marshal(packet)
+	if err := m.Store.Publish(ctx, ticketsTopic(ticket.Game, ticket.Peer), data); err != nil {
+		logging.GetLogger(ctx).Error("failed to publish ticket packet", zap.Error(err))
+	}
+}
+
+// groupTickets groups the tickets, sorted oldest first, into matches. The
+// oldest ticket that isn't matched yet is matched with the compatible
+// tickets closest to its skill, the oldest first on a tie, so the matches
+// only depend on the tickets and now. A peer is matched at most once.
+func groupTickets(tickets []stores.Ticket, now time.Time, window float64, widenAfter time.Duration) [][]stores.Ticket {
+	matchedPeers := make(map[string]bool)
+	var groups [][]stores.Ticket
+	for i, anchor := range tickets {
+		if matchedPeers[anchor.Game+anchor.Peer] {
+			continue
+		}
+		var candidates []stores.Ticket
+		for _, other := range tickets[i+1:] {
+			if !matchedPeers[other.Game+other.Peer] && ticketsCompatible(anchor, other, now, window, widenAfter) {
+				candidates = append(candidates, other)
+			}
+		}
+		if len(candidates)+1 < anchor.MaxPlayers {
+			continue
+		}
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return math.Abs(candidates[a].Skill-anchor.Skill) < math.Abs(candidates[b].Skill-anchor.Skill)
+		})
+
+		group := []stores.Ticket{anchor}
+	candidates:
+		for _, candidate := range candidates {
+			if len(group) == anchor.MaxPlayers {
+				break
+			}
+			for _, member := range group[1:] {
+				if !ticketsCompatible(member, candidate, now, window, widenAfter) {
+					continue candidates
+				}
+			}
+			group = append(group, candidate)
+		}
+		if len(group) < anchor.MaxPlayers {
+			continue
+		}
+		for _, ticket := range group {
+			matchedPeers[ticket.Game+ticket.Peer] = true
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// ticketsCompatible reports whether the tickets of two different peers can be
+// in the same match, the criteria of both tickets have to accept the other.
+func ticketsCompatible(a, b stores.Ticket, now time.Time, window float64, widenAfter time.Duration) bool {
+	if a.Game != b.Game || a.MaxPlayers != b.MaxPlayers || a.Peer == b.Peer {
+		return false
+	}
+	return ticketAccepts(a, b, now, window, widenAfter) && ticketAccepts(b, a, now, window, widenAfter)
+}
+
+// ticketAccepts reports whether other is within the criteria of ticket at
+// now, widened for every widenAfter ticket waited.
+func ticketAccepts(ticket, other stores.Ticket, now time.Time, window float64, widenAfter time.Duration) bool {
+	widened := 0
+	if widenAfter > 0 {
+		widened = int(now.Sub(ticket.CreatedAt) / widenAfter)
+	}
+	if math.Abs(ticket.Skill-other.Skill) > window*float64(1+widened) {
+		return false
+	}
+	if widened == 0 {
+		for key, value := range ticket.Preferences {
+			if other.Preferences[key] != value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// HandleMatchmakingTicketPacket enqueues a ticket for the Matcher, the peer
+// gets a ticket-matched packet with the lobby to join once it's matched or a
+// ticket-expired packet after Config.TicketTTL. A peer can have at most
+// Config.MaxTicketsPerPeer tickets waiting, they're cancelled when its
+// connection closes.
+func (p *Peer) HandleMatchmakingTicketPacket(ctx context.Context, packet MatchmakingTicketPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	if p.Lobby != "" {
+		return fmt.Errorf("already in a lobby %s:%s as %s", p.Game, p.Lobby, p.ID)
+	}
+	if packet.MaxPlayers < 2 {
+		return fmt.Errorf("maxPlayers of at least 2 is required for a ticket")
+	}
+
+	// Subscribe before the ticket can be matched so no notification is missed.
+	if !p.ticketsSubscribed {
+		p.store.Subscribe(p.connCtx, ticketsTopic(p.Game, p.ID), p.ForwardMessage)
+		p.ticketsSubscribed = true
+	}
+
+	ticket := stores.Ticket{
+		ID:          util.GeneratePeerID(ctx),
+		Game:        p.Game,
+		Peer:        p.ID,
+		Skill:       packet.Skill,
+		MaxPlayers:  packet.MaxPlayers,
+		Preferences: packet.Preferences,
+	}
+	expiresAt, err := p.store.EnqueueTicket(ctx, ticket, p.config.TicketTTL, p.config.MaxTicketsPerPeer)
+	if err == stores.ErrTicketLimit {
+		metrics.Inc("netlib_ticket_limit_rejections_total")
+		p.ReplyError(ctx, packet.RequestID, stores.ErrTicketLimit.WithParams("max", p.config.MaxTicketsPerPeer))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	metrics.Inc("netlib_tickets_total")
+
+	return p.Send(ctx, TicketPacket{
+		RequestID: packet.RequestID,
+		Type:      "ticket",
+		Ticket:    ticket.ID,
+		ExpiresAt: expiresAt.UnixMilli(),
+	})
+}
+
+func (p *Peer) HandleCancelTicketPacket(ctx context.Context, packet CancelTicketPacket) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer not connected")
+	}
+	err := p.store.CancelTicket(ctx, p.Game, p.ID, packet.Ticket)
+	if err == stores.ErrTicketNotFound {
+		p.ReplyError(ctx, packet.RequestID, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return p.Send(ctx, TicketPacket{
+		RequestID: packet.RequestID,
+		Type:      "ticket-cancelled",
+		Ticket:    packet.Ticket,
+	})
+}
+
+// cancelTickets cancels the tickets of the peer when its connection closed,
+// a ticket matched after that would put it in a lobby it never joins.
+func (p *Peer) cancelTickets(ctx context.Context) {
+	if !p.ticketsSubscribed || p.superseded.Load() {
+		return
+	}
+	cancelled, err := p.store.CancelPeerTickets(ctx, p.Game, p.ID)
+	if err != nil {
+		logging.GetLogger(ctx).Warn("failed to cancel tickets", zap.Error(err))
+		return
+	}
+	metrics.Add("netlib_tickets_cancelled_on_close_total", float64(cancelled))
+}
@@ -0,0 +1,365 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func ticketPeers(groups [][]stores.Ticket) [][]string {
+	peers := [][]string{}
+	for _, group := range groups {
+		ids := []string{}
+		for _, ticket := range group {
+			ids = append(ids, ticket.Peer)
+		}
+		peers = append(peers, ids)
+	}
+	return peers
+}
+
+func TestGroupTickets(t *testing.T) {
+	now := time.Now()
+	ticket := func(peer string, skill float64, maxPlayers int, preferences map[string]string) stores.Ticket {
+		return stores.Ticket{ID: "t" + peer, Game: "game", Peer: peer, Skill: skill, MaxPlayers: maxPlayers, Preferences: preferences, CreatedAt: now}
+	}
+	eu := map[string]string{"region": "eu"}
+	us := map[string]string{"region": "us"}
+
+	tickets := []stores.Ticket{
+		ticket("a", 1000, 2, eu),
+		ticket("b", 1500, 2, eu),
+		ticket("c", 1050, 2, us), // Close to a, but in another region.
+		ticket("d", 1450, 2, eu),
+		ticket("e", 1080, 2, eu),
+		ticket("f", 1000, 3, eu), // Wants a bigger lobby.
+		ticket("a", 1000, 2, eu), // A second ticket of a.
+		ticket("g", 1000, 2, eu),
+	}
+	groups := ticketPeers(groupTickets(tickets, now, 100, 15*time.Second))
+	expected := [][]string{{"a", "g"}, {"b", "d"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected %v, got %v", expected, groups)
+	}
+
+	// The oldest ticket picks the closest skill, the oldest first on a tie.
+	tickets = []stores.Ticket{
+		ticket("a", 1000, 3, nil),
+		ticket("b", 1090, 3, nil),
+		ticket("c", 1010, 3, nil),
+		ticket("d", 990, 3, nil),
+	}
+	groups = ticketPeers(groupTickets(tickets, now, 100, 15*time.Second))
+	expected = [][]string{{"a", "c", "d"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected %v, got %v", expected, groups)
+	}
+}
+
+func TestGroupTicketsWidening(t *testing.T) {
+	created := time.Now()
+	tickets := []stores.Ticket{
+		{ID: "1", Game: "game", Peer: "a", Skill: 1000, MaxPlayers: 2, Preferences: map[string]string{"region": "eu"}, CreatedAt: created},
+		{ID: "2", Game: "game", Peer: "b", Skill: 1250, MaxPlayers: 2, Preferences: map[string]string{"region": "us"}, CreatedAt: created},
+	}
+	for _, step := range []struct {
+		waited  time.Duration
+		matched bool
+	}{
+		{0, false},
+		{14 * time.Second, false},
+		{15 * time.Second, false}, // Preferences are ignored, but the skill is too far apart.
+		{30 * time.Second, true},  // The window grew to 300.
+	} {
+		groups := groupTickets(tickets, created.Add(step.waited), 100, 15*time.Second)
+		if matched := len(groups) == 1; matched != step.matched {
+			t.Fatalf("expected matched to be %v after %s, got %v", step.matched, step.waited, ticketPeers(groups))
+		}
+	}
+
+	// Both tickets need to accept each other, a fresh ticket keeps its criteria.
+	tickets[1].CreatedAt = created.Add(30 * time.Second)
+	if groups := groupTickets(tickets, created.Add(30*time.Second), 100, 15*time.Second); len(groups) != 0 {
+		t.Fatalf("expected a fresh ticket not to be matched by widened criteria, got %v", ticketPeers(groups))
+	}
+}
+
+// ticketsStore holds tickets in memory and records the lobbies created and
+// the packets published by the Matcher.
+type ticketsStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	tickets   []stores.Ticket
+	expired   []stores.Ticket
+	lobbies   map[string]stores.LobbyOptions
+	published map[string][]json.RawMessage
+
+	// claimed, when set, holds back MatchTickets until every concurrent
+	// matcher read the tickets, like nodes that match the same tickets.
+	claimed *sync.WaitGroup
+}
+
+func (s *ticketsStore) ExpireTickets(context.Context, int) ([]stores.Ticket, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expired := s.expired
+	s.expired = nil
+	return expired, nil
+}
+
+func (s *ticketsStore) MatchTickets(ctx context.Context, limit int, match func(context.Context, []stores.Ticket) ([]stores.Ticket, error)) error {
+	s.mutex.Lock()
+	tickets := s.tickets
+	s.mutex.Unlock()
+	if s.claimed != nil {
+		s.claimed.Done()
+		s.claimed.Wait()
+	}
+	matched, err := match(ctx, tickets)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	remaining := []stores.Ticket{}
+outer:
+	for _, ticket := range s.tickets {
+		for _, m := range matched {
+			if m.Peer == ticket.Peer {
+				continue outer
+			}
+		}
+		remaining = append(remaining, ticket)
+	}
+	s.tickets = remaining
+	return nil
+}
+
+func (s *ticketsStore) CreateLobby(ctx context.Context, game, lobby, id string, options stores.LobbyOptions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.lobbies[lobby]; ok {
+		return stores.ErrLobbyExists
+	}
+	s.lobbies[lobby] = options
+	return nil
+}
+
+func (s *ticketsStore) Publish(ctx context.Context, topic string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.published[topic] = append(s.published[topic], data)
+	return nil
+}
+
+func TestMatcher(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := &ticketsStore{
+		tickets: []stores.Ticket{
+			{ID: "1", Game: "game", Peer: "a", Skill: 10, MaxPlayers: 2, CreatedAt: now},
+			{ID: "2", Game: "game", Peer: "b", Skill: 20, MaxPlayers: 2, CreatedAt: now},
+			{ID: "3", Game: "game", Peer: "c", Skill: 500, MaxPlayers: 2, CreatedAt: now},
+		},
+		expired:   []stores.Ticket{{ID: "4", Game: "game", Peer: "d"}},
+		lobbies:   make(map[string]stores.LobbyOptions),
+		published: make(map[string][]json.RawMessage),
+	}
+	matcher := &Matcher{Store: store, SkillWindow: 100, WidenAfter: time.Minute, BatchSize: 10}
+	matcher.RunOnce(ctx)
+
+	if len(store.lobbies) != 1 {
+		t.Fatalf("expected a single lobby, got %v", store.lobbies)
+	}
+	var lobby string
+	for code, options := range store.lobbies {
+		lobby = code
+		if !options.Private || options.MaxPlayers != 2 {
+			t.Fatalf("expected a private lobby for 2 players, got %+v", options)
+		}
+	}
+	for peer, ticket := range map[string]string{"a": "1", "b": "2"} {
+		packets := store.published[ticketsTopic("game", peer)]
+		if len(packets) != 1 {
+			t.Fatalf("expected peer %s to be notified once, got %s", peer, packets)
+		}
+		matched := TicketMatchedPacket{}
+		if err := json.Unmarshal(packets[0], &matched); err != nil {
+			t.Fatal(err)
+		}
+		if matched.Type != "ticket-matched" || matched.Ticket != ticket || matched.Lobby != lobby {
+			t.Fatalf("expected ticket %s to be matched into %s, got %s", ticket, lobby, packets[0])
+		}
+	}
+	if packets := store.published[ticketsTopic("game", "c")]; len(packets) != 0 {
+		t.Fatalf("expected c to keep waiting, got %s", packets)
+	}
+	if len(store.tickets) != 1 || store.tickets[0].Peer != "c" {
+		t.Fatalf("expected only the ticket of c to remain, got %+v", store.tickets)
+	}
+	expired := TicketPacket{}
+	if packets := store.published[ticketsTopic("game", "d")]; len(packets) != 1 {
+		t.Fatalf("expected d to be told its ticket expired, got %s", packets)
+	} else if err := json.Unmarshal(packets[0], &expired); err != nil || expired.Type != "ticket-expired" || expired.Ticket != "4" {
+		t.Fatalf("expected ticket 4 to expire, got %s (%v)", packets[0], err)
+	}
+}
+
+func TestMatcherConcurrentMatch(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	claimed := &sync.WaitGroup{}
+	claimed.Add(2)
+	store := &ticketsStore{
+		tickets: []stores.Ticket{
+			{ID: "1", Game: "game", Peer: "a", Skill: 10, MaxPlayers: 2, CreatedAt: now},
+			{ID: "2", Game: "game", Peer: "b", Skill: 20, MaxPlayers: 2, CreatedAt: now},
+		},
+		lobbies:   make(map[string]stores.LobbyOptions),
+		published: make(map[string][]json.RawMessage),
+		claimed:   claimed,
+	}
+
+	// Both matchers group the same tickets, the second one finds the lobby
+	// of the match already created and sends its peers there too.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			matcher := &Matcher{Store: store, SkillWindow: 100, WidenAfter: time.Minute, BatchSize: 10}
+			matcher.RunOnce(ctx)
+		}()
+	}
+	wg.Wait()
+
+	if len(store.lobbies) != 1 {
+		t.Fatalf("expected a single lobby, got %v", store.lobbies)
+	}
+	var lobby string
+	for code := range store.lobbies {
+		lobby = code
+	}
+	for _, peer := range []string{"a", "b"} {
+		packets := store.published[ticketsTopic("game", peer)]
+		if len(packets) != 2 {
+			t.Fatalf("expected peer %s to be notified by both matchers, got %s", peer, packets)
+		}
+		for _, packet := range packets {
+			matched := TicketMatchedPacket{}
+			if err := json.Unmarshal(packet, &matched); err != nil {
+				t.Fatal(err)
+			}
+			if matched.Type != "ticket-matched" || matched.Lobby != lobby {
+				t.Fatalf("expected peer %s to be matched into %s, got %s", peer, lobby, packet)
+			}
+		}
+	}
+}
+
+// queueStore counts the waiting tickets per peer and reports the peers whose
+// tickets are cancelled.
+type queueStore struct {
+	*shutdownStore
+
+	mutex     sync.Mutex
+	waiting   map[string]int
+	cancelled chan string
+}
+
+func (s *queueStore) EnqueueTicket(ctx context.Context, ticket stores.Ticket, ttl time.Duration, max int) (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.waiting[ticket.Peer] >= max {
+		return time.Time{}, stores.ErrTicketLimit
+	}
+	s.waiting[ticket.Peer]++
+	return time.Now().Add(ttl), nil
+}
+
+func (s *queueStore) CancelPeerTickets(ctx context.Context, game, id string) (int, error) {
+	s.mutex.Lock()
+	cancelled := s.waiting[id]
+	delete(s.waiting, id)
+	s.mutex.Unlock()
+	s.cancelled <- id
+	return cancelled, nil
+}
+
+func TestTicketLimit(t *testing.T) {
+	ctx := context.Background()
+	store := &queueStore{
+		shutdownStore: &shutdownStore{t: t, timeouts: make(map[string]string)},
+		waiting:       make(map[string]int),
+		cancelled:     make(chan string, 1),
+	}
+	_, handler, _ := Handler(ctx, store, nil, Config{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readServerInfo(ctx, t, conn)
+	if err := wsjson.Write(ctx, conn, HelloPacket{Type: "hello", Game: "4307bd86-e1df-41b8-b9df-e22afcf084bd"}); err != nil {
+		t.Fatal(err)
+	}
+	welcome := WelcomePacket{}
+	if err := wsjson.Read(ctx, conn, &welcome); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wsjson.Write(ctx, conn, MatchmakingTicketPacket{Type: "matchmaking-ticket", RequestID: "first", MaxPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	ticket := TicketPacket{}
+	if err := wsjson.Read(ctx, conn, &ticket); err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Type != "ticket" || ticket.RequestID != "first" {
+		t.Fatalf("expected the first ticket to be enqueued, got %+v", ticket)
+	}
+
+	if err := wsjson.Write(ctx, conn, MatchmakingTicketPacket{Type: "matchmaking-ticket", RequestID: "second", MaxPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	limited := struct {
+		Type   string
+		Code   string
+		Params map[string]any
+	}{}
+	if err := wsjson.Read(ctx, conn, &limited); err != nil {
+		t.Fatal(err)
+	}
+	if limited.Code != "ticket-limit" || limited.Params["max"] != float64(DefaultMaxTicketsPerPeer) {
+		t.Fatalf("expected the second ticket to be rejected, got %+v", limited)
+	}
+
+	// The ticket is cancelled once the connection is gone.
+	conn.Close(websocket.StatusNormalClosure, "")
+	select {
+	case peer := <-store.cancelled:
+		if peer != welcome.ID {
+			t.Fatalf("expected the tickets of %s to be cancelled, got %s", welcome.ID, peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the tickets to be cancelled on close")
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if len(store.waiting) != 0 {
+		t.Fatalf("expected no tickets to be waiting, got %v", store.waiting)
+	}
+}
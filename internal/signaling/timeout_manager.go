@@ -6,24 +6,189 @@ import (
 	"time"
 
 	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
 	"github.com/poki/netlib/internal/signaling/stores"
+	"github.com/poki/netlib/internal/util"
+	"github.com/poki/netlib/internal/webhook"
 	"go.uber.org/zap"
 )
 
+// DefaultReapInterval and DefaultReapBatchSize bound the store load of
+// cleaning up stale lobbies.
+const DefaultReapInterval = 10 * time.Second
+const DefaultReapBatchSize = 100
+
+// EventPruneBatchSize is the most persisted events removed per reap tick.
+const EventPruneBatchSize = 10000
+
+// DefaultSeamlessWindow is how long a peer can be disconnected before its
+// lobby is told it's reconnecting.
+const DefaultSeamlessWindow = 5 * time.Second
+
+// DefaultDisconnectThreshold is how long a peer can be disconnected before
+// it's removed from its lobbies.
+const DefaultDisconnectThreshold = time.Minute
+
 type TimeoutManager struct {
 	DisconnectThreshold time.Duration
+	SeamlessWindow      time.Duration
+
+	ReapInterval  time.Duration
+	ReapBatchSize int
+	// ReuseCodes puts the short codes of reaped lobbies in the reuse pool.
+	ReuseCodes bool
+	// EventRetention prunes persisted events older than this, zero keeps them.
+	EventRetention time.Duration
+	// ClosedLobbyRetention forgets closed lobbies after this, zero keeps them.
+	ClosedLobbyRetention time.Duration
+	// MaxSessionLifetime refuses reconnects of sessions older than this, zero
+	// or negative doesn't.
+	MaxSessionLifetime time.Duration
+	// MaxConnectionTime is how long a connection can last, see
+	// Config.MaxConnectionTime. Zero uses MaxConnectionTime, without a cap
+	// (negative) stale lobbies aren't pruned as they could still have
+	// connected peers.
+	MaxConnectionTime time.Duration
+	// MetricGames are the games labelled in the lobby metrics, see
+	// Config.MetricGames.
+	MetricGames []string
 
-	Store stores.Store
+	Store   stores.Store
+	Webhook *webhook.Client
 }
 
+// Run handles the disconnected peers and stale lobbies until ctx is done, it
+// returns once the work in progress finished.
 func (i *TimeoutManager) Run(ctx context.Context) {
 	if i.DisconnectThreshold == 0 {
-		i.DisconnectThreshold = time.Minute
+		i.DisconnectThreshold = DefaultDisconnectThreshold
+	}
+	if i.MaxConnectionTime == 0 {
+		i.MaxConnectionTime = MaxConnectionTime
+	}
+
+	if i.ReapInterval == 0 {
+		i.ReapInterval = DefaultReapInterval
+	}
+	if i.ReapBatchSize == 0 {
+		i.ReapBatchSize = DefaultReapBatchSize
+	}
+	reaped := make(chan struct{})
+	go func() {
+		defer close(reaped)
+		i.reap(ctx)
+	}()
+
+	if i.SeamlessWindow == 0 {
+		i.SeamlessWindow = DefaultSeamlessWindow
 	}
 
 	for ctx.Err() == nil {
-		time.Sleep(time.Second)
+		i.closeScheduled(ctx)
+		i.notifyReconnecting(ctx)
 		i.RunOnce(ctx)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+	<-reaped
+}
+
+// reap prunes stale lobbies every ReapInterval, at most ReapBatchSize at a
+// time so a backlog is spread over multiple ticks. The first tick runs right
+// away to clean up state left behind when all nodes went down at once.
+func (i *TimeoutManager) reap(ctx context.Context) {
+	ticker := time.NewTicker(i.ReapInterval)
+	defer ticker.Stop()
+	for {
+		i.ReapOnce(ctx)
+		i.PruneEventsOnce(ctx)
+		i.PruneClosedLobbiesOnce(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReapOnce removes one batch of stale lobbies. The timeouts of peers whose
+// grace window was running are kept in the store and handled by RunOnce.
+// Lobbies without activity for longer than a connection can last can't have
+// connected peers and are pruned. It's safe to run on multiple nodes.
+func (i *TimeoutManager) ReapOnce(ctx context.Context) {
+	logger := logging.GetLogger(ctx)
+	if i.MaxConnectionTime < 0 {
+		return
+	}
+
+	staleAfter := 2*i.MaxConnectionTime + i.DisconnectThreshold
+	lobbies, err := i.Store.PruneStaleLobbies(ctx, staleAfter, i.ReapBatchSize)
+	if err != nil {
+		logger.Error("failed to prune stale lobbies", zap.Error(err))
+		return
+	}
+	pruned := len(lobbies)
+	for _, lobby := range lobbies {
+		observeLobbyClosed(lobby, i.MetricGames)
+	}
+	metrics.Add("netlib_reaped_lobbies_total", float64(pruned))
+	metrics.Set("netlib_reaped_lobbies_last_tick", float64(pruned))
+	if pruned > 0 {
+		logger.Info("pruned stale lobbies", zap.Int("lobbies", pruned), zap.Bool("caught_up", pruned < i.ReapBatchSize))
+	}
+
+	if i.ReuseCodes {
+		// Only short codes are worth reusing, the space of long codes is big enough.
+		var short []string
+		for _, lobby := range lobbies {
+			if util.IsShortLobbyCode(lobby.Code) {
+				short = append(short, lobby.Code)
+			}
+		}
+		if len(short) > 0 {
+			if err := i.Store.ReleaseLobbyCodes(ctx, short); err != nil {
+				logger.Error("failed to release lobby codes", zap.Error(err))
+			}
+		}
+	}
+}
+
+// PruneClosedLobbiesOnce forgets one batch of lobbies that were closed longer
+// than ClosedLobbyRetention ago. It's safe to run on multiple nodes.
+func (i *TimeoutManager) PruneClosedLobbiesOnce(ctx context.Context) {
+	if i.ClosedLobbyRetention <= 0 {
+		return
+	}
+	logger := logging.GetLogger(ctx)
+
+	pruned, err := i.Store.PruneClosedLobbies(ctx, util.Now(ctx).Add(-i.ClosedLobbyRetention), i.ReapBatchSize)
+	if err != nil {
+		logger.Error("failed to prune closed lobbies", zap.Error(err))
+		return
+	}
+	if pruned > 0 {
+		logger.Debug("pruned closed lobbies", zap.Int("lobbies", pruned))
+	}
+}
+
+// PruneEventsOnce removes one batch of persisted events that are older than
+// EventRetention. It's safe to run on multiple nodes.
+func (i *TimeoutManager) PruneEventsOnce(ctx context.Context) {
+	if i.EventRetention <= 0 {
+		return
+	}
+	logger := logging.GetLogger(ctx)
+
+	pruned, err := i.Store.PruneEvents(ctx, util.Now(ctx).Add(-i.EventRetention), EventPruneBatchSize)
+	if err != nil {
+		logger.Error("failed to prune events", zap.Error(err))
+		return
+	}
+	metrics.Add("netlib_pruned_events_total", float64(pruned))
+	if pruned > 0 {
+		logger.Info("pruned events", zap.Int("events", pruned), zap.Bool("caught_up", pruned < EventPruneBatchSize))
 	}
 }
 
@@ -54,25 +219,10 @@ func (i *TimeoutManager) disconnectPeerInLobby(ctx context.Context, peerID strin
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer cancel()
 
-	packet := DisconnectPacket{
-		Type: "disconnect",
-		ID:   peerID,
-	}
-	data, _ := json.Marshal(packet)
-
-	others, err := i.Store.LeaveLobby(ctx, gameID, lobby, peerID)
-	if err != nil {
+	if err := leaveLobby(ctx, i.Store, i.Webhook, i.MetricGames, gameID, lobby, peerID); err != nil {
 		logger.Warn("failed to leave lobby", zap.Error(err))
 		return err
 	}
-	for _, id := range others {
-		if id != peerID {
-			err := i.Store.Publish(ctx, gameID+lobby+id, data)
-			if err != nil {
-				logger.Error("failed to publish disconnect packet", zap.Error(err))
-			}
-		}
-	}
 	return nil
 }
 
@@ -84,7 +234,7 @@ func (i *TimeoutManager) Disconnected(ctx context.Context, p *Peer) {
 	}
 
 	logger.Debug("peer marked as disconnected", zap.String("id", p.ID))
-	err := i.Store.TimeoutPeer(ctx, p.ID, p.Secret, p.Game, []string{p.Lobby})
+	err := i.Store.TimeoutPeer(ctx, p.ID, p.Secret, p.Game, []string{p.Lobby}, p.sessionStart)
 	if err != nil {
 		logger.Error("failed to record timeout peer", zap.Error(err))
 	}
@@ -94,5 +244,59 @@ func (i *TimeoutManager) Reconnected(ctx context.Context, p *Peer) (bool, error)
 	logger := logging.GetLogger(ctx)
 
 	logger.Debug("peer marked as reconnected", zap.String("id", p.ID))
-	return i.Store.ReconnectPeer(ctx, p.ID, p.Secret, p.Game)
+	var startedAfter time.Time
+	if i.MaxSessionLifetime > 0 {
+		startedAfter = util.Now(ctx).Add(-i.MaxSessionLifetime)
+	}
+	reconnected, sessionStart, notified, err := i.Store.ReconnectPeer(ctx, p.ID, p.Secret, p.Game, startedAfter)
+	if err != nil || !reconnected {
+		return reconnected, err
+	}
+	if sessionStart.IsZero() {
+		// Disconnected before session starts were recorded, start counting now.
+		sessionStart = util.Now(ctx)
+	}
+	p.sessionStart = sessionStart
+	// Lobbies only know about the disconnect when it lasted longer than the
+	// seamless window, otherwise the reconnect is invisible to them.
+	for _, lobby := range notified {
+		i.publishStatus(ctx, PeerStatusPacket{Type: "peer-reconnected", ID: p.ID}, p.Game, lobby)
+	}
+	return true, nil
+}
+
+// notifyReconnecting tells lobbies about peers that have been disconnected for
+// longer than the seamless window, shorter gaps (e.g. a mobile client
+// switching networks) aren't broadcast at all.
+func (i *TimeoutManager) notifyReconnecting(ctx context.Context) {
+	logger := logging.GetLogger(ctx)
+
+	err := i.Store.MarkReconnectingPeers(ctx, i.SeamlessWindow, func(peerID, gameID string, lobbies []string) {
+		for _, lobby := range lobbies {
+			i.publishStatus(ctx, PeerStatusPacket{Type: "peer-reconnecting", ID: peerID}, gameID, lobby)
+		}
+	})
+	if err != nil {
+		logger.Error("failed to mark reconnecting peers", zap.Error(err))
+	}
+}
+
+func (i *TimeoutManager) publishStatus(ctx context.Context, packet PeerStatusPacket, gameID, lobby string) {
+	logger := logging.GetLogger(ctx)
+	if lobby == "" {
+		return
+	}
+	data, _ := json.Marshal(packet)
+	peers, err := i.Store.GetLobby(ctx, gameID, lobby)
+	if err != nil {
+		logger.Warn("failed to get lobby", zap.Error(err))
+		return
+	}
+	for _, id := range peers {
+		if id != packet.ID {
+			if err := i.Store.Publish(ctx, gameID+lobby+id, data); err != nil {
+				logger.Error("failed to publish peer status packet", zap.Error(err))
+			}
+		}
+	}
 }
@@ -0,0 +1,40 @@
+package signaling
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+)
+
+// reapStore records the cutoffs stale lobbies are pruned with.
+type reapStore struct {
+	stores.Store
+	cutoffs []time.Duration
+}
+
+func (s *reapStore) PruneStaleLobbies(_ context.Context, staleAfter time.Duration, _ int) ([]stores.LobbyLifetime, error) {
+	s.cutoffs = append(s.cutoffs, staleAfter)
+	return nil, nil
+}
+
+func TestReapCutoff(t *testing.T) {
+	ctx := context.Background()
+
+	// A lobby is stale once it could have outlived two connections.
+	store := &reapStore{}
+	manager := &TimeoutManager{Store: store, DisconnectThreshold: time.Minute, MaxConnectionTime: 10 * time.Minute}
+	manager.ReapOnce(ctx)
+	if len(store.cutoffs) != 1 || store.cutoffs[0] != 21*time.Minute {
+		t.Fatalf("expected a cutoff of 21m, got %v", store.cutoffs)
+	}
+
+	// Without a connection cap any lobby could still have connected peers.
+	store = &reapStore{}
+	manager = &TimeoutManager{Store: store, DisconnectThreshold: time.Minute, MaxConnectionTime: -1}
+	manager.ReapOnce(ctx)
+	if len(store.cutoffs) != 0 {
+		t.Fatalf("expected nothing to be pruned without a connection cap, got %v", store.cutoffs)
+	}
+}
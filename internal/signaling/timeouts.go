@@ -0,0 +1,46 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/poki/netlib/internal/util"
+)
+
+// DefaultHandlerTimeout bounds the time a single packet can be handled for,
+// DefaultHandlerTimeouts overrides it for specific packet types.
+const DefaultHandlerTimeout = 10 * time.Second
+
+var DefaultHandlerTimeouts = map[string]time.Duration{
+	"credentials": 15 * time.Second, // upstream calls are retried for up to 10 seconds.
+	"event":       time.Second,
+	"pong":        time.Second,
+}
+
+var ErrHandlerTimeout = util.NewError("timeout", "handler timed out")
+
+func (c *Config) handlerTimeout(typ string) time.Duration {
+	if timeout, found := c.HandlerTimeouts[typ]; found {
+		return timeout
+	}
+	if timeout, found := DefaultHandlerTimeouts[typ]; found {
+		return timeout
+	}
+	return DefaultHandlerTimeout
+}
+
+// runWithTimeout runs handle with a context that expires after timeout. When
+// the deadline was hit the error is replaced with ErrHandlerTimeout, so the
+// cause is clear even if the handler returned a store or network error.
+func runWithTimeout(ctx context.Context, timeout time.Duration, typ string, handle func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := handle(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s after %s", ErrHandlerTimeout, typ, timeout)
+	}
+	return err
+}
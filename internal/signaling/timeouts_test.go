@@ -0,0 +1,49 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunWithTimeoutCutsOffSlowHandler(t *testing.T) {
+	start := time.Now()
+	err := runWithTimeout(context.Background(), 20*time.Millisecond, "create", func(ctx context.Context) error {
+		select {
+		case <-time.After(time.Minute): // A stalled store write.
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if !errors.Is(err, ErrHandlerTimeout) {
+		t.Fatalf("expected ErrHandlerTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handler wasn't cut off at the deadline, took %s", elapsed)
+	}
+}
+
+func TestRunWithTimeoutFastHandler(t *testing.T) {
+	want := errors.New("handler error")
+	err := runWithTimeout(context.Background(), time.Second, "join", func(ctx context.Context) error {
+		return want
+	})
+	if err != want {
+		t.Fatalf("expected the handler error, got %v", err)
+	}
+}
+
+func TestHandlerTimeoutOverrides(t *testing.T) {
+	config := Config{HandlerTimeouts: map[string]time.Duration{"join": time.Second}}
+	if got := config.handlerTimeout("join"); got != time.Second {
+		t.Fatalf("expected configured timeout, got %s", got)
+	}
+	if got := config.handlerTimeout("credentials"); got != DefaultHandlerTimeouts["credentials"] {
+		t.Fatalf("expected default for credentials, got %s", got)
+	}
+	if got := config.handlerTimeout("create"); got != DefaultHandlerTimeout {
+		t.Fatalf("expected default timeout, got %s", got)
+	}
+}
@@ -0,0 +1,132 @@
+package signaling
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/poki/netlib/internal/metrics"
+)
+
+// LobbyTraffic counts the signaling bytes read from and written to the
+// members of each lobby on this node. A lobby is forgotten, and its counters
+// reset, once its last member on this node left it.
+type LobbyTraffic struct {
+	mutex   sync.Mutex
+	lobbies map[lobbyKey]*trafficCounter
+}
+
+// trafficCounter is shared by the members of a lobby, members is guarded by
+// the mutex of the LobbyTraffic.
+type trafficCounter struct {
+	key     lobbyKey
+	members int
+	read    atomic.Uint64
+	written atomic.Uint64
+}
+
+// LobbyTrafficUsage is the traffic of a lobby on this node since its first
+// member on this node joined.
+type LobbyTrafficUsage struct {
+	Game         string `json:"game"`
+	Lobby        string `json:"lobby"`
+	Members      int    `json:"members"`
+	ReadBytes    uint64 `json:"readBytes"`
+	WrittenBytes uint64 `json:"writtenBytes"`
+}
+
+func NewLobbyTraffic() *LobbyTraffic {
+	return &LobbyTraffic{
+		lobbies: make(map[lobbyKey]*trafficCounter),
+	}
+}
+
+func (t *LobbyTraffic) attach(key lobbyKey) *trafficCounter {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c, found := t.lobbies[key]
+	if !found {
+		c = &trafficCounter{key: key}
+		t.lobbies[key] = c
+	}
+	c.members++
+	return c
+}
+
+func (t *LobbyTraffic) detach(c *trafficCounter) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c.members--
+	if c.members <= 0 {
+		delete(t.lobbies, c.key)
+	}
+}
+
+// Snapshot returns the traffic of the lobbies of game, or of all games when
+// game is empty, optionally limited to a single lobby. The chattiest lobbies
+// come first.
+func (t *LobbyTraffic) Snapshot(game, lobby string) []LobbyTrafficUsage {
+	t.mutex.Lock()
+	list := []LobbyTrafficUsage{}
+	for key, c := range t.lobbies {
+		if (game != "" && key.game != game) || (lobby != "" && key.lobby != lobby) {
+			continue
+		}
+		list = append(list, LobbyTrafficUsage{
+			Game:         key.game,
+			Lobby:        key.lobby,
+			Members:      c.members,
+			ReadBytes:    c.read.Load(),
+			WrittenBytes: c.written.Load(),
+		})
+	}
+	t.mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ReadBytes+list[i].WrittenBytes > list[j].ReadBytes+list[j].WrittenBytes
+	})
+	return list
+}
+
+// syncTraffic moves the traffic of the peer to the counter of its current
+// lobby, it must be called from the goroutine handling p whenever p.Lobby
+// may have changed.
+func (p *Peer) syncTraffic() {
+	if p.traffic == nil {
+		return
+	}
+	current := p.trafficCounter.Load()
+	key := lobbyKey{p.Game, p.Lobby}
+	if current != nil && current.key == key {
+		return
+	}
+	var next *trafficCounter
+	if p.Lobby != "" {
+		next = p.traffic.attach(key)
+	}
+	p.trafficCounter.Store(next)
+	if current != nil {
+		p.traffic.detach(current)
+	}
+}
+
+func (p *Peer) countRead(n int) {
+	metrics.Add("netlib_signaling_bytes_total", float64(n), "direction", "read")
+	if c := p.trafficCounter.Load(); c != nil {
+		c.read.Add(uint64(n))
+	}
+}
+
+func (p *Peer) countWritten(n int) {
+	metrics.Add("netlib_signaling_bytes_total", float64(n), "direction", "written")
+	if c := p.trafficCounter.Load(); c != nil {
+		c.written.Add(uint64(n))
+	}
+}
+
+// stopTraffic detaches the peer from the counter of its lobby when the
+// connection closes.
+func (p *Peer) stopTraffic() {
+	if c := p.trafficCounter.Swap(nil); c != nil {
+		p.traffic.detach(c)
+	}
+}
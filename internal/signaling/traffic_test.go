@@ -0,0 +1,38 @@
+package signaling
+
+import "testing"
+
+func TestLobbyTraffic(t *testing.T) {
+	traffic := NewLobbyTraffic()
+	a := &Peer{traffic: traffic, Game: "game", Lobby: "a"}
+	b := &Peer{traffic: traffic, Game: "game", Lobby: "a"}
+	a.syncTraffic()
+	b.syncTraffic()
+
+	a.countRead(10)
+	b.countWritten(5)
+	usage := traffic.Snapshot("game", "a")
+	if len(usage) != 1 || usage[0].Members != 2 || usage[0].ReadBytes != 10 || usage[0].WrittenBytes != 5 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	// Switching lobbies moves the traffic that follows to the new lobby.
+	b.Lobby = "b"
+	b.syncTraffic()
+	b.countRead(7)
+	usage = traffic.Snapshot("game", "")
+	if len(usage) != 2 || usage[0].Lobby != "a" || usage[0].Members != 1 || usage[1].ReadBytes != 7 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	// The counters reset once the last member left.
+	a.stopTraffic()
+	a.countRead(100)
+	if usage := traffic.Snapshot("game", "a"); len(usage) != 0 {
+		t.Fatalf("expected lobby a to be forgotten, got %+v", usage)
+	}
+	a.syncTraffic()
+	if usage := traffic.Snapshot("game", "a"); len(usage) != 1 || usage[0].ReadBytes != 0 {
+		t.Fatalf("expected reset counters, got %+v", usage)
+	}
+}
@@ -2,6 +2,7 @@ package signaling
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/poki/netlib/internal/cloudflare"
 	"github.com/poki/netlib/internal/metrics"
@@ -19,6 +20,11 @@ type HelloPacket struct {
 	ID     string `json:"id"`
 	Secret string `json:"secret"`
 	Lobby  string `json:"lobby"`
+	// PlayerToken is the token of an earlier welcome, it keeps the PlayerID.
+	PlayerToken string `json:"playerToken"`
+
+	Capabilities    []string `json:"capabilities"`
+	ProtocolVersion int      `json:"protocolVersion"`
 }
 
 type WelcomePacket struct {
@@ -26,13 +32,67 @@ type WelcomePacket struct {
 
 	ID     string `json:"id"`
 	Secret string `json:"secret"`
+
+	Capabilities    []string `json:"capabilities,omitempty"`
+	ProtocolVersion int      `json:"protocolVersion"`
+
+	// Node is the node the client is connected to, see Config.NodeID.
+	Node string `json:"node,omitempty"`
+
+	// PlayerID identifies the player across sessions, see Peer.PlayerID. The
+	// client keeps PlayerToken to present in the hello of its next session.
+	PlayerID    string `json:"playerId,omitempty"`
+	PlayerToken string `json:"playerToken,omitempty"`
+
+	// ClosedLobby is set when a hello rejoining a lobby finds it closed, see
+	// ReconnectedPacket.
+	ClosedLobby *LobbyClosure `json:"closedLobby,omitempty"`
+}
+
+// ReconnectPacket is sent on a fresh connection to reclaim the identity of a
+// peer that lost its socket, Secret is the token received in the welcome.
+type ReconnectPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Game        string `json:"game"`
+	ID          string `json:"id"`
+	Secret      string `json:"secret"`
+	Lobby       string `json:"lobby"`
+	PlayerToken string `json:"playerToken"`
+
+	Capabilities    []string `json:"capabilities"`
+	ProtocolVersion int      `json:"protocolVersion"`
+}
+
+type ReconnectedPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	ID          string `json:"id"`
+	Secret      string `json:"secret"`
+	PlayerID    string `json:"playerId,omitempty"`
+	PlayerToken string `json:"playerToken,omitempty"`
+
+	Lobby    string                    `json:"lobby,omitempty"`
+	Peers    []string                  `json:"peers,omitempty"`
+	PeerData map[string]map[string]any `json:"peerData,omitempty"`
+	Seats    map[string]int            `json:"seats,omitempty"`
+	Affinity *Affinity                 `json:"affinity,omitempty"`
+	// ClosedLobby is set instead of Lobby when the lobby the peer reconnected
+	// to was closed while it was away.
+	ClosedLobby *LobbyClosure `json:"closedLobby,omitempty"`
+
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
 type ListPacket struct {
 	RequestID string `json:"rid"`
 	Type      string `json:"type"`
 
-	Filter string `json:"filter"`
+	Filter   string    `json:"filter"`
+	HideFull bool      `json:"hideFull"`
+	Sort     *ListSort `json:"sort"`
 }
 
 type LobbiesPacket struct {
@@ -42,6 +102,20 @@ type LobbiesPacket struct {
 	Lobbies []stores.Lobby `json:"lobbies"`
 }
 
+type GetLobbyPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Lobby string `json:"lobby"`
+}
+
+type LobbyInfoPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Lobby stores.Lobby `json:"lobby"`
+}
+
 type CreatePacket struct {
 	RequestID string `json:"rid"`
 	Type      string `json:"type"`
@@ -50,14 +124,70 @@ type CreatePacket struct {
 	Public     bool           `json:"public"`
 	Password   string         `json:"password"`
 	MaxPlayers int            `json:"maxPlayers"`
+	AutoStart  bool           `json:"autoStart"`
 	CustomData map[string]any `json:"customData"`
+	// MaxSpectators is the number of peers that can join as a spectator on
+	// top of MaxPlayers, zero disallows spectators.
+	MaxSpectators int `json:"maxSpectators"`
+	// CloseAt closes the lobby at this time regardless of activity.
+	CloseAt *time.Time `json:"closeAt"`
+	// Limits override the rate limits of the node for the peers in the lobby,
+	// up to Config.MaxLobbyLimits.
+	Limits stores.LobbyLimits `json:"limits"`
+
+	PeerData map[string]any `json:"peerData"`
+	// PublicKey is distributed as the PublicKeyField of the peer data.
+	PublicKey string `json:"publicKey"`
 }
 
 type JoinPacket struct {
 	RequestID string `json:"rid"`
 	Type      string `json:"type"`
 
-	Lobby string `json:"lobby"`
+	Lobby     string         `json:"lobby"`
+	Invite    string         `json:"invite"`
+	PeerData  map[string]any `json:"peerData"`
+	PublicKey string         `json:"publicKey"`
+	// Role is "player" or "spectator", empty joins as a player. Invites are
+	// only for players.
+	Role stores.Role `json:"role"`
+}
+
+// SwitchLobbyPacket moves the peer from its current lobby to Lobby, the
+// reply is a joined packet.
+type SwitchLobbyPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Lobby     string         `json:"lobby"`
+	PeerData  map[string]any `json:"peerData"`
+	PublicKey string         `json:"publicKey"`
+}
+
+type CreateInvitePacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	MaxUses   int `json:"maxUses"`
+	ExpiresIn int `json:"expiresIn"` // seconds
+}
+
+type InvitePacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Token     string `json:"token"`
+	MaxUses   int    `json:"maxUses"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type MatchmakePacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	MaxPlayers int            `json:"maxPlayers"`
+	PeerData   map[string]any `json:"peerData"`
+	PublicKey  string         `json:"publicKey"`
 }
 
 type JoinedPacket struct {
@@ -65,13 +195,268 @@ type JoinedPacket struct {
 	Type      string `json:"type"`
 
 	Lobby string `json:"lobby"`
+	// Seats holds the join index of every peer in the lobby, see stores.Store.GetSeats.
+	Seats map[string]int `json:"seats,omitempty"`
+	// Affinity is the node hosting the lobby, clients can prefer it when
+	// they reconnect.
+	Affinity *Affinity `json:"affinity,omitempty"`
+}
+
+type SetVisibilityPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Public bool `json:"public"`
+}
+
+type VisibilityPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby  string `json:"lobby"`
+	Public bool   `json:"public"`
+}
+
+// UpdateLobbyPacket changes the settings of the lobby, only the leader can
+// send it. A nil CloseAt cancels a scheduled close.
+type UpdateLobbyPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	CloseAt *time.Time `json:"closeAt"`
+}
+
+type LobbyUpdatedPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby   string     `json:"lobby"`
+	CloseAt *time.Time `json:"closeAt,omitempty"`
+}
+
+type SubscribeMembersPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+type UnsubscribeMembersPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+type Member struct {
+	ID   string         `json:"id"`
+	Data map[string]any `json:"data,omitempty"`
+	// Player is the PlayerID of the peer, empty when it has none.
+	Player string      `json:"player,omitempty"`
+	Role   stores.Role `json:"role"`
+}
+
+// MembersPacket is the roster of the lobby at Version, the members-delta
+// packets that follow continue from it.
+type MembersPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby   string   `json:"lobby"`
+	Version int64    `json:"version"`
+	Members []Member `json:"members"`
+}
+
+type MembersDeltaPacket struct {
+	Type string `json:"type"`
+
+	Lobby   string         `json:"lobby"`
+	Version int64          `json:"version"`
+	Op      string         `json:"op"`
+	ID      string         `json:"id"`
+	Data    map[string]any `json:"data,omitempty"`
+	Player  string         `json:"player,omitempty"`
+	// Role is only set when a peer is added.
+	Role stores.Role `json:"role,omitempty"`
+}
+
+type SetPeerDataPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	PeerData map[string]any `json:"peerData"`
+}
+
+type PeerDataPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	ID       string         `json:"id"`
+	PeerData map[string]any `json:"peerData"`
+}
+
+type SetReadyPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Ready bool `json:"ready"`
+}
+
+type ResetReadyPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+type ReadyPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Ready []string `json:"ready"`
+	Total int      `json:"total"`
+}
+
+type AllReadyPacket struct {
+	Type string `json:"type"`
+
+	Lobby string `json:"lobby"`
+}
+
+type StartPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+// SetLobbyStatePacket closes the lobby to new peers or reopens it, see
+// stores.LobbyStateWaiting.
+type SetLobbyStatePacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	State string `json:"state"`
+}
+
+type LobbyStatePacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby string `json:"lobby"`
+	State string `json:"state"`
+}
+
+type MatchmakingTicketPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Skill       float64           `json:"skill"`
+	MaxPlayers  int               `json:"maxPlayers"`
+	Preferences map[string]string `json:"preferences"`
+}
+
+type CancelTicketPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Ticket string `json:"ticket"`
+}
+
+// TicketPacket is the reply to a matchmaking-ticket or cancel-ticket packet,
+// and sent when a ticket expired. ExpiresAt is in milliseconds.
+type TicketPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Ticket    string `json:"ticket"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+type TicketMatchedPacket struct {
+	Type string `json:"type"`
+
+	Ticket string `json:"ticket"`
+	Lobby  string `json:"lobby"`
+}
+
+type SubscribePresencePacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Players []string `json:"players"`
+}
+
+type UnsubscribePresencePacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+}
+
+// PlayerPresence is whether a player is connected and the lobby it's in.
+type PlayerPresence struct {
+	Player string `json:"player"`
+	Online bool   `json:"online"`
+	Lobby  string `json:"lobby,omitempty"`
+}
+
+type PresencePacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Players []PlayerPresence `json:"players"`
+}
+
+type PresenceChangedPacket struct {
+	PlayerPresence
+	Type string `json:"type"`
+}
+
+// LobbyStartPacket is sent to all peers when the lobby starts, StartedAt is
+// the server time in milliseconds so clients can synchronize a countdown.
+type LobbyStartPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby     string `json:"lobby"`
+	Seed      string `json:"seed"`
+	StartedAt int64  `json:"startedAt"`
+}
+
+type TransferLeaderPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Leader string `json:"leader"`
+}
+
+// LeaderPacket is sent to all peers when the leader of the lobby changes.
+type LeaderPacket struct {
+	RequestID string `json:"rid,omitempty"`
+	Type      string `json:"type"`
+
+	Lobby  string `json:"lobby"`
+	Leader string `json:"leader"`
+}
+
+// ConnectionResultPacket is reported by clients once a connection to Peer
+// was established (or failed), CandidateType is the type of the local
+// candidate of the selected pair: host, srflx, prflx or relay.
+type ConnectionResultPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
+
+	Peer          string `json:"peer"`
+	Result        string `json:"result"`
+	CandidateType string `json:"candidateType"`
+}
+
+// PeerStatusPacket tells the lobby a peer lost its connection
+// ("peer-reconnecting") and got it back ("peer-reconnected").
+type PeerStatusPacket struct {
+	Type string `json:"type"`
+
+	ID string `json:"id"`
 }
 
 type ConnectPacket struct {
 	Type string `json:"type"`
 
-	ID     string `json:"id"`
-	Polite bool   `json:"polite"`
+	ID       string         `json:"id"`
+	Polite   bool           `json:"polite"`
+	PeerData map[string]any `json:"peerData,omitempty"`
+	Seat     int            `json:"seat"`
 }
 
 type DisconnectPacket struct {
@@ -93,11 +478,44 @@ type ForwardablePacket struct {
 
 	Source    string `json:"source"`
 	Recipient string `json:"recipient"`
+	// Recipients or Broadcast forward the packet to several members of the
+	// lobby at once instead of the single Recipient.
+	Recipients []string `json:"recipients,omitempty"`
+	Broadcast  bool     `json:"broadcast,omitempty"`
+}
+
+type AckPacket struct {
+	Type string `json:"type"`
+
+	MessageID string `json:"messageId"`
+}
+
+type NackPacket struct {
+	Type string `json:"type"`
+
+	MessageID string `json:"messageId"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// CredentialsPacket holds the Cloudflare TURN credentials at the top level
+// for older clients, IceServers also holds the static ICE servers.
+// ServerTime is the time of the server in milliseconds, clients compare the
+// ExpiresAt of the credentials to it rather than to their own clock.
+// CredentialsRequestPacket asks for the ICE servers, the reply is a
+// CredentialsPacket or an error with the same RequestID.
+type CredentialsRequestPacket struct {
+	RequestID string `json:"rid"`
+	Type      string `json:"type"`
 }
 
 type CredentialsPacket struct {
 	cloudflare.Credentials
-	Type string `json:"type"`
+	RequestID  string `json:"rid,omitempty"`
+	Type       string `json:"type"`
+	ServerTime int64  `json:"serverTime"`
+
+	IceServers []ICEServer `json:"iceServers,omitempty"`
 }
 
 type EventPacket struct {
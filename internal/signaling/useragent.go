@@ -0,0 +1,46 @@
+package signaling
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// UserAgentSampleRate is the fraction of connections for which the raw
+// User-Agent and its classification are logged.
+const UserAgentSampleRate = 0.01
+
+// classifyUserAgent returns the browser class used to decide on the Safari
+// compression workaround. Chrome and Android user agents also contain "safari"
+// so those are classified first.
+func classifyUserAgent(userAgent string) string {
+	userAgentLower := strings.ToLower(userAgent)
+	switch {
+	case userAgentLower == "":
+		return "unknown"
+	case strings.Contains(userAgentLower, "chrome"):
+		return "chrome"
+	case strings.Contains(userAgentLower, "android"):
+		return "android"
+	case strings.Contains(userAgentLower, "safari"):
+		return "safari"
+	default:
+		return "other"
+	}
+}
+
+// isSafari reports whether the connection should have compression disabled,
+// Safari's permessage-deflate implementation is broken.
+func isSafari(ctx context.Context, userAgent string) bool {
+	class := classifyUserAgent(userAgent)
+	metrics.Inc("netlib_safari_detection_total", "class", class)
+	if rand.Float64() < UserAgentSampleRate {
+		logger := logging.GetLogger(ctx)
+		logger.Info("user agent classified", zap.String("user_agent", userAgent), zap.String("class", class))
+	}
+	return class == "safari"
+}
@@ -0,0 +1,110 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/poki/netlib/internal/signaling/stores"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// visibilityStore keeps a lobby of a, b and c with a as its leader.
+type visibilityStore struct {
+	stores.Store
+
+	mutex     sync.Mutex
+	public    bool
+	published map[string][]VisibilityPacket
+}
+
+func (s *visibilityStore) SetLobbyVisibility(_ context.Context, _, _, id string, public bool) ([]string, error) {
+	if id != "a" {
+		return nil, stores.ErrNotLeader
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.public = public
+	return []string{"a", "b", "c"}, nil
+}
+
+func (s *visibilityStore) Publish(_ context.Context, topic string, data []byte) error {
+	packet := VisibilityPacket{}
+	if err := json.Unmarshal(data, &packet); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.published == nil {
+		s.published = make(map[string][]VisibilityPacket)
+	}
+	s.published[topic] = append(s.published[topic], packet)
+	return nil
+}
+
+func TestSetVisibility(t *testing.T) {
+	store := &visibilityStore{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		for _, id := range []string{"b", "a"} {
+			p := &Peer{store: store, conn: conn, config: &Config{}, ID: id, Game: "game", Lobby: "lobby"}
+			if err := p.HandleSetVisibilityPacket(r.Context(), SetVisibilityPacket{Type: "set-visibility", RequestID: id, Public: true}); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	// Only the leader can change the visibility.
+	reply := struct {
+		RequestID string `json:"rid"`
+		Type      string `json:"type"`
+		Code      string `json:"code"`
+	}{}
+	if err := wsjson.Read(ctx, conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.RequestID != "b" || reply.Type != "error" || reply.Code != "not-leader" {
+		t.Fatalf("expected a not-leader error for b, got %+v", reply)
+	}
+
+	update := VisibilityPacket{}
+	if err := wsjson.Read(ctx, conn, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.RequestID != "a" || update.Type != "visibility" || update.Lobby != "lobby" || !update.Public {
+		t.Fatalf("expected the leader to get the update as a reply, got %+v", update)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if !store.public {
+		t.Fatal("expected the lobby to be public")
+	}
+	if len(store.published["gamelobbya"]) != 0 {
+		t.Fatalf("expected the leader not to be sent the update, got %v", store.published["gamelobbya"])
+	}
+	for _, id := range []string{"b", "c"} {
+		got := store.published["gamelobby"+id]
+		if len(got) != 1 || got[0].Type != "visibility" || !got[0].Public || got[0].RequestID != "" {
+			t.Fatalf("expected %s to be told the lobby is public, got %+v", id, got)
+		}
+	}
+}
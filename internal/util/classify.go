@@ -0,0 +1,73 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrProtocol marks errors caused by a client sending packets that don't
+// follow the protocol, wrap it with fmt.Errorf("%w: %w", ErrProtocol, err).
+var ErrProtocol = errors.New("protocol error")
+
+// ErrorClass tells apart the reasons a connection ends so they can be logged
+// and closed appropriately.
+type ErrorClass int
+
+const (
+	// ErrorClassServer is a genuine server side issue, e.g. a store error.
+	ErrorClassServer ErrorClass = iota
+	// ErrorClassClosed is a normal disconnect: the client closed the socket,
+	// the connection was reset or the server is shutting down.
+	ErrorClassClosed
+	// ErrorClassProtocol is a client bug, e.g. a packet that isn't valid json.
+	ErrorClassProtocol
+	// ErrorClassPolicy is a client going over a limit, e.g. the read limit.
+	ErrorClassPolicy
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassClosed:
+		return "closed"
+	case ErrorClassProtocol:
+		return "protocol"
+	case ErrorClassPolicy:
+		return "policy"
+	default:
+		return "server"
+	}
+}
+
+// policyCodes are the codes of Errors that mean a client went over a limit.
+var policyCodes = map[string]bool{
+	"rate-limited":          true,
+	"packet-too-large":      true,
+	"store-budget-exceeded": true,
+}
+
+// ClassifyError returns the ErrorClass of an error that ended a connection.
+func ClassifyError(err error) ErrorClass {
+	if IsPipeError(err) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return ErrorClassClosed
+	}
+
+	var coded *Error
+	if errors.As(err, &coded) && policyCodes[coded.Code] {
+		return ErrorClassPolicy
+	}
+	// The websocket library doesn't export an error for this, it already
+	// closed the connection with StatusMessageTooBig.
+	if strings.Contains(err.Error(), "read limited at") {
+		return ErrorClassPolicy
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.Is(err, ErrProtocol) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrorClassProtocol
+	}
+	return ErrorClassServer
+}
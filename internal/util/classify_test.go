@@ -0,0 +1,42 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestClassifyError(t *testing.T) {
+	var syntaxErr error
+	if err := json.Unmarshal([]byte("{"), &struct{}{}); err != nil {
+		syntaxErr = err
+	}
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"eof", io.EOF, ErrorClassClosed},
+		{"close frame", websocket.CloseError{Code: websocket.StatusGoingAway}, ErrorClassClosed},
+		{"reset", fmt.Errorf("read: %w", syscall.ECONNRESET), ErrorClassClosed},
+		{"canceled", context.Canceled, ErrorClassClosed},
+		{"invalid json", syntaxErr, ErrorClassProtocol},
+		{"wrapped json", fmt.Errorf("unable to unmarshal json: %w", syntaxErr), ErrorClassProtocol},
+		{"marked", fmt.Errorf("%w: invalid source set", ErrProtocol), ErrorClassProtocol},
+		{"read limit", errors.New("failed to read: read limited at 32769 bytes"), ErrorClassPolicy},
+		{"rate limit", NewError("rate-limited", "too fast"), ErrorClassPolicy},
+		{"store budget", NewError("store-budget-exceeded", "too many store operations"), ErrorClassPolicy},
+		{"store", errors.New("connection to database refused"), ErrorClassServer},
+	}
+	for _, test := range tests {
+		if got := ClassifyError(test.err); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, got)
+		}
+	}
+}
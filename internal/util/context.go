@@ -0,0 +1,20 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+// WithoutCancel returns a context with the values of ctx that isn't done when
+// ctx is, like context.WithoutCancel in newer Go versions.
+func WithoutCancel(ctx context.Context) context.Context {
+	return withoutCancel{ctx}
+}
+
+type withoutCancel struct {
+	context.Context
+}
+
+func (withoutCancel) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (withoutCancel) Done() <-chan struct{}       { return nil }
+func (withoutCancel) Err() error                  { return nil }
@@ -0,0 +1,43 @@
+package util
+
+// Error is an error with a stable machine-readable code, and optionally
+// parameters, so clients can show their own localized message. The message
+// is meant for debugging and logs.
+type Error struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Params  map[string]any `json:"params,omitempty"`
+}
+
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) ErrorCode() string {
+	return e.Code
+}
+
+// WithParams returns a copy of e with the given key/value parameters, the
+// copy still matches e with errors.Is.
+func (e *Error) WithParams(kv ...any) *Error {
+	if len(kv)%2 != 0 {
+		panic("params must be pairs")
+	}
+	params := make(map[string]any, len(e.Params)+len(kv)/2)
+	for k, v := range e.Params {
+		params[k] = v
+	}
+	for i := 0; i < len(kv); i += 2 {
+		params[kv[i].(string)] = kv[i+1]
+	}
+	return &Error{Code: e.Code, Message: e.Message, Params: params}
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
@@ -47,34 +47,69 @@ func ErrorAndAbort(w http.ResponseWriter, r *http.Request, status int, key strin
 	panic(http.ErrAbortHandler)
 }
 
+// ErrorAndDisconnect ends the connection because of err, how it's logged and
+// the close code depend on the ErrorClass of err. It doesn't return.
 func ErrorAndDisconnect(ctx context.Context, conn *websocket.Conn, err error) {
 	logger := logging.GetLogger(ctx)
-	if !IsPipeError(err) {
-		logger.Warn("error during connection", zap.Error(err))
+	class := ClassifyError(err)
+	switch class {
+	case ErrorClassClosed:
+		logger.Debug("connection closed", zap.Error(err))
+	case ErrorClassProtocol:
+		logger.Warn("client protocol error", zap.Error(err))
+		ReplyError(ctx, conn, err)
+		conn.Close(websocket.StatusInvalidFramePayloadData, "protocol error") //nolint:errcheck
+	case ErrorClassPolicy:
+		logger.Warn("client violated policy", zap.Error(err))
+		ReplyError(ctx, conn, err)
+		conn.Close(websocket.StatusPolicyViolation, "policy violation") //nolint:errcheck
+	default:
+		logger.Error("error during connection", zap.Error(err))
+		ReplyError(ctx, conn, err)
+		conn.Close(websocket.StatusInternalError, "internal error") //nolint:errcheck
 	}
-	ReplyError(ctx, conn, err)
 	panic(http.ErrAbortHandler)
 }
 
 func ReplyError(ctx context.Context, conn *websocket.Conn, err error) {
+	ReplyRequestError(ctx, conn, "", err)
+}
+
+// ReplyRequestError is like ReplyError but includes the request ID of the
+// packet that caused the error so clients can match it to their request.
+func ReplyRequestError(ctx context.Context, conn *websocket.Conn, requestID string, err error) {
+	err = wsjson.Write(ctx, conn, RequestErrorPacket(requestID, err))
+	if err != nil && !IsPipeError(err) {
+		logger := logging.GetLogger(ctx)
+		logger.Warn("uncaught server error", zap.Error(err), zap.Stack("stack"))
+	}
+}
+
+// RequestErrorPacket returns the error packet ReplyRequestError sends, for
+// connections that encode their packets themselves.
+func RequestErrorPacket(requestID string, err error) any {
 	payload := struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
-		Error   any    `json:"error,omitempty"`
-		Code    string `json:"code,omitempty"`
+		RequestID string         `json:"rid,omitempty"`
+		Type      string         `json:"type"`
+		Message   string         `json:"message"`
+		Error     any            `json:"error,omitempty"`
+		Code      string         `json:"code,omitempty"`
+		Params    map[string]any `json:"params,omitempty"`
 	}{
-		Type:    "error",
-		Message: err.Error(),
-		Error:   err,
+		RequestID: requestID,
+		Type:      "error",
+		Message:   err.Error(),
+		Error:     err,
 	}
-	if cerr, ok := err.(interface{ ErrorCode() string }); ok {
+	var coded *Error
+	if errors.As(err, &coded) {
+		payload.Code = coded.Code
+		payload.Params = coded.Params
+		payload.Error = nil
+	} else if cerr, ok := err.(interface{ ErrorCode() string }); ok {
 		payload.Code = cerr.ErrorCode()
 	}
-	err = wsjson.Write(ctx, conn, &payload)
-	if err != nil && !IsPipeError(err) {
-		logger := logging.GetLogger(ctx)
-		logger.Warn("uncaught server error", zap.Error(err), zap.Stack("stack"))
-	}
+	return &payload
 }
 
 // RenderJSON will write a json response to the given ResponseWriter.
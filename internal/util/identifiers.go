@@ -2,11 +2,15 @@ package util
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
 	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"unicode"
 
 	crand "crypto/rand"
 
@@ -36,12 +40,137 @@ func GenerateSecret(ctx context.Context) string {
 	return strings.ToLower(base32.StdEncoding.EncodeToString(buf))
 }
 
+// GenerateSeed returns a random seed for peers to agree on, it's generated on
+// the server so no client can bias it.
+func GenerateSeed(ctx context.Context) string {
+	if os.Getenv("ENV") == "test" {
+		return "0123456789abcdef0123456789abcdef" // deterministic for testing
+	}
+
+	buf := make([]byte, 16)
+	if _, err := crand.Read(buf[:]); err != nil {
+		logger := logging.GetLogger(ctx)
+		logger.Error("error generating seed", zap.Error(err))
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// GenerateInviteToken returns a token that grants access to a lobby without
+// revealing its code.
+func GenerateInviteToken(ctx context.Context) string {
+	if os.Getenv("ENV") == "test" {
+		return "invite" + strconv.FormatInt(rand.Int63(), 36) // deterministic for testing
+	}
+
+	buf := make([]byte, 15)
+	if _, err := crand.Read(buf[:]); err != nil {
+		logger := logging.GetLogger(ctx)
+		logger.Error("error generating invite token", zap.Error(err))
+		panic(err)
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(buf))
+}
+
 func GenerateLobbyCode(ctx context.Context) string {
 	return strconv.FormatInt(rand.Int63(), 36)
 }
 
+const caseSensitiveCodeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// GenerateCaseSensitiveLobbyCode returns a code of 12 letters and digits in
+// both cases, a much larger space than GenerateLobbyCode for deployments that
+// don't fold the case of codes.
+func GenerateCaseSensitiveLobbyCode(ctx context.Context) string {
+	code := make([]byte, 12)
+	for i := range code {
+		code[i] = caseSensitiveCodeAlphabet[rand.Intn(len(caseSensitiveCodeAlphabet))]
+	}
+	return string(code)
+}
+
+// DeriveLobbyCode returns a code like GenerateLobbyCode, or with caseSensitive
+// GenerateCaseSensitiveLobbyCode, that only depends on seed.
+func DeriveLobbyCode(seed string, caseSensitive bool) string {
+	sum := sha256.Sum256([]byte(seed))
+	if !caseSensitive {
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(sum[:8])>>1), 36)
+	}
+	code := make([]byte, 12)
+	for i := range code {
+		code[i] = caseSensitiveCodeAlphabet[int(sum[i])%len(caseSensitiveCodeAlphabet)]
+	}
+	return string(code)
+}
+
+// The alphabets of GenerateShortLobbyCode, they leave out the characters that
+// are easily confused with others (0, 1, I, L, O, Q and U).
+const (
+	shortCodeDigits  = "23456789"
+	shortCodeLetters = "ABCDEFGHJKMNPRSTVWXYZ"
+)
+
+// IsShortLobbyCode reports whether code has the format of GenerateShortLobbyCode.
+func IsShortLobbyCode(code string) bool {
+	if len(code) != 4 {
+		return false
+	}
+	return strings.ContainsRune(shortCodeDigits, rune(code[0])) && strings.ContainsRune(shortCodeDigits, rune(code[1])) &&
+		strings.ContainsRune(shortCodeLetters, rune(code[2])) && strings.ContainsRune(shortCodeLetters, rune(code[3]))
+}
+
 func GenerateShortLobbyCode(ctx context.Context) string {
-	numbers := []string{"2", "3", "4", "5", "6", "7", "8", "9"}
-	alphabet := []string{"A", "B", "C", "D", "E", "F", "G", "H", "J", "K", "M", "N", "P", "R", "S", "T", "V", "W", "X", "Y", "Z"}
-	return numbers[rand.Intn(len(numbers))] + numbers[rand.Intn(len(numbers))] + alphabet[rand.Intn(len(alphabet))] + alphabet[rand.Intn(len(alphabet))]
+	return string([]byte{
+		shortCodeDigits[rand.Intn(len(shortCodeDigits))],
+		shortCodeDigits[rand.Intn(len(shortCodeDigits))],
+		shortCodeLetters[rand.Intn(len(shortCodeLetters))],
+		shortCodeLetters[rand.Intn(len(shortCodeLetters))],
+	})
+}
+
+// Characters typed in the wrong half of a short code, mapped to the character
+// they're mistaken for. Only characters that never occur in that half are
+// mapped, so a valid code is never changed.
+var (
+	shortCodeAsDigit  = strings.NewReplacer("Z", "2", "S", "5", "G", "6", "B", "8")
+	shortCodeAsLetter = strings.NewReplacer("2", "Z", "5", "S", "6", "G", "8", "B", "U", "V")
+)
+
+// NormalizeLobbyCode undoes the typos and copy-paste artifacts of a lobby code
+// typed by a user: surrounding whitespace is trimmed, a code that is a short
+// code once uppercased and with its confusable characters mapped becomes that
+// short code, and other codes of letters and digits are lowercased like
+// GenerateLobbyCode. Generated codes are returned as is, a GenerateLobbyCode
+// code is (practically) never 4 characters long.
+func NormalizeLobbyCode(code string) string {
+	return normalizeLobbyCode(code, true)
+}
+
+// NormalizeCaseSensitiveLobbyCode is NormalizeLobbyCode without lowercasing
+// the codes that aren't short codes, see GenerateCaseSensitiveLobbyCode.
+// Short codes are uppercase only so they're still recognized in any case.
+func NormalizeCaseSensitiveLobbyCode(code string) string {
+	return normalizeLobbyCode(code, false)
+}
+
+func normalizeLobbyCode(code string, fold bool) string {
+	code = strings.TrimFunc(code, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '\u200b' || r == '\ufeff'
+	})
+	for _, r := range code {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return code
+		}
+	}
+	if len(code) == 4 {
+		upper := strings.ToUpper(code)
+		short := shortCodeAsDigit.Replace(upper[:2]) + shortCodeAsLetter.Replace(upper[2:])
+		if IsShortLobbyCode(short) {
+			return short
+		}
+	}
+	if !fold {
+		return code
+	}
+	return strings.ToLower(code)
 }
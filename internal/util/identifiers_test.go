@@ -0,0 +1,128 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLobbyCode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"23AB", "23AB"},
+		{" 23AB\n", "23AB"},
+		{"​23AB ", "23AB"},
+		{"23ab", "23AB"},
+		{"z3a8", "23AB"},
+		{"ZSAB", "25AB"},
+		{"2385", "23BS"},
+		{"23AU", "23AV"},
+		{"230B", "230b"}, // Short codes never hold a 0, there is nothing to map it to.
+		{"k3f8z1a9q2xw", "k3f8z1a9q2xw"},
+		{" K3F8Z1A9Q2XW ", "k3f8z1a9q2xw"},
+		{"my-lobby", "my-lobby"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := NormalizeLobbyCode(test.input); got != test.want {
+			t.Errorf("NormalizeLobbyCode(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeLobbyCodeKeepsGeneratedCodes(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		if code := GenerateShortLobbyCode(ctx); NormalizeLobbyCode(code) != code {
+			t.Fatalf("expected short code %q to be kept", code)
+		}
+		if code := GenerateLobbyCode(ctx); NormalizeLobbyCode(code) != code {
+			t.Fatalf("expected code %q to be kept", code)
+		}
+	}
+}
+
+func TestNormalizeCaseSensitiveLobbyCode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"23ab", "23AB"}, // Short codes are uppercase only, so they're still folded.
+		{"z3a8", "23AB"},
+		{"k3f8Z1a9Q2xw", "k3f8Z1a9Q2xw"},
+		{" K3F8Z1A9Q2XW\n", "K3F8Z1A9Q2XW"},
+		{"My-Lobby", "My-Lobby"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := NormalizeCaseSensitiveLobbyCode(test.input); got != test.want {
+			t.Errorf("NormalizeCaseSensitiveLobbyCode(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestCaseSensitiveLobbyCodes(t *testing.T) {
+	ctx := context.Background()
+	mixed := false
+	for i := 0; i < 1000; i++ {
+		code := GenerateCaseSensitiveLobbyCode(ctx)
+		if NormalizeCaseSensitiveLobbyCode(code) != code {
+			t.Fatalf("expected code %q to be kept", code)
+		}
+		if strings.ToLower(code) != code && strings.ToUpper(code) != code {
+			mixed = true
+		}
+	}
+	if !mixed {
+		t.Fatal("expected mixed case codes")
+	}
+
+	// Codes that only differ in case stay different, folding them would
+	// resolve one of them to the other lobby.
+	if NormalizeCaseSensitiveLobbyCode("abcdefghijkl") == NormalizeCaseSensitiveLobbyCode("ABCDEFGHIJKL") {
+		t.Fatal("expected codes that differ in case to be kept apart")
+	}
+	// Codes generated when folding are lowercase, so folding never resolves
+	// one generated code to another.
+	for i := 0; i < 1000; i++ {
+		if code := GenerateLobbyCode(ctx); strings.ToLower(code) != code {
+			t.Fatalf("expected code %q to be lowercase", code)
+		}
+	}
+}
+
+func TestDeriveLobbyCode(t *testing.T) {
+	for _, caseSensitive := range []bool{false, true} {
+		code := DeriveLobbyCode("a,b", caseSensitive)
+		if DeriveLobbyCode("a,b", caseSensitive) != code {
+			t.Fatalf("expected the same seed to derive %q again", code)
+		}
+		if DeriveLobbyCode("a,c", caseSensitive) == code {
+			t.Fatalf("expected another seed to derive another code than %q", code)
+		}
+		normalized := NormalizeLobbyCode(code)
+		if caseSensitive {
+			normalized = NormalizeCaseSensitiveLobbyCode(code)
+		}
+		if normalized != code {
+			t.Fatalf("expected derived code %q to be kept", code)
+		}
+	}
+}
+
+func TestGenerateSeed(t *testing.T) {
+	ctx := context.Background()
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seed := GenerateSeed(ctx)
+		if len(seed) != 32 || strings.Trim(seed, "0123456789abcdef") != "" {
+			t.Fatalf("expected a 128 bit hex seed, got %q", seed)
+		}
+		if seen[seed] {
+			t.Fatalf("expected unique seeds, got %q twice", seed)
+		}
+		seen[seed] = true
+	}
+}
@@ -0,0 +1,160 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/koenbollen/logging"
+	"github.com/poki/netlib/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const timeout = 5 * time.Second
+const maxAttempts = 5
+const backoff = 500 * time.Millisecond
+const workers = 2
+const queueSize = 1024
+
+// SignatureHeader holds the hex encoded HMAC-SHA256 of the request body,
+// signed with the shared secret.
+const SignatureHeader = "X-Netlib-Signature"
+
+type Event struct {
+	Type  string `json:"type"`
+	Time  int64  `json:"time"`
+	Game  string `json:"game"`
+	Lobby string `json:"lobby"`
+	Peer  string `json:"peer,omitempty"`
+}
+
+// Client posts lobby lifecycle events to a webhook. Events are queued and
+// sent in the background, Emit never blocks.
+type Client struct {
+	url    string
+	secret []byte
+	events map[string]bool
+	client http.Client
+	queue  chan Event
+
+	// DeadLetter is called with events that couldn't be delivered after all
+	// attempts, it may be nil.
+	DeadLetter func(ctx context.Context, event Event, payload []byte, err error)
+}
+
+// New returns a Client that sends the given event types, or all event types
+// when events is empty.
+func New(url, secret string, events []string) *Client {
+	c := &Client{
+		url:    url,
+		secret: []byte(secret),
+		client: http.Client{Timeout: timeout},
+		queue:  make(chan Event, queueSize),
+	}
+	if len(events) > 0 {
+		c.events = make(map[string]bool)
+		for _, e := range events {
+			c.events[e] = true
+		}
+	}
+	return c
+}
+
+func (c *Client) Run(ctx context.Context) {
+	for i := 0; i < workers; i++ {
+		go c.work(ctx)
+	}
+}
+
+// Emit queues event to be sent, it's a no-op on a nil Client so callers don't
+// have to check whether a webhook is configured.
+func (c *Client) Emit(ctx context.Context, event Event) {
+	if c == nil || (c.events != nil && !c.events[event.Type]) {
+		return
+	}
+	select {
+	case c.queue <- event:
+	default:
+		metrics.Inc("netlib_webhook_events_total", "result", "dropped")
+	}
+}
+
+func (c *Client) work(ctx context.Context) {
+	logger := logging.GetLogger(ctx)
+	for {
+		select {
+		case event := <-c.queue:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				logger.Error("failed to marshal webhook event", zap.Error(err))
+				continue
+			}
+			if err := c.send(ctx, payload); err != nil {
+				logger.Error("failed to deliver webhook event", zap.String("type", event.Type), zap.Error(err))
+				metrics.Inc("netlib_webhook_events_total", "result", "failed")
+				if c.DeadLetter != nil {
+					c.DeadLetter(ctx, event, payload, err)
+				}
+				continue
+			}
+			metrics.Inc("netlib_webhook_events_total", "result", "delivered")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, payload []byte) error {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(payload) //nolint:errcheck
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			delay := backoff<<(i-1) + time.Duration(rand.Int63n(int64(backoff)))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var retry bool
+		retry, err = c.post(ctx, payload, signature)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) post(ctx context.Context, payload []byte, signature string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+	resp.Body.Close()              //nolint:errcheck
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status code from webhook: %d", resp.StatusCode)
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
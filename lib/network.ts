@@ -1,7 +1,7 @@
 import { EventEmitter } from 'eventemitter3'
 
 import { DefaultDataChannels, DefaultRTCConfiguration, DefaultSignalingURL } from '.'
-import { LobbyListEntry, LobbySettings, PeerConfiguration } from './types'
+import { LobbyListEntry, LobbyRole, LobbySettings, PeerConfiguration } from './types'
 import Signaling, { SignalingError } from './signaling'
 import Peer from './peer'
 import Credentials from './credentials'
@@ -73,13 +73,14 @@ export default class Network extends EventEmitter<NetworkListeners> {
     return ''
   }
 
-  async join (lobby: string): Promise<void> {
+  async join (lobby: string, role?: LobbyRole): Promise<void> {
     if (this._closing || this.signaling.receivedID === undefined) {
       return
     }
     await this.signaling.request({
       type: 'join',
-      lobby
+      lobby,
+      role
     })
   }
 
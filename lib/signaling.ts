@@ -1,7 +1,7 @@
 import { EventEmitter } from 'eventemitter3'
 import Network from './network'
 import Peer from './peer'
-import { SignalingPacketTypes } from './types'
+import { ChunkPacket, SignalingPacketTypes } from './types'
 
 interface SignalingListeners {
   credentials: (data: SignalingPacketTypes) => void | Promise<void>
@@ -22,10 +22,16 @@ export default class Signaling extends EventEmitter<SignalingListeners> {
 
   private readonly requests: Map<string, RequestHandler> = new Map()
 
+  // The parts of chunked packets that are still being received, by chunk id.
+  private readonly chunks: Map<number, string[]> = new Map()
+
   constructor (private readonly network: Network, peers: Map<string, Peer>, url: string) {
     super()
 
-    this.url = url
+    // The server picks the compression of the connection by game before the hello.
+    const withGame = new URL(url)
+    withGame.searchParams.set('game', network.gameID)
+    this.url = withGame.toString()
     this.connections = peers
     this.replayQueue = new Map()
 
@@ -42,7 +48,8 @@ export default class Signaling extends EventEmitter<SignalingListeners> {
         game: this.network.gameID,
         id: this.receivedID,
         secret: this.receivedSecret,
-        lobby: this.currentLobby
+        lobby: this.currentLobby,
+        capabilities: ['chunking']
       })
     }
     const onError = (e: Event): void => {
@@ -87,6 +94,7 @@ export default class Signaling extends EventEmitter<SignalingListeners> {
 
     this.requests.forEach((r) => r.reject(new SignalingError('socket-error', 'signaling socket closed')))
     this.requests.clear()
+    this.chunks.clear()
 
     if (this.reconnectAttempt > 42) {
       this.network.emit('failed')
@@ -130,13 +138,20 @@ export default class Signaling extends EventEmitter<SignalingListeners> {
   private async handleSignalingMessage (data: string): Promise<void> {
     try {
       const packet = JSON.parse(data) as SignalingPacketTypes
+      if (packet.type === 'chunk') {
+        const original = this.reassemble(packet)
+        if (original !== undefined) {
+          await this.handleSignalingMessage(original)
+        }
+        return
+      }
       this.network.log('signaling packet received:', packet.type)
       if (packet.rid !== undefined) {
         const request = this.requests.get(packet.rid)
         if (request != null) {
           this.requests.delete(packet.rid)
           if (packet.type === 'error') {
-            request.reject(new SignalingError('server-error', packet.message))
+            request.reject(new SignalingError('server-error', packet.message, undefined, packet.code))
           } else {
             request.resolve(packet)
           }
@@ -145,7 +160,7 @@ export default class Signaling extends EventEmitter<SignalingListeners> {
       switch (packet.type) {
         case 'error':
           {
-            const error = new SignalingError('server-error', packet.message)
+            const error = new SignalingError('server-error', packet.message, undefined, packet.code)
             this.network._onSignalingError(error)
             if (packet.code === 'missing-recipient' && packet.error?.recipient !== undefined) {
               const id = packet.error?.recipient
@@ -159,6 +174,10 @@ export default class Signaling extends EventEmitter<SignalingListeners> {
 
         case 'welcome':
           if (this.receivedID !== undefined) {
+            if (packet.closedLobby !== undefined) {
+              this.network.log('lobby closed while reconnecting', packet.closedLobby.lobby, packet.closedLobby.reason)
+              this.currentLobby = undefined
+            }
             this.network.log('signaling reconnected')
             this.network.emit('signalingreconnected')
             return
@@ -218,6 +237,27 @@ export default class Signaling extends EventEmitter<SignalingListeners> {
     }
   }
 
+  // reassemble returns the original packet once all of its chunks have been
+  // received, in any order.
+  private reassemble (chunk: ChunkPacket): string | undefined {
+    if (chunk.total <= 0 || chunk.seq < 0 || chunk.seq >= chunk.total || chunk.data === '') {
+      throw new Error(`invalid chunk ${chunk.seq}/${chunk.total}`)
+    }
+    let parts = this.chunks.get(chunk.id)
+    if (parts === undefined) {
+      parts = new Array<string>(chunk.total).fill('')
+      this.chunks.set(chunk.id, parts)
+    } else if (parts.length !== chunk.total) {
+      throw new Error(`chunk total mismatch for ${chunk.id}`)
+    }
+    parts[chunk.seq] = chunk.data
+    if (parts.includes('')) {
+      return undefined
+    }
+    this.chunks.delete(chunk.id)
+    return parts.join('')
+  }
+
   async event (category: string, action: string, data?: {[key: string]: string}): Promise<void> {
     return await new Promise(resolve => {
       setTimeout(() => {
@@ -245,7 +285,7 @@ export class SignalingError {
   /**
    * @internal
    */
-  constructor (public type: 'unknown-error' | 'socket-error' | 'server-error', public message: string, public event?: Event) {
+  constructor (public type: 'unknown-error' | 'socket-error' | 'server-error', public message: string, public event?: Event, public code?: string) {
   }
 
   public toString (): string {
@@ -10,14 +10,18 @@ export interface LobbySettings {
   codeFormat?: 'default' | 'short'
   codeLength?: number
   maxPlayers?: number
+  maxSpectators?: number
   password?: string
   public?: boolean
   customData?: {[key: string]: any}
 }
 
+export type LobbyRole = 'player' | 'spectator'
+
 export interface LobbyListEntry extends LobbySettings{
   code: string
   playerCount: number
+  spectatorCount: number
 }
 
 interface Base {
@@ -27,6 +31,7 @@ interface Base {
 
 export type SignalingPacketTypes =
 | CandidatePacket
+| ChunkPacket
 | ClosePacket
 | ConnectedPacket
 | ConnectPacket
@@ -62,12 +67,25 @@ export interface HelloPacket extends Base {
   id?: string
   secret?: string
   lobby?: string
+  capabilities?: string[]
+}
+
+export interface ChunkPacket extends Base {
+  type: 'chunk'
+  id: number
+  seq: number
+  total: number
+  data: string
 }
 
 export interface WelcomePacket extends Base {
   type: 'welcome'
   id: string
   secret: string
+  closedLobby?: {
+    lobby: string
+    reason?: string
+  }
 }
 
 export interface ListPacket extends Base {
@@ -88,6 +106,7 @@ export interface CreatePacket extends Base {
 export interface JoinPacket extends Base {
   type: 'join'
   lobby: string
+  role?: LobbyRole
 }
 
 export interface JoinedPacket extends Base {
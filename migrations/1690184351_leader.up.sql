@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "leader" VARCHAR(20) NULL;
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "peer_data" jsonb NOT NULL DEFAULT '{}';
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP TABLE "reservations";
+
+ALTER TABLE "lobbies" DROP COLUMN "max_players";
+
+COMMIT;
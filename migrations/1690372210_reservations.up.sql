@@ -0,0 +1,16 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "max_players" INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE "reservations" (
+  "game" uuid NOT NULL,
+  "peer" VARCHAR(20) NOT NULL,
+  "lobby" VARCHAR(20) NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY ("game", "peer")
+);
+
+CREATE INDEX "reservations_lobby" ON "reservations" ("game", "lobby", "expires_at");
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "ready" VARCHAR(20)[] NOT NULL DEFAULT '{}';
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "lobbies" DROP COLUMN "started_at";
+ALTER TABLE "lobbies" DROP COLUMN "seed";
+
+COMMIT;
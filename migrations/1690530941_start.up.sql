@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "seed" VARCHAR(32) NULL;
+ALTER TABLE "lobbies" ADD COLUMN "started_at" TIMESTAMP NULL;
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" DROP COLUMN "auto_start";
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "auto_start" BOOLEAN NOT NULL DEFAULT false;
+
+COMMIT;
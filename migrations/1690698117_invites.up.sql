@@ -0,0 +1,15 @@
+BEGIN;
+
+CREATE TABLE "invites" (
+  "game" uuid NOT NULL,
+  "token" VARCHAR(32) NOT NULL,
+  "lobby" VARCHAR(20) NOT NULL,
+  "uses_left" INTEGER NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY ("game", "token")
+);
+
+CREATE INDEX "invites_lobby" ON "invites" ("game", "lobby");
+
+COMMIT;
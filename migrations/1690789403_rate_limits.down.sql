@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE "rate_limits";
+
+COMMIT;
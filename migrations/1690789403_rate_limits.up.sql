@@ -0,0 +1,11 @@
+BEGIN;
+
+CREATE TABLE "rate_limits" (
+  "key" VARCHAR(64) NOT NULL,
+  "window_start" TIMESTAMP NOT NULL,
+  "count" INTEGER NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL,
+  PRIMARY KEY ("key", "window_start")
+);
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+CREATE TABLE "dead_letters" (
+  "id" BIGSERIAL PRIMARY KEY,
+  "kind" VARCHAR(32) NOT NULL,
+  "payload" jsonb NOT NULL,
+  "error" TEXT NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "timeouts" DROP COLUMN "notified";
+
+COMMIT;
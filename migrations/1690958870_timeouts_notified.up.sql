@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "timeouts" ADD COLUMN "notified" BOOLEAN NOT NULL DEFAULT false;
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "lobbies" DROP COLUMN "next_seat";
+ALTER TABLE "lobbies" DROP COLUMN "seats";
+
+COMMIT;
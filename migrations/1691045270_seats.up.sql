@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "seats" jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE "lobbies" ADD COLUMN "next_seat" INTEGER NOT NULL DEFAULT 0;
+
+COMMIT;
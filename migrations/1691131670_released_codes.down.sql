@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE "released_codes";
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+CREATE TABLE "released_codes" (
+  "code" VARCHAR(20) NOT NULL PRIMARY KEY,
+  "released_at" TIMESTAMP NOT NULL
+);
+
+CREATE INDEX "released_codes_released_at" ON "released_codes" ("released_at");
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "filled_at" TIMESTAMP NULL;
+
+COMMIT;
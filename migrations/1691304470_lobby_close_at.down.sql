@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX "lobbies_close_at";
+
+ALTER TABLE "lobbies" DROP COLUMN "close_at";
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "close_at" TIMESTAMP NULL;
+
+CREATE INDEX "lobbies_close_at" ON "lobbies" ("close_at") WHERE "close_at" IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX "lobbies_matchmaking";
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Lets the matchmaking candidate scan stop after its limit instead of sorting
+-- every public lobby of a game, full lobbies aren't candidates.
+CREATE INDEX "lobbies_matchmaking" ON "lobbies" ("game", "max_players", cardinality("peers") DESC, "created_at")
+  WHERE "public" = true AND cardinality("peers") > 0 AND cardinality("peers") < "max_players";
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "members_version" BIGINT NOT NULL DEFAULT 0;
+
+COMMIT;
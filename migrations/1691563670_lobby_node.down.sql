@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "lobbies" DROP COLUMN "node_endpoint";
+ALTER TABLE "lobbies" DROP COLUMN "node";
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "node" VARCHAR(64) NULL;
+ALTER TABLE "lobbies" ADD COLUMN "node_endpoint" TEXT NULL;
+
+COMMIT;
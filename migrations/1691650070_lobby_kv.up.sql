@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "kv" jsonb NOT NULL DEFAULT '{}';
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX "lobbies_public_player_count";
+DROP INDEX "lobbies_public_created_at";
+
+COMMIT;
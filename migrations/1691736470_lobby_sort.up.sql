@@ -0,0 +1,7 @@
+BEGIN;
+
+-- The sort orders of public lobby listings, see stores.LobbySort.
+CREATE INDEX "lobbies_public_created_at" ON "lobbies" ("game", "created_at" DESC) WHERE "public" = true;
+CREATE INDEX "lobbies_public_player_count" ON "lobbies" ("game", cardinality("peers")) WHERE "public" = true;
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Incremented on every change of the custom data, see stores.UpdateLobbyCustomData.
+ALTER TABLE "lobbies" ADD COLUMN "meta_version" BIGINT NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE "events" (
+  "id" BIGSERIAL PRIMARY KEY,
+  "time" TIMESTAMP NOT NULL,
+  "game" VARCHAR(64) NOT NULL,
+  "category" VARCHAR(64) NOT NULL,
+  "action" VARCHAR(64) NOT NULL,
+  "peer" VARCHAR(64) NOT NULL DEFAULT '',
+  "lobby" VARCHAR(64) NOT NULL DEFAULT '',
+  "client" VARCHAR(64) NOT NULL DEFAULT '',
+  "version" VARCHAR(64) NOT NULL DEFAULT '',
+  "data" jsonb
+);
+
+CREATE INDEX "events_game_time" ON "events" ("game", "time");
+CREATE INDEX "events_time" ON "events" ("time");
+
+COMMIT;
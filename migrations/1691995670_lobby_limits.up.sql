@@ -0,0 +1,6 @@
+BEGIN;
+
+-- The rate limits the lobby was created with, see stores.LobbyLimits.
+ALTER TABLE "lobbies" ADD COLUMN "limits" JSONB;
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+-- Lobbies closed by the server, so peers reconnecting to them learn why.
+CREATE TABLE "closed_lobbies" (
+  "code" VARCHAR(20) NOT NULL PRIMARY KEY,
+  "game" uuid NOT NULL,
+  "reason" VARCHAR(64) NOT NULL,
+  "closed_at" TIMESTAMP NOT NULL
+);
+
+CREATE INDEX "closed_lobbies_closed_at" ON "closed_lobbies" ("closed_at");
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+-- The durable player behind each peer, see Peer.PlayerID.
+CREATE TABLE "players" (
+  "game" uuid NOT NULL,
+  "peer" VARCHAR(20) NOT NULL,
+  "player" VARCHAR(128) NOT NULL,
+  "updated_at" TIMESTAMP NOT NULL,
+  PRIMARY KEY ("game", "peer")
+);
+
+CREATE INDEX "players_game_player" ON "players" ("game", "player");
+CREATE INDEX "players_updated_at" ON "players" ("updated_at");
+
+COMMIT;
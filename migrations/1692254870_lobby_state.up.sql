@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Whether the lobby accepts new peers: waiting, started or closed.
+ALTER TABLE "lobbies" ADD COLUMN "state" VARCHAR(16) NOT NULL DEFAULT 'waiting';
+UPDATE "lobbies" SET "state" = 'started' WHERE "started_at" IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "timeouts" DROP COLUMN "session_started_at";
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- When the session of a disconnected peer started, see MaxSessionLifetime.
+ALTER TABLE "timeouts" ADD COLUMN "session_started_at" TIMESTAMP NULL;
+
+COMMIT;
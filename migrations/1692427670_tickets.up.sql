@@ -0,0 +1,19 @@
+BEGIN;
+
+-- Matchmaking tickets waiting to be grouped into a lobby by the Matcher.
+CREATE TABLE "tickets" (
+  "id" VARCHAR(20) NOT NULL PRIMARY KEY,
+  "game" uuid NOT NULL,
+  "peer" VARCHAR(20) NOT NULL,
+  "skill" DOUBLE PRECISION NOT NULL,
+  "max_players" INTEGER NOT NULL,
+  "preferences" JSONB NOT NULL DEFAULT '{}',
+  "created_at" TIMESTAMP NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL
+);
+
+CREATE INDEX "tickets_game_peer" ON "tickets" ("game", "peer");
+CREATE INDEX "tickets_created_at" ON "tickets" ("created_at");
+CREATE INDEX "tickets_expires_at" ON "tickets" ("expires_at");
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "players" DROP COLUMN "lobby";
+ALTER TABLE "players" DROP COLUMN "online";
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- The presence of each peer, see Store.SetPresence.
+ALTER TABLE "players" ADD COLUMN "online" BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE "players" ADD COLUMN "lobby" VARCHAR(20) NULL;
+
+COMMIT;
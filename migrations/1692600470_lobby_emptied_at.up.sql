@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "lobbies" ADD COLUMN "emptied_at" TIMESTAMP NULL;
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+DROP INDEX "lobbies_public_player_count";
+CREATE INDEX "lobbies_public_player_count" ON "lobbies" ("game", cardinality("peers")) WHERE "public" = true;
+DROP INDEX "lobbies_matchmaking";
+CREATE INDEX "lobbies_matchmaking" ON "lobbies" ("game", "max_players", cardinality("peers") DESC, "created_at")
+  WHERE "public" = true AND cardinality("peers") > 0 AND cardinality("peers") < "max_players";
+
+ALTER TABLE "lobbies" DROP COLUMN "max_spectators";
+ALTER TABLE "lobbies" DROP COLUMN "spectators";
+
+COMMIT;
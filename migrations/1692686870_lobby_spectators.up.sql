@@ -0,0 +1,15 @@
+BEGIN;
+
+-- The peers of a lobby that joined as spectators, a subset of peers. They
+-- count against max_spectators instead of max_players, zero disallows them.
+ALTER TABLE "lobbies" ADD COLUMN "spectators" VARCHAR(20)[] NOT NULL DEFAULT '{}';
+ALTER TABLE "lobbies" ADD COLUMN "max_spectators" INT NOT NULL DEFAULT 0;
+
+-- Matchmaking and the player count sort only count players.
+DROP INDEX "lobbies_matchmaking";
+CREATE INDEX "lobbies_matchmaking" ON "lobbies" ("game", "max_players", (cardinality("peers") - cardinality("spectators")) DESC, "created_at")
+  WHERE "public" = true AND cardinality("peers") > 0 AND cardinality("peers") - cardinality("spectators") < "max_players";
+DROP INDEX "lobbies_public_player_count";
+CREATE INDEX "lobbies_public_player_count" ON "lobbies" ("game", (cardinality("peers") - cardinality("spectators"))) WHERE "public" = true;
+
+COMMIT;
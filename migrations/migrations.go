@@ -1,9 +1,13 @@
 package migrations
 
 import (
+	"context"
 	"embed"
+	"errors"
+	"io/fs"
 
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/stdlib"
@@ -14,21 +18,47 @@ import (
 //go:embed *.sql
 var migrations embed.FS
 
-func Up(config *pgx.ConnConfig) error {
+func open(config *pgx.ConnConfig) (*migrate.Migrate, source.Driver, error) {
 	d, err := iofs.New(migrations, ".")
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	db := stdlib.OpenDB(*config)
 	driver, err := driver.WithInstance(db, &driver.Config{})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	m, err := migrate.NewWithInstance("iofs", d, "pgx", driver)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, d, nil
+}
+
+func Up(config *pgx.ConnConfig) error {
+	return UpContext(context.Background(), config)
+}
+
+// UpContext applies all pending migrations, it's safe to call when the schema
+// is already up to date. Cancelling ctx stops after the running migration.
+func UpContext(ctx context.Context, config *pgx.ConnConfig) error {
+	m, _, err := open(config)
 	if err != nil {
 		return err
 	}
+	defer m.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.GracefulStop <- true
+		case <-done:
+		}
+	}()
+
 	err = m.Up()
 	if err != nil && err != migrate.ErrNoChange {
 		return err
@@ -36,3 +66,43 @@ func Up(config *pgx.ConnConfig) error {
 
 	return nil
 }
+
+// Pending returns the versions of the migrations that haven't been applied
+// yet, in the order they would be applied.
+func Pending(config *pgx.ConnConfig) ([]uint, error) {
+	m, d, err := open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	current, dirty, err := m.Version()
+	if err != nil && err != migrate.ErrNilVersion {
+		return nil, err
+	}
+	if dirty {
+		return nil, errors.New("database schema is dirty")
+	}
+
+	var pending []uint
+	var version uint
+	if err == migrate.ErrNilVersion {
+		version, err = d.First()
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, version)
+	} else {
+		version = current
+	}
+	for {
+		version, err = d.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		pending = append(pending, version)
+	}
+	return pending, nil
+}